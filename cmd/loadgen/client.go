@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type client struct {
+	base  string
+	http  *http.Client
+	stats *stats
+
+	mu      sync.Mutex
+	users   []string
+	forums  []string
+	threads []int32
+	// recent posts per thread, used as reply parents and for detail reads
+	posts map[int32][]int64
+}
+
+// postsPerThread bounds the remembered posts of a thread.
+const postsPerThread = 256
+
+func newClient(base string, conns int, timeout time.Duration) *client {
+	return &client{
+		base: base,
+		http: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				MaxIdleConns:        conns,
+				MaxIdleConnsPerHost: conns,
+				IdleConnTimeout:     time.Minute,
+			},
+		},
+		posts: map[int32][]int64{},
+	}
+}
+
+// do sends a request and decodes a successful response into out. The latency
+// is measured from start, which in open-loop mode is the time the request was
+// scheduled for, so that a slow server is not hidden by late sends.
+func (c *client) do(start time.Time, method string, route string, path string, body interface{}, out interface{}) int {
+	var reader io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			panic(err)
+		}
+		reader = bytes.NewReader(buf)
+	}
+
+	status := 0
+	req, err := http.NewRequest(method, c.base+path, reader)
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+
+		var resp *http.Response
+		resp, err = c.http.Do(req)
+		if err == nil {
+			status = resp.StatusCode
+			if out != nil && status < 300 {
+				json.NewDecoder(resp.Body).Decode(out)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+
+	if c.stats != nil {
+		c.stats.record(method+" "+route, status, time.Since(start))
+	}
+
+	return status
+}
+
+func (c *client) addPosts(thread int32, ids []int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	known := append(c.posts[thread], ids...)
+	if len(known) > postsPerThread {
+		known = known[len(known)-postsPerThread:]
+	}
+	c.posts[thread] = known
+}
@@ -0,0 +1,168 @@
+// Command loadgen drives a configurable workload against a running forum API
+// and reports latency percentiles per route and responses by status.
+//
+// In closed-loop mode a fixed number of workers send requests back to back,
+// optionally capped at -rps. In open-loop mode requests are started on a fixed
+// schedule of -rps per second whether or not earlier ones have finished, and
+// latency is counted from the scheduled time.
+//
+//	go run ./cmd/loadgen -mode open -rps 500 -duration 1m
+//	go run ./cmd/loadgen -mode closed -workers 64 -mix create=10,tree=40,details=50
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultMix = "create=15,vote=10,flat=15,tree=15,parent_tree=15,details=30"
+
+func main() {
+	addr := flag.String("addr", "http://127.0.0.1:5000/api", "base URL of the API")
+	mode := flag.String("mode", "closed", "open or closed loop")
+	rps := flag.Float64("rps", 0, "target requests per second, required in open-loop mode, a cap in closed-loop mode")
+	duration := flag.Duration("duration", 30*time.Second, "how long to run the workload")
+	workers := flag.Int("workers", 32, "concurrent workers in closed-loop mode")
+	inflight := flag.Int("inflight", 1024, "most requests in flight in open-loop mode, later ones are dropped")
+	timeout := flag.Duration("timeout", 10*time.Second, "request timeout")
+	mixFlag := flag.String("mix", defaultMix, "operation weights")
+	users := flag.Int("users", 100, "users to create")
+	forums := flag.Int("forums", 5, "forums to create")
+	threads := flag.Int("threads", 50, "threads to create")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "random seed")
+	flag.IntVar(&batchSize, "batch", batchSize, "posts per create request")
+	flag.IntVar(&readLimit, "limit", readLimit, "limit of post list reads")
+	flag.Parse()
+
+	m, err := parseMix(*mixFlag)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if *mode != "open" && *mode != "closed" {
+		log.Fatalf("unknown mode %q", *mode)
+	}
+	if *mode == "open" && *rps <= 0 {
+		log.Fatalln("open-loop mode needs -rps")
+	}
+
+	conns := *workers
+	if *mode == "open" {
+		conns = *inflight
+	}
+	c := newClient(*addr, conns, *timeout)
+
+	run := strconv.FormatInt(*seed%1000000, 36)
+	setupStart := time.Now()
+	setup(c, rand.New(rand.NewSource(*seed)), run, *users, *forums, *threads, batchSize)
+	fmt.Printf("setup: %d users, %d forums, %d threads in %s\n", *users, *forums, *threads, time.Since(setupStart).Round(time.Millisecond))
+	fmt.Printf("running %s loop for %s, mix %s\n\n", *mode, *duration, m)
+
+	c.stats = newStats()
+	rnds := newRandPool(*seed)
+
+	start := time.Now()
+	if *mode == "open" {
+		openLoop(c, m, rnds, *rps, *duration, *inflight)
+	} else {
+		closedLoop(c, m, rnds, *rps, *duration, *workers)
+	}
+
+	c.stats.report(os.Stdout, time.Since(start))
+}
+
+// openLoop starts a request every 1/rps seconds. When the server falls behind
+// the number of requests in flight grows up to the limit, after that sends are
+// dropped and counted.
+func openLoop(c *client, m *mix, rnds *randPool, rps float64, duration time.Duration, limit int) {
+	interval := time.Duration(float64(time.Second) / rps)
+	end := time.Now().Add(duration)
+
+	var inflight int64
+	wg := sync.WaitGroup{}
+	for next := time.Now(); next.Before(end); next = next.Add(interval) {
+		if wait := time.Until(next); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		if atomic.LoadInt64(&inflight) >= int64(limit) {
+			c.stats.drop()
+			continue
+		}
+
+		atomic.AddInt64(&inflight, 1)
+		wg.Add(1)
+		go func(scheduled time.Time) {
+			defer wg.Done()
+			defer atomic.AddInt64(&inflight, -1)
+
+			rnd := rnds.get()
+			m.pick(rnd)(c, rnd, scheduled)
+			rnds.put(rnd)
+		}(next)
+	}
+	wg.Wait()
+}
+
+// closedLoop runs workers that send the next request as soon as the previous
+// one is answered. With rps > 0 they share a schedule that caps the rate.
+func closedLoop(c *client, m *mix, rnds *randPool, rps float64, duration time.Duration, workers int) {
+	end := time.Now().Add(duration)
+
+	var tokens <-chan time.Time
+	if rps > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rps))
+		defer ticker.Stop()
+		tokens = ticker.C
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			rnd := rnds.get()
+			for time.Now().Before(end) {
+				if tokens != nil {
+					select {
+					case <-tokens:
+					case <-time.After(time.Until(end)):
+						return
+					}
+				}
+				m.pick(rnd)(c, rnd, time.Now())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// randPool hands out generators derived from one seed, math/rand.Rand is not
+// safe for concurrent use.
+type randPool struct {
+	seed int64
+	next int64
+	pool sync.Pool
+}
+
+func newRandPool(seed int64) *randPool {
+	return &randPool{seed: seed}
+}
+
+func (p *randPool) get() *rand.Rand {
+	if rnd, ok := p.pool.Get().(*rand.Rand); ok {
+		return rnd
+	}
+	return rand.New(rand.NewSource(p.seed + atomic.AddInt64(&p.next, 1)))
+}
+
+func (p *randPool) put(rnd *rand.Rand) {
+	p.pool.Put(rnd)
+}
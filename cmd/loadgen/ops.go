@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"forum/internal/models"
+)
+
+type operation func(c *client, rnd *rand.Rand, start time.Time)
+
+// replyShare is the part of new posts that answer an existing post of the
+// thread rather than start a new branch.
+const replyShare = 0.7
+
+var (
+	batchSize = 10
+	readLimit = 100
+)
+
+func createPosts(c *client, rnd *rand.Rand, start time.Time, thread int32, n int) {
+	c.mu.Lock()
+	users := c.users
+	known := c.posts[thread]
+	c.mu.Unlock()
+
+	posts := make([]*models.Post, 0, n)
+	for i := 0; i < n; i++ {
+		post := &models.Post{
+			Author:  users[rnd.Intn(len(users))],
+			Message: fmt.Sprintf("loadgen post %d", rnd.Int63()),
+		}
+		if len(known) > 0 && rnd.Float64() < replyShare {
+			// recent posts are answered more often than old ones
+			post.Parent = known[len(known)-1-int(rnd.ExpFloat64()*8)%len(known)]
+		}
+		posts = append(posts, post)
+	}
+
+	created := []*models.Post{}
+	status := c.do(start, http.MethodPost, "/thread/{id}/create", fmt.Sprintf("/thread/%d/create", thread), posts, &created)
+	if status == http.StatusCreated {
+		ids := make([]int64, 0, len(created))
+		for _, post := range created {
+			ids = append(ids, post.Id)
+		}
+		c.addPosts(thread, ids)
+	}
+}
+
+func randomThread(c *client, rnd *rand.Rand) int32 {
+	return c.threads[rnd.Intn(len(c.threads))]
+}
+
+func opCreate(c *client, rnd *rand.Rand, start time.Time) {
+	createPosts(c, rnd, start, randomThread(c, rnd), batchSize)
+}
+
+func opVote(c *client, rnd *rand.Rand, start time.Time) {
+	voice := int32(1)
+	if rnd.Intn(3) == 0 {
+		voice = -1
+	}
+
+	c.do(start, http.MethodPost, "/thread/{id}/vote", fmt.Sprintf("/thread/%d/vote", randomThread(c, rnd)), &models.Vote{
+		Nickname: c.users[rnd.Intn(len(c.users))],
+		Voice:    voice,
+	}, nil)
+}
+
+func readPosts(sort string) operation {
+	return func(c *client, rnd *rand.Rand, start time.Time) {
+		thread := randomThread(c, rnd)
+		path := fmt.Sprintf("/thread/%d/posts?sort=%s&limit=%d&desc=%t", thread, sort, readLimit, rnd.Intn(2) == 0)
+
+		c.do(start, http.MethodGet, "/thread/{id}/posts?sort="+sort, path, nil, nil)
+	}
+}
+
+var relations = []string{"user", "thread", "forum"}
+
+func opDetails(c *client, rnd *rand.Rand, start time.Time) {
+	thread := randomThread(c, rnd)
+
+	c.mu.Lock()
+	known := c.posts[thread]
+	c.mu.Unlock()
+	if len(known) == 0 {
+		return
+	}
+
+	related := []string{}
+	for _, relation := range relations {
+		if rnd.Intn(2) == 0 {
+			related = append(related, relation)
+		}
+	}
+
+	id := known[rnd.Intn(len(known))]
+	c.do(start, http.MethodGet, "/post/{id}/details", "/post/"+strconv.FormatInt(id, 10)+"/details?related="+strings.Join(related, ","), nil, nil)
+}
+
+var operations = map[string]operation{
+	"create":      opCreate,
+	"vote":        opVote,
+	"flat":        readPosts("flat"),
+	"tree":        readPosts("tree"),
+	"parent_tree": readPosts("parent_tree"),
+	"details":     opDetails,
+}
+
+// mix picks operations with the configured weights.
+type mix struct {
+	names   []string
+	weights []int
+	total   int
+}
+
+// parseMix reads weights in the form "create=10,tree=30".
+func parseMix(raw string) (*mix, error) {
+	m := &mix{}
+	for _, pair := range strings.Split(raw, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad mix entry %q", pair)
+		}
+		if _, ok := operations[parts[0]]; !ok {
+			return nil, fmt.Errorf("unknown operation %q", parts[0])
+		}
+		weight, err := strconv.Atoi(parts[1])
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("bad weight in %q", pair)
+		}
+		if weight == 0 {
+			continue
+		}
+		m.names = append(m.names, parts[0])
+		m.weights = append(m.weights, weight)
+		m.total += weight
+	}
+	if m.total == 0 {
+		return nil, fmt.Errorf("empty mix")
+	}
+
+	return m, nil
+}
+
+func (m *mix) pick(rnd *rand.Rand) operation {
+	n := rnd.Intn(m.total)
+	for i, weight := range m.weights {
+		if n < weight {
+			return operations[m.names[i]]
+		}
+		n -= weight
+	}
+	return operations[m.names[len(m.names)-1]]
+}
+
+func (m *mix) String() string {
+	parts := make([]string, 0, len(m.names))
+	for i, name := range m.names {
+		parts = append(parts, fmt.Sprintf("%s=%d", name, m.weights[i]))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"forum/internal/models"
+)
+
+// setup creates the users, forums and threads the workload runs against.
+// Names carry the run id, so several runs can share a database.
+func setup(c *client, rnd *rand.Rand, run string, users int, forums int, threads int, batch int) {
+	for i := 0; i < users; i++ {
+		nickname := fmt.Sprintf("lg%s_%d", run, i)
+		status := c.do(time.Now(), http.MethodPost, "/user/{nickname}/create", "/user/"+nickname+"/create", &models.User{
+			Fullname: "Load Generator " + nickname,
+			About:    "created by loadgen",
+			Email:    nickname + "@loadgen.local",
+		}, nil)
+		if status != http.StatusCreated && status != http.StatusConflict {
+			log.Fatalf("can not create user %s: status %d", nickname, status)
+		}
+		c.users = append(c.users, nickname)
+	}
+
+	for i := 0; i < forums; i++ {
+		forum := &models.Forum{}
+		status := c.do(time.Now(), http.MethodPost, "/forum/create", "/forum/create", &models.Forum{
+			Title: fmt.Sprintf("Load %s forum %d", run, i),
+			User:  c.users[rnd.Intn(len(c.users))],
+			Slug:  fmt.Sprintf("lg%s-forum-%d", run, i),
+		}, forum)
+		if status != http.StatusCreated {
+			log.Fatalf("can not create forum %d: status %d", i, status)
+		}
+		c.forums = append(c.forums, forum.Slug)
+	}
+
+	for i := 0; i < threads; i++ {
+		forum := c.forums[rnd.Intn(len(c.forums))]
+		thread := &models.Thread{}
+		status := c.do(time.Now(), http.MethodPost, "/forum/{slug}/create", "/forum/"+forum+"/create", &models.Thread{
+			Title:   fmt.Sprintf("Load %s thread %d", run, i),
+			Author:  c.users[rnd.Intn(len(c.users))],
+			Message: "thread created by loadgen",
+			Slug:    fmt.Sprintf("lg%s-thread-%d", run, i),
+		}, thread)
+		if status != http.StatusCreated {
+			log.Fatalf("can not create thread %d: status %d", i, status)
+		}
+		c.threads = append(c.threads, thread.Id)
+	}
+
+	// every thread starts with one batch, so that reads have something to sort
+	for _, thread := range c.threads {
+		createPosts(c, rnd, time.Now(), thread, batch)
+	}
+}
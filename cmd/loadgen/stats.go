@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// stats collects latencies per route and outcomes by status code. Transport
+// errors are counted under status 0.
+type stats struct {
+	mu       sync.Mutex
+	routes   map[string][]time.Duration
+	statuses map[string]map[int]int64
+	dropped  int64
+}
+
+func newStats() *stats {
+	return &stats{
+		routes:   map[string][]time.Duration{},
+		statuses: map[string]map[int]int64{},
+	}
+}
+
+func (s *stats) record(route string, status int, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.routes[route] = append(s.routes[route], latency)
+	if s.statuses[route] == nil {
+		s.statuses[route] = map[int]int64{}
+	}
+	s.statuses[route][status]++
+}
+
+func (s *stats) drop() {
+	s.mu.Lock()
+	s.dropped++
+	s.mu.Unlock()
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p)
+	return sorted[i]
+}
+
+// isError tells expected outcomes from failures. Conflicts on create and not
+// found on reads of data removed by other clients are part of the workload.
+func isError(status int) bool {
+	return status == 0 || status >= 500
+}
+
+func (s *stats) report(w io.Writer, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	routes := make([]string, 0, len(s.routes))
+	for route := range s.routes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	var total, failed int64
+	fmt.Fprintf(w, "%-40s %8s %8s %9s %9s %9s %9s %9s\n", "route", "count", "rps", "p50", "p90", "p99", "p999", "max")
+	for _, route := range routes {
+		latencies := s.routes[route]
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+		total += int64(len(latencies))
+		fmt.Fprintf(w, "%-40s %8d %8.1f %9s %9s %9s %9s %9s\n", route, len(latencies),
+			float64(len(latencies))/elapsed.Seconds(),
+			round(percentile(latencies, 0.5)), round(percentile(latencies, 0.9)),
+			round(percentile(latencies, 0.99)), round(percentile(latencies, 0.999)),
+			round(latencies[len(latencies)-1]))
+	}
+
+	fmt.Fprintf(w, "\n%-40s %s\n", "route", "responses by status")
+	for _, route := range routes {
+		codes := make([]int, 0, len(s.statuses[route]))
+		for code := range s.statuses[route] {
+			codes = append(codes, code)
+			if isError(code) {
+				failed += s.statuses[route][code]
+			}
+		}
+		sort.Ints(codes)
+
+		line := ""
+		for _, code := range codes {
+			line += fmt.Sprintf(" %d=%d", code, s.statuses[route][code])
+		}
+		fmt.Fprintf(w, "%-40s%s\n", route, line)
+	}
+
+	fmt.Fprintf(w, "\ntotal %d requests in %s, %.1f rps, %d errors (5xx or transport)", total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds(), failed)
+	if s.dropped > 0 {
+		fmt.Fprintf(w, ", %d not sent (in-flight limit)", s.dropped)
+	}
+	fmt.Fprintln(w)
+}
+
+func round(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	}
+	return d.Round(time.Microsecond)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	serviceRepo "forum/internal/pkg/service/repository"
+	serviceUse "forum/internal/pkg/service/usecase"
+)
+
+// runCheck implements "check [-repair] [-batch N]": it prints drift of
+// trigger maintained counters as JSON and exits with 1 if any was found.
+func runCheck(args []string) {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "fix found drifts")
+	batch := flags.Int("batch", 500, "keys repaired per transaction")
+	flags.Parse(args)
+
+	sqlDB := getPostgres(dsn)
+	defer sqlDB.Close()
+
+	su := serviceUse.NewServiceUsecase(serviceRepo.NewServiceRepository(sqlDB))
+
+	report, err := su.Check(context.Background(), *repair, *batch)
+	if report != nil {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	}
+	if err != nil {
+		log.Fatalln("check failed:", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "%d drifts found, %d rows repaired\n", len(report.Drifts), report.Repaired)
+	if len(report.Drifts) > 0 && !*repair {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"forum/internal/record"
+)
+
+// runReplay implements "replay [flags] recording.ndjson": it sends a recorded
+// session to a server and reports the responses that differ from the
+// recording. Ids created by the server are remapped, so the target database
+// should be in the state the recorded one was in when recording started.
+func runReplay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	addr := flags.String("addr", "http://127.0.0.1:5000", "server to replay against")
+	speed := flags.Float64("speed", 1, "playback speed, 2 is twice as fast, 0 sends requests one by one")
+	timeout := flags.Duration("timeout", 10*time.Second, "request timeout")
+	ignore := flags.String("ignore", "created", "comma separated response fields not to compare")
+	redact := flags.String("redact", "email", "comma separated fields redacted in the recording")
+	diffs := flags.String("diffs", "", "write every difference to this file as NDJSON")
+	show := flags.Int("show", 20, "differences to print")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		log.Fatalln("usage: replay [flags] recording.ndjson")
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	entries, err := record.Read(file)
+	file.Close()
+	if err != nil {
+		log.Fatalln("can not read recording:", err)
+	}
+
+	replayer := record.NewReplayer(*addr, entries, *speed, *timeout, strings.Split(*ignore, ","), strings.Split(*redact, ","))
+	report := replayer.Run()
+
+	if *diffs != "" {
+		out, err := os.Create(*diffs)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		encoder := json.NewEncoder(out)
+		for _, diff := range report.Diffs {
+			encoder.Encode(diff)
+		}
+		out.Close()
+	}
+
+	fmt.Printf("replayed %d requests in %s, recorded in %s\n", report.Requests,
+		report.Elapsed.Round(time.Millisecond), report.RecordedTime.Round(time.Millisecond))
+	fmt.Printf("%d status differences, %d body differences, %d failed, %d ids not remapped\n\n",
+		report.StatusDiffs, report.BodyDiffs, report.Failed, report.UnmappedIds)
+
+	routes := make([]string, 0, len(report.RouteTotals))
+	for route := range report.RouteTotals {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		fmt.Printf("%-50s %6d requests %6d differ\n", route, report.RouteTotals[route], report.RouteDiffs[route])
+	}
+
+	for i, diff := range report.Diffs {
+		if i == *show {
+			fmt.Printf("\n... %d more\n", len(report.Diffs)-i)
+			break
+		}
+		fmt.Printf("\n#%d %s %s: status %d, recorded %d\n", diff.Index, diff.Method, diff.Path, diff.Status, diff.Recorded)
+		if diff.Error != "" {
+			fmt.Printf("  %s\n", diff.Error)
+		}
+		for _, field := range diff.Fields {
+			fmt.Printf("  %s\n", field)
+		}
+	}
+}
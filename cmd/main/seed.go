@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"forum/internal/seed"
+
+	serviceRepo "forum/internal/pkg/service/repository"
+)
+
+// runSeed implements "seed [flags]": it loads a generated dataset that only
+// depends on the flags, so benchmark runs on different machines compare the
+// same data. -digest prints a hash of the rows without touching the database.
+func runSeed(args []string) {
+	c := &seed.Config{}
+
+	flags := flag.NewFlagSet("seed", flag.ExitOnError)
+	flags.Int64Var(&c.Seed, "seed", 42, "random seed")
+	flags.IntVar(&c.Users, "users", 1000, "users")
+	flags.IntVar(&c.Forums, "forums", 20, "forums")
+	flags.IntVar(&c.Threads, "threads", 2000, "threads")
+	flags.IntVar(&c.Posts, "posts", 200000, "posts")
+	flags.IntVar(&c.Votes, "votes", 20000, "thread votes")
+	flags.IntVar(&c.PostVotes, "post-votes", 50000, "post votes")
+	flags.IntVar(&c.MaxDepth, "max-depth", 30, "deepest reply chain")
+	flags.Float64Var(&c.Skew, "skew", 1.2, "Zipf exponent of activity over users, forums and threads, > 1")
+	clear := flags.Bool("clear", false, "truncate all tables first")
+	digest := flags.Bool("digest", false, "print a hash of the generated rows and exit")
+	flags.Parse(args)
+
+	if *digest {
+		sum, err := c.Digest()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Println(sum)
+		return
+	}
+
+	sqlDB := getPostgres(dsn)
+	defer sqlDB.Close()
+
+	if *clear {
+		if err := serviceRepo.NewServiceRepository(sqlDB).Clear(context.Background()); err != nil {
+			log.Fatalln("clear failed:", err)
+		}
+	}
+
+	report, err := seed.Write(sqlDB, c)
+	if err != nil {
+		log.Fatalln("seed failed:", err)
+	}
+
+	fmt.Printf("seed %d: %d users, %d forums, %d threads, %d posts, %d votes, %d post votes in %s\n",
+		c.Seed, report.Users, report.Forums, report.Threads, report.Posts, report.Votes, report.PostVotes,
+		report.Elapsed.Round(time.Millisecond))
+}
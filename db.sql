@@ -4,6 +4,17 @@ DROP TABLE IF EXISTS thread CASCADE;
 DROP TABLE IF EXISTS post CASCADE;
 DROP TABLE IF EXISTS vote CASCADE;
 DROP TABLE IF EXISTS forum_users CASCADE;
+DROP TABLE IF EXISTS thread_slug_alias CASCADE;
+DROP TABLE IF EXISTS forum_slug_alias CASCADE;
+DROP TABLE IF EXISTS user_nickname_alias CASCADE;
+DROP TABLE IF EXISTS post_vote CASCADE;
+DROP TABLE IF EXISTS post_reaction CASCADE;
+DROP TABLE IF EXISTS user_reputation CASCADE;
+DROP TABLE IF EXISTS thread_subscription CASCADE;
+DROP TABLE IF EXISTS notification CASCADE;
+DROP TABLE IF EXISTS notification_pending CASCADE;
+DROP TABLE IF EXISTS post_mention CASCADE;
+DROP TABLE IF EXISTS idempotency_key CASCADE;
 
 CREATE EXTENSION IF NOT EXISTS citext;
 
@@ -12,7 +23,8 @@ CREATE TABLE IF NOT EXISTS users (
     nickname citext UNIQUE PRIMARY KEY,
     fullname TEXT NOT NULL,
     about TEXT,
-    email citext UNIQUE NOT NULL
+    email citext UNIQUE NOT NULL,
+    role TEXT NOT NULL DEFAULT 'user'
 );
 
 CREATE TABLE IF NOT EXISTS forum (
@@ -23,7 +35,14 @@ CREATE TABLE IF NOT EXISTS forum (
     posts BIGINT DEFAULT 0,
     threads INT DEFAULT 0,
 
-    FOREIGN KEY (author) REFERENCES users (nickname)
+    FOREIGN KEY (author) REFERENCES users (nickname) ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS user_nickname_alias (
+    nickname citext PRIMARY KEY,
+    target citext NOT NULL,
+
+    FOREIGN KEY (target) REFERENCES users (nickname) ON UPDATE CASCADE
 );
 
 CREATE TABLE IF NOT EXISTS thread (
@@ -36,13 +55,27 @@ CREATE TABLE IF NOT EXISTS thread (
     slug citext,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
 
-    FOREIGN KEY (author) REFERENCES users (nickname),
-    FOREIGN KEY (forum) REFERENCES forum (slug)
+    FOREIGN KEY (author) REFERENCES users (nickname) ON UPDATE CASCADE,
+    FOREIGN KEY (forum) REFERENCES forum (slug) ON UPDATE CASCADE
 );
 
 CREATE UNIQUE INDEX thread_slug_nn_idx ON thread (slug)
 WHERE slug != '';
 
+CREATE TABLE IF NOT EXISTS thread_slug_alias (
+    slug citext PRIMARY KEY,
+    thread INT NOT NULL,
+
+    FOREIGN KEY (thread) REFERENCES thread (id)
+);
+
+CREATE TABLE IF NOT EXISTS forum_slug_alias (
+    slug citext PRIMARY KEY,
+    forum citext NOT NULL,
+
+    FOREIGN KEY (forum) REFERENCES forum (slug) ON UPDATE CASCADE
+);
+
 CREATE TABLE IF NOT EXISTS post (
     id BIGSERIAL PRIMARY KEY,
     parent BIGINT DEFAULT 0,
@@ -52,38 +85,147 @@ CREATE TABLE IF NOT EXISTS post (
     forum citext,
     thread INT,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    score BIGINT NOT NULL DEFAULT 0,
+    reactions JSONB NOT NULL DEFAULT '{}',
 
     path BIGINT[] DEFAULT ARRAY []::BIGINT[],
 
-    FOREIGN KEY (forum) REFERENCES forum (slug),
+    FOREIGN KEY (forum) REFERENCES forum (slug) ON UPDATE CASCADE,
     FOREIGN KEY (thread) REFERENCES thread (id),
-    FOREIGN KEY (author) REFERENCES users (nickname)
+    FOREIGN KEY (author) REFERENCES users (nickname) ON UPDATE CASCADE
 );
 
 CREATE TABLE IF NOT EXISTS vote (
     id BIGSERIAL PRIMARY KEY,
     author citext,
-    voice INT,
+    voice INT CHECK (voice IN (-1, 1)),
+    weight INT NOT NULL DEFAULT 1 CHECK (weight > 0),
     thread INT,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
 
     UNIQUE (author, thread),
 
-    FOREIGN KEY (author) REFERENCES users (nickname),
+    FOREIGN KEY (author) REFERENCES users (nickname) ON UPDATE CASCADE,
+    FOREIGN KEY (thread) REFERENCES thread (id)
+);
+
+CREATE TABLE IF NOT EXISTS post_vote (
+    id BIGSERIAL PRIMARY KEY,
+    author citext NOT NULL,
+    post BIGINT NOT NULL,
+    voice INT NOT NULL CHECK (voice IN (-1, 1)),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    UNIQUE (author, post),
+
+    FOREIGN KEY (author) REFERENCES users (nickname) ON UPDATE CASCADE,
+    FOREIGN KEY (post) REFERENCES post (id)
+);
+
+CREATE TABLE IF NOT EXISTS post_reaction (
+    author citext NOT NULL,
+    post BIGINT NOT NULL,
+    emoji TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    PRIMARY KEY (post, emoji, author),
+
+    FOREIGN KEY (author) REFERENCES users (nickname) ON UPDATE CASCADE,
+    FOREIGN KEY (post) REFERENCES post (id)
+);
+
+CREATE TABLE IF NOT EXISTS user_reputation (
+    nickname citext NOT NULL,
+    forum citext NOT NULL,
+    thread_score BIGINT NOT NULL DEFAULT 0,
+    post_score BIGINT NOT NULL DEFAULT 0,
+
+    PRIMARY KEY (nickname, forum),
+
+    FOREIGN KEY (nickname) REFERENCES users (nickname) ON UPDATE CASCADE,
+    FOREIGN KEY (forum) REFERENCES forum (slug) ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS post_mention (
+    post BIGINT NOT NULL,
+    nickname citext NOT NULL,
+
+    PRIMARY KEY (post, nickname),
+
+    FOREIGN KEY (post) REFERENCES post (id),
+    FOREIGN KEY (nickname) REFERENCES users (nickname) ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS thread_subscription (
+    nickname citext NOT NULL,
+    thread INT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    PRIMARY KEY (thread, nickname),
+
+    FOREIGN KEY (nickname) REFERENCES users (nickname) ON UPDATE CASCADE,
     FOREIGN KEY (thread) REFERENCES thread (id)
 );
 
+-- the thread and forum of a notification are read from the post, so merged
+-- and moved threads need no update here
+CREATE TABLE IF NOT EXISTS notification (
+    id BIGSERIAL PRIMARY KEY,
+    nickname citext NOT NULL,
+    kind TEXT NOT NULL CHECK (kind IN ('mention', 'reply', 'post')),
+    post BIGINT NOT NULL,
+    is_read BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    UNIQUE (nickname, post),
+
+    FOREIGN KEY (nickname) REFERENCES users (nickname) ON UPDATE CASCADE,
+    FOREIGN KEY (post) REFERENCES post (id)
+);
+
+-- post batches waiting for notification fan-out that did not fit into the
+-- in-memory queue, drained by the server in the background
+CREATE TABLE IF NOT EXISTS notification_pending (
+    id BIGSERIAL PRIMARY KEY,
+    posts BIGINT[] NOT NULL,
+    mentions_only BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
 CREATE TABLE IF NOT EXISTS forum_users (
     nickname    CITEXT              NOT NULL,
     fullname    TEXT                NOT NULL,
     email       CITEXT              NOT NULL,
     about       TEXT,
     forum       CITEXT              NOT NULL,
-    FOREIGN KEY (nickname) REFERENCES users (nickname),
-    FOREIGN KEY (forum) REFERENCES forum (slug),
+    FOREIGN KEY (nickname) REFERENCES users (nickname) ON UPDATE CASCADE,
+    FOREIGN KEY (forum) REFERENCES forum (slug) ON UPDATE CASCADE,
 	PRIMARY KEY (nickname, forum)
 );
 
+-- responses to create requests sent with an Idempotency-Key, replayed when
+-- the client retries. status is NULL while the first request is served, a
+-- retry may take the key over once locked_until has passed.
+CREATE TABLE IF NOT EXISTS idempotency_key (
+    key TEXT PRIMARY KEY,
+    request_hash TEXT NOT NULL,
+    status INT,
+    body BYTEA,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    locked_until TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+-- reputation recomputed from source rows, used to verify and rebuild user_reputation
+CREATE OR REPLACE VIEW user_reputation_actual AS
+SELECT nickname, forum, sum(thread_score)::BIGINT AS thread_score, sum(post_score)::BIGINT AS post_score FROM (
+    SELECT t.author AS nickname, t.forum AS forum, v.voice * v.weight AS thread_score, 0 AS post_score
+    FROM vote AS v JOIN thread AS t ON t.id = v.thread
+    UNION ALL
+    SELECT p.author, p.forum, 0, pv.voice
+    FROM post_vote AS pv JOIN post AS p ON p.id = pv.post
+) AS scores
+GROUP BY nickname, forum;
+
 CREATE OR REPLACE FUNCTION post_insert() RETURNS TRIGGER AS $post_insert$
 BEGIN
     UPDATE post
@@ -99,7 +241,7 @@ CREATE TRIGGER post_insert AFTER INSERT ON post FOR EACH ROW EXECUTE PROCEDURE p
 CREATE OR REPLACE FUNCTION vote_insert() RETURNS TRIGGER AS $vote_insert$
 BEGIN
     UPDATE thread
-    SET votes = votes + NEW.voice
+    SET votes = votes + NEW.voice * NEW.weight
     WHERE id = NEW.thread;
     RETURN NULL;
 END;
@@ -110,12 +252,12 @@ CREATE TRIGGER vote_insert AFTER INSERT ON vote FOR EACH ROW EXECUTE PROCEDURE v
 
 CREATE OR REPLACE FUNCTION vote_update() RETURNS TRIGGER AS $vote_update$
 BEGIN
-	IF OLD.voice = NEW.voice
+	IF OLD.voice = NEW.voice AND OLD.weight = NEW.weight
 		THEN RETURN NULL;
 	END IF;
   	UPDATE thread
 	SET
-		votes = votes + NEW.voice * 2
+		votes = votes - OLD.voice * OLD.weight + NEW.voice * NEW.weight
   	WHERE id = NEW.thread;
   	RETURN NULL;
 END;
@@ -124,6 +266,91 @@ $vote_update$ LANGUAGE  plpgsql;
 DROP TRIGGER IF EXISTS vote_update ON vote;
 CREATE TRIGGER vote_update AFTER UPDATE ON vote FOR EACH ROW EXECUTE PROCEDURE vote_update();
 
+CREATE OR REPLACE FUNCTION vote_delete() RETURNS TRIGGER AS $vote_delete$
+BEGIN
+    UPDATE thread
+    SET votes = votes - OLD.voice * OLD.weight
+    WHERE id = OLD.thread;
+    RETURN NULL;
+END;
+$vote_delete$  LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS vote_delete ON vote;
+CREATE TRIGGER vote_delete AFTER DELETE ON vote FOR EACH ROW EXECUTE PROCEDURE vote_delete();
+
+CREATE OR REPLACE FUNCTION post_vote_change() RETURNS TRIGGER AS $post_vote_change$
+BEGIN
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        UPDATE post SET score = score - OLD.voice WHERE id = OLD.post;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        UPDATE post SET score = score + NEW.voice WHERE id = NEW.post;
+    END IF;
+    RETURN NULL;
+END;
+$post_vote_change$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS post_vote_change ON post_vote;
+CREATE TRIGGER post_vote_change AFTER INSERT OR UPDATE OF voice OR DELETE ON post_vote FOR EACH ROW EXECUTE PROCEDURE post_vote_change();
+
+CREATE OR REPLACE FUNCTION post_reaction_change() RETURNS TRIGGER AS $post_reaction_change$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        UPDATE post
+        SET reactions = jsonb_set(reactions, ARRAY[NEW.emoji], to_jsonb(COALESCE((reactions->>NEW.emoji)::BIGINT, 0) + 1))
+        WHERE id = NEW.post;
+    ELSE
+        UPDATE post
+        SET reactions = (CASE WHEN COALESCE((reactions->>OLD.emoji)::BIGINT, 0) <= 1
+            THEN reactions - OLD.emoji
+            ELSE jsonb_set(reactions, ARRAY[OLD.emoji], to_jsonb((reactions->>OLD.emoji)::BIGINT - 1)) END)
+        WHERE id = OLD.post;
+    END IF;
+    RETURN NULL;
+END;
+$post_reaction_change$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS post_reaction_change ON post_reaction;
+CREATE TRIGGER post_reaction_change AFTER INSERT OR DELETE ON post_reaction FOR EACH ROW EXECUTE PROCEDURE post_reaction_change();
+
+CREATE OR REPLACE FUNCTION vote_reputation() RETURNS TRIGGER AS $vote_reputation$
+BEGIN
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        INSERT INTO user_reputation (nickname, forum, thread_score)
+        SELECT author, forum, -OLD.voice * OLD.weight FROM thread WHERE id = OLD.thread
+        ON CONFLICT (nickname, forum) DO UPDATE SET thread_score = user_reputation.thread_score + EXCLUDED.thread_score;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        INSERT INTO user_reputation (nickname, forum, thread_score)
+        SELECT author, forum, NEW.voice * NEW.weight FROM thread WHERE id = NEW.thread
+        ON CONFLICT (nickname, forum) DO UPDATE SET thread_score = user_reputation.thread_score + EXCLUDED.thread_score;
+    END IF;
+    RETURN NULL;
+END;
+$vote_reputation$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS vote_reputation ON vote;
+CREATE TRIGGER vote_reputation AFTER INSERT OR UPDATE OF voice, weight OR DELETE ON vote FOR EACH ROW EXECUTE PROCEDURE vote_reputation();
+
+CREATE OR REPLACE FUNCTION post_vote_reputation() RETURNS TRIGGER AS $post_vote_reputation$
+BEGIN
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        INSERT INTO user_reputation (nickname, forum, post_score)
+        SELECT author, forum, -OLD.voice FROM post WHERE id = OLD.post
+        ON CONFLICT (nickname, forum) DO UPDATE SET post_score = user_reputation.post_score + EXCLUDED.post_score;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        INSERT INTO user_reputation (nickname, forum, post_score)
+        SELECT author, forum, NEW.voice FROM post WHERE id = NEW.post
+        ON CONFLICT (nickname, forum) DO UPDATE SET post_score = user_reputation.post_score + EXCLUDED.post_score;
+    END IF;
+    RETURN NULL;
+END;
+$post_vote_reputation$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS post_vote_reputation ON post_vote;
+CREATE TRIGGER post_vote_reputation AFTER INSERT OR UPDATE OF voice OR DELETE ON post_vote FOR EACH ROW EXECUTE PROCEDURE post_vote_reputation();
+
 CREATE OR REPLACE FUNCTION increment_posts_count() RETURNS TRIGGER AS $increment_posts_count$
 BEGIN
     UPDATE forum SET
@@ -180,6 +407,23 @@ $thread_paste_forum_user$ LANGUAGE plpgsql;
 DROP TRIGGER IF EXISTS thread_paste_forum_user ON thread;
 CREATE TRIGGER thread_paste_forum_user AFTER INSERT ON thread FOR EACH ROW EXECUTE PROCEDURE thread_paste_forum_user();
 
+CREATE OR REPLACE FUNCTION user_update_forum_users() RETURNS TRIGGER AS $user_update_forum_users$
+BEGIN
+    UPDATE forum_users SET
+        fullname = NEW.fullname,
+        email = NEW.email,
+        about = NEW.about
+    WHERE nickname = NEW.nickname;
+
+    RETURN NULL;
+END;
+$user_update_forum_users$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS user_update_forum_users ON users;
+CREATE TRIGGER user_update_forum_users AFTER UPDATE OF fullname, email, about ON users
+FOR EACH ROW WHEN (OLD.fullname IS DISTINCT FROM NEW.fullname OR OLD.email IS DISTINCT FROM NEW.email OR OLD.about IS DISTINCT FROM NEW.about)
+EXECUTE PROCEDURE user_update_forum_users();
+
 -- indexes
 
 CREATE INDEX IF NOT EXISTS users_email ON users USING hash (email);
@@ -189,9 +433,25 @@ CREATE INDEX IF NOT EXISTS forum_slug ON forum USING hash (slug);
 
 CREATE INDEX IF NOT EXISTS thread_slug ON thread USING hash (slug);
 CREATE INDEX IF NOT EXISTS thread_forum ON thread USING hash (forum);
+CREATE INDEX IF NOT EXISTS thread_author_created ON thread (author, created_at, id);
 
 CREATE INDEX IF NOT EXISTS post_thread_thread ON post (thread);
 CREATE INDEX IF NOT EXISTS post_forum ON post USING hash (forum);
 CREATE INDEX IF NOT EXISTS post_pathes ON post (forum, (path[1]), (path[2:]));
+CREATE INDEX IF NOT EXISTS post_author_created ON post (author, created_at, id);
+
+CREATE INDEX IF NOT EXISTS fu_forum ON forum_users USING hash (forum);
+
+CREATE INDEX IF NOT EXISTS vote_thread ON vote (thread, author);
+CREATE INDEX IF NOT EXISTS post_vote_post ON post_vote (post);
+CREATE INDEX IF NOT EXISTS post_top_roots ON post (thread, score, id) WHERE parent = 0;
+CREATE INDEX IF NOT EXISTS user_reputation_leaderboard ON user_reputation (forum, (thread_score + post_score) DESC, nickname);
+
+CREATE INDEX IF NOT EXISTS thread_slug_alias_thread ON thread_slug_alias (thread);
+
+CREATE INDEX IF NOT EXISTS post_mention_nickname ON post_mention (nickname, post DESC);
+
+CREATE INDEX IF NOT EXISTS notification_inbox ON notification (nickname, id DESC);
+CREATE INDEX IF NOT EXISTS notification_unread ON notification (nickname) WHERE NOT is_read;
 
-CREATE INDEX IF NOT EXISTS fu_forum ON forum_users USING hash (forum);
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS idempotency_key_created ON idempotency_key (created_at);
\ No newline at end of file
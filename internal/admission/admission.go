@@ -0,0 +1,284 @@
+package admission
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	myerror "forum/internal/error"
+
+	"github.com/gorilla/mux"
+)
+
+// Route classes. Heavy reads walk whole post trees, writes hold row locks and
+// run triggers, everything else is a cheap read.
+const (
+	Read  = "read"
+	Write = "write"
+	Heavy = "heavy"
+)
+
+type ClassConfig struct {
+	// InitialLimit, MinLimit and MaxLimit bound the concurrency of the class,
+	// the limit moves between them with observed latency
+	InitialLimit int
+	MinLimit     int
+	MaxLimit     int
+	// Budget is the longest a request may wait for a slot. Requests whose
+	// estimated wait is longer are refused right away.
+	Budget time.Duration
+	// Priority decides which class gets a freed slot when requests of several
+	// classes wait for the shared pool, higher goes first
+	Priority int
+}
+
+type Config struct {
+	// Pool is the number of requests served at once over all classes, it
+	// should not exceed the database pool
+	Pool    int
+	Classes map[string]*ClassConfig
+}
+
+// DefaultConfig shares a pool of 100 connections, cheap reads go first.
+func DefaultConfig() *Config {
+	return &Config{
+		Pool: 100,
+		Classes: map[string]*ClassConfig{
+			Read:  {InitialLimit: 60, MinLimit: 10, MaxLimit: 100, Budget: 50 * time.Millisecond, Priority: 2},
+			Write: {InitialLimit: 30, MinLimit: 5, MaxLimit: 80, Budget: 200 * time.Millisecond, Priority: 1},
+			Heavy: {InitialLimit: 10, MinLimit: 2, MaxLimit: 40, Budget: 500 * time.Millisecond, Priority: 0},
+		},
+	}
+}
+
+// Latency smoothing of the gradient limiter: short follows recent requests,
+// long is the baseline the class is compared to.
+const (
+	shortWeight = 0.1
+	longWeight  = 0.005
+	// tolerance is how much slower than the baseline a class may get before
+	// its limit shrinks
+	tolerance = 1.5
+	smoothing = 0.2
+)
+
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+type class struct {
+	name string
+	ClassConfig
+
+	limit    float64
+	inflight int
+	queue    []*waiter
+
+	short time.Duration
+	long  time.Duration
+}
+
+// update moves the limit by the gradient between the baseline and recent
+// latency. A class that does not use half its limit does not grow.
+func (c *class) update(latency time.Duration) {
+	if c.short == 0 {
+		c.short, c.long = latency, latency
+		return
+	}
+	c.short = time.Duration(float64(c.short)*(1-shortWeight) + float64(latency)*shortWeight)
+	c.long = time.Duration(float64(c.long)*(1-longWeight) + float64(latency)*longWeight)
+
+	// let the baseline follow a lasting change of the workload
+	if c.long > 2*c.short {
+		c.long = time.Duration(float64(c.long) * 0.95)
+	}
+
+	gradient := math.Max(0.5, math.Min(1, tolerance*float64(c.long)/float64(c.short)))
+	next := c.limit*gradient + math.Sqrt(c.limit)
+	if float64(c.inflight) < c.limit/2 {
+		next = math.Min(next, c.limit)
+	}
+
+	c.limit = c.limit*(1-smoothing) + next*smoothing
+	c.limit = math.Max(float64(c.MinLimit), math.Min(float64(c.MaxLimit), c.limit))
+}
+
+// wait estimates how long a new request of the class would queue.
+func (c *class) wait() time.Duration {
+	return time.Duration(float64(len(c.queue)+1) * float64(c.short) / math.Max(1, c.limit))
+}
+
+// Controller admits requests per route class and sheds them with a 503 once
+// they would wait longer than the class budget.
+type Controller struct {
+	mu       sync.Mutex
+	pool     int
+	inflight int
+	classes  map[string]*class
+	// byPriority is the order in which waiting classes get freed slots
+	byPriority []*class
+}
+
+func NewController(c *Config) *Controller {
+	ctrl := &Controller{
+		pool:    c.Pool,
+		classes: map[string]*class{},
+	}
+
+	for name, config := range c.Classes {
+		cl := &class{
+			name:        name,
+			ClassConfig: *config,
+			limit:       float64(config.InitialLimit),
+		}
+		ctrl.classes[name] = cl
+
+		i := 0
+		for i < len(ctrl.byPriority) && ctrl.byPriority[i].Priority >= cl.Priority {
+			i++
+		}
+		ctrl.byPriority = append(ctrl.byPriority, nil)
+		copy(ctrl.byPriority[i+1:], ctrl.byPriority[i:])
+		ctrl.byPriority[i] = cl
+	}
+
+	return ctrl
+}
+
+func (ctrl *Controller) free(c *class) bool {
+	return ctrl.inflight < ctrl.pool && float64(c.inflight) < c.limit
+}
+
+// acquire returns false when the request is shed.
+func (ctrl *Controller) acquire(r *http.Request, c *class) bool {
+	ctrl.mu.Lock()
+	if len(c.queue) == 0 && ctrl.free(c) && !ctrl.preferred(c) {
+		c.inflight++
+		ctrl.inflight++
+		ctrl.mu.Unlock()
+		return true
+	}
+	if c.wait() > c.Budget {
+		ctrl.mu.Unlock()
+		return false
+	}
+
+	w := &waiter{ready: make(chan struct{})}
+	c.queue = append(c.queue, w)
+	ctrl.mu.Unlock()
+
+	timer := time.NewTimer(c.Budget)
+	defer timer.Stop()
+
+	select {
+	case <-w.ready:
+		return true
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+
+	ctrl.mu.Lock()
+	defer ctrl.mu.Unlock()
+	if w.granted {
+		return true
+	}
+	for i, queued := range c.queue {
+		if queued == w {
+			c.queue = append(c.queue[:i], c.queue[i+1:]...)
+			break
+		}
+	}
+	return false
+}
+
+// preferred reports whether a class of higher priority waits for the pool,
+// a freed pool slot has to go there first.
+func (ctrl *Controller) preferred(c *class) bool {
+	for _, other := range ctrl.byPriority {
+		if other.Priority <= c.Priority {
+			return false
+		}
+		if len(other.queue) > 0 && float64(other.inflight) < other.limit {
+			return true
+		}
+	}
+	return false
+}
+
+func (ctrl *Controller) release(c *class, latency time.Duration) {
+	ctrl.mu.Lock()
+	defer ctrl.mu.Unlock()
+
+	c.inflight--
+	ctrl.inflight--
+	c.update(latency)
+
+	for _, next := range ctrl.byPriority {
+		for len(next.queue) > 0 && ctrl.free(next) {
+			w := next.queue[0]
+			next.queue = next.queue[1:]
+			w.granted = true
+			next.inflight++
+			ctrl.inflight++
+			close(w.ready)
+		}
+	}
+}
+
+// Classify puts a request into a route class by its route template.
+func Classify(r *http.Request) string {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return Write
+	}
+
+	route := ""
+	if current := mux.CurrentRoute(r); current != nil {
+		route, _ = current.GetPathTemplate()
+	}
+
+	switch {
+	case strings.HasSuffix(route, "/thread/{slug_or_id}/posts"):
+		query := r.URL.Query()
+		if sort := query.Get("sort"); (sort != "" && sort != "flat") || query.Get("format") == "nested" {
+			return Heavy
+		}
+	case strings.HasSuffix(route, "/post/{id}/replies"):
+		return Heavy
+	}
+	return Read
+}
+
+// Middleware admits requests through the controller. Service routes are
+// never shed, so that an overloaded server can still be inspected.
+func (ctrl *Controller) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/service/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		c, ok := ctrl.classes[Classify(r)]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !ctrl.acquire(r, c) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(myerror.Message{Message: "overloaded, retry later"})
+			return
+		}
+
+		start := time.Now()
+		defer func() {
+			ctrl.release(c, time.Since(start))
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
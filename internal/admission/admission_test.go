@@ -0,0 +1,301 @@
+package admission
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func request(ctx context.Context) *http.Request {
+	return httptest.NewRequest(http.MethodGet, "/api/forum/tea/details", nil).WithContext(ctx)
+}
+
+// queued waits until n requests of c wait for a slot.
+func queued(t *testing.T, ctrl *Controller, c *class, n int) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		ctrl.mu.Lock()
+		length := len(c.queue)
+		ctrl.mu.Unlock()
+		if length == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests of %s queued, want %d", length, c.name, n)
+		}
+	}
+}
+
+// counters returns the requests in flight in c and in the whole pool and the
+// length of the queue of c.
+func counters(ctrl *Controller, c *class) (int, int, int) {
+	ctrl.mu.Lock()
+	defer ctrl.mu.Unlock()
+	return c.inflight, ctrl.inflight, len(c.queue)
+}
+
+func TestShedWhenWaitExceedsBudget(t *testing.T) {
+	ctrl := NewController(&Config{
+		Pool: 10,
+		Classes: map[string]*ClassConfig{
+			Read: {InitialLimit: 1, MinLimit: 1, MaxLimit: 1, Budget: 50 * time.Millisecond},
+		},
+	})
+	c := ctrl.classes[Read]
+
+	if !ctrl.acquire(request(context.Background()), c) {
+		t.Fatal("first request shed on an idle controller")
+	}
+
+	// requests take 100ms and one runs at a time, the next would wait twice
+	// its budget and is refused without waiting
+	c.short = 100 * time.Millisecond
+	start := time.Now()
+	if ctrl.acquire(request(context.Background()), c) {
+		t.Fatal("request admitted beyond the limit")
+	}
+	if waited := time.Since(start); waited >= c.Budget {
+		t.Fatalf("shed after %v, want right away", waited)
+	}
+
+	// with fast requests it queues and gives up after the budget
+	c.short = time.Millisecond
+	start = time.Now()
+	if ctrl.acquire(request(context.Background()), c) {
+		t.Fatal("request admitted beyond the limit")
+	}
+	if waited := time.Since(start); waited < c.Budget {
+		t.Fatalf("gave up after %v, before the budget of %v", waited, c.Budget)
+	}
+
+	if inflight, total, queue := counters(ctrl, c); inflight != 1 || total != 1 || queue != 0 {
+		t.Fatalf("inflight %d, pool %d, queue %d after shedding, want 1, 1, 0", inflight, total, queue)
+	}
+}
+
+func TestFreedSlotGoesToHigherPriority(t *testing.T) {
+	ctrl := NewController(&Config{
+		Pool: 1,
+		Classes: map[string]*ClassConfig{
+			Read:  {InitialLimit: 1, MinLimit: 1, MaxLimit: 1, Budget: time.Second, Priority: 2},
+			Heavy: {InitialLimit: 1, MinLimit: 1, MaxLimit: 1, Budget: time.Second, Priority: 0},
+		},
+	})
+	read, heavy := ctrl.classes[Read], ctrl.classes[Heavy]
+
+	if !ctrl.acquire(request(context.Background()), heavy) {
+		t.Fatal("first request shed on an idle controller")
+	}
+
+	// a heavy request queues first, a read after it
+	heavyAdmitted := make(chan bool, 1)
+	go func() { heavyAdmitted <- ctrl.acquire(request(context.Background()), heavy) }()
+	queued(t, ctrl, heavy, 1)
+
+	readAdmitted := make(chan bool, 1)
+	go func() { readAdmitted <- ctrl.acquire(request(context.Background()), read) }()
+	queued(t, ctrl, read, 1)
+
+	ctrl.release(heavy, time.Millisecond)
+	select {
+	case ok := <-readAdmitted:
+		if !ok {
+			t.Fatal("read shed although a slot was freed")
+		}
+	case <-heavyAdmitted:
+		t.Fatal("freed slot went to the heavy request waiting longer")
+	case <-time.After(time.Second):
+		t.Fatal("freed slot not handed over")
+	}
+
+	// a new heavy request can not take the pool slot while the read holds it
+	if inflight, total, queue := counters(ctrl, heavy); inflight != 0 || total != 1 || queue != 1 {
+		t.Fatalf("heavy inflight %d, pool %d, queue %d, want 0, 1, 1", inflight, total, queue)
+	}
+
+	ctrl.release(read, time.Millisecond)
+	if ok := <-heavyAdmitted; !ok {
+		t.Fatal("heavy request shed after the read finished")
+	}
+	ctrl.release(heavy, time.Millisecond)
+
+	if inflight, total, queue := counters(ctrl, heavy); inflight != 0 || total != 0 || queue != 0 {
+		t.Fatalf("heavy inflight %d, pool %d, queue %d at the end, want zeros", inflight, total, queue)
+	}
+}
+
+func TestNoSlotOnPriorityWhileHigherWaits(t *testing.T) {
+	ctrl := NewController(&Config{
+		Pool: 1,
+		Classes: map[string]*ClassConfig{
+			Read:  {InitialLimit: 1, MinLimit: 1, MaxLimit: 1, Budget: time.Second, Priority: 2},
+			Write: {InitialLimit: 1, MinLimit: 1, MaxLimit: 1, Budget: 20 * time.Millisecond, Priority: 1},
+		},
+	})
+	read, write := ctrl.classes[Read], ctrl.classes[Write]
+
+	// a read waits for a pool slot that was just freed and not handed out
+	// yet, a write arriving now must not take it
+	ctrl.mu.Lock()
+	read.queue = append(read.queue, &waiter{ready: make(chan struct{})})
+	ctrl.mu.Unlock()
+	if ctrl.acquire(request(context.Background()), write) {
+		t.Fatal("write took the pool slot while a read waited")
+	}
+}
+
+// A waiter that gives up at the moment its slot is granted either keeps the
+// slot and returns true, or is removed from the queue and gets none. Either
+// way every slot is accounted for.
+func TestTimedOutWaiterKeepsNoSlot(t *testing.T) {
+	ctrl := NewController(&Config{
+		Pool: 1,
+		Classes: map[string]*ClassConfig{
+			Write: {InitialLimit: 1, MinLimit: 1, MaxLimit: 1, Budget: time.Second},
+		},
+	})
+	c := ctrl.classes[Write]
+
+	granted, removed := 0, 0
+	for i := 0; i < 200; i++ {
+		if !ctrl.acquire(request(context.Background()), c) {
+			t.Fatal("request shed on an idle controller")
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		admitted := make(chan bool, 1)
+		go func() { admitted <- ctrl.acquire(request(ctx), c) }()
+		queued(t, ctrl, c, 1)
+
+		// the client goes away while the slot is freed, sometimes just before
+		if i%2 == 0 {
+			cancel()
+			runtime.Gosched()
+		} else {
+			go cancel()
+		}
+		ctrl.release(c, time.Millisecond)
+		ok := <-admitted
+
+		inflight, total, queue := counters(ctrl, c)
+		if queue != 0 {
+			t.Fatalf("waiter still queued after returning %v", ok)
+		}
+		if ok {
+			granted++
+			if inflight != 1 || total != 1 {
+				t.Fatalf("admitted waiter holds inflight %d, pool %d, want 1, 1", inflight, total)
+			}
+			ctrl.release(c, time.Millisecond)
+		} else {
+			removed++
+			if inflight != 0 || total != 0 {
+				t.Fatalf("removed waiter leaked inflight %d, pool %d", inflight, total)
+			}
+		}
+	}
+	t.Logf("waiters granted %d, removed %d", granted, removed)
+
+	// a plain timeout leaves nothing behind either
+	c.Budget = 10 * time.Millisecond
+	if !ctrl.acquire(request(context.Background()), c) {
+		t.Fatal("request shed on an idle controller")
+	}
+	if ctrl.acquire(request(context.Background()), c) {
+		t.Fatal("request admitted beyond the limit")
+	}
+	ctrl.release(c, time.Millisecond)
+	if inflight, total, queue := counters(ctrl, c); inflight != 0 || total != 0 || queue != 0 {
+		t.Fatalf("inflight %d, pool %d, queue %d after a timeout, want zeros", inflight, total, queue)
+	}
+}
+
+func TestLimitStaysWithinBounds(t *testing.T) {
+	c := &class{
+		name:        Read,
+		ClassConfig: ClassConfig{InitialLimit: 10, MinLimit: 5, MaxLimit: 20},
+		limit:       10,
+	}
+
+	// steady fast requests with the class fully used grow the limit
+	for i := 0; i < 1000; i++ {
+		c.inflight = int(c.limit)
+		c.update(time.Millisecond)
+		if c.limit < float64(c.MinLimit) || c.limit > float64(c.MaxLimit) {
+			t.Fatalf("limit %.2f outside [%d, %d] while growing", c.limit, c.MinLimit, c.MaxLimit)
+		}
+	}
+	if c.limit != float64(c.MaxLimit) {
+		t.Fatalf("limit %.2f after fast requests, want %d", c.limit, c.MaxLimit)
+	}
+
+	// a class using less than half its limit does not grow
+	c.limit = 10
+	c.inflight = 2
+	for i := 0; i < 100; i++ {
+		c.update(time.Millisecond)
+	}
+	if c.limit > 10 {
+		t.Fatalf("limit grew to %.2f with the class mostly idle", c.limit)
+	}
+
+	// requests getting much slower than the baseline shrink it down to the
+	// minimum
+	c.inflight = 10
+	for i := 0; i < 50; i++ {
+		c.update(time.Second)
+		if c.limit < float64(c.MinLimit) || c.limit > float64(c.MaxLimit) {
+			t.Fatalf("limit %.2f outside [%d, %d] while shrinking", c.limit, c.MinLimit, c.MaxLimit)
+		}
+	}
+	if c.limit != float64(c.MinLimit) {
+		t.Fatalf("limit %.2f after slow requests, want %d", c.limit, c.MinLimit)
+	}
+
+	// once the baseline follows the slower workload the limit grows again
+	for i := 0; i < 2000; i++ {
+		c.inflight = int(c.limit)
+		c.update(time.Second)
+		if c.limit < float64(c.MinLimit) || c.limit > float64(c.MaxLimit) {
+			t.Fatalf("limit %.2f outside [%d, %d] while recovering", c.limit, c.MinLimit, c.MaxLimit)
+		}
+	}
+	if c.limit != float64(c.MaxLimit) {
+		t.Fatalf("limit %.2f after a lasting slowdown, want %d", c.limit, c.MaxLimit)
+	}
+}
+
+func TestMiddlewareSheds(t *testing.T) {
+	ctrl := NewController(&Config{
+		Pool: 1,
+		Classes: map[string]*ClassConfig{
+			Read: {InitialLimit: 1, MinLimit: 1, MaxLimit: 1, Budget: time.Millisecond},
+		},
+	})
+	if !ctrl.acquire(request(context.Background()), ctrl.classes[Read]) {
+		t.Fatal("first request shed on an idle controller")
+	}
+	ctrl.classes[Read].short = time.Second
+
+	served := false
+	handler := ctrl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = true
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/forum/tea/details", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "1" || served {
+		t.Fatalf("status %d, Retry-After %q, served %v, want a shed 503", rec.Code, rec.Header().Get("Retry-After"), served)
+	}
+
+	// service routes are never shed
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/service/status", nil))
+	if rec.Code != http.StatusOK || !served {
+		t.Fatalf("service route status %d, served %v", rec.Code, served)
+	}
+}
@@ -0,0 +1,157 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	forumHandle "forum/internal/pkg/forum/delivery"
+	forumRepo "forum/internal/pkg/forum/repository"
+	forumUse "forum/internal/pkg/forum/usecase"
+
+	userHandle "forum/internal/pkg/user/delivery"
+	userRepo "forum/internal/pkg/user/repository"
+	userUse "forum/internal/pkg/user/usecase"
+
+	threadHandle "forum/internal/pkg/thread/delivery"
+	threadRepo "forum/internal/pkg/thread/repository"
+	threadUse "forum/internal/pkg/thread/usecase"
+
+	notificationHandle "forum/internal/pkg/notification/delivery"
+	notificationRepo "forum/internal/pkg/notification/repository"
+	notificationUse "forum/internal/pkg/notification/usecase"
+
+	postHandle "forum/internal/pkg/post/delivery"
+	postRepo "forum/internal/pkg/post/repository"
+	postUse "forum/internal/pkg/post/usecase"
+
+	postVoteHandle "forum/internal/pkg/postvote/delivery"
+	postVoteRepo "forum/internal/pkg/postvote/repository"
+	postVoteUse "forum/internal/pkg/postvote/usecase"
+
+	reactionHandle "forum/internal/pkg/reaction/delivery"
+	reactionRepo "forum/internal/pkg/reaction/repository"
+	reactionUse "forum/internal/pkg/reaction/usecase"
+
+	voteHandle "forum/internal/pkg/vote/delivery"
+	voteRepo "forum/internal/pkg/vote/repository"
+	voteUse "forum/internal/pkg/vote/usecase"
+
+	serviceHandle "forum/internal/pkg/service/delivery"
+	serviceRepo "forum/internal/pkg/service/repository"
+	serviceUse "forum/internal/pkg/service/usecase"
+
+	"forum/internal/admission"
+	"forum/internal/fault"
+	"forum/internal/idempotency"
+	"forum/internal/markdown"
+	"forum/internal/querylog"
+	"forum/internal/record"
+)
+
+// DefaultRenderCacheSize is the number of rendered message revisions kept in
+// memory.
+const DefaultRenderCacheSize = 50000
+
+type Config struct {
+	// VoteWeights gives the voice of a vote by the role of the voter
+	VoteWeights     map[string]int32
+	RenderCacheSize int
+	// QueryLog is the slow query log of db served under /service, nil when
+	// statements are not timed
+	QueryLog *querylog.Log
+	// Faults are the fault injection rules managed under /service, nil
+	// unless fault injection is enabled
+	Faults *fault.Injector
+	// Admission sheds requests when the database falls behind, nil admits
+	// everything
+	Admission *admission.Controller
+	// Recorder records requests for replay, nil when nothing is recorded
+	Recorder *record.Recorder
+	// IdempotencyTTL is how long responses to create requests with an
+	// Idempotency-Key are kept for replay, idempotency.DefaultTTL when zero
+	IdempotencyTTL time.Duration
+}
+
+// NewRouter wires repositories, usecases and handlers on db and returns the
+// router that serves the API under /api, and a function that stops the
+// background work of the router. Call it once the server stopped serving.
+func NewRouter(sqlDB *sql.DB, c *Config) (*mux.Router, func(ctx context.Context) error) {
+	renderCacheSize := c.RenderCacheSize
+	if renderCacheSize <= 0 {
+		renderCacheSize = DefaultRenderCacheSize
+	}
+
+	r := mux.NewRouter()
+	r = r.PathPrefix("/api").Subrouter()
+
+	// Middleware runs in this order. Every statement of a request carries
+	// its ID, faults and shedding come before anything touches the database,
+	// and idempotency is last, so that it buffers the response of the
+	// handler only and a shed request claims no key.
+	if c.QueryLog != nil {
+		r.Use(c.QueryLog.Middleware)
+	}
+	if c.Faults != nil {
+		r.Use(c.Faults.Middleware)
+	}
+	if c.Admission != nil {
+		r.Use(c.Admission.Middleware)
+	}
+	if c.Recorder != nil {
+		r.Use(c.Recorder.Middleware)
+	}
+	r.Use(idempotency.NewStore(sqlDB, c.IdempotencyTTL).Middleware)
+
+	ur := userRepo.NewUserRepository(sqlDB)
+	uu := userUse.NewUserUsecase(ur)
+	uh := userHandle.NewUserHandler(uu)
+	uh.Routing(r)
+
+	fr := forumRepo.NewForumRepository(sqlDB)
+	fu := forumUse.NewForumUsecase(fr)
+	fh := forumHandle.NewUserHandler(fu, uu)
+	fh.Routing(r)
+
+	md := markdown.NewRenderer(renderCacheSize)
+
+	tr := threadRepo.NewThreadRepository(sqlDB)
+	tu := threadUse.NewThreadUsecase(tr)
+	th := threadHandle.NewThreadHandler(tu, uu, fu, md)
+	th.Routing(r)
+
+	nr := notificationRepo.NewNotificationRepository(sqlDB)
+	nu := notificationUse.NewNotificationUsecase(nr, tr)
+	nh := notificationHandle.NewNotificationHandler(nu, uu)
+	nh.Routing(r)
+
+	pr := postRepo.NewPostRepository(sqlDB)
+	pu := postUse.NewPostUsecase(pr, tr, nu)
+	ph := postHandle.NewPostHandler(pu, uu, tu, fu, md)
+	ph.Routing(r)
+
+	vr := voteRepo.NewVoteRepository(sqlDB)
+	vu := voteUse.NewVoteUsecase(vr, tr)
+	vu.SetRoleWeights(c.VoteWeights)
+	vh := voteHandle.NewVoteHandler(vu, tu)
+	vh.Routing(r)
+
+	pvr := postVoteRepo.NewPostVoteRepository(sqlDB)
+	pvu := postVoteUse.NewPostVoteUsecase(pvr, pr)
+	pvh := postVoteHandle.NewPostVoteHandler(pvu)
+	pvh.Routing(r)
+
+	rr := reactionRepo.NewReactionRepository(sqlDB)
+	ru := reactionUse.NewReactionUsecase(rr, pr)
+	rh := reactionHandle.NewReactionHandler(ru)
+	rh.Routing(r)
+
+	sr := serviceRepo.NewServiceRepository(sqlDB)
+	su := serviceUse.NewServiceUsecase(sr)
+	sh := serviceHandle.NewServiceHandler(su, nu, uu, c.QueryLog, c.Faults)
+	sh.Routing(r)
+
+	return r, nu.Close
+}
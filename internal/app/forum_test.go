@@ -0,0 +1,227 @@
+package app_test
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"forum/internal/models"
+)
+
+func TestForumCreate(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("Alice")
+
+	// the owner is stored with the nickname as registered
+	forum := &models.Forum{}
+	a.expect(http.MethodPost, "/api/forum/create", &models.Forum{
+		Slug:  "tea",
+		Title: "Tea",
+		User:  "alice",
+	}, http.StatusCreated, forum)
+	if forum.User != "Alice" || forum.Slug != "tea" || forum.Title != "Tea" {
+		t.Fatalf("created %+v", forum)
+	}
+
+	// the existing forum comes back on conflict
+	existing := &models.Forum{}
+	a.expect(http.MethodPost, "/api/forum/create", &models.Forum{
+		Slug:  "TEA",
+		Title: "Other",
+		User:  "Alice",
+	}, http.StatusConflict, existing)
+	if existing.Slug != "tea" || existing.Title != "Tea" {
+		t.Fatalf("conflict %+v", existing)
+	}
+
+	a.expect(http.MethodPost, "/api/forum/create", &models.Forum{
+		Slug:  "coffee",
+		Title: "Coffee",
+		User:  "nobody",
+	}, http.StatusNotFound, nil)
+}
+
+func TestForumDetails(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.forum("tea", "alice")
+	thread := a.thread("tea", "alice", "party", time.Time{})
+	a.posts(thread.Id, "alice", 0, 0)
+
+	forum := &models.Forum{}
+	a.expect(http.MethodGet, "/api/forum/TEA/details", nil, http.StatusOK, forum)
+	if forum.Slug != "tea" || forum.Threads != 1 || forum.Posts != 2 {
+		t.Fatalf("details %+v", forum)
+	}
+
+	full := &models.ForumFull{}
+	a.expect(http.MethodGet, "/api/forum/tea/details?include=owner", nil, http.StatusOK, full)
+	if full.Forum == nil || full.Owner == nil || full.Owner.Nickname != "alice" || full.Owner.Email != "alice@example.com" {
+		t.Fatalf("details with owner %+v", full)
+	}
+
+	a.expect(http.MethodGet, "/api/forum/tea/details?include=moderators", nil, http.StatusBadRequest, nil)
+	a.expect(http.MethodGet, "/api/forum/nothing/details", nil, http.StatusNotFound, nil)
+}
+
+func TestForumUpdate(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.forum("tea", "alice")
+	a.forum("coffee", "alice")
+	thread := a.thread("tea", "alice", "party", time.Time{})
+
+	title, slug := "Green tea", "green-tea"
+	forum := &models.Forum{}
+	a.expect(http.MethodPost, "/api/forum/tea/details", &models.ForumUpdate{Title: &title, Slug: &slug}, http.StatusOK, forum)
+	if forum.Slug != slug || forum.Title != title {
+		t.Fatalf("updated %+v", forum)
+	}
+
+	// threads follow the forum and the old slug redirects
+	details := &models.Thread{}
+	a.expect(http.MethodGet, "/api/thread/party/details", nil, http.StatusOK, details)
+	if details.Forum != slug || details.Id != thread.Id {
+		t.Fatalf("thread after forum rename %+v", details)
+	}
+	resp := a.expect(http.MethodGet, "/api/forum/tea/details", nil, http.StatusMovedPermanently, nil)
+	if location := resp.Header.Get("Location"); location != "/api/forum/green-tea/details" {
+		t.Fatalf("Location %q", location)
+	}
+	resp = a.expect(http.MethodGet, "/api/forum/tea/threads?limit=1", nil, http.StatusMovedPermanently, nil)
+	if location := resp.Header.Get("Location"); location != "/api/forum/green-tea/threads?limit=1" {
+		t.Fatalf("Location %q", location)
+	}
+
+	taken, numeric := "coffee", "12345"
+	a.expect(http.MethodPost, "/api/forum/green-tea/details", &models.ForumUpdate{Slug: &taken}, http.StatusConflict, nil)
+	a.expect(http.MethodPost, "/api/forum/green-tea/details", &models.ForumUpdate{Slug: &numeric}, http.StatusBadRequest, nil)
+	a.expect(http.MethodPost, "/api/forum/nothing/details", &models.ForumUpdate{Title: &title}, http.StatusNotFound, nil)
+}
+
+func TestForumThreads(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.forum("tea", "alice")
+
+	base := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+	slugs := []string{"t0", "t1", "t2", "t3", "t4"}
+	for i, slug := range slugs {
+		a.thread("tea", "alice", slug, base.Add(time.Duration(i)*time.Hour))
+	}
+
+	at := func(i int) string {
+		return url.QueryEscape(base.Add(time.Duration(i) * time.Hour).Format(time.RFC3339))
+	}
+
+	// since is inclusive for threads
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{"", "t0,t1,t2,t3,t4"},
+		{"?limit=2", "t0,t1"},
+		{"?desc=true", "t4,t3,t2,t1,t0"},
+		{"?desc=true&limit=2", "t4,t3"},
+		{"?since=" + at(2), "t2,t3,t4"},
+		{"?since=" + at(2) + "&limit=2", "t2,t3"},
+		{"?since=" + at(2) + "&desc=true", "t2,t1,t0"},
+		{"?since=" + at(2) + "&desc=true&limit=1", "t2"},
+		{"?since=" + at(10), ""},
+	}
+	for _, c := range cases {
+		threads := []*models.Thread{}
+		a.expect(http.MethodGet, "/api/forum/tea/threads"+c.query, nil, http.StatusOK, &threads)
+		got := []string{}
+		for _, thread := range threads {
+			got = append(got, thread.Slug)
+		}
+		if strings.Join(got, ",") != c.want {
+			t.Errorf("threads%s: %v, want %s", c.query, got, c.want)
+		}
+	}
+
+	a.expect(http.MethodGet, "/api/forum/nothing/threads", nil, http.StatusNotFound, nil)
+}
+
+func TestForumUsers(t *testing.T) {
+	a := newAPI(t)
+
+	for _, nickname := range []string{"dave", "Alice", "carol", "bob", "eve"} {
+		a.user(nickname)
+	}
+	a.forum("tea", "eve")
+	a.forum("empty", "eve")
+
+	// users join a forum by starting a thread or posting in one
+	thread := a.thread("tea", "dave", "party", time.Time{})
+	a.posts(thread.Id, "Alice", 0)
+	a.posts(thread.Id, "carol", 0)
+	a.posts(thread.Id, "bob", 0)
+
+	// nicknames compare case insensitively
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{"", "Alice,bob,carol,dave"},
+		{"?limit=2", "Alice,bob"},
+		{"?desc=true", "dave,carol,bob,Alice"},
+		{"?since=bob", "carol,dave"},
+		{"?since=BOB&limit=1", "carol"},
+		{"?since=carol&desc=true", "bob,Alice"},
+		{"?since=aaron&desc=true", ""},
+	}
+	for _, c := range cases {
+		users := []*models.User{}
+		a.expect(http.MethodGet, "/api/forum/tea/users"+c.query, nil, http.StatusOK, &users)
+		got := []string{}
+		for _, user := range users {
+			got = append(got, user.Nickname)
+		}
+		if strings.Join(got, ",") != c.want {
+			t.Errorf("users%s: %v, want %s", c.query, got, c.want)
+		}
+	}
+
+	users := []*models.User{}
+	a.expect(http.MethodGet, "/api/forum/empty/users", nil, http.StatusOK, &users)
+	if len(users) != 0 {
+		t.Fatalf("users of an empty forum %+v", users)
+	}
+	a.expect(http.MethodGet, "/api/forum/nothing/users", nil, http.StatusNotFound, nil)
+}
+
+func TestForumLeaderboard(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.user("bob")
+	a.user("carol")
+	a.forum("tea", "alice")
+	thread := a.thread("tea", "alice", "party", time.Time{})
+	posts := a.posts(thread.Id, "bob", 0)
+
+	a.expect(http.MethodPost, "/api/thread/party/vote", &models.Vote{Nickname: "bob", Voice: 1}, http.StatusOK, nil)
+	a.expect(http.MethodPost, "/api/thread/party/vote", &models.Vote{Nickname: "carol", Voice: 1}, http.StatusOK, nil)
+	a.expect(http.MethodPost, "/api/post/"+itoa(posts[0].Id)+"/vote", &models.PostVote{Nickname: "alice", Voice: 1}, http.StatusOK, nil)
+
+	leaders := []*models.Reputation{}
+	a.expect(http.MethodGet, "/api/forum/tea/leaderboard", nil, http.StatusOK, &leaders)
+	if len(leaders) < 2 || leaders[0].Nickname != "alice" || leaders[0].Total != 2 || leaders[1].Nickname != "bob" || leaders[1].Total != 1 {
+		t.Fatalf("leaderboard %+v", leaders)
+	}
+
+	a.expect(http.MethodGet, "/api/forum/tea/leaderboard?limit=1", nil, http.StatusOK, &leaders)
+	if len(leaders) != 1 {
+		t.Fatalf("leaderboard with limit 1 has %d entries", len(leaders))
+	}
+
+	a.expect(http.MethodGet, "/api/forum/nothing/leaderboard", nil, http.StatusNotFound, nil)
+}
@@ -0,0 +1,240 @@
+package app_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/stdlib"
+
+	"forum/internal/app"
+	"forum/internal/fault"
+	"forum/internal/idempotency"
+	"forum/internal/models"
+)
+
+// keyed posts body as JSON with an Idempotency-Key.
+func (a *api) keyed(path string, key string, body interface{}) (*http.Response, []byte) {
+	a.t.Helper()
+
+	buf, err := json.Marshal(body)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, a.server.URL+path, bytes.NewReader(buf))
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(idempotency.Header, key)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		a.t.Fatalf("POST %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		a.t.Fatalf("POST %s: %v", path, err)
+	}
+	return resp, data
+}
+
+func TestIdempotencyPostBatch(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.forum("tea", "alice")
+	thread := a.thread("tea", "alice", "party", time.Time{})
+	path := fmt.Sprintf("/api/thread/%d/create", thread.Id)
+	batch := []*models.Post{
+		{Author: "alice", Message: "first"},
+		{Author: "alice", Message: "second"},
+	}
+
+	first, created := a.keyed(path, "batch-1", batch)
+	if first.StatusCode != http.StatusCreated {
+		t.Fatalf("status %d: %s", first.StatusCode, created)
+	}
+	if first.Header.Get(idempotency.ReplayedHeader) != "" {
+		t.Fatalf("first response marked as replayed")
+	}
+
+	// the client timed out and retries
+	retry, replayed := a.keyed(path, "batch-1", batch)
+	if retry.StatusCode != http.StatusCreated || retry.Header.Get(idempotency.ReplayedHeader) != "true" {
+		t.Fatalf("retry status %d, replayed %q", retry.StatusCode, retry.Header.Get(idempotency.ReplayedHeader))
+	}
+	if !bytes.Equal(created, replayed) {
+		t.Fatalf("replayed %s, want %s", replayed, created)
+	}
+
+	posts := []*models.Post{}
+	a.expect(http.MethodGet, fmt.Sprintf("/api/thread/%d/posts", thread.Id), nil, http.StatusOK, &posts)
+	if len(posts) != len(batch) {
+		t.Fatalf("%d posts after the retry, want %d", len(posts), len(batch))
+	}
+
+	// the same key with another batch is refused, another key is a new batch
+	other := []*models.Post{{Author: "alice", Message: "third"}}
+	if resp, data := a.keyed(path, "batch-1", other); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("reused key status %d: %s", resp.StatusCode, data)
+	}
+	if resp, data := a.keyed(path, "batch-2", other); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("new key status %d: %s", resp.StatusCode, data)
+	}
+}
+
+func TestIdempotencyVote(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.user("bob")
+	a.forum("tea", "alice")
+	thread := a.thread("tea", "alice", "party", time.Time{})
+	path := fmt.Sprintf("/api/thread/%d/vote", thread.Id)
+
+	if resp, data := a.keyed(path, "vote-1", &models.Vote{Nickname: "bob", Voice: 1}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, data)
+	}
+	// bob changes the vote in between, the retry must not undo that
+	a.expect(http.MethodPost, path, &models.Vote{Nickname: "bob", Voice: -1}, http.StatusOK, nil)
+
+	resp, data := a.keyed(path, "vote-1", &models.Vote{Nickname: "bob", Voice: 1})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(idempotency.ReplayedHeader) != "true" {
+		t.Fatalf("retry status %d: %s", resp.StatusCode, data)
+	}
+
+	voted := &models.Thread{}
+	a.expect(http.MethodGet, fmt.Sprintf("/api/thread/%d/details", thread.Id), nil, http.StatusOK, voted)
+	if voted.Votes != -1 {
+		t.Fatalf("votes %d after the retry, want -1", voted.Votes)
+	}
+
+	// errors are replayed like any other answer below 500
+	if resp, _ := a.keyed(path, "vote-2", &models.Vote{Nickname: "nobody", Voice: 1}); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status %d, want 404", resp.StatusCode)
+	}
+	a.user("nobody")
+	if resp, _ := a.keyed(path, "vote-2", &models.Vote{Nickname: "nobody", Voice: 1}); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("replayed status %d, want 404", resp.StatusCode)
+	}
+
+	// requests without a key are never replayed
+	a.expect(http.MethodPost, path, &models.Vote{Nickname: "bob", Voice: 1}, http.StatusOK, voted)
+	if voted.Votes != 1 {
+		t.Fatalf("votes %d, want 1", voted.Votes)
+	}
+}
+
+// A key left without a response, because the server died or the response
+// could not be stored, is free again for the same request once its lease ran
+// out.
+func TestIdempotencyLease(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.forum("tea", "alice")
+	thread := a.thread("tea", "alice", "party", time.Time{})
+	path := fmt.Sprintf("/api/thread/%d/create", thread.Id)
+	batch := []*models.Post{{Author: "alice", Message: "first"}}
+
+	if resp, data := a.keyed(path, "lease-1", batch); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("status %d: %s", resp.StatusCode, data)
+	}
+
+	// the server died while serving the request
+	_, err := testDB.Exec(`UPDATE idempotency_key SET status = NULL, body = NULL, locked_until = NOW() + interval '1 minute'
+	WHERE key = 'lease-1'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, data := a.keyed(path, "lease-1", batch); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("status %d during the lease, want 409: %s", resp.StatusCode, data)
+	}
+
+	if _, err := testDB.Exec("UPDATE idempotency_key SET locked_until = NOW() - interval '1 second' WHERE key = 'lease-1'"); err != nil {
+		t.Fatal(err)
+	}
+	other := []*models.Post{{Author: "alice", Message: "other"}}
+	if resp, data := a.keyed(path, "lease-1", other); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("another request took over the key: status %d: %s", resp.StatusCode, data)
+	}
+
+	resp, data := a.keyed(path, "lease-1", batch)
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get(idempotency.ReplayedHeader) != "" {
+		t.Fatalf("retry after the lease status %d, replayed %q: %s", resp.StatusCode, resp.Header.Get(idempotency.ReplayedHeader), data)
+	}
+	if resp, _ := a.keyed(path, "lease-1", batch); resp.Header.Get(idempotency.ReplayedHeader) != "true" {
+		t.Fatalf("response of the retry not stored")
+	}
+}
+
+// dsnConnector opens connections to the test database for wrapped drivers.
+type dsnConnector struct {
+	dsn string
+}
+
+func (c *dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return stdlib.GetDefaultDriver().Open(c.dsn)
+}
+
+func (c *dsnConnector) Driver() driver.Driver {
+	return stdlib.GetDefaultDriver()
+}
+
+// When the response can not be stored the client learns about it, and the
+// key stays claimed so that a retry does not create the posts again.
+func TestIdempotencyCompleteFails(t *testing.T) {
+	if testDB == nil {
+		t.Skip("FORUM_TEST_DSN is not set")
+	}
+
+	inj := fault.NewInjector()
+	db := sql.OpenDB(inj.Wrap(&dsnConnector{dsn: os.Getenv("FORUM_TEST_DSN")}))
+	defer db.Close()
+	a := newAPIOn(t, db, &app.Config{Faults: inj})
+
+	a.user("alice")
+	a.forum("tea", "alice")
+	thread := a.thread("tea", "alice", "party", time.Time{})
+	path := fmt.Sprintf("/api/thread/%d/create", thread.Id)
+	batch := []*models.Post{{Author: "alice", Message: "first"}}
+
+	err := inj.SetRules([]*fault.Rule{{
+		Target:    fault.TargetDB,
+		Percent:   100,
+		Statement: "UPDATE idempotency_key",
+		DBError:   "timeout",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, data := a.keyed(path, "store-1", batch)
+	if resp.StatusCode != http.StatusInternalServerError || resp.Header.Get("Location") != "" {
+		t.Fatalf("status %d when the response can not be stored, want 500: %s", resp.StatusCode, data)
+	}
+
+	inj.SetRules([]*fault.Rule{})
+	resp, data = a.keyed(path, "store-1", batch)
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("retry status %d within the lease, want 409: %s", resp.StatusCode, data)
+	}
+
+	// the failed attempt did create its posts, only once
+	posts := []*models.Post{}
+	a.expect(http.MethodGet, fmt.Sprintf("/api/thread/%d/posts", thread.Id), nil, http.StatusOK, &posts)
+	if len(posts) != 1 {
+		t.Fatalf("%d posts, want the one of the first attempt", len(posts))
+	}
+}
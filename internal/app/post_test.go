@@ -0,0 +1,640 @@
+package app_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"forum/internal/models"
+)
+
+func TestPostCreate(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.user("bob")
+	a.forum("tea", "alice")
+	a.forum("coffee", "alice")
+	thread := a.thread("tea", "alice", "party", time.Time{})
+	other := a.thread("coffee", "alice", "espresso", time.Time{})
+
+	// the thread can be addressed by slug, posts of a batch share created
+	created := []*models.Post{}
+	a.expect(http.MethodPost, "/api/thread/party/create", []*models.Post{
+		{Author: "bob", Message: "first"},
+		{Author: "ALICE", Message: "second"},
+	}, http.StatusCreated, &created)
+	if len(created) != 2 || created[0].Thread != thread.Id || created[0].Forum != "tea" {
+		t.Fatalf("created %+v", created)
+	}
+	if !created[0].Created.Equal(created[1].Created) {
+		t.Fatalf("posts of one batch created at %v and %v", created[0].Created, created[1].Created)
+	}
+
+	a.expect(http.MethodPost, "/api/thread/party/create", []*models.Post{}, http.StatusCreated, &created)
+	if len(created) != 0 {
+		t.Fatalf("empty batch created %+v", created)
+	}
+
+	// a parent has to be in the same thread
+	foreign := a.posts(other.Id, "bob", 0)
+	a.expect(http.MethodPost, "/api/thread/party/create", []*models.Post{
+		{Author: "bob", Message: "reply", Parent: foreign[0].Id},
+	}, http.StatusConflict, nil)
+	a.expect(http.MethodPost, "/api/thread/party/create", []*models.Post{
+		{Author: "bob", Message: "reply", Parent: 1 << 40},
+	}, http.StatusConflict, nil)
+
+	a.expect(http.MethodPost, "/api/thread/party/create", []*models.Post{
+		{Author: "nobody", Message: "hello"},
+	}, http.StatusNotFound, nil)
+	a.expect(http.MethodPost, "/api/thread/nothing/create", []*models.Post{
+		{Author: "bob", Message: "hello"},
+	}, http.StatusNotFound, nil)
+	a.expect(http.MethodPost, "/api/thread/999999/create", []*models.Post{
+		{Author: "bob", Message: "hello"},
+	}, http.StatusNotFound, nil)
+}
+
+// postTree builds
+//
+//	r1
+//	├── c1
+//	│   └── g1
+//	└── c3
+//	r2
+//	└── c2
+//	r3
+//
+// in three batches, so posts of later batches are created later.
+type postTree struct {
+	thread                     *models.Thread
+	r1, r2, r3, c1, c2, c3, g1 int64
+}
+
+func newPostTree(a *api) *postTree {
+	a.t.Helper()
+
+	a.user("alice")
+	a.user("bob")
+	a.forum("tea", "alice")
+
+	tree := &postTree{thread: a.thread("tea", "alice", "party", time.Time{})}
+
+	roots := a.posts(tree.thread.Id, "alice", 0, 0, 0)
+	tree.r1, tree.r2, tree.r3 = roots[0].Id, roots[1].Id, roots[2].Id
+
+	children := a.posts(tree.thread.Id, "bob", tree.r1, tree.r2, tree.r1)
+	tree.c1, tree.c2, tree.c3 = children[0].Id, children[1].Id, children[2].Id
+
+	tree.g1 = a.posts(tree.thread.Id, "alice", tree.c1)[0].Id
+	return tree
+}
+
+func TestPostSort(t *testing.T) {
+	a := newAPI(t)
+	p := newPostTree(a)
+
+	cases := []struct {
+		query string
+		want  []int64
+	}{
+		{"", []int64{p.r1, p.r2, p.r3, p.c1, p.c2, p.c3, p.g1}},
+		{"?sort=flat&limit=2", []int64{p.r1, p.r2}},
+		{"?sort=flat&desc=true", []int64{p.g1, p.c3, p.c2, p.c1, p.r3, p.r2, p.r1}},
+		{"?sort=flat&since=" + itoa(p.c1), []int64{p.c2, p.c3, p.g1}},
+		{"?sort=flat&since=" + itoa(p.c1) + "&desc=true&limit=2", []int64{p.r3, p.r2}},
+
+		{"?sort=tree", []int64{p.r1, p.c1, p.g1, p.c3, p.r2, p.c2, p.r3}},
+		{"?sort=tree&limit=3", []int64{p.r1, p.c1, p.g1}},
+		{"?sort=tree&desc=true", []int64{p.r3, p.c2, p.r2, p.c3, p.g1, p.c1, p.r1}},
+		{"?sort=tree&since=" + itoa(p.c1), []int64{p.g1, p.c3, p.r2, p.c2, p.r3}},
+		{"?sort=tree&since=" + itoa(p.c1) + "&limit=2", []int64{p.g1, p.c3}},
+		{"?sort=tree&since=" + itoa(p.r2) + "&desc=true", []int64{p.c3, p.g1, p.c1, p.r1}},
+
+		// the limit counts root posts, replies stay in tree order
+		{"?sort=parent_tree", []int64{p.r1, p.c1, p.g1, p.c3, p.r2, p.c2, p.r3}},
+		{"?sort=parent_tree&limit=2", []int64{p.r1, p.c1, p.g1, p.c3, p.r2, p.c2}},
+		{"?sort=parent_tree&limit=1&since=" + itoa(p.r1), []int64{p.r2, p.c2}},
+		{"?sort=parent_tree&limit=2&desc=true", []int64{p.r3, p.r2, p.c2}},
+		{"?sort=parent_tree&limit=3&desc=true", []int64{p.r3, p.r2, p.c2, p.r1, p.c1, p.g1, p.c3}},
+		{"?sort=parent_tree&limit=1&since=" + itoa(p.r3) + "&desc=true", []int64{p.r2, p.c2}},
+		{"?sort=parent_tree&limit=1&since=" + itoa(p.r3), []int64{}},
+	}
+	for _, c := range cases {
+		posts := []*models.Post{}
+		a.expect(http.MethodGet, "/api/thread/party/posts"+c.query, nil, http.StatusOK, &posts)
+		if got := ids(posts); !sameIds(got, c.want) {
+			t.Errorf("posts%s: %v, want %v", c.query, got, c.want)
+		}
+	}
+
+	// the thread id works as well as the slug
+	posts := []*models.Post{}
+	a.expect(http.MethodGet, "/api/thread/"+itoa(int64(p.thread.Id))+"/posts?sort=tree", nil, http.StatusOK, &posts)
+	if got, want := ids(posts), []int64{p.r1, p.c1, p.g1, p.c3, p.r2, p.c2, p.r3}; !sameIds(got, want) {
+		t.Errorf("posts by thread id: %v, want %v", got, want)
+	}
+
+	a.expect(http.MethodGet, "/api/thread/nothing/posts", nil, http.StatusNotFound, nil)
+	a.expect(http.MethodGet, "/api/thread/999999/posts", nil, http.StatusNotFound, nil)
+}
+
+func TestPostSortTop(t *testing.T) {
+	a := newAPI(t)
+	p := newPostTree(a)
+
+	a.expect(http.MethodPost, "/api/post/"+itoa(p.r3)+"/vote", &models.PostVote{Nickname: "bob", Voice: 1}, http.StatusOK, nil)
+
+	cases := []struct {
+		query string
+		want  []int64
+	}{
+		// ascending like the other sorts, ties by id in the same direction
+		{"?sort=top", []int64{p.r1, p.c1, p.g1, p.c3, p.r2, p.c2, p.r3}},
+		{"?sort=top&desc=true", []int64{p.r3, p.r2, p.c2, p.r1, p.c1, p.g1, p.c3}},
+		{"?sort=top&desc=true&limit=1", []int64{p.r3}},
+		{"?sort=top&desc=true&limit=2", []int64{p.r3, p.r2, p.c2}},
+
+		// pages continue after the root of since
+		{"?sort=top&desc=true&limit=1&since=" + itoa(p.r3), []int64{p.r2, p.c2}},
+		{"?sort=top&desc=true&limit=1&since=" + itoa(p.c2), []int64{p.r1, p.c1, p.g1, p.c3}},
+		{"?sort=top&desc=true&since=" + itoa(p.r1), []int64{}},
+		{"?sort=top&limit=2&since=" + itoa(p.r1), []int64{p.r2, p.c2, p.r3}},
+		{"?sort=top&since=" + itoa(p.g1), []int64{p.r2, p.c2, p.r3}},
+	}
+	for _, c := range cases {
+		posts := []*models.Post{}
+		a.expect(http.MethodGet, "/api/thread/party/posts"+c.query, nil, http.StatusOK, &posts)
+		if got := ids(posts); !sameIds(got, c.want) {
+			t.Errorf("posts%s: %v, want %v", c.query, got, c.want)
+		}
+	}
+}
+
+func TestPostNested(t *testing.T) {
+	a := newAPI(t)
+	p := newPostTree(a)
+
+	tree := models.PostTree{}
+	a.expect(http.MethodGet, "/api/thread/party/posts?sort=parent_tree&format=nested&limit=2", nil, http.StatusOK, &tree)
+	if len(tree) != 2 || tree[0].Id != p.r1 || tree[1].Id != p.r2 {
+		t.Fatalf("roots %+v", tree)
+	}
+	r1 := tree[0]
+	if r1.ReplyCount != 2 || r1.HasMore || len(r1.Children) != 2 || r1.Children[0].Id != p.c1 || r1.Children[1].Id != p.c3 {
+		t.Fatalf("r1 %+v", r1)
+	}
+	if c1 := r1.Children[0]; len(c1.Children) != 1 || c1.Children[0].Id != p.g1 || len(c1.Children[0].Children) != 0 {
+		t.Fatalf("c1 %+v", c1)
+	}
+
+	// trimmed branches report that there is more
+	a.expect(http.MethodGet, "/api/thread/party/posts?sort=parent_tree&format=nested&max_depth=2&child_limit=1", nil, http.StatusOK, &tree)
+	if len(tree) != 3 {
+		t.Fatalf("roots %+v", tree)
+	}
+	r1 = tree[0]
+	if len(r1.Children) != 1 || !r1.HasMore || r1.Children[0].Id != p.c1 {
+		t.Fatalf("r1 with child_limit %+v", r1)
+	}
+	if c1 := r1.Children[0]; len(c1.Children) != 0 || !c1.HasMore || c1.ReplyCount != 1 {
+		t.Fatalf("c1 with max_depth %+v", c1)
+	}
+	if r3 := tree[2]; len(r3.Children) != 0 || r3.HasMore || r3.ReplyCount != 0 {
+		t.Fatalf("r3 %+v", r3)
+	}
+
+	a.expect(http.MethodGet, "/api/thread/nothing/posts?format=nested", nil, http.StatusNotFound, nil)
+}
+
+func TestPostDetails(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.user("bob")
+	a.forum("tea", "alice")
+	thread := a.thread("tea", "alice", "party", time.Time{})
+	post := a.posts(thread.Id, "bob", 0)[0]
+
+	full := &models.PostFull{}
+	a.expect(http.MethodGet, "/api/post/"+itoa(post.Id)+"/details", nil, http.StatusOK, full)
+	if full.Post == nil || full.Post.Id != post.Id || full.Author != nil || full.Thread != nil || full.Forum != nil {
+		t.Fatalf("details %+v", full)
+	}
+
+	full = &models.PostFull{}
+	a.expect(http.MethodGet, "/api/post/"+itoa(post.Id)+"/details?related=user,thread,forum", nil, http.StatusOK, full)
+	if full.Author == nil || full.Author.Nickname != "bob" || full.Thread == nil || full.Thread.Id != thread.Id || full.Forum == nil || full.Forum.Slug != "tea" {
+		t.Fatalf("details with related %+v", full)
+	}
+
+	full = &models.PostFull{}
+	a.expect(http.MethodGet, "/api/post/"+itoa(post.Id)+"/details?include=forum", nil, http.StatusOK, full)
+	if full.Forum == nil || full.Author != nil {
+		t.Fatalf("details with include %+v", full)
+	}
+
+	// unknown relations are ignored in related and refused in include
+	full = &models.PostFull{}
+	a.expect(http.MethodGet, "/api/post/"+itoa(post.Id)+"/details?related=votes,user", nil, http.StatusOK, full)
+	if full.Author == nil || full.Thread != nil {
+		t.Fatalf("details with an unknown relation %+v", full)
+	}
+	a.expect(http.MethodGet, "/api/post/"+itoa(post.Id)+"/details?include=votes", nil, http.StatusBadRequest, nil)
+	a.expect(http.MethodGet, "/api/post/999999/details", nil, http.StatusNotFound, nil)
+}
+
+func TestPostUpdate(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.forum("tea", "alice")
+	thread := a.thread("tea", "alice", "party", time.Time{})
+	post := a.posts(thread.Id, "alice", 0)[0]
+
+	// the same message does not mark the post as edited
+	updated := &models.Post{}
+	a.expect(http.MethodPost, "/api/post/"+itoa(post.Id)+"/details", &models.PostUpdate{Message: &post.Message}, http.StatusOK, updated)
+	if updated.IsEdited || updated.Message != post.Message {
+		t.Fatalf("unchanged %+v", updated)
+	}
+
+	a.expect(http.MethodPost, "/api/post/"+itoa(post.Id)+"/details", &models.PostUpdate{}, http.StatusOK, updated)
+	if updated.IsEdited {
+		t.Fatalf("empty update %+v", updated)
+	}
+
+	message := "**edited**"
+	a.expect(http.MethodPost, "/api/post/"+itoa(post.Id)+"/details?render=html", &models.PostUpdate{Message: &message}, http.StatusOK, updated)
+	if !updated.IsEdited || updated.Message != message || !strings.Contains(updated.MessageHTML, "<strong>edited</strong>") {
+		t.Fatalf("edited %+v", updated)
+	}
+
+	a.expect(http.MethodPost, "/api/post/999999/details", &models.PostUpdate{Message: &message}, http.StatusNotFound, nil)
+}
+
+func TestPostNavigation(t *testing.T) {
+	a := newAPI(t)
+	p := newPostTree(a)
+
+	cases := []struct {
+		path string
+		want []int64
+	}{
+		{"/replies", []int64{p.c1, p.g1, p.c3}},
+		{"/replies?limit=2", []int64{p.c1, p.g1}},
+		{"/replies?desc=true", []int64{p.c3, p.g1, p.c1}},
+		{"/replies?since=" + itoa(p.c1), []int64{p.g1, p.c3}},
+		{"/ancestors", []int64{}},
+	}
+	for _, c := range cases {
+		posts := []*models.Post{}
+		a.expect(http.MethodGet, "/api/post/"+itoa(p.r1)+c.path, nil, http.StatusOK, &posts)
+		if got := ids(posts); !sameIds(got, c.want) {
+			t.Errorf("r1%s: %v, want %v", c.path, got, c.want)
+		}
+	}
+
+	// ancestors go from the root down to the parent
+	posts := []*models.Post{}
+	a.expect(http.MethodGet, "/api/post/"+itoa(p.g1)+"/ancestors", nil, http.StatusOK, &posts)
+	if got, want := ids(posts), []int64{p.r1, p.c1}; !sameIds(got, want) {
+		t.Errorf("ancestors of g1: %v, want %v", got, want)
+	}
+	a.expect(http.MethodGet, "/api/post/"+itoa(p.g1)+"/ancestors?limit=1", nil, http.StatusOK, &posts)
+	if got, want := ids(posts), []int64{p.c1}; !sameIds(got, want) {
+		t.Errorf("nearest ancestor of g1: %v, want %v", got, want)
+	}
+
+	context := &models.PostContext{}
+	a.expect(http.MethodGet, "/api/post/"+itoa(p.r2)+"/context?n=1", nil, http.StatusOK, context)
+	if context.Post == nil || context.Post.Id != p.r2 || len(context.Ancestors) != 0 ||
+		!sameIds(ids(context.SiblingsBefore), []int64{p.r1}) || !sameIds(ids(context.SiblingsAfter), []int64{p.r3}) {
+		t.Fatalf("context of r2 %+v", context)
+	}
+	a.expect(http.MethodGet, "/api/post/"+itoa(p.c3)+"/context", nil, http.StatusOK, context)
+	if !sameIds(ids(context.Ancestors), []int64{p.r1}) || !sameIds(ids(context.SiblingsBefore), []int64{p.c1}) || len(context.SiblingsAfter) != 0 {
+		t.Fatalf("context of c3 %+v", context)
+	}
+
+	for _, path := range []string{"/replies", "/ancestors", "/context"} {
+		a.expect(http.MethodGet, "/api/post/999999"+path, nil, http.StatusNotFound, nil)
+	}
+}
+
+func TestPostVote(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.user("bob")
+	a.forum("tea", "alice")
+	thread := a.thread("tea", "alice", "party", time.Time{})
+	path := "/api/post/" + itoa(a.posts(thread.Id, "alice", 0)[0].Id) + "/vote"
+
+	post := &models.Post{}
+	a.expect(http.MethodPost, path, &models.PostVote{Nickname: "bob", Voice: 1}, http.StatusOK, post)
+	if post.Score != 1 {
+		t.Fatalf("score after upvote %d", post.Score)
+	}
+
+	// a second vote replaces the first one
+	a.expect(http.MethodPost, path, &models.PostVote{Nickname: "bob", Voice: -1}, http.StatusOK, post)
+	if post.Score != -1 {
+		t.Fatalf("score after revote %d", post.Score)
+	}
+
+	a.expect(http.MethodDelete, path+"?nickname=bob", nil, http.StatusOK, post)
+	if post.Score != 0 {
+		t.Fatalf("score after retraction %d", post.Score)
+	}
+	a.expect(http.MethodDelete, path+"?nickname=bob", nil, http.StatusNotFound, nil)
+
+	a.expect(http.MethodPost, path, &models.PostVote{Nickname: "bob", Voice: 2}, http.StatusBadRequest, nil)
+	a.expect(http.MethodPost, path, &models.PostVote{Nickname: "nobody", Voice: 1}, http.StatusNotFound, nil)
+	a.expect(http.MethodPost, "/api/post/999999/vote", &models.PostVote{Nickname: "bob", Voice: 1}, http.StatusNotFound, nil)
+}
+
+func TestPostReactions(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.user("bob")
+	a.forum("tea", "alice")
+	thread := a.thread("tea", "alice", "party", time.Time{})
+	path := "/api/post/" + itoa(a.posts(thread.Id, "alice", 0)[0].Id) + "/reactions"
+
+	post := &models.Post{}
+	a.expect(http.MethodPost, path, &models.Reaction{Nickname: "alice", Emoji: "🍵"}, http.StatusOK, post)
+	a.expect(http.MethodPost, path, &models.Reaction{Nickname: "bob", Emoji: "🍵"}, http.StatusOK, post)
+	a.expect(http.MethodPost, path, &models.Reaction{Nickname: "bob", Emoji: "👍"}, http.StatusOK, post)
+	if post.Reactions["🍵"] != 2 || post.Reactions["👍"] != 1 {
+		t.Fatalf("reactions %+v", post.Reactions)
+	}
+
+	reactions := []*models.Reaction{}
+	a.expect(http.MethodGet, path, nil, http.StatusOK, &reactions)
+	if len(reactions) != 3 {
+		t.Fatalf("reaction list %+v", reactions)
+	}
+
+	a.expect(http.MethodDelete, path+"?nickname=bob&emoji=%F0%9F%8D%B5", nil, http.StatusOK, post)
+	if post.Reactions["🍵"] != 1 {
+		t.Fatalf("reactions after removal %+v", post.Reactions)
+	}
+
+	a.expect(http.MethodPost, path, &models.Reaction{Nickname: "bob", Emoji: ""}, http.StatusBadRequest, nil)
+	a.expect(http.MethodPost, path, &models.Reaction{Nickname: "bob", Emoji: "a b"}, http.StatusBadRequest, nil)
+	a.expect(http.MethodGet, "/api/post/999999/reactions", nil, http.StatusNotFound, nil)
+}
+
+func TestUserPosts(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.user("bob")
+	a.forum("tea", "alice")
+	a.forum("coffee", "alice")
+	tea := a.thread("tea", "alice", "party", time.Time{})
+	coffee := a.thread("coffee", "alice", "espresso", time.Time{})
+
+	want := ids(a.posts(tea.Id, "bob", 0, 0))
+	want = append(want, ids(a.posts(coffee.Id, "bob", 0))...)
+	a.posts(tea.Id, "alice", 0)
+
+	// pages follow the cursor until there is no next one
+	got := []int64{}
+	path := "/api/user/bob/posts?limit=2"
+	for pages := 0; path != ""; pages++ {
+		if pages > len(want) {
+			t.Fatalf("cursor does not end, got %v", got)
+		}
+		posts := []*models.Post{}
+		resp := a.expect(http.MethodGet, path, nil, http.StatusOK, &posts)
+		got = append(got, ids(posts)...)
+
+		path = ""
+		if next := resp.Header.Get("X-Next-Cursor"); next != "" {
+			path = "/api/user/bob/posts?limit=2&cursor=" + next
+		}
+	}
+	if !sameIds(got, want) {
+		t.Fatalf("paged posts %v, want %v", got, want)
+	}
+
+	posts := []*models.Post{}
+	a.expect(http.MethodGet, "/api/user/bob/posts?forum=coffee", nil, http.StatusOK, &posts)
+	if !sameIds(ids(posts), want[2:]) {
+		t.Fatalf("posts in coffee %v, want %v", ids(posts), want[2:])
+	}
+
+	a.expect(http.MethodGet, "/api/user/bob/posts?limit=0", nil, http.StatusBadRequest, nil)
+	a.expect(http.MethodGet, "/api/user/bob/posts?cursor=garbage", nil, http.StatusBadRequest, nil)
+	a.expect(http.MethodGet, "/api/user/nobody/posts", nil, http.StatusNotFound, nil)
+}
+
+func TestUserMentions(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.user("bob")
+	a.forum("tea", "alice")
+	a.thread("tea", "alice", "party", time.Time{})
+
+	created := []*models.Post{}
+	a.expect(http.MethodPost, "/api/thread/party/create", []*models.Post{
+		{Author: "alice", Message: "hi @bob"},
+		{Author: "alice", Message: "@nobody is not here"},
+		{Author: "alice", Message: "@BOB again"},
+	}, http.StatusCreated, &created)
+	if len(created[0].Mentions) != 1 || *created[0].Mentions[0] != (models.Mention{Nickname: "bob", Offset: 3, Length: 4}) {
+		t.Fatalf("mentions %+v", created[0].Mentions)
+	}
+	if len(created[1].Mentions) != 0 {
+		t.Fatalf("mention of an unknown user %+v", created[1].Mentions)
+	}
+
+	// newest first
+	posts := []*models.Post{}
+	a.expect(http.MethodGet, "/api/user/bob/mentions", nil, http.StatusOK, &posts)
+	if got, want := ids(posts), []int64{created[2].Id, created[0].Id}; !sameIds(got, want) {
+		t.Fatalf("mentions of bob %v, want %v", got, want)
+	}
+	a.expect(http.MethodGet, "/api/user/bob/mentions?limit=1&since="+itoa(created[2].Id), nil, http.StatusOK, &posts)
+	if got, want := ids(posts), []int64{created[0].Id}; !sameIds(got, want) {
+		t.Fatalf("mentions of bob since %d: %v, want %v", created[2].Id, got, want)
+	}
+
+	// editing a post updates the index
+	message := "bye"
+	a.expect(http.MethodPost, "/api/post/"+itoa(created[0].Id)+"/details", &models.PostUpdate{Message: &message}, http.StatusOK, nil)
+	a.expect(http.MethodGet, "/api/user/bob/mentions", nil, http.StatusOK, &posts)
+	if got, want := ids(posts), []int64{created[2].Id}; !sameIds(got, want) {
+		t.Fatalf("mentions of bob after edit %v, want %v", got, want)
+	}
+
+	a.expect(http.MethodGet, "/api/user/nobody/mentions", nil, http.StatusNotFound, nil)
+}
+
+// Messages keep the name a user had when they were written, the mention
+// follows the user through a rename.
+func TestMentionsAfterRename(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.user("bob")
+	a.forum("tea", "alice")
+	a.thread("tea", "alice", "party", time.Time{})
+
+	created := []*models.Post{}
+	a.expect(http.MethodPost, "/api/thread/party/create", []*models.Post{{Author: "alice", Message: "hi @bob"}}, http.StatusCreated, &created)
+	a.expect(http.MethodPost, "/api/user/bob/rename", &models.UserRename{Nickname: "robert"}, http.StatusOK, nil)
+
+	want := models.Mention{Nickname: "robert", Offset: 3, Length: 4}
+	post := &models.PostFull{}
+	a.expect(http.MethodGet, "/api/post/"+itoa(created[0].Id)+"/details", nil, http.StatusOK, post)
+	if len(post.Post.Mentions) != 1 || *post.Post.Mentions[0] != want {
+		t.Fatalf("mentions after rename %+v", post.Post.Mentions)
+	}
+
+	// the old name still reaches the user in new and edited posts
+	again := []*models.Post{}
+	a.expect(http.MethodPost, "/api/thread/party/create", []*models.Post{{Author: "alice", Message: "@bob again"}}, http.StatusCreated, &again)
+	if len(again[0].Mentions) != 1 || *again[0].Mentions[0] != (models.Mention{Nickname: "robert", Offset: 0, Length: 4}) {
+		t.Fatalf("mentions of the old name %+v", again[0].Mentions)
+	}
+	message := "bye @bob"
+	edited := &models.Post{}
+	a.expect(http.MethodPost, "/api/post/"+itoa(created[0].Id)+"/details", &models.PostUpdate{Message: &message}, http.StatusOK, edited)
+	if len(edited.Mentions) != 1 || *edited.Mentions[0] != (models.Mention{Nickname: "robert", Offset: 4, Length: 4}) {
+		t.Fatalf("mentions of an edited post %+v", edited.Mentions)
+	}
+
+	posts := []*models.Post{}
+	a.expect(http.MethodGet, "/api/user/robert/mentions", nil, http.StatusOK, &posts)
+	if got, want := ids(posts), []int64{again[0].Id, created[0].Id}; !sameIds(got, want) {
+		t.Fatalf("mentions of robert %v, want %v", got, want)
+	}
+}
+
+// notifications are written in the background, so the inbox is polled.
+func (a *api) inbox(nickname string, unread int64) *models.NotificationInbox {
+	a.t.Helper()
+
+	inbox := &models.NotificationInbox{}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		a.expect(http.MethodGet, "/api/user/"+nickname+"/notifications", nil, http.StatusOK, inbox)
+		if inbox.Unread == unread {
+			return inbox
+		}
+		if time.Now().After(deadline) {
+			a.t.Fatalf("%s has %d unread notifications, want %d", nickname, inbox.Unread, unread)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.user("bob")
+	a.user("carol")
+	a.forum("tea", "alice")
+	thread := a.thread("tea", "alice", "party", time.Time{})
+
+	subscription := &models.Subscription{}
+	a.expect(http.MethodPost, "/api/thread/party/subscribe", &models.Subscription{Nickname: "carol"}, http.StatusOK, subscription)
+	if subscription.Nickname != "carol" || subscription.Thread != thread.Id {
+		t.Fatalf("subscription %+v", subscription)
+	}
+
+	root := a.posts(thread.Id, "alice", 0)[0]
+	a.expect(http.MethodPost, "/api/thread/party/create", []*models.Post{
+		{Author: "bob", Message: "hey @carol", Parent: root.Id},
+	}, http.StatusCreated, nil)
+
+	// carol is subscribed and mentioned, alice gets a reply, nobody hears
+	// about their own posts
+	inbox := a.inbox("carol", 2)
+	if len(inbox.Notifications) != 2 || inbox.Notifications[0].Kind != models.NotificationMention || inbox.Notifications[1].Kind != models.NotificationPost {
+		t.Fatalf("carol's inbox %+v", inbox.Notifications)
+	}
+	inbox = a.inbox("alice", 1)
+	if inbox.Notifications[0].Kind != models.NotificationReply || inbox.Notifications[0].Author != "bob" {
+		t.Fatalf("alice's inbox %+v", inbox.Notifications)
+	}
+	a.inbox("bob", 0)
+
+	read := &models.NotificationInbox{}
+	a.expect(http.MethodPost, "/api/user/carol/notifications/read", nil, http.StatusOK, read)
+	if read.Unread != 0 {
+		t.Fatalf("unread after marking all read %d", read.Unread)
+	}
+	a.expect(http.MethodGet, "/api/user/carol/notifications?unread=true", nil, http.StatusOK, inbox)
+	if len(inbox.Notifications) != 0 {
+		t.Fatalf("unread notifications %+v", inbox.Notifications)
+	}
+
+	a.expect(http.MethodDelete, "/api/thread/party/subscribe?nickname=carol", nil, http.StatusNoContent, nil)
+	a.posts(thread.Id, "bob", 0)
+	a.inbox("alice", 1)
+	a.inbox("carol", 0)
+
+	a.expect(http.MethodPost, "/api/thread/nothing/subscribe", &models.Subscription{Nickname: "carol"}, http.StatusNotFound, nil)
+	a.expect(http.MethodGet, "/api/user/nobody/notifications", nil, http.StatusNotFound, nil)
+}
+
+// notified counts the notifications of nickname and the posts waiting in
+// notification_pending.
+func notified(t *testing.T, nickname string) (int64, int64) {
+	t.Helper()
+
+	var notifications, pending int64
+	if err := testDB.QueryRow("SELECT count(*) FROM notification WHERE nickname = $1", nickname).Scan(&notifications); err != nil {
+		t.Fatal(err)
+	}
+	if err := testDB.QueryRow("SELECT COALESCE(sum(cardinality(posts)), 0) FROM notification_pending").Scan(&pending); err != nil {
+		t.Fatal(err)
+	}
+	return notifications, pending
+}
+
+// Closing the router fans out what is queued, without time left the queue is
+// deferred to the next start, and so are posts created afterwards.
+func TestNotificationsClose(t *testing.T) {
+	for _, expired := range []bool{false, true} {
+		a := newAPI(t)
+
+		a.user("alice")
+		a.user("carol")
+		a.forum("tea", "alice")
+		thread := a.thread("tea", "alice", "party", time.Time{})
+		a.expect(http.MethodPost, "/api/thread/party/subscribe", &models.Subscription{Nickname: "carol"}, http.StatusOK, nil)
+		for i := 0; i < 20; i++ {
+			a.posts(thread.Id, "alice", 0)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if expired {
+			cancel()
+		}
+		err := a.close(ctx)
+		cancel()
+		if err != nil && !(expired && err == context.Canceled) {
+			t.Fatalf("close: %v", err)
+		}
+
+		notifications, pending := notified(t, "carol")
+		if notifications+pending != 20 || (!expired && pending != 0) {
+			t.Fatalf("%d notified and %d pending after close with expired %v, want 20 notified", notifications, pending, expired)
+		}
+
+		a.posts(thread.Id, "alice", 0)
+		if _, after := notified(t, "carol"); after != pending+1 {
+			t.Fatalf("%d pending after a post on a closed router, want %d", after, pending+1)
+		}
+	}
+}
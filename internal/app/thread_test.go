@@ -0,0 +1,396 @@
+package app_test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"forum/internal/app"
+	"forum/internal/models"
+)
+
+func TestThreadCreate(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.forum("Tea", "alice")
+
+	created := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+	thread := &models.Thread{}
+	a.expect(http.MethodPost, "/api/forum/tea/create", &models.Thread{
+		Title:   "Party",
+		Author:  "ALICE",
+		Message: "Come over",
+		Slug:    "party",
+		Created: created,
+	}, http.StatusCreated, thread)
+	if thread.Id == 0 || thread.Forum != "Tea" || thread.Slug != "party" || !thread.Created.Equal(created) {
+		t.Fatalf("created %+v", thread)
+	}
+
+	// the thread holding the slug comes back on conflict
+	existing := &models.Thread{}
+	a.expect(http.MethodPost, "/api/forum/tea/create", &models.Thread{
+		Title:   "Other",
+		Author:  "alice",
+		Message: "Other",
+		Slug:    "PARTY",
+	}, http.StatusConflict, existing)
+	if existing.Id != thread.Id || existing.Title != "Party" {
+		t.Fatalf("conflict %+v, want %+v", existing, thread)
+	}
+
+	// a thread without a slug gets one from its title
+	generated := &models.Thread{}
+	a.expect(http.MethodPost, "/api/forum/tea/create", &models.Thread{
+		Title:   "Another party",
+		Author:  "alice",
+		Message: "Again",
+	}, http.StatusCreated, generated)
+	if generated.Slug == "" || strings.EqualFold(generated.Slug, "party") {
+		t.Fatalf("generated slug %q", generated.Slug)
+	}
+
+	// slugs that can not be routed as slug_or_id are refused
+	for _, bad := range []string{"a/b", "with space", "  ", "42"} {
+		a.expect(http.MethodPost, "/api/forum/tea/create", &models.Thread{
+			Title: "Bad", Author: "alice", Message: "Bad", Slug: bad,
+		}, http.StatusBadRequest, nil)
+	}
+
+	a.expect(http.MethodPost, "/api/forum/nothing/create", &models.Thread{
+		Title: "Lost", Author: "alice", Message: "Lost", Slug: "lost",
+	}, http.StatusNotFound, nil)
+	a.expect(http.MethodPost, "/api/forum/tea/create", &models.Thread{
+		Title: "Lost", Author: "nobody", Message: "Lost", Slug: "lost",
+	}, http.StatusNotFound, nil)
+}
+
+func TestThreadDetails(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.forum("tea", "alice")
+	thread := a.thread("tea", "alice", "party", time.Time{})
+
+	byId, bySlug := &models.Thread{}, &models.Thread{}
+	a.expect(http.MethodGet, fmt.Sprintf("/api/thread/%d/details", thread.Id), nil, http.StatusOK, byId)
+	a.expect(http.MethodGet, "/api/thread/PARTY/details", nil, http.StatusOK, bySlug)
+	if byId.Id != thread.Id || bySlug.Id != thread.Id || byId.Message != thread.Message {
+		t.Fatalf("details %+v and %+v, want %+v", byId, bySlug, thread)
+	}
+
+	full := &models.ThreadFull{}
+	a.expect(http.MethodGet, "/api/thread/party/details?include=author,forum", nil, http.StatusOK, full)
+	if full.Thread == nil || full.Author == nil || full.Forum == nil || full.Author.Nickname != "alice" || full.Forum.Slug != "tea" {
+		t.Fatalf("details with author and forum %+v", full)
+	}
+
+	a.expect(http.MethodGet, "/api/thread/party/details?include=posts", nil, http.StatusBadRequest, nil)
+	a.expect(http.MethodGet, "/api/thread/nothing/details", nil, http.StatusNotFound, nil)
+	a.expect(http.MethodGet, "/api/thread/999999/details", nil, http.StatusNotFound, nil)
+}
+
+func TestThreadUpdate(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.forum("tea", "alice")
+	thread := a.thread("tea", "alice", "party", time.Time{})
+	a.thread("tea", "alice", "taken", time.Time{})
+
+	message := "Updated message"
+	updated := &models.Thread{}
+	a.expect(http.MethodPost, fmt.Sprintf("/api/thread/%d/details", thread.Id), &models.ThreadUpdate{Message: &message}, http.StatusOK, updated)
+	if updated.Message != message || updated.Title != thread.Title {
+		t.Fatalf("updated %+v", updated)
+	}
+
+	slug := "garden-party"
+	a.expect(http.MethodPost, "/api/thread/party/details", &models.ThreadUpdate{Slug: &slug}, http.StatusOK, updated)
+	if updated.Slug != slug {
+		t.Fatalf("updated slug %+v", updated)
+	}
+	resp := a.expect(http.MethodGet, "/api/thread/party/details", nil, http.StatusMovedPermanently, nil)
+	if location := resp.Header.Get("Location"); location != "/api/thread/garden-party/details" {
+		t.Fatalf("Location %q", location)
+	}
+
+	taken, numeric := "taken", "42"
+	a.expect(http.MethodPost, "/api/thread/garden-party/details", &models.ThreadUpdate{Slug: &taken}, http.StatusConflict, nil)
+	a.expect(http.MethodPost, "/api/thread/garden-party/details", &models.ThreadUpdate{Slug: &numeric}, http.StatusBadRequest, nil)
+	a.expect(http.MethodPost, "/api/thread/999999/details", &models.ThreadUpdate{Message: &message}, http.StatusNotFound, nil)
+}
+
+func TestThreadVote(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.user("bob")
+	a.user("carol")
+	a.forum("tea", "alice")
+	thread := a.thread("tea", "alice", "party", time.Time{})
+	path := fmt.Sprintf("/api/thread/%d/vote", thread.Id)
+
+	voted := &models.Thread{}
+	a.expect(http.MethodPost, path, &models.Vote{Nickname: "bob", Voice: 1}, http.StatusOK, voted)
+	a.expect(http.MethodPost, "/api/thread/party/vote", &models.Vote{Nickname: "carol", Voice: 1}, http.StatusOK, voted)
+	if voted.Votes != 2 {
+		t.Fatalf("votes %d, want 2", voted.Votes)
+	}
+
+	// voting again replaces the earlier voice
+	a.expect(http.MethodPost, path, &models.Vote{Nickname: "bob", Voice: -1}, http.StatusOK, voted)
+	if voted.Votes != 0 {
+		t.Fatalf("votes after a changed voice %d, want 0", voted.Votes)
+	}
+	a.expect(http.MethodPost, path, &models.Vote{Nickname: "bob", Voice: -1}, http.StatusOK, voted)
+	if voted.Votes != 0 {
+		t.Fatalf("votes after a repeated voice %d, want 0", voted.Votes)
+	}
+
+	a.expect(http.MethodDelete, path+"?nickname=carol", nil, http.StatusOK, voted)
+	if voted.Votes != -1 {
+		t.Fatalf("votes after a retracted vote %d, want -1", voted.Votes)
+	}
+	a.expect(http.MethodDelete, path+"?nickname=carol", nil, http.StatusNotFound, nil)
+
+	a.expect(http.MethodPost, path, &models.Vote{Nickname: "bob", Voice: 2}, http.StatusBadRequest, nil)
+	a.expect(http.MethodPost, path, &models.Vote{Nickname: "nobody", Voice: 1}, http.StatusNotFound, nil)
+	a.expect(http.MethodPost, "/api/thread/999999/vote", &models.Vote{Nickname: "bob", Voice: 1}, http.StatusNotFound, nil)
+	a.expect(http.MethodPost, "/api/thread/nothing/vote", &models.Vote{Nickname: "bob", Voice: 1}, http.StatusNotFound, nil)
+}
+
+// Roles are assigned under /service, votes count with the weight of the role
+// the voter has when voting.
+func TestThreadVoteWeights(t *testing.T) {
+	if testDB == nil {
+		t.Skip("FORUM_TEST_DSN is not set")
+	}
+	a := newAPIOn(t, testDB, &app.Config{VoteWeights: map[string]int32{"moderator": 3}})
+
+	a.user("alice")
+	a.user("bob")
+	a.user("carol")
+	a.forum("tea", "alice")
+	thread := a.thread("tea", "alice", "party", time.Time{})
+	path := fmt.Sprintf("/api/thread/%d/vote", thread.Id)
+
+	role := &models.UserRole{}
+	a.expect(http.MethodPost, "/api/service/user/bob/role", &models.UserRole{Role: "moderator"}, http.StatusOK, role)
+	if *role != (models.UserRole{Nickname: "bob", Role: "moderator"}) {
+		t.Fatalf("role %+v", role)
+	}
+
+	voted := &models.Thread{}
+	a.expect(http.MethodPost, path, &models.Vote{Nickname: "bob", Voice: 1}, http.StatusOK, voted)
+	a.expect(http.MethodPost, path, &models.Vote{Nickname: "carol", Voice: -1}, http.StatusOK, voted)
+	if voted.Votes != 2 {
+		t.Fatalf("votes %d, want 3 of the moderator and -1 of the user", voted.Votes)
+	}
+
+	// the vote keeps its weight until it is cast again
+	a.expect(http.MethodPost, "/api/service/user/bob/role", &models.UserRole{Role: "user"}, http.StatusOK, nil)
+	a.expect(http.MethodGet, fmt.Sprintf("/api/thread/%d/details", thread.Id), nil, http.StatusOK, voted)
+	if voted.Votes != 2 {
+		t.Fatalf("votes %d after the role changed, want 2", voted.Votes)
+	}
+	a.expect(http.MethodPost, path, &models.Vote{Nickname: "bob", Voice: 1}, http.StatusOK, voted)
+	if voted.Votes != 0 {
+		t.Fatalf("votes %d after voting again as a user, want 0", voted.Votes)
+	}
+
+	a.expect(http.MethodPost, "/api/service/user/nobody/role", &models.UserRole{Role: "moderator"}, http.StatusNotFound, nil)
+	a.expect(http.MethodPost, "/api/service/user/bob/role", &models.UserRole{Role: ""}, http.StatusBadRequest, nil)
+	a.expect(http.MethodPost, "/api/service/user/bob/role", &models.UserRole{Role: "Mod=2"}, http.StatusBadRequest, nil)
+}
+
+func TestThreadVoteLists(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	for _, nickname := range []string{"bob", "carol", "dave"} {
+		a.user(nickname)
+	}
+	a.forum("tea", "alice")
+	threads := []*models.Thread{
+		a.thread("tea", "alice", "first", time.Time{}),
+		a.thread("tea", "alice", "second", time.Time{}),
+		a.thread("tea", "alice", "third", time.Time{}),
+	}
+	for _, nickname := range []string{"dave", "bob", "carol"} {
+		a.expect(http.MethodPost, "/api/thread/first/vote", &models.Vote{Nickname: nickname, Voice: 1}, http.StatusOK, nil)
+	}
+	for _, thread := range threads {
+		a.expect(http.MethodPost, fmt.Sprintf("/api/thread/%d/vote", thread.Id), &models.Vote{Nickname: "bob", Voice: -1}, http.StatusOK, nil)
+	}
+
+	voters := func(votes []*models.Vote) string {
+		names := []string{}
+		for _, vote := range votes {
+			names = append(names, vote.Nickname)
+		}
+		return strings.Join(names, ",")
+	}
+
+	byThread := []struct {
+		query string
+		want  string
+	}{
+		{"", "bob,carol,dave"},
+		{"?desc=true", "dave,carol,bob"},
+		{"?since=bob", "carol,dave"},
+		{"?since=dave&desc=true&limit=1", "carol"},
+	}
+	for _, c := range byThread {
+		votes := []*models.Vote{}
+		a.expect(http.MethodGet, "/api/thread/first/votes"+c.query, nil, http.StatusOK, &votes)
+		if got := voters(votes); got != c.want {
+			t.Errorf("votes%s: %s, want %s", c.query, got, c.want)
+		}
+	}
+	a.expect(http.MethodGet, "/api/thread/nothing/votes", nil, http.StatusNotFound, nil)
+
+	votes := []*models.Vote{}
+	a.expect(http.MethodGet, "/api/user/bob/votes", nil, http.StatusOK, &votes)
+	if len(votes) != 3 || votes[0].Thread != threads[0].Id || votes[2].Thread != threads[2].Id || votes[0].Voice != -1 {
+		t.Fatalf("votes of bob %+v", votes)
+	}
+	a.expect(http.MethodGet, fmt.Sprintf("/api/user/bob/votes?since=%d&desc=true", threads[2].Id), nil, http.StatusOK, &votes)
+	if len(votes) != 2 || votes[0].Thread != threads[1].Id || votes[1].Thread != threads[0].Id {
+		t.Fatalf("votes of bob since the third thread %+v", votes)
+	}
+	a.expect(http.MethodGet, "/api/user/nobody/votes", nil, http.StatusNotFound, nil)
+}
+
+func TestThreadModeration(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.user("bob")
+	a.forum("tea", "alice")
+	a.forum("coffee", "alice")
+	a.expect(http.MethodPost, "/api/service/user/alice/role", &models.UserRole{Role: "moderator"}, http.StatusOK, nil)
+	source := a.thread("tea", "alice", "source", time.Time{})
+	target := a.thread("coffee", "alice", "target", time.Time{})
+	posts := a.posts(source.Id, "bob", 0)
+	reply := a.posts(source.Id, "bob", posts[0].Id)[0]
+
+	// only moderators and admins moderate
+	for _, moderator := range []string{"", "bob", "nobody"} {
+		a.expect(http.MethodPost, "/api/thread/source/move", &models.ThreadMove{Moderator: moderator, Forum: "coffee"}, http.StatusForbidden, nil)
+		a.expect(http.MethodPost, "/api/thread/source/merge", &models.ThreadMerge{Moderator: moderator, Into: "target"}, http.StatusForbidden, nil)
+		a.expect(http.MethodPost, "/api/post/"+itoa(posts[0].Id)+"/split", &models.ThreadSplit{Moderator: moderator, Title: "Split off"}, http.StatusForbidden, nil)
+	}
+
+	// move takes the posts along
+	moved := &models.Thread{}
+	a.expect(http.MethodPost, "/api/thread/source/move", &models.ThreadMove{Moderator: "alice", Forum: "coffee"}, http.StatusOK, moved)
+	if moved.Forum != "coffee" {
+		t.Fatalf("moved %+v", moved)
+	}
+	post := &models.PostFull{}
+	a.expect(http.MethodGet, "/api/post/"+itoa(posts[0].Id)+"/details", nil, http.StatusOK, post)
+	if post.Post.Forum != "coffee" {
+		t.Fatalf("post after move %+v", post.Post)
+	}
+	a.expect(http.MethodPost, "/api/thread/source/move", &models.ThreadMove{Moderator: "alice", Forum: "nothing"}, http.StatusNotFound, nil)
+	a.expect(http.MethodPost, "/api/thread/source/move", &models.ThreadMove{Moderator: "alice"}, http.StatusBadRequest, nil)
+
+	// split makes a post the root of a new thread with its replies
+	split := &models.Thread{}
+	a.expect(http.MethodPost, "/api/post/"+itoa(posts[0].Id)+"/split", &models.ThreadSplit{Moderator: "alice", Title: "Split off", Slug: "split"}, http.StatusCreated, split)
+	if split.Author != "bob" || split.Forum != "coffee" {
+		t.Fatalf("split %+v", split)
+	}
+	replyDetails := &models.PostFull{}
+	a.expect(http.MethodGet, "/api/post/"+itoa(reply.Id)+"/details", nil, http.StatusOK, replyDetails)
+	if replyDetails.Post.Thread != split.Id || replyDetails.Post.Parent != posts[0].Id {
+		t.Fatalf("reply after split %+v", replyDetails.Post)
+	}
+	a.expect(http.MethodPost, "/api/post/999999/split", &models.ThreadSplit{Moderator: "alice", Title: "Nothing"}, http.StatusNotFound, nil)
+	a.expect(http.MethodPost, "/api/post/"+itoa(reply.Id)+"/split", &models.ThreadSplit{Moderator: "alice"}, http.StatusBadRequest, nil)
+
+	// merge deletes the source, its slug leads to the target
+	merged := &models.Thread{}
+	a.expect(http.MethodPost, "/api/thread/split/merge", &models.ThreadMerge{Moderator: "alice", Into: itoa(int64(target.Id))}, http.StatusOK, merged)
+	if merged.Id != target.Id {
+		t.Fatalf("merged %+v", merged)
+	}
+	a.expect(http.MethodGet, fmt.Sprintf("/api/thread/%d/details", split.Id), nil, http.StatusNotFound, nil)
+	resp := a.expect(http.MethodGet, "/api/thread/split/details", nil, http.StatusMovedPermanently, nil)
+	if location := resp.Header.Get("Location"); location != "/api/thread/target/details" {
+		t.Fatalf("Location %q", location)
+	}
+	a.expect(http.MethodPost, "/api/thread/target/merge", &models.ThreadMerge{Moderator: "alice", Into: "target"}, http.StatusConflict, nil)
+	a.expect(http.MethodPost, "/api/thread/target/merge", &models.ThreadMerge{Moderator: "alice", Into: "nothing"}, http.StatusNotFound, nil)
+	a.expect(http.MethodPost, "/api/thread/target/merge", &models.ThreadMerge{Moderator: "alice"}, http.StatusBadRequest, nil)
+
+	// counters stay consistent through all of it
+	report := &models.CheckReport{}
+	a.expect(http.MethodGet, "/api/service/check", nil, http.StatusOK, report)
+	if len(report.Drifts) != 0 {
+		t.Fatalf("drifts after moderation: %+v", report.Drifts)
+	}
+}
+
+func TestUserThreads(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.forum("tea", "alice")
+	a.forum("coffee", "alice")
+
+	base := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		forum := "tea"
+		if i%2 == 1 {
+			forum = "coffee"
+		}
+		a.thread(forum, "alice", fmt.Sprintf("t%d", i), base.Add(time.Duration(i)*time.Hour))
+	}
+
+	// pages follow X-Next-Cursor until it is gone
+	got := []string{}
+	path := "/api/user/alice/threads?limit=2"
+	for pages := 0; path != ""; pages++ {
+		if pages > 5 {
+			t.Fatalf("paging does not end")
+		}
+		threads := []*models.Thread{}
+		resp := a.expect(http.MethodGet, path, nil, http.StatusOK, &threads)
+		for _, thread := range threads {
+			got = append(got, thread.Slug)
+		}
+		path = ""
+		if next := resp.Header.Get("X-Next-Cursor"); next != "" {
+			path = "/api/user/alice/threads?limit=2&cursor=" + next
+		}
+	}
+	if strings.Join(got, ",") != "t0,t1,t2,t3,t4" {
+		t.Fatalf("paged threads %v", got)
+	}
+
+	threads := []*models.Thread{}
+	a.expect(http.MethodGet, "/api/user/alice/threads?forum=coffee&desc=true", nil, http.StatusOK, &threads)
+	if len(threads) != 2 || threads[0].Slug != "t3" || threads[1].Slug != "t1" {
+		t.Fatalf("coffee threads %+v", threads)
+	}
+
+	// a cursor continues the order and filters it was issued for only
+	resp := a.expect(http.MethodGet, "/api/user/alice/threads?forum=coffee&limit=1", nil, http.StatusOK, &threads)
+	next := resp.Header.Get("X-Next-Cursor")
+	if next == "" {
+		t.Fatalf("no cursor after the first coffee thread")
+	}
+	a.expect(http.MethodGet, "/api/user/alice/threads?forum=coffee&limit=2&cursor="+next, nil, http.StatusOK, &threads)
+	a.expect(http.MethodGet, "/api/user/alice/threads?forum=coffee&desc=true&cursor="+next, nil, http.StatusBadRequest, nil)
+	a.expect(http.MethodGet, "/api/user/alice/threads?forum=tea&cursor="+next, nil, http.StatusBadRequest, nil)
+	a.expect(http.MethodGet, "/api/user/alice/threads?cursor="+next, nil, http.StatusBadRequest, nil)
+
+	a.expect(http.MethodGet, "/api/user/alice/threads?cursor=garbage", nil, http.StatusBadRequest, nil)
+	a.expect(http.MethodGet, "/api/user/alice/threads?limit=-1", nil, http.StatusBadRequest, nil)
+	a.expect(http.MethodGet, "/api/user/nobody/threads", nil, http.StatusNotFound, nil)
+}
@@ -0,0 +1,169 @@
+package app_test
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"forum/internal/models"
+)
+
+func TestUserCreate(t *testing.T) {
+	a := newAPI(t)
+
+	created := a.user("Alice")
+	if created.Nickname != "Alice" || created.Fullname != "Full Alice" || created.About != "About Alice" || created.Email != "Alice@example.com" {
+		t.Fatalf("created %+v", created)
+	}
+	a.user("bob")
+
+	// the nickname is case insensitive, the conflicting user comes back as is
+	conflict := []*models.User{}
+	a.expect(http.MethodPost, "/api/user/alice/create", &models.User{
+		Fullname: "Other",
+		Email:    "other@example.com",
+	}, http.StatusConflict, &conflict)
+	if len(conflict) != 1 || conflict[0].Nickname != "Alice" {
+		t.Fatalf("nickname conflict %+v, want Alice", conflict)
+	}
+
+	a.expect(http.MethodPost, "/api/user/carol/create", &models.User{
+		Fullname: "Carol",
+		Email:    "BOB@example.com",
+	}, http.StatusConflict, &conflict)
+	if len(conflict) != 1 || conflict[0].Nickname != "bob" {
+		t.Fatalf("email conflict %+v, want bob", conflict)
+	}
+
+	// a new user can clash with two existing ones at once
+	a.expect(http.MethodPost, "/api/user/ALICE/create", &models.User{
+		Fullname: "Both",
+		Email:    "bob@example.com",
+	}, http.StatusConflict, &conflict)
+	nicknames := []string{}
+	for _, user := range conflict {
+		nicknames = append(nicknames, user.Nickname)
+	}
+	sort.Strings(nicknames)
+	if strings.Join(nicknames, ",") != "Alice,bob" {
+		t.Fatalf("double conflict %v, want Alice and bob", nicknames)
+	}
+}
+
+func TestUserProfile(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.user("bob")
+
+	profile := &models.User{}
+	a.expect(http.MethodGet, "/api/user/ALICE/profile", nil, http.StatusOK, profile)
+	if profile.Nickname != "alice" || profile.Email != "alice@example.com" {
+		t.Fatalf("profile %+v", profile)
+	}
+	a.expect(http.MethodGet, "/api/user/nobody/profile", nil, http.StatusNotFound, nil)
+
+	// fields missing from the update keep their values
+	fullname := "Alice Liddell"
+	a.expect(http.MethodPost, "/api/user/alice/profile", &models.UserUpdate{Fullname: &fullname}, http.StatusOK, profile)
+	if profile.Fullname != fullname || profile.About != "About alice" || profile.Email != "alice@example.com" {
+		t.Fatalf("partial update %+v", profile)
+	}
+
+	a.expect(http.MethodPost, "/api/user/alice/profile", &models.UserUpdate{}, http.StatusOK, profile)
+	if profile.Fullname != fullname {
+		t.Fatalf("empty update changed the profile: %+v", profile)
+	}
+
+	taken := "BOB@example.com"
+	a.expect(http.MethodPost, "/api/user/alice/profile", &models.UserUpdate{Email: &taken}, http.StatusConflict, nil)
+	a.expect(http.MethodPost, "/api/user/nobody/profile", &models.UserUpdate{Fullname: &fullname}, http.StatusNotFound, nil)
+}
+
+// forum_users is a copy of the profile per forum, kept up to date by a
+// trigger. The forum user list has to show the profile after an update.
+func TestUserProfileUpdateReachesForumUsers(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.user("bob")
+	a.forum("tea", "alice")
+	thread := a.thread("tea", "alice", "party", time.Time{})
+	a.posts(thread.Id, "bob", 0)
+
+	fullname, about, email := "Bob Updated", "New about", "bob.new@example.com"
+	a.expect(http.MethodPost, "/api/user/bob/profile", &models.UserUpdate{
+		Fullname: &fullname,
+		About:    &about,
+		Email:    &email,
+	}, http.StatusOK, nil)
+
+	users := []*models.User{}
+	a.expect(http.MethodGet, "/api/forum/tea/users", nil, http.StatusOK, &users)
+	if len(users) != 2 {
+		t.Fatalf("forum users %+v, want alice and bob", users)
+	}
+	for _, user := range users {
+		if user.Nickname != "bob" {
+			continue
+		}
+		if user.Fullname != fullname || user.About != about || user.Email != email {
+			t.Fatalf("forum user %+v does not match the updated profile", user)
+		}
+	}
+}
+
+func TestUserRename(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.user("bob")
+	a.forum("tea", "alice")
+	thread := a.thread("tea", "alice", "party", time.Time{})
+
+	renamed := &models.User{}
+	a.expect(http.MethodPost, "/api/user/alice/rename", &models.UserRename{Nickname: "alicia"}, http.StatusOK, renamed)
+	if renamed.Nickname != "alicia" {
+		t.Fatalf("renamed %+v", renamed)
+	}
+
+	// the old nickname points to the new one
+	resp := a.expect(http.MethodGet, "/api/user/alice/profile", nil, http.StatusMovedPermanently, nil)
+	if location := resp.Header.Get("Location"); location != "/api/user/alicia/profile" {
+		t.Fatalf("Location %q", location)
+	}
+
+	// references follow the rename
+	details := &models.Thread{}
+	a.expect(http.MethodGet, "/api/thread/party/details", nil, http.StatusOK, details)
+	if details.Author != "alicia" || details.Id != thread.Id {
+		t.Fatalf("thread after rename %+v", details)
+	}
+
+	a.expect(http.MethodPost, "/api/user/alicia/rename", &models.UserRename{Nickname: "BOB"}, http.StatusConflict, nil)
+	a.expect(http.MethodPost, "/api/user/alicia/rename", &models.UserRename{}, http.StatusBadRequest, nil)
+	a.expect(http.MethodPost, "/api/user/nobody/rename", &models.UserRename{Nickname: "somebody"}, http.StatusNotFound, nil)
+}
+
+func TestUserSummary(t *testing.T) {
+	a := newAPI(t)
+
+	a.user("alice")
+	a.user("bob")
+	a.forum("tea", "alice")
+	a.forum("coffee", "alice")
+	tea := a.thread("tea", "alice", "party", time.Time{})
+	a.thread("coffee", "bob", "espresso", time.Time{})
+	a.posts(tea.Id, "bob", 0, 0)
+
+	summary := &models.UserSummary{}
+	a.expect(http.MethodGet, "/api/user/bob/summary", nil, http.StatusOK, summary)
+	sort.Strings(summary.Forums)
+	if summary.Posts != 2 || summary.Threads != 1 || strings.Join(summary.Forums, ",") != "coffee,tea" {
+		t.Fatalf("summary %+v", summary)
+	}
+
+	a.expect(http.MethodGet, "/api/user/nobody/summary", nil, http.StatusNotFound, nil)
+}
@@ -0,0 +1,111 @@
+package cursor
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"forum/internal/models"
+
+	myerror "forum/internal/error"
+)
+
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// Encode packs the sort key of the last row of a page into an opaque token,
+// so that the next page can continue right after it. The token is bound to
+// scope, see Scope.
+func Encode(scope string, created time.Time, id int64) string {
+	raw := fmt.Sprintf("%s|%d|%s", created.UTC().Format(time.RFC3339Nano), id, scope)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// Decode unpacks a token of Encode. A token issued for another scope is
+// invalid, the page after it would skip or repeat rows.
+func Decode(token string, scope string) (time.Time, int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return time.Time{}, 0, myerror.InvalidCursor
+	}
+
+	parts := strings.SplitN(string(raw), "|", 3)
+	if len(parts) != 3 || parts[2] != scope {
+		return time.Time{}, 0, myerror.InvalidCursor
+	}
+
+	created, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, 0, myerror.InvalidCursor
+	}
+
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, myerror.InvalidCursor
+	}
+
+	return created, id, nil
+}
+
+// Scope identifies the order and the filters of a filter, the parts of a
+// request a cursor is only valid for. The limit may change between pages.
+func Scope(filter *models.AuthorFilter) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%t|%s|%s|%s", filter.Desc, strings.ToLower(filter.Forum),
+		filter.From.UTC().Format(time.RFC3339Nano), filter.To.UTC().Format(time.RFC3339Nano))
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// ParseAuthorFilter reads forum, from, to, limit, cursor and desc from the
+// query of a user activity request. Dates are RFC 3339.
+func ParseAuthorFilter(query url.Values) (*models.AuthorFilter, error) {
+	filter := &models.AuthorFilter{
+		Forum:  query.Get("forum"),
+		Cursor: query.Get("cursor"),
+		Desc:   query.Get("desc") == "true",
+		Limit:  DefaultLimit,
+	}
+
+	if raw := query.Get("limit"); raw != "" {
+		limit, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || limit <= 0 {
+			return nil, myerror.InvalidFilter
+		}
+		if limit > MaxLimit {
+			limit = MaxLimit
+		}
+		filter.Limit = limit
+	}
+
+	var err error
+	if raw := query.Get("from"); raw != "" {
+		if filter.From, err = time.Parse(time.RFC3339Nano, raw); err != nil {
+			return nil, myerror.InvalidFilter
+		}
+	}
+	if raw := query.Get("to"); raw != "" {
+		if filter.To, err = time.Parse(time.RFC3339Nano, raw); err != nil {
+			return nil, myerror.InvalidFilter
+		}
+	}
+
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		return nil, myerror.InvalidFilter
+	}
+
+	filter.Scope = Scope(filter)
+	if filter.Cursor != "" {
+		if _, _, err := Decode(filter.Cursor, filter.Scope); err != nil {
+			return nil, err
+		}
+	}
+
+	return filter, nil
+}
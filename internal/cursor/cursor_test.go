@@ -0,0 +1,47 @@
+package cursor
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	myerror "forum/internal/error"
+)
+
+func TestCursorScope(t *testing.T) {
+	first, err := ParseAuthorFilter(url.Values{"forum": {"Tea"}, "limit": {"2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+	token := Encode(first.Scope, created, 42)
+
+	// the limit and the casing of the forum may change between pages
+	next, err := ParseAuthorFilter(url.Values{"forum": {"tea"}, "limit": {"5"}, "cursor": {token}})
+	if err != nil {
+		t.Fatalf("next page: %v", err)
+	}
+	gotCreated, gotId, err := Decode(next.Cursor, next.Scope)
+	if err != nil || !gotCreated.Equal(created) || gotId != 42 {
+		t.Fatalf("Decode = %v, %d, %v", gotCreated, gotId, err)
+	}
+
+	mismatches := []url.Values{
+		{"forum": {"tea"}, "desc": {"true"}},
+		{"forum": {"coffee"}},
+		{},
+		{"forum": {"tea"}, "from": {"2021-01-01T00:00:00Z"}},
+		{"forum": {"tea"}, "to": {"2021-01-01T00:00:00Z"}},
+	}
+	for _, query := range mismatches {
+		query.Set("cursor", token)
+		if _, err := ParseAuthorFilter(query); err != myerror.InvalidCursor {
+			t.Errorf("ParseAuthorFilter(%v) = %v, want an invalid cursor", query, err)
+		}
+	}
+
+	if _, err := ParseAuthorFilter(url.Values{"cursor": {"garbage"}}); err != myerror.InvalidCursor {
+		t.Errorf("garbage cursor: %v", err)
+	}
+}
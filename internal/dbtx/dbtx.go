@@ -0,0 +1,158 @@
+package dbtx
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	myerror "forum/internal/error"
+
+	"github.com/jackc/pgx"
+)
+
+// SQLSTATE codes the repositories react to.
+const (
+	SerializationFailure = "40001"
+	DeadlockDetected     = "40P01"
+	UniqueViolation      = "23505"
+	ForeignKeyViolation  = "23503"
+)
+
+// MaxAttempts is how often a transaction runs before a serialization failure
+// or deadlock is returned to the caller.
+const MaxAttempts = 4
+
+// backoff is the longest first pause between attempts, it doubles with every
+// retry and the actual pause is drawn at random below it, so that the
+// transactions that collided do not collide again.
+const backoff = 5 * time.Millisecond
+
+// Code returns the SQLSTATE of a Postgres error, or "" for other errors.
+func Code(err error) string {
+	var pgErr pgx.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	return ""
+}
+
+// Retryable reports whether running the transaction again can succeed.
+func Retryable(err error) bool {
+	code := Code(err)
+	return code == SerializationFailure || code == DeadlockDetected
+}
+
+// Classify maps a database error to the repository error for it: unique
+// violations are conflicts, foreign key violations and missing rows mean a
+// referenced entity does not exist, and serialization failures or deadlocks
+// that outlasted the retries are internal errors. Repository errors pass
+// through, anything else becomes fallback.
+func Classify(err error, fallback error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(myerror.Message); ok {
+		return err
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return myerror.NotExist
+	}
+
+	switch Code(err) {
+	case UniqueViolation:
+		return myerror.ConflictError
+	case ForeignKeyViolation:
+		return myerror.NotExist
+	case SerializationFailure, DeadlockDetected:
+		return myerror.InternalError
+	}
+	return fallback
+}
+
+// Fail classifies an error inside a transaction function, for steps that fail
+// differently than the transaction as a whole. Serialization failures and
+// deadlocks are kept as they are, so that Run still retries them.
+func Fail(err error, fallback error) error {
+	if Retryable(err) {
+		return err
+	}
+	return Classify(err, fallback)
+}
+
+// Stats counts the transactions run through Run.
+type Stats struct {
+	Transactions int64 `json:"transactions"`
+	// Retries counts the attempts after the first by the SQLSTATE that
+	// caused them
+	Retries map[string]int64 `json:"retries"`
+	// Exhausted counts transactions that still failed after MaxAttempts
+	Exhausted int64 `json:"exhausted"`
+}
+
+var (
+	statsMu sync.Mutex
+	stats   = Stats{Retries: map[string]int64{}}
+)
+
+// GetStats returns the retry counters since start.
+func GetStats() Stats {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	copied := stats
+	copied.Retries = make(map[string]int64, len(stats.Retries))
+	for code, n := range stats.Retries {
+		copied.Retries[code] = n
+	}
+	return copied
+}
+
+func count(update func(s *Stats)) {
+	statsMu.Lock()
+	update(&stats)
+	statsMu.Unlock()
+}
+
+// Run runs fn in a transaction and commits it. A serialization failure or
+// deadlock, in fn or on commit, rolls back and runs fn again after a short
+// random pause. fn may run several times, so it has to reset whatever it
+// fills. Other errors roll back and are returned as they are, a failed
+// begin is an InternalError. The transaction runs in ctx, fn should use the
+// Context methods of tx with the same ctx.
+func Run(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	count(func(s *Stats) { s.Transactions++ })
+
+	var err error
+	for attempt := 0; attempt < MaxAttempts; attempt++ {
+		if attempt > 0 {
+			code := Code(err)
+			count(func(s *Stats) { s.Retries[code]++ })
+			time.Sleep(time.Duration(rand.Int63n(int64(backoff) << (attempt - 1))))
+		}
+
+		err = try(ctx, db, fn)
+		if !Retryable(err) {
+			return err
+		}
+	}
+
+	count(func(s *Stats) { s.Exhausted++ })
+	return err
+}
+
+func try(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return myerror.InternalError
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
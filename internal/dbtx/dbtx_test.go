@@ -0,0 +1,265 @@
+package dbtx
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	myerror "forum/internal/error"
+
+	"github.com/jackc/pgx"
+)
+
+func TestClassify(t *testing.T) {
+	pgErr := func(code string) error {
+		return pgx.PgError{Severity: "ERROR", Code: code}
+	}
+
+	cases := []struct {
+		err       error
+		want      error
+		retryable bool
+	}{
+		{nil, nil, false},
+		{sql.ErrNoRows, myerror.NotExist, false},
+		{fmt.Errorf("scan: %w", sql.ErrNoRows), myerror.NotExist, false},
+		{pgErr(UniqueViolation), myerror.ConflictError, false},
+		{pgErr(ForeignKeyViolation), myerror.NotExist, false},
+		{fmt.Errorf("insert: %w", pgErr(ForeignKeyViolation)), myerror.NotExist, false},
+		{pgErr(SerializationFailure), myerror.InternalError, true},
+		{pgErr(DeadlockDetected), myerror.InternalError, true},
+		{pgErr("57014"), myerror.BadUpdate, false},
+		{myerror.ConflictError, myerror.ConflictError, false},
+	}
+
+	for _, c := range cases {
+		if got := Classify(c.err, myerror.BadUpdate); got != c.want {
+			t.Errorf("Classify(%v) = %v, want %v", c.err, got, c.want)
+		}
+		if got := Retryable(c.err); got != c.retryable {
+			t.Errorf("Retryable(%v) = %v, want %v", c.err, got, c.retryable)
+		}
+	}
+
+	// inside a transaction retryable errors have to reach Run unchanged
+	if err := Fail(pgErr(DeadlockDetected), myerror.NotExist); Code(err) != DeadlockDetected {
+		t.Errorf("Fail kept %v", err)
+	}
+	if err := Fail(sql.ErrNoRows, myerror.ConflictError); err != myerror.NotExist {
+		t.Errorf("Fail(no rows) = %v", err)
+	}
+}
+
+// stub is a database whose transactions only count what happens to them.
+// Commits fail with the errors queued in commitErrs, one per commit.
+type stub struct {
+	mu         sync.Mutex
+	beginErr   error
+	commitErrs []error
+	begins     int
+	commits    int
+	rollbacks  int
+}
+
+func (s *stub) Connect(context.Context) (driver.Conn, error) { return stubConn{s}, nil }
+func (s *stub) Driver() driver.Driver                        { return nil }
+
+type stubConn struct{ s *stub }
+
+func (c stubConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c stubConn) Close() error                        { return nil }
+
+func (c stubConn) Begin() (driver.Tx, error) {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	if c.s.beginErr != nil {
+		return nil, c.s.beginErr
+	}
+	c.s.begins++
+	return stubTx{c.s}, nil
+}
+
+type stubTx struct{ s *stub }
+
+func (tx stubTx) Commit() error {
+	tx.s.mu.Lock()
+	defer tx.s.mu.Unlock()
+
+	tx.s.commits++
+	if len(tx.s.commitErrs) == 0 {
+		return nil
+	}
+	err := tx.s.commitErrs[0]
+	tx.s.commitErrs = tx.s.commitErrs[1:]
+	return err
+}
+
+func (tx stubTx) Rollback() error {
+	tx.s.mu.Lock()
+	defer tx.s.mu.Unlock()
+
+	tx.s.rollbacks++
+	return nil
+}
+
+// statsSince returns how much the counters grew since before.
+func statsSince(before Stats) Stats {
+	after := GetStats()
+	delta := Stats{
+		Transactions: after.Transactions - before.Transactions,
+		Retries:      map[string]int64{},
+		Exhausted:    after.Exhausted - before.Exhausted,
+	}
+	for code, n := range after.Retries {
+		if n != before.Retries[code] {
+			delta.Retries[code] = n - before.Retries[code]
+		}
+	}
+	return delta
+}
+
+func TestRun(t *testing.T) {
+	pgErr := func(code string) error {
+		return pgx.PgError{Severity: "ERROR", Code: code}
+	}
+	other := errors.New("syntax error")
+
+	cases := []struct {
+		name string
+		// fnErrs are returned by the attempts of fn in turn, nil after them
+		fnErrs     []error
+		commitErrs []error
+		want       error
+		attempts   int
+		commits    int
+		retries    map[string]int64
+		exhausted  int64
+	}{
+		{
+			name:     "commits",
+			attempts: 1, commits: 1,
+			retries: map[string]int64{},
+		},
+		{
+			name:     "retries a serialization failure in fn",
+			fnErrs:   []error{pgErr(SerializationFailure)},
+			attempts: 2, commits: 1,
+			retries: map[string]int64{SerializationFailure: 1},
+		},
+		{
+			name:     "retries a deadlock in fn",
+			fnErrs:   []error{pgErr(DeadlockDetected), pgErr(DeadlockDetected)},
+			attempts: 3, commits: 1,
+			retries: map[string]int64{DeadlockDetected: 2},
+		},
+		{
+			name:       "retries a serialization failure on commit",
+			commitErrs: []error{pgErr(SerializationFailure)},
+			attempts:   2, commits: 2,
+			retries: map[string]int64{SerializationFailure: 1},
+		},
+		{
+			name:       "retries mixed failures",
+			fnErrs:     []error{pgErr(DeadlockDetected)},
+			commitErrs: []error{pgErr(SerializationFailure)},
+			attempts:   3, commits: 2,
+			retries: map[string]int64{DeadlockDetected: 1, SerializationFailure: 1},
+		},
+		{
+			name:     "gives up after MaxAttempts",
+			fnErrs:   []error{pgErr(DeadlockDetected), pgErr(DeadlockDetected), pgErr(DeadlockDetected), pgErr(DeadlockDetected), nil},
+			want:     pgErr(DeadlockDetected),
+			attempts: MaxAttempts, commits: 0,
+			retries:   map[string]int64{DeadlockDetected: MaxAttempts - 1},
+			exhausted: 1,
+		},
+		{
+			name:       "gives up after MaxAttempts on commit",
+			commitErrs: []error{pgErr(SerializationFailure), pgErr(SerializationFailure), pgErr(SerializationFailure), pgErr(SerializationFailure)},
+			want:       pgErr(SerializationFailure),
+			attempts:   MaxAttempts, commits: MaxAttempts,
+			retries:   map[string]int64{SerializationFailure: MaxAttempts - 1},
+			exhausted: 1,
+		},
+		{
+			name:     "passes other errors through",
+			fnErrs:   []error{other},
+			want:     other,
+			attempts: 1, commits: 0,
+			retries: map[string]int64{},
+		},
+		{
+			name:     "passes repository errors through",
+			fnErrs:   []error{myerror.NotExist},
+			want:     myerror.NotExist,
+			attempts: 1, commits: 0,
+			retries: map[string]int64{},
+		},
+		{
+			name:     "stops at another error after a retry",
+			fnErrs:   []error{pgErr(SerializationFailure), pgErr(UniqueViolation)},
+			want:     pgErr(UniqueViolation),
+			attempts: 2, commits: 0,
+			retries: map[string]int64{SerializationFailure: 1},
+		},
+		{
+			name:       "passes other commit errors through",
+			commitErrs: []error{other},
+			want:       other,
+			attempts:   1, commits: 1,
+			retries: map[string]int64{},
+		},
+	}
+
+	for _, c := range cases {
+		s := &stub{commitErrs: c.commitErrs}
+		db := sql.OpenDB(s)
+
+		before := GetStats()
+		attempts := 0
+		err := Run(context.Background(), db, func(tx *sql.Tx) error {
+			attempts++
+			if attempts <= len(c.fnErrs) {
+				return c.fnErrs[attempts-1]
+			}
+			return nil
+		})
+		db.Close()
+
+		if err != c.want {
+			t.Errorf("%s: Run returned %v, want %v", c.name, err, c.want)
+		}
+		if attempts != c.attempts || s.begins != c.attempts {
+			t.Errorf("%s: fn ran %d times in %d transactions, want %d", c.name, attempts, s.begins, c.attempts)
+		}
+		if s.commits != c.commits || s.rollbacks != c.attempts-c.commits {
+			t.Errorf("%s: %d commits and %d rollbacks, want %d and %d", c.name, s.commits, s.rollbacks, c.commits, c.attempts-c.commits)
+		}
+
+		stats := statsSince(before)
+		if stats.Transactions != 1 || stats.Exhausted != c.exhausted || !reflect.DeepEqual(stats.Retries, c.retries) {
+			t.Errorf("%s: stats grew by %+v, want 1 transaction, retries %v, %d exhausted", c.name, stats, c.retries, c.exhausted)
+		}
+	}
+}
+
+func TestRunBeginFails(t *testing.T) {
+	s := &stub{beginErr: errors.New("connection refused")}
+	db := sql.OpenDB(s)
+	defer db.Close()
+
+	ran := false
+	err := Run(context.Background(), db, func(tx *sql.Tx) error {
+		ran = true
+		return nil
+	})
+	if err != myerror.InternalError || ran {
+		t.Fatalf("Run returned %v, fn ran %v, want InternalError without running fn", err, ran)
+	}
+}
@@ -96,4 +96,36 @@ var (
 	ConflictError error = Message{
 		Message: "Conflict error",
 	}
+
+	UnknownRelation error = Message{
+		Message: "Unknown relation",
+	}
+
+	Forbidden error = Message{
+		Message: "Only moderators and admins may do this",
+	}
+
+	InvalidVoice error = Message{
+		Message: "Voice must be -1, 0 or 1",
+	}
+
+	InvalidReaction error = Message{
+		Message: "Invalid reaction",
+	}
+
+	InvalidCursor error = Message{
+		Message: "Invalid cursor",
+	}
+
+	InvalidFilter error = Message{
+		Message: "Invalid filter",
+	}
+
+	InvalidSlug error = Message{
+		Message: "Invalid slug",
+	}
+
+	SlugUnavailable error = Message{
+		Message: "No free slug, retry later",
+	}
 )
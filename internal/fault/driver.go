@@ -0,0 +1,114 @@
+package fault
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// dbErrors are the errors Postgres returns for the faults repository rules
+// simulate.
+var dbErrors = map[string]error{
+	"": nil,
+	"timeout": pgx.PgError{
+		Severity: "ERROR",
+		Code:     "57014",
+		Message:  "canceling statement due to statement timeout",
+	},
+	"serialization": pgx.PgError{
+		Severity: "ERROR",
+		Code:     "40001",
+		Message:  "could not serialize access due to concurrent update",
+	},
+	"deadlock": pgx.PgError{
+		Severity: "ERROR",
+		Code:     "40P01",
+		Message:  "deadlock detected",
+	},
+}
+
+// statement applies the first repository rule that matches query.
+func (inj *Injector) statement(query string) error {
+	rule := inj.match(func(rule *Rule) bool {
+		return rule.repository() && (rule.Statement == "" || strings.Contains(strings.ToLower(query), strings.ToLower(rule.Statement)))
+	})
+	if rule == nil {
+		return nil
+	}
+
+	if rule.Latency > 0 {
+		time.Sleep(time.Duration(rule.Latency) * time.Millisecond)
+	}
+	return dbErrors[rule.DBError]
+}
+
+// Wrap returns a connector whose statements are subject to the repository
+// rules. Statements are not tied to requests, so repository rules can not
+// target routes.
+func (inj *Injector) Wrap(c driver.Connector) driver.Connector {
+	return &connector{Connector: c, inj: inj}
+}
+
+type connector struct {
+	driver.Connector
+	inj *Injector
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	inner, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: inner, inj: c.inj}, nil
+}
+
+type conn struct {
+	driver.Conn
+	inj *Injector
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	if err := c.inj.statement(query); err != nil {
+		return nil, err
+	}
+	return queryer.QueryContext(ctx, query, args)
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	if err := c.inj.statement(query); err != nil {
+		return nil, err
+	}
+	return execer.ExecContext(ctx, query, args)
+}
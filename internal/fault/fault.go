@@ -0,0 +1,311 @@
+package fault
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	myerror "forum/internal/error"
+
+	"github.com/gorilla/mux"
+)
+
+// Rule targets of the target field.
+const (
+	TargetDB   = "db"
+	TargetHTTP = "http"
+)
+
+// Rule injects a fault into a share of the requests or statements it
+// matches. Target says which: repository rules apply to SQL statements, HTTP
+// rules to requests. Without a target a rule with Statement or DBError set is
+// a repository rule and any other an HTTP rule, so a rule that only adds
+// latency to statements needs target "db".
+type Rule struct {
+	Name   string `json:"name,omitempty"`
+	Target string `json:"target,omitempty"`
+	// Percent is the share of matching requests or statements that get the
+	// fault, from 0 to 100
+	Percent float64 `json:"percent"`
+
+	// Route is a route template like /api/thread/{slug_or_id}/create, empty
+	// matches every route
+	Route  string `json:"route,omitempty"`
+	Method string `json:"method,omitempty"`
+	// Headers have to be present with the given value, an empty value only
+	// requires the header
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Latency is added before the request is served or the statement runs
+	Latency int64 `json:"latency_ms,omitempty"`
+	// Status answers the request with a 5xx instead of serving it
+	Status int `json:"status,omitempty"`
+	// Drop closes the connection without an answer
+	Drop bool `json:"drop,omitempty"`
+	// SlowBody streams the response at this many bytes per second
+	SlowBody int `json:"slow_body_bps,omitempty"`
+
+	// Statement is matched case insensitively against the SQL text, empty
+	// matches every statement
+	Statement string `json:"statement,omitempty"`
+	// DBError fails the statement with a timeout, serialization or
+	// deadlock error like Postgres would
+	DBError string `json:"db_error,omitempty"`
+
+	// Injected counts the faults injected by the rule
+	Injected int64 `json:"injected"`
+}
+
+func (rule *Rule) repository() bool {
+	return rule.Target == TargetDB
+}
+
+// target fills in Target when it was left out.
+func (rule *Rule) target() {
+	if rule.Target != "" {
+		return
+	}
+	if rule.Statement != "" || rule.DBError != "" {
+		rule.Target = TargetDB
+	} else {
+		rule.Target = TargetHTTP
+	}
+}
+
+func (rule *Rule) validate() error {
+	if rule.Percent < 0 || rule.Percent > 100 {
+		return fmt.Errorf("rule %q: percent %g is not between 0 and 100", rule.Name, rule.Percent)
+	}
+	if rule.Latency < 0 {
+		return fmt.Errorf("rule %q: negative latency", rule.Name)
+	}
+
+	switch rule.Target {
+	case TargetDB:
+		if rule.Route != "" || rule.Method != "" || len(rule.Headers) != 0 || rule.Status != 0 || rule.Drop || rule.SlowBody != 0 {
+			return fmt.Errorf("rule %q: repository rules only take statement, db_error and latency_ms", rule.Name)
+		}
+		if _, ok := dbErrors[rule.DBError]; rule.DBError != "" && !ok {
+			return fmt.Errorf("rule %q: unknown db_error %q", rule.Name, rule.DBError)
+		}
+		if rule.Latency == 0 && rule.DBError == "" {
+			return fmt.Errorf("rule %q: no fault to inject", rule.Name)
+		}
+		return nil
+	case TargetHTTP:
+	default:
+		return fmt.Errorf("rule %q: target %q is neither %q nor %q", rule.Name, rule.Target, TargetDB, TargetHTTP)
+	}
+
+	if rule.Statement != "" || rule.DBError != "" {
+		return fmt.Errorf("rule %q: statement and db_error need target %q", rule.Name, TargetDB)
+	}
+
+	if rule.Status != 0 && (rule.Status < 500 || rule.Status > 599) {
+		return fmt.Errorf("rule %q: status %d is not a 5xx", rule.Name, rule.Status)
+	}
+	if rule.SlowBody < 0 {
+		return fmt.Errorf("rule %q: negative slow_body_bps", rule.Name)
+	}
+	if rule.Latency == 0 && rule.Status == 0 && !rule.Drop && rule.SlowBody == 0 {
+		return fmt.Errorf("rule %q: no fault to inject", rule.Name)
+	}
+	return nil
+}
+
+func (rule *Rule) roll() bool {
+	return rule.Percent > 0 && rand.Float64()*100 < rule.Percent
+}
+
+// Injector holds the active rules. It is only created when fault injection
+// is enabled, a nil *Injector is never consulted.
+type Injector struct {
+	mu    sync.RWMutex
+	rules []*Rule
+}
+
+func NewInjector() *Injector {
+	return &Injector{
+		rules: []*Rule{},
+	}
+}
+
+// ReadRules decodes a JSON array of rules.
+func ReadRules(r io.Reader) ([]*Rule, error) {
+	rules := []*Rule{}
+	if err := json.NewDecoder(r).Decode(&rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// SetRules replaces all rules, nothing changes when one of them is invalid.
+func (inj *Injector) SetRules(rules []*Rule) error {
+	for _, rule := range rules {
+		rule.target()
+		if err := rule.validate(); err != nil {
+			return err
+		}
+		rule.Injected = 0
+	}
+
+	inj.mu.Lock()
+	inj.rules = rules
+	inj.mu.Unlock()
+	return nil
+}
+
+// Rules returns a copy of the rules with their counters. Injected is
+// updated by requests while the rules are read, so the fields are copied one
+// by one instead of copying the struct.
+func (inj *Injector) Rules() []Rule {
+	inj.mu.RLock()
+	defer inj.mu.RUnlock()
+
+	rules := make([]Rule, len(inj.rules))
+	for i, rule := range inj.rules {
+		var headers map[string]string
+		if rule.Headers != nil {
+			headers = make(map[string]string, len(rule.Headers))
+			for name, value := range rule.Headers {
+				headers[name] = value
+			}
+		}
+
+		rules[i] = Rule{
+			Name:      rule.Name,
+			Target:    rule.Target,
+			Percent:   rule.Percent,
+			Route:     rule.Route,
+			Method:    rule.Method,
+			Headers:   headers,
+			Latency:   rule.Latency,
+			Status:    rule.Status,
+			Drop:      rule.Drop,
+			SlowBody:  rule.SlowBody,
+			Statement: rule.Statement,
+			DBError:   rule.DBError,
+			Injected:  atomic.LoadInt64(&rule.Injected),
+		}
+	}
+	return rules
+}
+
+// match returns the first rule that matches and wins its roll.
+func (inj *Injector) match(matches func(rule *Rule) bool) *Rule {
+	inj.mu.RLock()
+	defer inj.mu.RUnlock()
+
+	for _, rule := range inj.rules {
+		if matches(rule) && rule.roll() {
+			atomic.AddInt64(&rule.Injected, 1)
+			return rule
+		}
+	}
+	return nil
+}
+
+// AdminPath is never faulted, so that rules can always be removed again.
+const AdminPath = "/api/service/faults"
+
+// Middleware injects the faults of HTTP rules. It has to run inside the
+// router for route templates to be known.
+func (inj *Injector) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == AdminPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+
+		rule := inj.match(func(rule *Rule) bool {
+			if rule.repository() {
+				return false
+			}
+			if rule.Route != "" && rule.Route != route {
+				return false
+			}
+			if rule.Method != "" && !strings.EqualFold(rule.Method, r.Method) {
+				return false
+			}
+			for name, value := range rule.Headers {
+				if got, ok := r.Header[http.CanonicalHeaderKey(name)]; !ok || (value != "" && (len(got) == 0 || got[0] != value)) {
+					return false
+				}
+			}
+			return true
+		})
+		if rule == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if rule.Latency > 0 {
+			time.Sleep(time.Duration(rule.Latency) * time.Millisecond)
+		}
+
+		if rule.Drop {
+			if hijacker, ok := w.(http.Hijacker); ok {
+				if conn, _, err := hijacker.Hijack(); err == nil {
+					conn.Close()
+					return
+				}
+			}
+			// HTTP/2 connections can not be hijacked, abort the stream
+			panic(http.ErrAbortHandler)
+		}
+
+		if rule.Status != 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(rule.Status)
+			json.NewEncoder(w).Encode(myerror.Message{Message: "injected fault " + rule.Name})
+			return
+		}
+
+		if rule.SlowBody > 0 {
+			w = &slowWriter{ResponseWriter: w, bps: rule.SlowBody}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// slowWriter streams the body in chunks sent every tenth of a second.
+type slowWriter struct {
+	http.ResponseWriter
+	bps int
+}
+
+func (sw *slowWriter) Write(data []byte) (int, error) {
+	chunk := sw.bps / 10
+	if chunk < 1 {
+		chunk = 1
+	}
+
+	written := 0
+	for written < len(data) {
+		end := written + chunk
+		if end > len(data) {
+			end = len(data)
+		}
+		n, err := sw.ResponseWriter.Write(data[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return written, nil
+}
@@ -0,0 +1,84 @@
+package fault
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRuleTargets(t *testing.T) {
+	cases := []struct {
+		rule   Rule
+		target string
+		err    string
+	}{
+		{Rule{Percent: 100, Latency: 10}, TargetHTTP, ""},
+		{Rule{Percent: 100, Latency: 10, Target: TargetDB}, TargetDB, ""},
+		{Rule{Percent: 100, Statement: "INSERT INTO post", Latency: 10}, TargetDB, ""},
+		{Rule{Percent: 100, DBError: "deadlock"}, TargetDB, ""},
+		{Rule{Percent: 100, Status: 503, Target: TargetHTTP}, TargetHTTP, ""},
+
+		{Rule{Percent: 100, Latency: 10, Target: "queue"}, "", "neither"},
+		{Rule{Percent: 100, DBError: "deadlock", Target: TargetHTTP}, "", "need target"},
+		{Rule{Percent: 100, Status: 503, Target: TargetDB}, "", "only take"},
+		{Rule{Percent: 100, Statement: "SELECT"}, "", "no fault"},
+		{Rule{Percent: 100, Target: TargetHTTP}, "", "no fault"},
+		{Rule{Percent: 100, DBError: "disk full"}, "", "unknown db_error"},
+	}
+
+	for _, c := range cases {
+		rule := c.rule
+		err := NewInjector().SetRules([]*Rule{&rule})
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%+v: error %v, want one about %q", c.rule, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %v", c.rule, err)
+			continue
+		}
+		if rule.Target != c.target || rule.repository() != (c.target == TargetDB) {
+			t.Errorf("%+v: target %q, want %q", c.rule, rule.Target, c.target)
+		}
+	}
+}
+
+// Rules is read by /api/service/faults while requests and statements count
+// their faults, run with -race.
+func TestRulesWhileInjecting(t *testing.T) {
+	inj := NewInjector()
+	err := inj.SetRules([]*Rule{
+		{Name: "timeout", Target: TargetDB, Percent: 100, Statement: "select", DBError: "timeout"},
+		{Name: "fail", Percent: 100, Status: 503, Headers: map[string]string{"X-Fault": ""}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				inj.statement("SELECT 1")
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		rules := inj.Rules()
+		rules[1].Headers["X-Other"] = "changed"
+	}
+	wg.Wait()
+
+	rules := inj.Rules()
+	if rules[0].Injected != 4000 || rules[1].Injected != 0 {
+		t.Fatalf("injected %d and %d, want 4000 and 0", rules[0].Injected, rules[1].Injected)
+	}
+	if _, ok := rules[1].Headers["X-Other"]; ok {
+		t.Fatalf("a copy of the rules changed the headers of the rule")
+	}
+}
@@ -0,0 +1,294 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	myerror "forum/internal/error"
+
+	"github.com/gorilla/mux"
+)
+
+// Header carries the key a client picks for a create request and sends again
+// with every retry of it.
+const Header = "Idempotency-Key"
+
+// ReplayedHeader is set on responses served from the store.
+const ReplayedHeader = "Idempotent-Replayed"
+
+// DefaultTTL is how long a response is kept for replay.
+const DefaultTTL = 24 * time.Hour
+
+// Lease is how long a claimed key waits for its response. A key whose
+// request died with the server, or whose response could not be stored, is
+// free for a retry once the lease ran out.
+const Lease = 30 * time.Second
+
+// maxKeyLength keeps keys to the size of the UUIDs and random tokens clients
+// send.
+const maxKeyLength = 255
+
+// Routes are the create endpoints that honour the header. Other routes
+// ignore it.
+var Routes = map[string]bool{
+	"/api/user/{nickname}/create":     true,
+	"/api/forum/create":               true,
+	"/api/forum/{slug}/create":        true,
+	"/api/thread/{slug_or_id}/create": true,
+	"/api/thread/{slug_or_id}/vote":   true,
+	"/api/post/{id}/vote":             true,
+	"/api/post/{id}/reactions":        true,
+}
+
+// Store keeps the responses to keyed requests in the idempotency_key table.
+type Store struct {
+	db  *sql.DB
+	ttl time.Duration
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+func NewStore(db *sql.DB, ttl time.Duration) *Store {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+
+	return &Store{
+		db:  db,
+		ttl: ttl,
+	}
+}
+
+type stored struct {
+	hash   string
+	status sql.NullInt64
+	body   []byte
+}
+
+// claim reserves key for the request with hash and returns the end of the
+// lease, which identifies the claim in complete and release. An expired key
+// is claimed again, and so is a key of the same request whose lease ran out
+// without a response. When the key is taken claim returns the request that
+// took it.
+func (s *Store) claim(ctx context.Context, key string, hash string) (*time.Time, *stored, error) {
+	var lockedUntil time.Time
+	err := s.db.QueryRowContext(ctx, `INSERT INTO idempotency_key (key, request_hash, locked_until)
+	VALUES ($1, $2, NOW() + make_interval(secs => $4))
+	ON CONFLICT (key) DO UPDATE SET request_hash = EXCLUDED.request_hash, status = NULL, body = NULL,
+	created_at = NOW(), locked_until = EXCLUDED.locked_until
+	WHERE idempotency_key.created_at < NOW() - make_interval(secs => $3)
+	OR (idempotency_key.status IS NULL AND idempotency_key.locked_until < NOW() AND idempotency_key.request_hash = EXCLUDED.request_hash)
+	RETURNING locked_until`, key, hash, s.ttl.Seconds(), Lease.Seconds()).Scan(&lockedUntil)
+	if err == nil {
+		return &lockedUntil, nil, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, nil, err
+	}
+
+	previous := &stored{}
+	err = s.db.QueryRowContext(ctx, "SELECT request_hash, status, body FROM idempotency_key WHERE key = $1", key).
+		Scan(&previous.hash, &previous.status, &previous.body)
+	if err == sql.ErrNoRows {
+		// expired and swept in between, try again
+		return s.claim(ctx, key, hash)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, previous, nil
+}
+
+// complete stores the response of the claim that ends its lease at
+// lockedUntil. A claim taken over by a retry after its lease ran out stores
+// nothing. Unlike claim it does not run in the request context, the response
+// is stored even when the client is gone.
+func (s *Store) complete(key string, lockedUntil *time.Time, status int, body []byte) error {
+	result, err := s.db.Exec(`UPDATE idempotency_key SET status = $3, body = $4
+	WHERE key = $1 AND locked_until = $2 AND status IS NULL`, key, *lockedUntil, status, body)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return errors.New("claim was taken over")
+	}
+	return nil
+}
+
+// release forgets the claim on key, so that a retry runs the request again.
+func (s *Store) release(key string, lockedUntil *time.Time) {
+	_, err := s.db.Exec("DELETE FROM idempotency_key WHERE key = $1 AND locked_until = $2 AND status IS NULL", key, *lockedUntil)
+	if err != nil {
+		log.Printf("can not release idempotency key %q: %v", key, err)
+	}
+}
+
+// sweep deletes expired keys, at most once per tenth of the TTL.
+func (s *Store) sweep() {
+	s.mu.Lock()
+	if time.Since(s.lastSweep) < s.ttl/10 {
+		s.mu.Unlock()
+		return
+	}
+	s.lastSweep = time.Now()
+	s.mu.Unlock()
+
+	go func() {
+		_, err := s.db.Exec("DELETE FROM idempotency_key WHERE created_at < NOW() - make_interval(secs => $1)", s.ttl.Seconds())
+		if err != nil {
+			log.Printf("can not delete expired idempotency keys: %v", err)
+		}
+	}()
+}
+
+// requestHash covers method, path, query and body, a key sent to another
+// endpoint counts as a different request.
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(myerror.Message{Message: message})
+}
+
+// Middleware replays the stored response when a create request comes again
+// with the same Idempotency-Key and the same body. The same key with another
+// body gets a 422, a retry while the first request is still served a 409.
+// Responses with a 5xx status are not kept, the client may retry them.
+//
+// The response is held back until it is stored. When storing fails the
+// request did take effect, so the claim is kept rather than released: the
+// client gets a 500 saying so, and retries get a 409 until the lease runs
+// out.
+func (s *Store) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(Header)
+		if key == "" || r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		if !Routes[route] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > maxKeyLength {
+			writeError(w, http.StatusBadRequest, "idempotency key is too long")
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "can not read request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		s.sweep()
+
+		hash := requestHash(r, body)
+		lockedUntil, previous, err := s.claim(r.Context(), key, hash)
+		if err != nil {
+			log.Printf("can not look up idempotency key %q: %v", key, err)
+			writeError(w, http.StatusInternalServerError, "can not look up idempotency key")
+			return
+		}
+
+		if lockedUntil == nil {
+			switch {
+			case previous.hash != hash:
+				writeError(w, http.StatusUnprocessableEntity, "idempotency key was used for a different request")
+			case !previous.status.Valid:
+				writeError(w, http.StatusConflict, "request with this idempotency key is in progress")
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set(ReplayedHeader, "true")
+				w.WriteHeader(int(previous.status.Int64))
+				w.Write(previous.body)
+			}
+			return
+		}
+
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		done := false
+		defer func() {
+			// the handler panicked or aborted the connection
+			if !done {
+				s.release(key, lockedUntil)
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+		done = true
+
+		if rec.status >= 500 {
+			s.release(key, lockedUntil)
+			rec.send()
+			return
+		}
+
+		if err := s.complete(key, lockedUntil, rec.status, rec.body.Bytes()); err != nil {
+			log.Printf("can not store response for idempotency key %q: %v", key, err)
+			for name := range w.Header() {
+				w.Header().Del(name)
+			}
+			writeError(w, http.StatusInternalServerError, "request was applied but its response can not be stored for idempotency key")
+			return
+		}
+		rec.send()
+	})
+}
+
+// recorder holds the response back until it is stored for replay. Headers
+// go to the response writer right away, they are only sent with the status.
+type recorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+}
+
+func (rec *recorder) Write(data []byte) (int, error) {
+	rec.wroteHeader = true
+	return rec.body.Write(data)
+}
+
+// send writes the recorded response.
+func (rec *recorder) send() {
+	rec.ResponseWriter.WriteHeader(rec.status)
+	rec.ResponseWriter.Write(rec.body.Bytes())
+}
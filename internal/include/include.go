@@ -0,0 +1,62 @@
+package include
+
+import (
+	"strings"
+
+	myerror "forum/internal/error"
+)
+
+// Set is a parsed list of relations requested through related/include query
+// parameters, e.g. "user,thread" or "thread, USER".
+type Set map[string]bool
+
+// Parse splits raw by commas and checks every relation against allowed.
+// Order, case and duplicates do not matter.
+func Parse(raw string, allowed ...string) (Set, error) {
+	set := Set{}
+	if strings.TrimSpace(raw) == "" {
+		return set, nil
+	}
+
+	known := make(map[string]bool, len(allowed))
+	for _, relation := range allowed {
+		known[relation] = true
+	}
+
+	for _, relation := range strings.Split(raw, ",") {
+		relation = strings.ToLower(strings.TrimSpace(relation))
+		if relation == "" {
+			continue
+		}
+		if !known[relation] {
+			return nil, myerror.UnknownRelation
+		}
+		set[relation] = true
+	}
+
+	return set, nil
+}
+
+// ParseKnown is Parse for the related parameter of the original API, which
+// clients send with relations this server does not know. Those are ignored.
+func ParseKnown(raw string, allowed ...string) Set {
+	set := Set{}
+	for _, relation := range strings.Split(raw, ",") {
+		relation = strings.ToLower(strings.TrimSpace(relation))
+		for _, known := range allowed {
+			if relation == known {
+				set[relation] = true
+			}
+		}
+	}
+
+	return set
+}
+
+func (s Set) Has(relation string) bool {
+	return s[relation]
+}
+
+func (s Set) Empty() bool {
+	return len(s) == 0
+}
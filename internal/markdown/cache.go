@@ -0,0 +1,96 @@
+package markdown
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sync"
+
+	"forum/internal/models"
+)
+
+// Renderer renders messages through an LRU cache. Entries are keyed by the
+// post or thread id and a hash of the message, so an edit is a new revision
+// and never sees the HTML of the old one.
+type Renderer struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type entry struct {
+	key  string
+	html string
+}
+
+func NewRenderer(size int) *Renderer {
+	return &Renderer{
+		size:    size,
+		entries: make(map[string]*list.Element, size),
+		order:   list.New(),
+	}
+}
+
+func revision(kind string, id int64, message string) string {
+	h := fnv.New64a()
+	h.Write([]byte(message))
+	return fmt.Sprintf("%s:%d:%x", kind, id, h.Sum64())
+}
+
+func (r *Renderer) render(key string, message string) string {
+	r.mu.Lock()
+	if el, ok := r.entries[key]; ok {
+		r.order.MoveToFront(el)
+		r.mu.Unlock()
+		return el.Value.(*entry).html
+	}
+	r.mu.Unlock()
+
+	// rendered outside the lock, two requests for a cold revision may both
+	// render it, which is cheaper than serialising all renders
+	rendered := Render(message)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.entries[key]; !ok {
+		r.entries[key] = r.order.PushFront(&entry{key: key, html: rendered})
+		for r.order.Len() > r.size {
+			oldest := r.order.Back()
+			r.order.Remove(oldest)
+			delete(r.entries, oldest.Value.(*entry).key)
+		}
+	}
+
+	return rendered
+}
+
+func (r *Renderer) Posts(posts ...*models.Post) {
+	for _, post := range posts {
+		if post != nil {
+			post.MessageHTML = r.render(revision("post", post.Id, post.Message), post.Message)
+		}
+	}
+}
+
+func (r *Renderer) PostTree(nodes models.PostTree) {
+	for _, node := range nodes {
+		r.Posts(node.Post)
+		r.PostTree(node.Children)
+	}
+}
+
+func (r *Renderer) Threads(threads ...*models.Thread) {
+	for _, thread := range threads {
+		if thread != nil {
+			thread.MessageHTML = r.render(revision("thread", int64(thread.Id), thread.Message), thread.Message)
+		}
+	}
+}
+
+// Requested reports whether the client asked for rendered messages with
+// ?render=html.
+func Requested(r *http.Request) bool {
+	return r.URL.Query().Get("render") == "html"
+}
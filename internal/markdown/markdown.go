@@ -0,0 +1,526 @@
+package markdown
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Render turns a post or thread message into HTML. Only a subset of Markdown
+// is supported: paragraphs, headings, block quotes, lists, fenced code, rules,
+// emphasis, code spans and links. Raw HTML in the message is always escaped
+// and links are kept only for http, https, mailto and relative targets, so the
+// output can be inserted into a page as is. >>12345 links to the post 12345.
+func Render(message string) string {
+	lines := strings.Split(strings.ReplaceAll(message, "\r\n", "\n"), "\n")
+
+	var b strings.Builder
+	renderBlocks(&b, lines)
+
+	return b.String()
+}
+
+var (
+	headingRe     = regexp.MustCompile(`^(#{1,6})[ \t]+(.*?)[ \t#]*$`)
+	ruleRe        = regexp.MustCompile(`^ {0,3}([-*_])([ \t]*[-*_]){2,}[ \t]*$`)
+	bulletRe      = regexp.MustCompile(`^ {0,3}[-*+][ \t]+`)
+	orderedRe     = regexp.MustCompile(`^ {0,3}(\d{1,9})[.)][ \t]+`)
+	fenceRe       = regexp.MustCompile("^ {0,3}(```+|~~~+)[ \t]*([A-Za-z0-9_+-]*)")
+	postRefLineRe = regexp.MustCompile(`^>>\d`)
+	languageRe    = regexp.MustCompile(`^[A-Za-z0-9_+-]+$`)
+)
+
+func isQuote(line string) bool {
+	trimmed := strings.TrimLeft(line, " ")
+	return strings.HasPrefix(trimmed, ">") && !postRefLineRe.MatchString(trimmed)
+}
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// startsBlock reports whether line opens a block other than a paragraph.
+func startsBlock(line string) bool {
+	return headingRe.MatchString(line) || ruleRe.MatchString(line) || fenceRe.MatchString(line) ||
+		isQuote(line) || bulletRe.MatchString(line) || orderedRe.MatchString(line)
+}
+
+func renderBlocks(b *strings.Builder, lines []string) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+
+		switch {
+		case isBlank(line):
+			i++
+
+		case fenceRe.MatchString(line):
+			i = renderFence(b, lines, i)
+
+		case headingRe.MatchString(line):
+			m := headingRe.FindStringSubmatch(line)
+			fmt.Fprintf(b, "<h%d>%s</h%d>\n", len(m[1]), renderInline(m[2]), len(m[1]))
+			i++
+
+		case ruleRe.MatchString(line):
+			b.WriteString("<hr>\n")
+			i++
+
+		case isQuote(line):
+			quoted := []string{}
+			for ; i < len(lines) && isQuote(lines[i]); i++ {
+				inner := strings.TrimPrefix(strings.TrimLeft(lines[i], " "), ">")
+				quoted = append(quoted, strings.TrimPrefix(inner, " "))
+			}
+			b.WriteString("<blockquote>\n")
+			renderBlocks(b, quoted)
+			b.WriteString("</blockquote>\n")
+
+		case bulletRe.MatchString(line):
+			i = renderList(b, lines, i, bulletRe, "ul", 1)
+
+		case orderedRe.MatchString(line):
+			start, _ := strconv.Atoi(orderedRe.FindStringSubmatch(line)[1])
+			i = renderList(b, lines, i, orderedRe, "ol", start)
+
+		default:
+			paragraph := []string{}
+			for ; i < len(lines) && !isBlank(lines[i]) && (len(paragraph) == 0 || !startsBlock(lines[i])); i++ {
+				paragraph = append(paragraph, strings.TrimSpace(lines[i]))
+			}
+			parts := make([]string, 0, len(paragraph))
+			for _, p := range paragraph {
+				parts = append(parts, renderInline(p))
+			}
+			b.WriteString("<p>" + strings.Join(parts, "<br>\n") + "</p>\n")
+		}
+	}
+}
+
+func renderFence(b *strings.Builder, lines []string, i int) int {
+	m := fenceRe.FindStringSubmatch(lines[i])
+	fence, language := m[1], m[2]
+
+	code := []string{}
+	for i++; i < len(lines); i++ {
+		if strings.HasPrefix(strings.TrimLeft(lines[i], " "), fence) {
+			i++
+			break
+		}
+		code = append(code, lines[i])
+	}
+
+	if language != "" && languageRe.MatchString(language) {
+		fmt.Fprintf(b, "<pre><code class=\"language-%s\">", language)
+	} else {
+		b.WriteString("<pre><code>")
+	}
+	for _, line := range code {
+		b.WriteString(html.EscapeString(line) + "\n")
+	}
+	b.WriteString("</code></pre>\n")
+
+	return i
+}
+
+// renderList collects items starting with marker. Indented lines continue the
+// previous item, nested lists are not supported.
+func renderList(b *strings.Builder, lines []string, i int, marker *regexp.Regexp, tag string, start int) int {
+	items := [][]string{}
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if loc := marker.FindStringIndex(line); loc != nil {
+			items = append(items, []string{line[loc[1]:]})
+			continue
+		}
+		if isBlank(line) || !strings.HasPrefix(line, "  ") {
+			break
+		}
+		last := len(items) - 1
+		items[last] = append(items[last], strings.TrimSpace(line))
+	}
+
+	if tag == "ol" && start != 1 {
+		fmt.Fprintf(b, "<ol start=\"%d\">\n", start)
+	} else {
+		b.WriteString("<" + tag + ">\n")
+	}
+	for _, item := range items {
+		parts := make([]string, 0, len(item))
+		for _, p := range item {
+			parts = append(parts, renderInline(p))
+		}
+		b.WriteString("<li>" + strings.Join(parts, "<br>\n") + "</li>\n")
+	}
+	b.WriteString("</" + tag + ">\n")
+
+	return i
+}
+
+// PostLink is the target of a >>id reference.
+func PostLink(id int64) string {
+	return fmt.Sprintf("/api/post/%d/details", id)
+}
+
+// maxInlineDepth bounds how deep links and emphasis nest. The content of each
+// level is rendered again, deeper levels are kept as plain text.
+const maxInlineDepth = 8
+
+// span is a line being rendered. Lookups that would scan to the end of the
+// line from every opening bracket or delimiter are done once per span, so
+// that rendering stays linear in the length of the message whatever a
+// client posts.
+type span struct {
+	text  string
+	depth int
+
+	// closing holds the matching ']' of every '[' and the matching ')' of
+	// every '(', -1 when there is none. It is filled on first use.
+	closing []int
+	// unclosed holds the emphasis delimiters that have no closer left in the
+	// line, later openers are not looked at again
+	unclosed map[string]bool
+}
+
+func renderInline(text string) string {
+	return renderSpan(text, 0)
+}
+
+func renderSpan(text string, depth int) string {
+	var b strings.Builder
+
+	if depth > maxInlineDepth {
+		for i := 0; i < len(text); {
+			i += writeRune(&b, text[i:])
+		}
+		return b.String()
+	}
+
+	s := &span{text: text, depth: depth}
+	for i := 0; i < len(text); {
+		c := text[i]
+
+		switch {
+		case c == '\\' && i+1 < len(text) && isASCIIPunct(text[i+1]):
+			b.WriteString(html.EscapeString(text[i+1 : i+2]))
+			i += 2
+			continue
+
+		case c == '`':
+			if n := renderCode(&b, text[i:]); n > 0 {
+				i += n
+				continue
+			}
+
+		case c == '[' || (c == '!' && i+1 < len(text) && text[i+1] == '['):
+			if n := s.renderLink(&b, i); n > 0 {
+				i += n
+				continue
+			}
+
+		case c == '<':
+			if n := renderAutolink(&b, text[i:]); n > 0 {
+				i += n
+				continue
+			}
+
+		case c == '>' && !afterWord(text, i):
+			if n := renderPostRef(&b, text[i:]); n > 0 {
+				i += n
+				continue
+			}
+
+		case c == '*' || c == '_' || c == '~':
+			if n := s.renderEmphasis(&b, i); n > 0 {
+				i += n
+				continue
+			}
+		}
+
+		i += writeRune(&b, text[i:])
+	}
+
+	return b.String()
+}
+
+// writeRune writes the first rune of text escaped and returns its length.
+func writeRune(b *strings.Builder, text string) int {
+	r, size := utf8.DecodeRuneInString(text)
+	if r == utf8.RuneError && size == 1 {
+		b.WriteString("�")
+	} else {
+		b.WriteString(html.EscapeString(text[:size]))
+	}
+	return size
+}
+
+// renderCode handles `code`. An opening run of backticks without a closing
+// run of the same length is text, as is an empty code span, both are
+// written out whole so that the backticks inside are not tried again.
+func renderCode(b *strings.Builder, text string) int {
+	n := 0
+	for n < len(text) && text[n] == '`' {
+		n++
+	}
+	ticks := text[:n]
+
+	for j := n; j < len(text); {
+		k := strings.Index(text[j:], ticks)
+		if k < 0 {
+			break
+		}
+		end := j + k
+		// the closing run must be exactly as long as the opening one
+		if end+n < len(text) && text[end+n] == '`' {
+			j = end + n
+			for j < len(text) && text[j] == '`' {
+				j++
+			}
+			continue
+		}
+		code := strings.TrimSpace(text[n:end])
+		if code == "" {
+			b.WriteString(html.EscapeString(text[:end+n]))
+			return end + n
+		}
+		b.WriteString("<code>" + html.EscapeString(code) + "</code>")
+		return end + n
+	}
+
+	b.WriteString(ticks)
+	return n
+}
+
+// matchBrackets pairs the brackets and the parentheses of text the way a
+// scan from each opening one would. Inside brackets a backslash escapes the
+// next byte, parentheses of link targets are taken as they are.
+func matchBrackets(text string) []int {
+	closing := make([]int, len(text))
+	brackets, parens := []int{}, []int{}
+
+	escaped := false
+	for j := 0; j < len(text); j++ {
+		closing[j] = -1
+
+		switch text[j] {
+		case '(':
+			parens = append(parens, j)
+		case ')':
+			if n := len(parens); n > 0 {
+				closing[parens[n-1]] = j
+				parens = parens[:n-1]
+			}
+		}
+
+		if escaped {
+			escaped = false
+			continue
+		}
+		switch text[j] {
+		case '\\':
+			escaped = true
+		case '[':
+			brackets = append(brackets, j)
+		case ']':
+			if n := len(brackets); n > 0 {
+				closing[brackets[n-1]] = j
+				brackets = brackets[:n-1]
+			}
+		}
+	}
+
+	return closing
+}
+
+// renderLink handles [text](url) and ![alt](url) starting at i. Images are
+// turned into links so that messages can not load remote content into the
+// page.
+func (s *span) renderLink(b *strings.Builder, i int) int {
+	text := s.text
+	open := i
+	if text[i] == '!' {
+		open++
+	}
+
+	if s.closing == nil {
+		s.closing = matchBrackets(text)
+	}
+	closing := s.closing[open]
+	if closing < 0 || closing+1 >= len(text) || text[closing+1] != '(' {
+		return 0
+	}
+	// parentheses inside the target have to be balanced
+	end := s.closing[closing+1]
+	if end < 0 {
+		return 0
+	}
+
+	label := text[open+1 : closing]
+	target := strings.TrimSpace(text[closing+2 : end])
+	// an optional "title" is accepted and dropped
+	if k := strings.IndexAny(target, " \t"); k >= 0 {
+		target = target[:k]
+	}
+	target = strings.TrimSuffix(strings.TrimPrefix(target, "<"), ">")
+
+	inner := renderSpan(label, s.depth+1)
+	if inner == "" {
+		inner = html.EscapeString(target)
+	}
+
+	if !SafeURL(target) {
+		b.WriteString(inner)
+		return end + 1 - i
+	}
+
+	b.WriteString(anchor(target, inner))
+	return end + 1 - i
+}
+
+func renderAutolink(b *strings.Builder, text string) int {
+	// stop at the next '<' too, a run of them is not scanned to the end
+	end := strings.IndexAny(text[1:], "<> \t") + 1
+	if end == 0 || text[end] != '>' {
+		return 0
+	}
+
+	target := text[1:end]
+	if !strings.Contains(target, ":") || !SafeURL(target) {
+		return 0
+	}
+
+	b.WriteString(anchor(target, html.EscapeString(target)))
+	return end + 1
+}
+
+func renderPostRef(b *strings.Builder, text string) int {
+	if !strings.HasPrefix(text, ">>") {
+		return 0
+	}
+
+	n := 2
+	for n < len(text) && n < 21 && text[n] >= '0' && text[n] <= '9' {
+		n++
+	}
+	if n == 2 || (n < len(text) && isWordByte(text[n])) {
+		return 0
+	}
+
+	id, err := strconv.ParseInt(text[2:n], 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	fmt.Fprintf(b, "<a href=\"%s\" class=\"post-ref\">&gt;&gt;%d</a>", PostLink(id), id)
+	return n
+}
+
+// renderEmphasis handles **strong**, __strong__, *em*, _em_ and ~~del~~. The
+// delimited text must not start or end with a space, and underscores inside
+// words (snake_case) are left alone.
+func (s *span) renderEmphasis(b *strings.Builder, i int) int {
+	text := s.text
+	c := text[i]
+	n := 1
+	if i+1 < len(text) && text[i+1] == c {
+		n = 2
+	}
+	if c == '~' && n != 2 {
+		return 0
+	}
+	if c == '_' && afterWord(text, i) {
+		return 0
+	}
+
+	delim := text[i : i+n]
+	start := i + n
+	if start >= len(text) || text[start] == ' ' || text[start] == delim[0] || s.unclosed[delim] {
+		return 0
+	}
+
+	for j := start; j < len(text); {
+		k := strings.Index(text[j:], delim)
+		if k < 0 {
+			break
+		}
+		end := j + k
+		valid := text[end-1] != ' ' && text[end-1] != '\\'
+		if n == 1 && end+1 < len(text) && text[end+1] == c {
+			valid = false
+		}
+		if c == '_' && end+n < len(text) && isWordByte(text[end+n]) {
+			valid = false
+		}
+		if !valid {
+			j = end + n
+			continue
+		}
+
+		tag := "em"
+		if c == '~' {
+			tag = "del"
+		} else if n == 2 {
+			tag = "strong"
+		}
+		b.WriteString("<" + tag + ">" + renderSpan(text[start:end], s.depth+1) + "</" + tag + ">")
+		return end + n - i
+	}
+
+	if s.unclosed == nil {
+		s.unclosed = map[string]bool{}
+	}
+	s.unclosed[delim] = true
+	return 0
+}
+
+func anchor(target string, inner string) string {
+	return fmt.Sprintf("<a href=\"%s\" rel=\"nofollow noopener noreferrer\">%s</a>", html.EscapeString(target), inner)
+}
+
+// SafeURL accepts http, https and mailto links and relative ones. Anything
+// with another scheme, such as javascript: or data:, is rejected.
+func SafeURL(target string) bool {
+	if target == "" {
+		return false
+	}
+	for _, r := range target {
+		if r < 0x20 || r == 0x7f || unicode.IsSpace(r) {
+			return false
+		}
+	}
+
+	colon := strings.IndexByte(target, ':')
+	if colon < 0 {
+		return true
+	}
+	if k := strings.IndexAny(target, "/?#"); k >= 0 && k < colon {
+		// the colon is part of the path, not a scheme
+		return true
+	}
+
+	switch strings.ToLower(target[:colon]) {
+	case "http", "https", "mailto":
+		return true
+	}
+
+	return false
+}
+
+func afterWord(text string, i int) bool {
+	if i == 0 {
+		return false
+	}
+	r, _ := utf8.DecodeLastRuneInString(text[:i])
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isASCIIPunct(c byte) bool {
+	return strings.IndexByte("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", c) >= 0
+}
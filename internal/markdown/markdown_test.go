@@ -0,0 +1,239 @@
+package markdown
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"forum/internal/models"
+)
+
+type renderCase struct {
+	name    string
+	message string
+	want    string
+}
+
+func runCases(t *testing.T, cases []renderCase) {
+	t.Helper()
+
+	for _, c := range cases {
+		if got := Render(c.message); got != c.want {
+			t.Errorf("%s: Render(%q)\n got %q\nwant %q", c.name, c.message, got, c.want)
+		}
+	}
+}
+
+const rel = ` rel="nofollow noopener noreferrer"`
+
+func TestRenderEscapesHTML(t *testing.T) {
+	runCases(t, []renderCase{
+		{"script", `<script>alert(1)</script>`, "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"script in heading", `# <script>x</script>`, "<h1>&lt;script&gt;x&lt;/script&gt;</h1>\n"},
+		{"event handler", `<img src=x onerror="alert(1)">`, "<p>&lt;img src=x onerror=&#34;alert(1)&#34;&gt;</p>\n"},
+		{"entity", `&lt;b&gt; & "q" 'a'`, "<p>&amp;lt;b&amp;gt; &amp; &#34;q&#34; &#39;a&#39;</p>\n"},
+		{"quote breaking out of href", `[x](http://a.com/"onmouseover="alert(1))`, `<p><a href="http://a.com/&#34;onmouseover=&#34;alert(1)"` + rel + ">x</a></p>\n"},
+		{"quote in autolink", `<http://a.com/"><script>>`, `<p><a href="http://a.com/&#34;"` + rel + ">http://a.com/&#34;</a>&lt;script&gt;&gt;</p>\n"},
+		{"html in label", `[<b>bold</b>](http://a.com)`, `<p><a href="http://a.com"` + rel + ">&lt;b&gt;bold&lt;/b&gt;</a></p>\n"},
+		{"invalid utf-8", "a\xffb", "<p>a�b</p>\n"},
+	})
+}
+
+func TestRenderLinks(t *testing.T) {
+	runCases(t, []renderCase{
+		{"http", `[site](http://example.com)`, `<p><a href="http://example.com"` + rel + ">site</a></p>\n"},
+		{"https with title", `[site](https://example.com "title")`, `<p><a href="https://example.com"` + rel + ">site</a></p>\n"},
+		{"mailto", `[mail](mailto:a@example.com)`, `<p><a href="mailto:a@example.com"` + rel + ">mail</a></p>\n"},
+		{"relative", `[post](/api/post/1/details)`, `<p><a href="/api/post/1/details"` + rel + ">post</a></p>\n"},
+		{"colon in path", `[p](a/b:c)`, `<p><a href="a/b:c"` + rel + ">p</a></p>\n"},
+		{"empty label", `[](http://a.com)`, `<p><a href="http://a.com"` + rel + ">http://a.com</a></p>\n"},
+		{"balanced parentheses", `[w](http://a.com/x_(y))`, `<p><a href="http://a.com/x_(y)"` + rel + ">w</a></p>\n"},
+
+		{"javascript", `[x](javascript:alert(1))`, "<p>x</p>\n"},
+		{"mixed case javascript", `[x](JaVaScRiPt:alert(1))`, "<p>x</p>\n"},
+		{"data", `[x](data:text/html;base64,PHNjcmlwdD4=)`, "<p>x</p>\n"},
+		{"vbscript", `[x](vbscript:msgbox)`, "<p>x</p>\n"},
+		// whitespace ends the target, what is left is a relative link
+		{"tab in scheme", "[x](java\tscript:alert(1))", `<p><a href="java"` + rel + ">x</a></p>\n"},
+		{"angle brackets", `[x](<javascript:alert(1)>)`, "<p>x</p>\n"},
+		{"empty target", `[x]()`, "<p>x</p>\n"},
+
+		{"autolink", `<https://example.com/a?b=1&c=2>`, `<p><a href="https://example.com/a?b=1&amp;c=2"` + rel + ">https://example.com/a?b=1&amp;c=2</a></p>\n"},
+		{"autolink mailto", `<mailto:a@example.com>`, `<p><a href="mailto:a@example.com"` + rel + ">mailto:a@example.com</a></p>\n"},
+		{"autolink javascript", `<javascript:alert(1)>`, "<p>&lt;javascript:alert(1)&gt;</p>\n"},
+		{"autolink mixed case", `<JAVASCRIPT:alert(1)>`, "<p>&lt;JAVASCRIPT:alert(1)&gt;</p>\n"},
+		{"autolink data", `<data:text/html,x>`, "<p>&lt;data:text/html,x&gt;</p>\n"},
+		{"autolink without scheme", `<example.com>`, "<p>&lt;example.com&gt;</p>\n"},
+
+		{"unclosed", `[x](http://a.com`, "<p>[x](http://a.com</p>\n"},
+		{"no target", `[x] (http://a.com)`, "<p>[x] (http://a.com)</p>\n"},
+	})
+}
+
+func TestRenderImagesBecomeLinks(t *testing.T) {
+	runCases(t, []renderCase{
+		{"image", `![cat](https://example.com/cat.png)`, `<p><a href="https://example.com/cat.png"` + rel + ">cat</a></p>\n"},
+		{"image without alt", `![](https://example.com/cat.png)`, `<p><a href="https://example.com/cat.png"` + rel + ">https://example.com/cat.png</a></p>\n"},
+		{"javascript image", `![x](javascript:alert(1))`, "<p>x</p>\n"},
+		{"data image", `![x](data:image/png;base64,AAAA)`, "<p>x</p>\n"},
+	})
+
+	if got := Render(`![cat](https://example.com/cat.png)`); strings.Contains(got, "<img") {
+		t.Errorf("image rendered as %q", got)
+	}
+}
+
+func TestRenderPostRefs(t *testing.T) {
+	runCases(t, []renderCase{
+		{"ref", `>>123`, `<p><a href="/api/post/123/details" class="post-ref">&gt;&gt;123</a></p>` + "\n"},
+		{"ref in text", `see >>7, >>8.`, `<p>see <a href="/api/post/7/details" class="post-ref">&gt;&gt;7</a>, <a href="/api/post/8/details" class="post-ref">&gt;&gt;8</a>.</p>` + "\n"},
+		{"not a quote", ">>1 and\n> quoted", `<p><a href="/api/post/1/details" class="post-ref">&gt;&gt;1</a> and</p>` + "\n<blockquote>\n<p>quoted</p>\n</blockquote>\n"},
+		{"after word", `a>>1`, "<p>a&gt;&gt;1</p>\n"},
+		{"followed by word", `>>12abc`, "<p>&gt;&gt;12abc</p>\n"},
+		{"no digits", `>>abc`, "<blockquote>\n<blockquote>\n<p>abc</p>\n</blockquote>\n</blockquote>\n"},
+		{"overflow", `>>99999999999999999999`, "<p>&gt;&gt;99999999999999999999</p>\n"},
+		{"in code", "`>>1`", "<p><code>&gt;&gt;1</code></p>\n"},
+	})
+}
+
+func TestRenderCode(t *testing.T) {
+	runCases(t, []renderCase{
+		{"span", "use `<b>` here", "<p>use <code>&lt;b&gt;</code> here</p>\n"},
+		{"span keeps markup", "`*a* [x](javascript:y)`", "<p><code>*a* [x](javascript:y)</code></p>\n"},
+		{"double ticks", "``a ` b``", "<p><code>a ` b</code></p>\n"},
+		{"unclosed span", "`a", "<p>`a</p>\n"},
+		// an opening run without a closing run of its length is text as a
+		// whole, a shorter run inside it does not open a span
+		{"mismatched ticks", "``a`", "<p>``a`</p>\n"},
+		{"mismatched ticks before a span", "``a `b`", "<p>``a <code>b</code></p>\n"},
+		{"empty span", "` `", "<p>` `</p>\n"},
+
+		{"fence", "```\n<script>alert(1)</script>\n**a**\n```", "<pre><code>&lt;script&gt;alert(1)&lt;/script&gt;\n**a**\n</code></pre>\n"},
+		{"fence language", "```go\nx := 1 < 2\n```", "<pre><code class=\"language-go\">x := 1 &lt; 2\n</code></pre>\n"},
+		{"fence language injection", "```\"><script>\nx\n```", "<pre><code>x\n</code></pre>\n"},
+		{"tilde fence", "~~~\n~~x~~\n~~~", "<pre><code>~~x~~\n</code></pre>\n"},
+		{"unclosed fence", "```\na\nb", "<pre><code>a\nb\n</code></pre>\n"},
+		{"longer closing fence", "```\na\n````\nafter", "<pre><code>a\n</code></pre>\n<p>after</p>\n"},
+	})
+}
+
+func TestRenderEmphasis(t *testing.T) {
+	runCases(t, []renderCase{
+		{"em", `*a*`, "<p><em>a</em></p>\n"},
+		{"strong", `**a**`, "<p><strong>a</strong></p>\n"},
+		{"underscores", `_a_ __b__`, "<p><em>a</em> <strong>b</strong></p>\n"},
+		{"del", `~~a~~`, "<p><del>a</del></p>\n"},
+		{"single tilde", `~a~`, "<p>~a~</p>\n"},
+		{"nested", `**a *b* c**`, "<p><strong>a <em>b</em> c</strong></p>\n"},
+		{"snake case", `snake_case_name`, "<p>snake_case_name</p>\n"},
+		{"space after opener", `* a*`, "<ul>\n<li>a*</li>\n</ul>\n"},
+		{"space before closer", `*a *`, "<p>*a *</p>\n"},
+		{"unclosed", `**a`, "<p>**a</p>\n"},
+		{"escaped closer", `*a\*`, "<p>*a*</p>\n"},
+		{"escaped opener", `\*a*`, "<p>*a*</p>\n"},
+		{"star in word", `2*3*4`, "<p>2<em>3</em>4</p>\n"},
+		{"html inside", `*<i>x</i>*`, "<p><em>&lt;i&gt;x&lt;/i&gt;</em></p>\n"},
+		{"link inside", `**[x](javascript:y)**`, "<p><strong>x</strong></p>\n"},
+	})
+}
+
+func TestRenderBlocks(t *testing.T) {
+	runCases(t, []renderCase{
+		{"paragraphs", "a\nb\n\nc", "<p>a<br>\nb</p>\n<p>c</p>\n"},
+		{"heading", "## Title ##", "<h2>Title</h2>\n"},
+		{"rule", "- - -", "<hr>\n"},
+		{"list", "- a\n- b\n  more", "<ul>\n<li>a</li>\n<li>b<br>\nmore</li>\n</ul>\n"},
+		{"ordered", "3. a\n4. b", "<ol start=\"3\">\n<li>a</li>\n<li>b</li>\n</ol>\n"},
+		{"quote", "> a\n> *b*", "<blockquote>\n<p>a<br>\n<em>b</em></p>\n</blockquote>\n"},
+		{"crlf", "a\r\nb", "<p>a<br>\nb</p>\n"},
+	})
+}
+
+// Any client can render any post, a message built to make the renderer scan
+// the rest of the line from every byte must not take quadratic time.
+func TestRenderAdversarial(t *testing.T) {
+	const n = 64 << 10
+
+	ticks := ""
+	for run := 1; len(ticks) < n; run++ {
+		ticks += strings.Repeat("`", run) + "a"
+	}
+
+	messages := map[string]string{
+		"open brackets":    strings.Repeat("[", n),
+		"open images":      strings.Repeat("![", n/2),
+		"open targets":     strings.Repeat("[a](", n/4),
+		"nested links":     strings.Repeat("[", n/8) + "x" + strings.Repeat("](u)", n/8),
+		"open autolinks":   strings.Repeat("<a", n/2),
+		"backtick runs":    ticks,
+		"open emphasis":    strings.Repeat("*a ", n/3),
+		"open strong":      strings.Repeat("**a ", n/4),
+		"open strike":      strings.Repeat("~~a ", n/4),
+		"open underscores": strings.Repeat(" _a", n/3),
+		"nested emphasis":  strings.Repeat("*_", n/4) + "x" + strings.Repeat("_*", n/4),
+	}
+
+	for name, message := range messages {
+		start := time.Now()
+		Render(message)
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: rendering %d bytes took %v", name, len(message), elapsed)
+		}
+	}
+
+	// links nested deeper than maxInlineDepth keep their labels as text
+	deep := strings.Repeat("[", 20) + "x" + strings.Repeat("](/u)", 20)
+	if links := strings.Count(Render(deep), "<a "); links != maxInlineDepth+1 {
+		t.Errorf("%d nested links rendered, want %d", links, maxInlineDepth+1)
+	}
+}
+
+func TestRendererRevisions(t *testing.T) {
+	r := NewRenderer(2)
+
+	post := &models.Post{Id: 1, Message: "*old*"}
+	r.Posts(post)
+	if post.MessageHTML != "<p><em>old</em></p>\n" {
+		t.Fatalf("first render %q", post.MessageHTML)
+	}
+
+	// an edit is a new revision, the cached HTML of the old one is not used
+	post.Message = "**new**"
+	r.Posts(post)
+	if post.MessageHTML != "<p><strong>new</strong></p>\n" {
+		t.Fatalf("render after edit %q", post.MessageHTML)
+	}
+
+	// the same message on another post or on a thread is its own entry
+	other := &models.Post{Id: 2, Message: "*old*"}
+	thread := &models.Thread{Id: 1, Message: "**new**"}
+	r.Posts(other)
+	r.Threads(thread)
+	if other.MessageHTML != "<p><em>old</em></p>\n" || thread.MessageHTML != "<p><strong>new</strong></p>\n" {
+		t.Fatalf("post %q, thread %q", other.MessageHTML, thread.MessageHTML)
+	}
+
+	// the cache holds size entries, the least recently used go first
+	if len(r.entries) != 2 || r.order.Len() != 2 {
+		t.Fatalf("%d entries, %d in order, want 2", len(r.entries), r.order.Len())
+	}
+	if _, ok := r.entries[revision("post", 1, "*old*")]; ok {
+		t.Fatalf("oldest revision still cached")
+	}
+	if _, ok := r.entries[revision("thread", 1, "**new**")]; !ok {
+		t.Fatalf("newest revision not cached")
+	}
+
+	// a reverted edit renders the old message again
+	post.Message = "*old*"
+	r.Posts(post)
+	if post.MessageHTML != "<p><em>old</em></p>\n" {
+		t.Fatalf("render after revert %q", post.MessageHTML)
+	}
+
+	tree := models.PostTree{{Post: &models.Post{Id: 3, Message: "_a_"}, Children: models.PostTree{{Post: &models.Post{Id: 4, Message: "`b`"}}}}}
+	r.PostTree(tree)
+	if tree[0].Post.MessageHTML != "<p><em>a</em></p>\n" || tree[0].Children[0].Post.MessageHTML != "<p><code>b</code></p>\n" {
+		t.Fatalf("tree %q, %q", tree[0].Post.MessageHTML, tree[0].Children[0].Post.MessageHTML)
+	}
+}
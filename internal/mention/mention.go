@@ -0,0 +1,99 @@
+package mention
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"forum/internal/models"
+)
+
+// Find returns every @nickname in a message with its position. Offset and
+// Length count runes and cover the leading @. An @ preceded by a letter or
+// digit, as in an email address, is not a mention.
+func Find(message string) []*models.Mention {
+	mentions := []*models.Mention{}
+	runes := 0
+
+	for i := 0; i < len(message); {
+		r, size := utf8.DecodeRuneInString(message[i:])
+		if r != '@' || (i > 0 && isNicknameRune(lastRune(message[:i]))) {
+			i += size
+			runes++
+			continue
+		}
+
+		end, length := i+1, 1
+		for end < len(message) {
+			next, nextSize := utf8.DecodeRuneInString(message[end:])
+			if !isNicknameRune(next) {
+				break
+			}
+			end += nextSize
+			length++
+		}
+
+		// a nickname may contain dots but does not end with one
+		name := strings.TrimRight(message[i+1:end], ".")
+		if name != "" {
+			mentions = append(mentions, &models.Mention{
+				Nickname: name,
+				Offset:   runes,
+				Length:   utf8.RuneCountInString(name) + 1,
+			})
+		}
+
+		i = end
+		runes += length
+	}
+
+	return mentions
+}
+
+// Parse returns the distinct nicknames mentioned in a message, in order of
+// first appearance. Nicknames are compared case-insensitively, the casing of
+// the first mention is kept.
+func Parse(message string) []string {
+	names := []string{}
+	seen := map[string]bool{}
+
+	for _, m := range Find(message) {
+		key := strings.ToLower(m.Nickname)
+		if !seen[key] {
+			seen[key] = true
+			names = append(names, m.Nickname)
+		}
+	}
+
+	return names
+}
+
+// Resolve keeps the mentions of a message that name a mentioned user and
+// replaces the name as written with the current nickname of the user. names
+// maps lowercased names to nicknames, it holds the nicknames of the users and
+// the aliases their renames left, as the message still says @old after the
+// user renamed.
+func Resolve(message string, names map[string]string) []*models.Mention {
+	if len(names) == 0 {
+		return nil
+	}
+
+	resolved := []*models.Mention{}
+	for _, m := range Find(message) {
+		if nickname, ok := names[strings.ToLower(m.Nickname)]; ok {
+			m.Nickname = nickname
+			resolved = append(resolved, m)
+		}
+	}
+
+	return resolved
+}
+
+func lastRune(s string) rune {
+	r, _ := utf8.DecodeLastRuneInString(s)
+	return r
+}
+
+func isNicknameRune(r rune) bool {
+	return r == '_' || r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
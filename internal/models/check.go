@@ -0,0 +1,14 @@
+package models
+
+type Drift struct {
+	Entity string `json:"entity"`
+	Key    string `json:"key"`
+	Field  string `json:"field"`
+	Stored int64  `json:"stored"`
+	Actual int64  `json:"actual"`
+}
+
+type CheckReport struct {
+	Drifts   []*Drift `json:"drifts"`
+	Repaired int64    `json:"repaired"`
+}
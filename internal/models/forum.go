@@ -7,3 +7,13 @@ type Forum struct {
 	Posts   int64  `json:"posts,omitempty"`
 	Threads int32  `json:"threads,omitempty"`
 }
+
+type ForumUpdate struct {
+	Title *string
+	Slug  *string
+}
+
+type ForumFull struct {
+	Forum *Forum `json:"forum,omitempty"`
+	Owner *User  `json:"owner,omitempty"`
+}
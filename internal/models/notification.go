@@ -0,0 +1,57 @@
+package models
+
+import "time"
+
+type Subscription struct {
+	Nickname string    `json:"nickname"`
+	Thread   int32     `json:"thread,omitempty"`
+	Created  time.Time `json:"created,omitempty"`
+}
+
+// Notification kinds, a post produces at most one notification per user and
+// the first matching kind wins.
+const (
+	NotificationMention = "mention"
+	NotificationReply   = "reply"
+	NotificationPost    = "post"
+)
+
+type Notification struct {
+	Id      int64     `json:"id"`
+	Kind    string    `json:"kind"`
+	Post    int64     `json:"post"`
+	Thread  int32     `json:"thread"`
+	Forum   string    `json:"forum"`
+	Author  string    `json:"author"`
+	Created time.Time `json:"created"`
+	IsRead  bool      `json:"is_read"`
+}
+
+type NotificationInbox struct {
+	Unread        int64           `json:"unread"`
+	Notifications []*Notification `json:"notifications"`
+}
+
+// NotificationRead marks the listed notifications as read, or all of them
+// up to and including Until when no ids are given.
+type NotificationRead struct {
+	Ids   []int64 `json:"ids,omitempty"`
+	Until int64   `json:"until,omitempty"`
+}
+
+// NotificationStats counts post batches handed to the notification fan-out
+// since start.
+type NotificationStats struct {
+	// Queued is the number of batches waiting in memory right now
+	Queued int64 `json:"queued"`
+	// FannedOut counts batches whose notifications were created
+	FannedOut int64 `json:"fanned_out"`
+	// Deferred counts batches kept in notification_pending because the
+	// queue was full
+	Deferred int64 `json:"deferred"`
+	// Failed counts batches whose fan-out returned an error
+	Failed int64 `json:"failed"`
+	// Dropped counts batches lost because the queue was full and they could
+	// not be deferred either
+	Dropped int64 `json:"dropped"`
+}
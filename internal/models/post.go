@@ -12,6 +12,12 @@ type Post struct {
 	Thread   int32     `json:"thread,omitempty"`
 	Created  time.Time `json:"created,omitempty"`
 
+	Score     int64            `json:"score,omitempty"`
+	Reactions map[string]int64 `json:"reactions,omitempty"`
+	Mentions  []*Mention       `json:"mentions,omitempty"`
+
+	MessageHTML string `json:"message_html,omitempty"`
+
 	Path []int64 `json:"-"`
 }
 
@@ -27,3 +33,27 @@ type PostFull struct {
 	Thread *Thread `json:"thread,omitempty"`
 	Forum  *Forum  `json:"forum,omitempty"`
 }
+
+type PostNode struct {
+	*Post
+	Children   []*PostNode `json:"children"`
+	ReplyCount int64       `json:"reply_count"`
+	HasMore    bool        `json:"has_more"`
+}
+
+type PostTree = []*PostNode
+
+type PostContext struct {
+	Post           *Post   `json:"post"`
+	Ancestors      []*Post `json:"ancestors"`
+	SiblingsBefore []*Post `json:"siblings_before"`
+	SiblingsAfter  []*Post `json:"siblings_after"`
+}
+
+// Mention is an @nickname in a post message that names an existing user.
+// Offset and Length are in runes and include the @.
+type Mention struct {
+	Nickname string `json:"nickname"`
+	Offset   int    `json:"offset"`
+	Length   int    `json:"length"`
+}
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+type PostVote struct {
+	Nickname  string    `json:"nickname"`
+	Voice     int32     `json:"voice"`
+	Post      int64     `json:"post,omitempty"`
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+}
+
+type Reaction struct {
+	Nickname string    `json:"nickname"`
+	Emoji    string    `json:"emoji"`
+	Post     int64     `json:"post,omitempty"`
+	Created  time.Time `json:"created,omitempty"`
+}
+
+type Reactions = []Reaction
@@ -11,6 +11,8 @@ type Thread struct {
 	Votes   int32     `json:"votes,omitempty"`
 	Slug    string    `json:"slug,omitempty"`
 	Created time.Time `json:"created,omitempty"`
+
+	MessageHTML string `json:"message_html,omitempty"`
 }
 
 type Threads = []Thread
@@ -18,4 +20,30 @@ type Threads = []Thread
 type ThreadUpdate struct {
 	Title   *string
 	Message *string
+	Slug    *string
+}
+
+type ThreadFull struct {
+	Thread *Thread `json:"thread,omitempty"`
+	Author *User   `json:"author,omitempty"`
+	Forum  *Forum  `json:"forum,omitempty"`
+}
+
+// ThreadMove, ThreadMerge and ThreadSplit name the moderator who acts, a
+// user with one of the ModeratorRoles.
+type ThreadMove struct {
+	Moderator string `json:"moderator"`
+	Forum     string `json:"forum"`
+}
+
+type ThreadMerge struct {
+	Moderator string `json:"moderator"`
+	Into      string `json:"into"`
+}
+
+type ThreadSplit struct {
+	Moderator string `json:"moderator"`
+	Title     string `json:"title"`
+	Slug      string `json:"slug,omitempty"`
+	Message   string `json:"message,omitempty"`
 }
@@ -1,10 +1,15 @@
 package models
 
+import "time"
+
 type User struct {
 	Nickname string `json:"nickname,omitempty"`
 	Fullname string `json:"fullname,omitempty"`
 	About    string `json:"about,omitempty"`
 	Email    string `json:"email,omitempty"`
+
+	Reputation        int64         `json:"reputation,omitempty"`
+	ReputationByForum []*Reputation `json:"reputation_by_forum,omitempty"`
 }
 
 type Users = []User
@@ -14,3 +19,48 @@ type UserUpdate struct {
 	About    *string
 	Email    *string
 }
+
+type UserRename struct {
+	Nickname string `json:"nickname"`
+}
+
+// ModeratorRoles may move, merge and split threads.
+var ModeratorRoles = map[string]bool{
+	"moderator": true,
+	"admin":     true,
+}
+
+// UserRole is the role of a user, votes of users with a role count with the
+// weight configured for it.
+type UserRole struct {
+	Nickname string `json:"nickname,omitempty"`
+	Role     string `json:"role"`
+}
+
+type Reputation struct {
+	Nickname    string `json:"nickname,omitempty"`
+	Forum       string `json:"forum,omitempty"`
+	ThreadScore int64  `json:"thread_score"`
+	PostScore   int64  `json:"post_score"`
+	Total       int64  `json:"reputation"`
+}
+
+type UserSummary struct {
+	Nickname string   `json:"nickname"`
+	Posts    int64    `json:"posts"`
+	Threads  int64    `json:"threads"`
+	Forums   []string `json:"forums"`
+}
+
+// AuthorFilter selects posts or threads of one author. From is inclusive,
+// To is exclusive, Cursor continues a previous page of the same Scope, which
+// covers Desc and the filters as requested.
+type AuthorFilter struct {
+	Forum  string
+	From   time.Time
+	To     time.Time
+	Limit  int64
+	Cursor string
+	Desc   bool
+	Scope  string
+}
@@ -3,8 +3,11 @@ package models
 import "time"
 
 type Vote struct {
-	Nickname  string
-	Voice     int32
-	Thread    int32
-	UpdatedAt time.Time
+	Nickname  string    `json:"nickname"`
+	Voice     int32     `json:"voice"`
+	Thread    int32     `json:"thread,omitempty"`
+	Weight    int32     `json:"weight,omitempty"`
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
 }
+
+type Votes = []Vote
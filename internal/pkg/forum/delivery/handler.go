@@ -5,9 +5,12 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 
+	"forum/internal/include"
 	"forum/internal/models"
 	"forum/internal/pkg/forum/usecase"
+	user "forum/internal/pkg/user/usecase"
 
 	"github.com/gorilla/mux"
 
@@ -16,18 +19,22 @@ import (
 
 type ForumHandler struct {
 	fu *usecase.ForumUsecase
+	uu *user.UserUsecase
 }
 
-func NewUserHandler(fu *usecase.ForumUsecase) *ForumHandler {
+func NewUserHandler(fu *usecase.ForumUsecase, uu *user.UserUsecase) *ForumHandler {
 	return &ForumHandler{
 		fu: fu,
+		uu: uu,
 	}
 }
 
 func (fh *ForumHandler) Routing(r *mux.Router) {
 	r.HandleFunc("/forum/create", http.HandlerFunc(fh.CreateForum)).Methods(http.MethodPost)
 	r.HandleFunc(`/forum/{slug}/details`, http.HandlerFunc(fh.ForumDetails)).Methods(http.MethodGet)
+	r.HandleFunc(`/forum/{slug}/details`, http.HandlerFunc(fh.UpdateForum)).Methods(http.MethodPost)
 	r.HandleFunc(`/forum/{slug}/users`, http.HandlerFunc(fh.GetUsers)).Methods(http.MethodGet)
+	r.HandleFunc(`/forum/{slug}/leaderboard`, http.HandlerFunc(fh.GetLeaderboard)).Methods(http.MethodGet)
 }
 
 func (fh *ForumHandler) CreateForum(w http.ResponseWriter, r *http.Request) {
@@ -42,9 +49,9 @@ func (fh *ForumHandler) CreateForum(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	createdForum, createErr := fh.fu.Create(forum)
+	createdForum, createErr := fh.fu.Create(r.Context(), forum)
 	if createErr == myerror.UAlreadyExist {
-		selectedForum, selectErr := fh.fu.GetBySlug(forum.Slug)
+		selectedForum, selectErr := fh.fu.GetBySlug(r.Context(), forum.Slug)
 		if selectErr != nil {
 			w.WriteHeader(http.StatusNotFound)
 			json.NewEncoder(w).Encode(selectErr)
@@ -73,15 +80,81 @@ func (fh *ForumHandler) ForumDetails(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	slug := vars["slug"]
 
-	forum, err := fh.fu.GetBySlug(slug)
+	u, _ := url.Parse(r.URL.RequestURI())
+	related, parseErr := include.Parse(u.Query().Get("include"), "owner")
+	if parseErr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(parseErr)
+		return
+	}
+
+	forum, err := fh.fu.GetBySlug(r.Context(), slug)
 	if err != nil || forum.User == "" {
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(myerror.UNotFound)
 		return
 	}
 
+	status := http.StatusOK
+	if !strings.EqualFold(slug, forum.Slug) {
+		// requested by an old slug, point the client to the current one
+		w.Header().Set("Location", "/api/forum/"+forum.Slug+"/details")
+		status = http.StatusMovedPermanently
+	}
+
+	if related.Empty() {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(forum)
+		return
+	}
+
+	full := models.ForumFull{Forum: forum}
+	if related.Has("owner") {
+		full.Owner, _ = fh.uu.GetByNickname(r.Context(), forum.User)
+	}
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(full)
+}
+
+func (fh *ForumHandler) UpdateForum(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+	toUpdate := &models.ForumUpdate{}
+
+	err := json.NewDecoder(r.Body).Decode(toUpdate)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(err)
+		return
+	}
+
+	slug := mux.Vars(r)["slug"]
+
+	updatedForum, updateErr := fh.fu.Update(r.Context(), slug, toUpdate)
+	if updateErr == myerror.BadUpdate {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(updateErr)
+		return
+	}
+	if updateErr == myerror.NotExist {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(updateErr)
+		return
+	}
+	if updateErr == myerror.ConflictError {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(updateErr)
+		return
+	}
+	if updateErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(updateErr)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(forum)
+	json.NewEncoder(w).Encode(updatedForum)
 }
 
 func (fh *ForumHandler) GetUsers(w http.ResponseWriter, r *http.Request) {
@@ -102,8 +175,15 @@ func (fh *ForumHandler) GetUsers(w http.ResponseWriter, r *http.Request) {
 		isDescOrder = true
 	}
 
-	users, err := fh.fu.GetUsersBySlug(slug, since, limit, isDescOrder)
+	users, err := fh.fu.GetUsersBySlug(r.Context(), slug, since, limit, isDescOrder)
 	if err != nil {
+		if current, resolveErr := fh.fu.ResolveSlug(r.Context(), slug); resolveErr == nil {
+			u.Path = "/api/forum/" + current + "/users"
+			w.Header().Set("Location", u.RequestURI())
+			w.WriteHeader(http.StatusMovedPermanently)
+			return
+		}
+
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(myerror.UNotFound)
 		return
@@ -112,3 +192,34 @@ func (fh *ForumHandler) GetUsers(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(users)
 }
+
+func (fh *ForumHandler) GetLeaderboard(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	slug := mux.Vars(r)["slug"]
+	limit, _ := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+
+	leaders, err := fh.fu.GetLeaderboard(r.Context(), slug, limit)
+	if err == myerror.NotExist {
+		if current, resolveErr := fh.fu.ResolveSlug(r.Context(), slug); resolveErr == nil {
+			u, _ := url.Parse(r.URL.RequestURI())
+			u.Path = "/api/forum/" + current + "/leaderboard"
+			w.Header().Set("Location", u.RequestURI())
+			w.WriteHeader(http.StatusMovedPermanently)
+			return
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(myerror.UNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(leaders)
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"forum/internal/dbtx"
 	myerror "forum/internal/error"
 	"forum/internal/models"
+	"strings"
 )
 
 type ForumRepository struct {
@@ -18,32 +20,29 @@ func NewForumRepository(DB *sql.DB) *ForumRepository {
 	}
 }
 
-func (fr *ForumRepository) Insert(forum *models.Forum) error {
-	tx, err := fr.DB.BeginTx(context.Background(), nil)
-	if err != nil {
-		return myerror.DBCreateTxError
-	}
+func (fr *ForumRepository) Insert(ctx context.Context, forum *models.Forum) error {
+	err := dbtx.Run(ctx, fr.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `INSERT INTO forum (title, author, slug, posts, threads)
+							VALUES ($1, COALESCE((SELECT nickname FROM users WHERE nickname = $2), $2), $3, $4, $5) RETURNING title, author, slug, posts, threads;`,
+			forum.Title, forum.User, forum.Slug, forum.Posts, forum.Threads).Scan(&forum.Title, &forum.User, &forum.Slug, &forum.Posts, &forum.Threads)
 
-	err = tx.QueryRow(`INSERT INTO forum (title, author, slug, posts, threads)
-						VALUES ($1, COALESCE((SELECT nickname FROM users WHERE nickname = $2), $2), $3, $4, $5) RETURNING title, author, slug, posts, threads;`,
-		forum.Title, forum.User, forum.Slug, forum.Posts, forum.Threads).Scan(&forum.Title, &forum.User, &forum.Slug, &forum.Posts, &forum.Threads)
-
-	if err != nil {
-		tx.Rollback()
-		return myerror.DBScanError
-	}
-
-	err = tx.Commit()
-	if err != nil {
-		return myerror.DBCommitError
-	}
+		// the usecase tells a duplicate slug from a missing author itself
+		if err != nil && !dbtx.Retryable(err) {
+			return myerror.DBScanError
+		}
+		return err
+	})
 
-	return nil
+	return dbtx.Classify(err, myerror.DBCommitError)
 }
 
-func (fr *ForumRepository) SelectBySlug(slug string) (*models.Forum, error) {
-	row := fr.DB.QueryRow(
-		"SELECT title, author, slug, posts, threads FROM forum WHERE slug = $1",
+func (fr *ForumRepository) SelectBySlug(ctx context.Context, slug string) (*models.Forum, error) {
+	row := fr.DB.QueryRowContext(ctx,
+		`SELECT title, author, slug, posts, threads FROM forum WHERE slug = $1
+		UNION ALL
+		SELECT f.title, f.author, f.slug, f.posts, f.threads FROM forum AS f
+		JOIN forum_slug_alias AS a ON a.forum = f.slug WHERE a.slug = $1
+		LIMIT 1`,
 		slug)
 
 	forum := models.Forum{}
@@ -60,9 +59,91 @@ func (fr *ForumRepository) SelectBySlug(slug string) (*models.Forum, error) {
 	return &forum, nil
 }
 
-func (fr *ForumRepository) SelectUsersBySlug(slug string, since string, limit int64, isDescOrder bool) ([]*models.User, error) {
+// ResolveSlug returns the current slug of a forum renamed from slug.
+func (fr *ForumRepository) ResolveSlug(ctx context.Context, slug string) (string, error) {
+	var forum string
+	err := fr.DB.QueryRowContext(ctx, "SELECT forum FROM forum_slug_alias WHERE slug = $1", slug).Scan(&forum)
+	if err != nil {
+		return "", myerror.NotExist
+	}
+
+	return forum, nil
+}
+
+// UniqueSlug returns base or the first of base-2, base-3, ... that is used
+// neither by a forum nor by a forum slug alias.
+func (fr *ForumRepository) UniqueSlug(ctx context.Context, base string) (string, error) {
+	var slug string
+	err := fr.DB.QueryRowContext(ctx, `SELECT candidate FROM (
+		SELECT n, CASE WHEN n = 1 THEN $1 ELSE $1 || '-' || n END AS candidate FROM generate_series(1, 1000) AS n
+	) AS c
+	WHERE NOT EXISTS (SELECT 1 FROM forum WHERE slug = c.candidate)
+	AND NOT EXISTS (SELECT 1 FROM forum_slug_alias WHERE slug = c.candidate)
+	ORDER BY n LIMIT 1`, base).Scan(&slug)
+	if err != nil {
+		return "", myerror.InternalError
+	}
+
+	return slug, nil
+}
+
+// Update changes title and slug of the forum. Threads, posts and forum users
+// follow the new slug through ON UPDATE CASCADE, the old one is kept as an
+// alias.
+func (fr *ForumRepository) Update(ctx context.Context, slug string, toUpdate *models.ForumUpdate) (*models.Forum, error) {
+	forum := &models.Forum{}
+	err := dbtx.Run(ctx, fr.DB, func(tx *sql.Tx) error {
+		var oldSlug string
+		err := tx.QueryRowContext(ctx, `SELECT slug FROM forum WHERE slug = $1
+		UNION ALL
+		SELECT forum FROM forum_slug_alias WHERE slug = $1
+		LIMIT 1`, slug).Scan(&oldSlug)
+		if err != nil {
+			return dbtx.Fail(err, myerror.NotExist)
+		}
+
+		renamed := toUpdate.Slug != nil && !strings.EqualFold(oldSlug, *toUpdate.Slug)
+		if renamed {
+			var taken bool
+			err = tx.QueryRowContext(ctx, "SELECT exists (SELECT 1 FROM forum_slug_alias WHERE slug = $1 AND forum != $2)", *toUpdate.Slug, oldSlug).Scan(&taken)
+			if err != nil {
+				return dbtx.Fail(err, myerror.ConflictError)
+			}
+			if taken {
+				return myerror.ConflictError
+			}
+
+			_, err = tx.ExecContext(ctx, "DELETE FROM forum_slug_alias WHERE slug = $1", *toUpdate.Slug)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = tx.QueryRowContext(ctx, `UPDATE forum SET title = COALESCE($2, title), slug = COALESCE($3, slug) WHERE slug = $1
+		RETURNING title, author, slug, posts, threads`, oldSlug, toUpdate.Title, toUpdate.Slug).
+			Scan(&forum.Title, &forum.User, &forum.Slug, &forum.Posts, &forum.Threads)
+		if err != nil {
+			return dbtx.Fail(err, myerror.ConflictError)
+		}
+
+		if renamed {
+			_, err = tx.ExecContext(ctx, "INSERT INTO forum_slug_alias (slug, forum) VALUES ($1, $2)", oldSlug, forum.Slug)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, dbtx.Classify(err, myerror.InternalError)
+	}
+
+	return forum, nil
+}
+
+func (fr *ForumRepository) SelectUsersBySlug(ctx context.Context, slug string, since string, limit int64, isDescOrder bool) ([]*models.User, error) {
 	var exists bool
-	err := fr.DB.QueryRow("SELECT exists (SELECT id FROM forum WHERE slug=$1)", slug).Scan(&exists)
+	err := fr.DB.QueryRowContext(ctx, "SELECT exists (SELECT id FROM forum WHERE slug=$1)", slug).Scan(&exists)
 	if err != nil || !exists {
 		return nil, myerror.NotExist
 	}
@@ -95,7 +176,7 @@ func (fr *ForumRepository) SelectUsersBySlug(slug string, since string, limit in
 		arr = append(arr, limit)
 	}
 
-	rows, err := fr.DB.Query(query, arr...)
+	rows, err := fr.DB.QueryContext(ctx, query, arr...)
 	if err != nil {
 		return nil, myerror.NotExist
 	}
@@ -112,3 +193,39 @@ func (fr *ForumRepository) SelectUsersBySlug(slug string, since string, limit in
 	}
 	return users, nil
 }
+
+func (fr *ForumRepository) SelectLeaderboard(ctx context.Context, slug string, limit int64) ([]*models.Reputation, error) {
+	var exists bool
+	err := fr.DB.QueryRowContext(ctx, "SELECT exists (SELECT 1 FROM forum WHERE slug=$1)", slug).Scan(&exists)
+	if err != nil || !exists {
+		return nil, myerror.NotExist
+	}
+
+	query := `SELECT nickname, thread_score, post_score, thread_score + post_score FROM user_reputation
+	WHERE forum = $1 ORDER BY thread_score + post_score DESC, nickname`
+	arr := []interface{}{
+		slug,
+	}
+
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT $%d", len(arr)+1)
+		arr = append(arr, limit)
+	}
+
+	rows, err := fr.DB.QueryContext(ctx, query, arr...)
+	if err != nil {
+		return nil, myerror.InternalError
+	}
+	defer rows.Close()
+
+	leaders := []*models.Reputation{}
+	for rows.Next() {
+		leader := models.Reputation{}
+		if err := rows.Scan(&leader.Nickname, &leader.ThreadScore, &leader.PostScore, &leader.Total); err != nil {
+			return nil, myerror.InternalError
+		}
+		leaders = append(leaders, &leader)
+	}
+
+	return leaders, nil
+}
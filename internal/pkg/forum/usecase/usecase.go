@@ -1,8 +1,10 @@
 package usecase
 
 import (
+	"context"
 	"forum/internal/models"
 	"forum/internal/pkg/forum/repository"
+	"forum/internal/slug"
 
 	myerror "forum/internal/error"
 )
@@ -17,8 +19,16 @@ func NewForumUsecase(fr *repository.ForumRepository) *ForumUsecase {
 	}
 }
 
-func (fu *ForumUsecase) Create(forum *models.Forum) (*models.Forum, error) {
-	dbErr := fu.fr.Insert(forum)
+func (fu *ForumUsecase) Create(ctx context.Context, forum *models.Forum) (*models.Forum, error) {
+	if forum.Slug == "" {
+		unique, err := fu.fr.UniqueSlug(ctx, slug.FromTitle(forum.Title, "forum"))
+		if err != nil {
+			return nil, myerror.UInternalError
+		}
+		forum.Slug = unique
+	}
+
+	dbErr := fu.fr.Insert(ctx, forum)
 
 	switch dbErr {
 	case myerror.DBCommitError, myerror.DBCreateTxError, myerror.DBRollbackError:
@@ -32,8 +42,8 @@ func (fu *ForumUsecase) Create(forum *models.Forum) (*models.Forum, error) {
 	return nil, myerror.UnexpectedError
 }
 
-func (fu *ForumUsecase) GetBySlug(slug string) (*models.Forum, error) {
-	forum, dbErr := fu.fr.SelectBySlug(slug)
+func (fu *ForumUsecase) GetBySlug(ctx context.Context, slug string) (*models.Forum, error) {
+	forum, dbErr := fu.fr.SelectBySlug(ctx, slug)
 
 	switch dbErr {
 	case myerror.DBScanError:
@@ -45,6 +55,23 @@ func (fu *ForumUsecase) GetBySlug(slug string) (*models.Forum, error) {
 	return nil, myerror.UnexpectedError
 }
 
-func (fu *ForumUsecase) GetUsersBySlug(slug string, since string, limit int64, isDescOrder bool) ([]*models.User, error) {
-	return fu.fr.SelectUsersBySlug(slug, since, limit, isDescOrder)
+func (fu *ForumUsecase) GetUsersBySlug(ctx context.Context, slug string, since string, limit int64, isDescOrder bool) ([]*models.User, error) {
+	return fu.fr.SelectUsersBySlug(ctx, slug, since, limit, isDescOrder)
+}
+
+func (fu *ForumUsecase) Update(ctx context.Context, forumSlug string, toUpdate *models.ForumUpdate) (*models.Forum, error) {
+	if toUpdate.Slug != nil && !slug.Valid(*toUpdate.Slug) {
+		return nil, myerror.BadUpdate
+	}
+
+	return fu.fr.Update(ctx, forumSlug, toUpdate)
+}
+
+// ResolveSlug returns the current slug for a forum renamed from slug.
+func (fu *ForumUsecase) ResolveSlug(ctx context.Context, slug string) (string, error) {
+	return fu.fr.ResolveSlug(ctx, slug)
+}
+
+func (fu *ForumUsecase) GetLeaderboard(ctx context.Context, slug string, limit int64) ([]*models.Reputation, error) {
+	return fu.fr.SelectLeaderboard(ctx, slug, limit)
 }
@@ -0,0 +1,158 @@
+package delivery
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"forum/internal/models"
+	"forum/internal/pkg/notification/usecase"
+	user "forum/internal/pkg/user/usecase"
+
+	myerror "forum/internal/error"
+
+	"github.com/gorilla/mux"
+)
+
+type NotificationHandler struct {
+	nu *usecase.NotificationUsecase
+	uu *user.UserUsecase
+}
+
+func NewNotificationHandler(nu *usecase.NotificationUsecase, uu *user.UserUsecase) *NotificationHandler {
+	return &NotificationHandler{
+		nu: nu,
+		uu: uu,
+	}
+}
+
+func (nh *NotificationHandler) Routing(r *mux.Router) {
+	r.HandleFunc("/thread/{slug_or_id}/subscribe", http.HandlerFunc(nh.Subscribe)).Methods(http.MethodPost)
+	r.HandleFunc("/thread/{slug_or_id}/subscribe", http.HandlerFunc(nh.Unsubscribe)).Methods(http.MethodDelete)
+	r.HandleFunc("/user/{nickname}/notifications", http.HandlerFunc(nh.GetNotifications)).Methods(http.MethodGet)
+	r.HandleFunc("/user/{nickname}/notifications/read", http.HandlerFunc(nh.MarkRead)).Methods(http.MethodPost)
+}
+
+func (nh *NotificationHandler) Subscribe(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+	subscription := &models.Subscription{}
+
+	err := json.NewDecoder(r.Body).Decode(subscription)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(err)
+		return
+	}
+
+	created, subscribeErr := nh.nu.Subscribe(r.Context(), mux.Vars(r)["slug_or_id"], subscription.Nickname)
+	if subscribeErr == myerror.NotExist {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(subscribeErr)
+		return
+	}
+	if subscribeErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(subscribeErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(created)
+}
+
+func (nh *NotificationHandler) Unsubscribe(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	subscription := &models.Subscription{
+		Nickname: r.URL.Query().Get("nickname"),
+	}
+	if subscription.Nickname == "" {
+		err := json.NewDecoder(r.Body).Decode(subscription)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(err)
+			return
+		}
+	}
+
+	deleteErr := nh.nu.Unsubscribe(r.Context(), mux.Vars(r)["slug_or_id"], subscription.Nickname)
+	if deleteErr == myerror.NotExist {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(deleteErr)
+		return
+	}
+	if deleteErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(deleteErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (nh *NotificationHandler) GetNotifications(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	user, err := nh.uu.GetByNickname(r.Context(), mux.Vars(r)["nickname"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(myerror.UNotFound)
+		return
+	}
+
+	u, _ := url.Parse(r.URL.RequestURI())
+	query := u.Query()
+
+	limit, _ := strconv.ParseInt(query.Get("limit"), 10, 64)
+	since, _ := strconv.ParseInt(query.Get("since"), 10, 64)
+	unreadOnly := query.Get("unread") == "true"
+
+	inbox, selectErr := nh.nu.GetInbox(r.Context(), user.Nickname, limit, since, unreadOnly)
+	if selectErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(selectErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(inbox)
+}
+
+func (nh *NotificationHandler) MarkRead(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	user, err := nh.uu.GetByNickname(r.Context(), mux.Vars(r)["nickname"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(myerror.UNotFound)
+		return
+	}
+
+	// an empty body marks everything as read
+	read := &models.NotificationRead{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(read); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(err)
+			return
+		}
+	}
+
+	unread, updateErr := nh.nu.MarkRead(r.Context(), user.Nickname, read)
+	if updateErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(updateErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&models.NotificationInbox{
+		Unread:        unread,
+		Notifications: []*models.Notification{},
+	})
+}
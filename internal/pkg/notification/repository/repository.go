@@ -0,0 +1,254 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"forum/internal/dbtx"
+	myerror "forum/internal/error"
+	"forum/internal/models"
+	"strconv"
+	"strings"
+)
+
+type NotificationRepository struct {
+	DB *sql.DB
+}
+
+func NewNotificationRepository(DB *sql.DB) *NotificationRepository {
+	return &NotificationRepository{
+		DB: DB,
+	}
+}
+
+func (nr *NotificationRepository) Subscribe(ctx context.Context, nickname string, thread int64) (*models.Subscription, error) {
+	subscription := &models.Subscription{}
+	err := nr.DB.QueryRowContext(ctx, `INSERT INTO thread_subscription (nickname, thread)
+	VALUES ($1, $2) ON CONFLICT (thread, nickname)
+	DO
+	UPDATE
+	SET nickname = EXCLUDED.nickname RETURNING nickname, thread, created_at`, nickname, thread).
+		Scan(&subscription.Nickname, &subscription.Thread, &subscription.Created)
+	if err != nil {
+		return nil, myerror.NotExist
+	}
+
+	return subscription, nil
+}
+
+func (nr *NotificationRepository) Unsubscribe(ctx context.Context, nickname string, thread int64) error {
+	result, err := nr.DB.ExecContext(ctx, "DELETE FROM thread_subscription WHERE nickname = $1 AND thread = $2", nickname, thread)
+	if err != nil {
+		return myerror.InternalError
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil || deleted == 0 {
+		return myerror.NotExist
+	}
+
+	return nil
+}
+
+// FanOut creates the notifications for a batch of new posts: mentions first,
+// then replies to the parent author, then subscribers of the thread. A user
+// gets one notification per post, so a subscriber who is also mentioned only
+// sees the mention. Authors are never notified about their own posts.
+func (nr *NotificationRepository) FanOut(ctx context.Context, posts []*models.Post, mentionsOnly bool) error {
+	if len(posts) == 0 {
+		return nil
+	}
+
+	ids := make([]string, 0, len(posts))
+	for _, post := range posts {
+		ids = append(ids, fmt.Sprintf("'%d'", post.Id))
+	}
+	queries := fanOutQueries(strings.Join(ids, ", "), mentionsOnly)
+
+	err := dbtx.Run(ctx, nr.DB, func(tx *sql.Tx) error {
+		for _, query := range queries {
+			if _, err := tx.ExecContext(ctx, query); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return dbtx.Classify(err, myerror.InternalError)
+}
+
+// fanOutQueries insert the notifications for the posts selected by in, a
+// list of ids or a subquery.
+func fanOutQueries(in string, mentionsOnly bool) []string {
+	queries := []string{
+		fmt.Sprintf(`INSERT INTO notification (nickname, kind, post)
+		SELECT m.nickname, '%s', p.id FROM post AS p JOIN post_mention AS m ON m.post = p.id
+		WHERE p.id IN (%s) AND m.nickname <> p.author
+		ON CONFLICT (nickname, post) DO NOTHING`, models.NotificationMention, in),
+	}
+	if !mentionsOnly {
+		queries = append(queries,
+			fmt.Sprintf(`INSERT INTO notification (nickname, kind, post)
+			SELECT parent.author, '%s', p.id FROM post AS p JOIN post AS parent ON parent.id = p.parent
+			WHERE p.id IN (%s) AND parent.author <> p.author
+			ON CONFLICT (nickname, post) DO NOTHING`, models.NotificationReply, in),
+			fmt.Sprintf(`INSERT INTO notification (nickname, kind, post)
+			SELECT s.nickname, '%s', p.id FROM post AS p JOIN thread_subscription AS s ON s.thread = p.thread
+			WHERE p.id IN (%s) AND s.nickname <> p.author
+			ON CONFLICT (nickname, post) DO NOTHING`, models.NotificationPost, in),
+		)
+	}
+	return queries
+}
+
+// Defer keeps a batch for a later FanOutPending.
+func (nr *NotificationRepository) Defer(ctx context.Context, posts []*models.Post, mentionsOnly bool) error {
+	ids := make([]string, 0, len(posts))
+	for _, post := range posts {
+		ids = append(ids, strconv.FormatInt(post.Id, 10))
+	}
+
+	_, err := nr.DB.ExecContext(ctx, "INSERT INTO notification_pending (posts, mentions_only) VALUES ($1::BIGINT[], $2)",
+		"{"+strings.Join(ids, ",")+"}", mentionsOnly)
+	if err != nil {
+		return myerror.InternalError
+	}
+
+	return nil
+}
+
+// FanOutPending fans out up to limit deferred batches, oldest first, and
+// returns how many it took. Batches are removed in the transaction that
+// creates their notifications, so a failure leaves them for the next call.
+// Servers draining at the same time skip each other's batches.
+func (nr *NotificationRepository) FanOutPending(ctx context.Context, limit int64) (int, error) {
+	var drained int
+	err := dbtx.Run(ctx, nr.DB, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `SELECT id, mentions_only FROM notification_pending
+		ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED`, limit)
+		if err != nil {
+			return err
+		}
+
+		type pending struct {
+			id           int64
+			mentionsOnly bool
+		}
+		batches := []pending{}
+		for rows.Next() {
+			b := pending{}
+			if err := rows.Scan(&b.id, &b.mentionsOnly); err != nil {
+				rows.Close()
+				return err
+			}
+			batches = append(batches, b)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, b := range batches {
+			in := fmt.Sprintf("SELECT unnest(posts) FROM notification_pending WHERE id = %d", b.id)
+			for _, query := range fanOutQueries(in, b.mentionsOnly) {
+				if _, err := tx.ExecContext(ctx, query); err != nil {
+					return err
+				}
+			}
+			if _, err := tx.ExecContext(ctx, "DELETE FROM notification_pending WHERE id = $1", b.id); err != nil {
+				return err
+			}
+		}
+
+		drained = len(batches)
+		return nil
+	})
+	if err != nil {
+		return 0, dbtx.Classify(err, myerror.InternalError)
+	}
+
+	return drained, nil
+}
+
+// Select returns notifications newest first. Since is the id of the last
+// notification of the previous page.
+func (nr *NotificationRepository) Select(ctx context.Context, nickname string, limit int64, since int64, unreadOnly bool) ([]*models.Notification, error) {
+	query := `SELECT n.id, n.kind, n.post, p.thread, p.forum, p.author, n.created_at, n.is_read
+	FROM notification AS n JOIN post AS p ON p.id = n.post WHERE n.nickname = $1`
+	arr := []interface{}{
+		nickname,
+	}
+
+	if unreadOnly {
+		query += " AND NOT n.is_read"
+	}
+
+	if since > 0 {
+		query += fmt.Sprintf(" AND n.id < $%d", len(arr)+1)
+		arr = append(arr, since)
+	}
+
+	query += " ORDER BY n.id DESC"
+
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT $%d", len(arr)+1)
+		arr = append(arr, limit)
+	}
+
+	rows, err := nr.DB.QueryContext(ctx, query, arr...)
+	if err != nil {
+		return nil, myerror.DBSelectError
+	}
+	defer rows.Close()
+
+	notifications := []*models.Notification{}
+	for rows.Next() {
+		n := &models.Notification{}
+		if err := rows.Scan(&n.Id, &n.Kind, &n.Post, &n.Thread, &n.Forum, &n.Author, &n.Created, &n.IsRead); err != nil {
+			return nil, myerror.DBScanError
+		}
+		notifications = append(notifications, n)
+	}
+
+	return notifications, nil
+}
+
+func (nr *NotificationRepository) CountUnread(ctx context.Context, nickname string) (int64, error) {
+	var unread int64
+	err := nr.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM notification WHERE nickname = $1 AND NOT is_read", nickname).Scan(&unread)
+	if err != nil {
+		return 0, myerror.DBSelectError
+	}
+
+	return unread, nil
+}
+
+func (nr *NotificationRepository) MarkRead(ctx context.Context, nickname string, read *models.NotificationRead) (int64, error) {
+	query := "UPDATE notification SET is_read = TRUE WHERE nickname = $1 AND NOT is_read"
+	arr := []interface{}{
+		nickname,
+	}
+
+	if len(read.Ids) > 0 {
+		ids := make([]string, 0, len(read.Ids))
+		for _, id := range read.Ids {
+			ids = append(ids, fmt.Sprintf("'%d'", id))
+		}
+		query += fmt.Sprintf(" AND id IN (%s)", strings.Join(ids, ", "))
+	} else if read.Until > 0 {
+		query += fmt.Sprintf(" AND id <= $%d", len(arr)+1)
+		arr = append(arr, read.Until)
+	}
+
+	result, err := nr.DB.ExecContext(ctx, query, arr...)
+	if err != nil {
+		return 0, myerror.DBUpdateError
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return 0, myerror.DBUpdateError
+	}
+
+	return updated, nil
+}
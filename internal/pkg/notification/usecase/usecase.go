@@ -0,0 +1,268 @@
+package usecase
+
+import (
+	"context"
+	"forum/internal/models"
+	"forum/internal/pkg/notification/repository"
+	threadRepository "forum/internal/pkg/thread/repository"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	myerror "forum/internal/error"
+)
+
+// queueSize is the number of post batches waiting for fan-out in memory. When
+// the queue is full new batches go to notification_pending rather than
+// holding up post creation.
+const queueSize = 1024
+
+// fanOutWorkers drain the queue concurrently, a slow fan-out of one batch
+// does not hold up the others.
+const fanOutWorkers = 4
+
+// drainInterval is how often deferred batches are picked up, pendingBatch how
+// many are taken per transaction.
+const (
+	drainInterval = time.Second
+	pendingBatch  = 32
+)
+
+type batch struct {
+	posts []*models.Post
+	// edited posts only notify users mentioned in the new message
+	mentionsOnly bool
+}
+
+type NotificationUsecase struct {
+	nr    *repository.NotificationRepository
+	tr    *threadRepository.ThreadRepository
+	queue chan batch
+
+	// mu guards closed, no batch is queued once the queue is closed
+	mu     sync.RWMutex
+	closed bool
+	// done stops drainPending, hurry makes the workers defer what is left
+	done    chan struct{}
+	hurry   chan struct{}
+	workers sync.WaitGroup
+
+	fannedOut int64
+	deferred  int64
+	failed    int64
+	dropped   int64
+}
+
+func NewNotificationUsecase(nr *repository.NotificationRepository, tr *threadRepository.ThreadRepository) *NotificationUsecase {
+	nu := &NotificationUsecase{
+		nr:    nr,
+		tr:    tr,
+		queue: make(chan batch, queueSize),
+		done:  make(chan struct{}),
+		hurry: make(chan struct{}),
+	}
+	nu.workers.Add(fanOutWorkers + 1)
+	for i := 0; i < fanOutWorkers; i++ {
+		go nu.fanOut()
+	}
+	go nu.drainPending()
+
+	return nu
+}
+
+// Close stops the fan-out. Batches still queued are fanned out first, those
+// left when ctx is done are deferred to notification_pending for the next
+// run of the server. Batches of posts created after Close are deferred as
+// well. Close waits for the workers and returns the error of ctx when it had
+// to defer.
+func (nu *NotificationUsecase) Close(ctx context.Context) error {
+	nu.mu.Lock()
+	if nu.closed {
+		nu.mu.Unlock()
+		return nil
+	}
+	nu.closed = true
+	close(nu.queue)
+	close(nu.done)
+	nu.mu.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		nu.workers.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		close(nu.hurry)
+		<-stopped
+		return ctx.Err()
+	}
+}
+
+// Notify queues created posts for fan-out and returns immediately. Mentions
+// are read from the mention index, so they have to be stored before.
+func (nu *NotificationUsecase) Notify(posts []*models.Post) {
+	nu.enqueue(batch{posts: posts})
+}
+
+// NotifyMentions queues edited posts, only users mentioned in the new message
+// who were not notified about the post yet get a notification.
+func (nu *NotificationUsecase) NotifyMentions(posts []*models.Post) {
+	nu.enqueue(batch{posts: posts, mentionsOnly: true})
+}
+
+func (nu *NotificationUsecase) enqueue(b batch) {
+	if len(b.posts) == 0 {
+		return
+	}
+
+	nu.mu.RLock()
+	queued := false
+	if !nu.closed {
+		select {
+		case nu.queue <- b:
+			queued = true
+		default:
+		}
+	}
+	nu.mu.RUnlock()
+
+	if !queued {
+		nu.deferBatch(b)
+	}
+}
+
+// deferBatch stores a batch in one insert instead of waiting for a worker,
+// drainPending fans it out. Fan-out outlives the request, so none of it runs
+// in its context.
+func (nu *NotificationUsecase) deferBatch(b batch) {
+	if err := nu.nr.Defer(context.Background(), b.posts, b.mentionsOnly); err != nil {
+		atomic.AddInt64(&nu.dropped, 1)
+		log.Printf("can not defer notifications, dropped %d posts: %v", len(b.posts), err)
+		return
+	}
+	atomic.AddInt64(&nu.deferred, 1)
+}
+
+func (nu *NotificationUsecase) fanOut() {
+	defer nu.workers.Done()
+
+	for b := range nu.queue {
+		select {
+		case <-nu.hurry:
+			nu.deferBatch(b)
+			continue
+		default:
+		}
+
+		if err := nu.nr.FanOut(context.Background(), b.posts, b.mentionsOnly); err != nil {
+			atomic.AddInt64(&nu.failed, 1)
+			log.Printf("notification fan-out of %d posts failed: %v", len(b.posts), err)
+			continue
+		}
+		atomic.AddInt64(&nu.fannedOut, 1)
+	}
+}
+
+// drainPending fans out deferred batches, also those left by a previous run
+// of the server.
+func (nu *NotificationUsecase) drainPending() {
+	defer nu.workers.Done()
+
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-nu.done:
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			drained, err := nu.nr.FanOutPending(context.Background(), pendingBatch)
+			if err != nil {
+				atomic.AddInt64(&nu.failed, 1)
+				log.Printf("fan-out of deferred notifications failed: %v", err)
+				break
+			}
+			atomic.AddInt64(&nu.fannedOut, int64(drained))
+			if drained < pendingBatch {
+				break
+			}
+		}
+	}
+}
+
+// Stats returns the fan-out counters since start.
+func (nu *NotificationUsecase) Stats() *models.NotificationStats {
+	return &models.NotificationStats{
+		Queued:    int64(len(nu.queue)),
+		FannedOut: atomic.LoadInt64(&nu.fannedOut),
+		Deferred:  atomic.LoadInt64(&nu.deferred),
+		Failed:    atomic.LoadInt64(&nu.failed),
+		Dropped:   atomic.LoadInt64(&nu.dropped),
+	}
+}
+
+func (nu *NotificationUsecase) resolveThread(ctx context.Context, slug_or_id string) (int64, error) {
+	if id, err := strconv.Atoi(slug_or_id); err == nil {
+		return int64(id), nil
+	}
+
+	pId, _, err := nu.tr.SelectThreadIdForumBySlug(ctx, slug_or_id)
+	if err != nil {
+		return 0, myerror.NotExist
+	}
+
+	return *pId, nil
+}
+
+func (nu *NotificationUsecase) Subscribe(ctx context.Context, slug_or_id string, nickname string) (*models.Subscription, error) {
+	thread, err := nu.resolveThread(ctx, slug_or_id)
+	if err != nil {
+		return nil, err
+	}
+
+	return nu.nr.Subscribe(ctx, nickname, thread)
+}
+
+func (nu *NotificationUsecase) Unsubscribe(ctx context.Context, slug_or_id string, nickname string) error {
+	thread, err := nu.resolveThread(ctx, slug_or_id)
+	if err != nil {
+		return err
+	}
+
+	return nu.nr.Unsubscribe(ctx, nickname, thread)
+}
+
+func (nu *NotificationUsecase) GetInbox(ctx context.Context, nickname string, limit int64, since int64, unreadOnly bool) (*models.NotificationInbox, error) {
+	notifications, err := nu.nr.Select(ctx, nickname, limit, since, unreadOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	unread, err := nu.nr.CountUnread(ctx, nickname)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.NotificationInbox{
+		Unread:        unread,
+		Notifications: notifications,
+	}, nil
+}
+
+// MarkRead returns the number of notifications still unread afterwards.
+func (nu *NotificationUsecase) MarkRead(ctx context.Context, nickname string, read *models.NotificationRead) (int64, error) {
+	if _, err := nu.nr.MarkRead(ctx, nickname, read); err != nil {
+		return 0, err
+	}
+
+	return nu.nr.CountUnread(ctx, nickname)
+}
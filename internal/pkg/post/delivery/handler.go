@@ -2,11 +2,15 @@ package delivery
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 
+	"forum/internal/cursor"
+	"forum/internal/include"
+	"forum/internal/markdown"
 	"forum/internal/models"
 	forum "forum/internal/pkg/forum/usecase"
 	"forum/internal/pkg/post/usecase"
@@ -23,14 +27,16 @@ type PostHandler struct {
 	uu *user.UserUsecase
 	tu *thread.ThreadUsecase
 	fu *forum.ForumUsecase
+	md *markdown.Renderer
 }
 
-func NewPostHandler(pu *usecase.PostUsecase, uu *user.UserUsecase, tu *thread.ThreadUsecase, fu *forum.ForumUsecase) *PostHandler {
+func NewPostHandler(pu *usecase.PostUsecase, uu *user.UserUsecase, tu *thread.ThreadUsecase, fu *forum.ForumUsecase, md *markdown.Renderer) *PostHandler {
 	return &PostHandler{
 		pu: pu,
 		uu: uu,
 		tu: tu,
 		fu: fu,
+		md: md,
 	}
 }
 
@@ -39,6 +45,11 @@ func (ph *PostHandler) Routing(r *mux.Router) {
 	r.HandleFunc(`/thread/{slug_or_id}/posts`, http.HandlerFunc(ph.GetAllPostsInThread)).Methods(http.MethodGet)
 	r.HandleFunc(`/post/{id}/details`, http.HandlerFunc(ph.GetPost)).Methods(http.MethodGet)
 	r.HandleFunc(`/post/{id}/details`, http.HandlerFunc(ph.UpdatePost)).Methods(http.MethodPost)
+	r.HandleFunc(`/post/{id}/replies`, http.HandlerFunc(ph.GetReplies)).Methods(http.MethodGet)
+	r.HandleFunc(`/post/{id}/ancestors`, http.HandlerFunc(ph.GetAncestors)).Methods(http.MethodGet)
+	r.HandleFunc(`/post/{id}/context`, http.HandlerFunc(ph.GetContext)).Methods(http.MethodGet)
+	r.HandleFunc(`/user/{nickname}/posts`, http.HandlerFunc(ph.GetUserPosts)).Methods(http.MethodGet)
+	r.HandleFunc(`/user/{nickname}/mentions`, http.HandlerFunc(ph.GetUserMentions)).Methods(http.MethodGet)
 }
 
 func (ph *PostHandler) CreatePosts(w http.ResponseWriter, r *http.Request) {
@@ -55,7 +66,7 @@ func (ph *PostHandler) CreatePosts(w http.ResponseWriter, r *http.Request) {
 
 	slug_or_id := mux.Vars(r)["slug_or_id"]
 
-	createdThread, createErr := ph.pu.CreateAll(posts, slug_or_id)
+	createdThread, createErr := ph.pu.CreateAll(r.Context(), posts, slug_or_id)
 	if createErr == myerror.ConflictError {
 		w.WriteHeader(http.StatusConflict)
 		json.NewEncoder(w).Encode(createErr)
@@ -67,6 +78,9 @@ func (ph *PostHandler) CreatePosts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if markdown.Requested(r) {
+		ph.md.Posts(createdThread...)
+	}
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(createdThread)
 }
@@ -89,7 +103,30 @@ func (ph *PostHandler) GetAllPostsInThread(w http.ResponseWriter, r *http.Reques
 		isDescOrder = true
 	}
 
-	selectedPosts, selectErr := ph.pu.GetAll(slug_or_id, limit, since, sort, isDescOrder)
+	if query.Get("format") == "nested" {
+		maxDepth, _ := strconv.Atoi(query.Get("max_depth"))
+		childLimit, _ := strconv.Atoi(query.Get("child_limit"))
+
+		tree, selectErr := ph.pu.GetAllNested(r.Context(), slug_or_id, limit, since, sort, isDescOrder, maxDepth, childLimit)
+		if selectErr == myerror.NotExist {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(selectErr)
+			return
+		}
+		if selectErr != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(selectErr)
+			return
+		}
+		if markdown.Requested(r) {
+			ph.md.PostTree(tree)
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(tree)
+		return
+	}
+
+	selectedPosts, selectErr := ph.pu.GetAll(r.Context(), slug_or_id, limit, since, sort, isDescOrder)
 	if selectErr == myerror.NotExist {
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(selectErr)
@@ -100,6 +137,9 @@ func (ph *PostHandler) GetAllPostsInThread(w http.ResponseWriter, r *http.Reques
 		json.NewEncoder(w).Encode(selectErr)
 		return
 	}
+	if markdown.Requested(r) {
+		ph.md.Posts(selectedPosts...)
+	}
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(selectedPosts)
 }
@@ -118,12 +158,15 @@ func (ph *PostHandler) UpdatePost(w http.ResponseWriter, r *http.Request) {
 
 	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 
-	updatedPost, updateErr := ph.pu.Update(id, postToUpdate)
+	updatedPost, updateErr := ph.pu.Update(r.Context(), id, postToUpdate)
 	if updateErr != nil {
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(postToUpdate)
 		return
 	}
+	if markdown.Requested(r) {
+		ph.md.Posts(updatedPost)
+	}
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(updatedPost)
 }
@@ -134,56 +177,242 @@ func (ph *PostHandler) GetPost(w http.ResponseWriter, r *http.Request) {
 
 	u, _ := url.Parse(r.URL.RequestURI())
 	query := u.Query()
-	related := query.Get("related")
+
+	// related is lenient like the original API, include is checked
+	related := include.ParseKnown(query.Get("related"), "user", "thread", "forum")
+	included, parseErr := include.Parse(query.Get("include"), "user", "thread", "forum")
+	if parseErr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(parseErr)
+		return
+	}
+	for relation := range included {
+		related[relation] = true
+	}
+
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+	post, selectErr := ph.pu.Get(r.Context(), id)
+	if selectErr == myerror.NotExist {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(selectErr)
+		return
+	}
+
+	full := models.PostFull{Post: post}
+	wg := sync.WaitGroup{}
+
+	if related.Has("user") {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			full.Author, _ = ph.uu.GetByNickname(r.Context(), post.Author)
+		}()
+	}
+
+	if related.Has("thread") {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			full.Thread, _ = ph.tu.Get(r.Context(), post.Thread)
+		}()
+	}
+
+	if related.Has("forum") {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			full.Forum, _ = ph.fu.GetBySlug(r.Context(), post.Forum)
+		}()
+	}
+
+	wg.Wait()
+
+	if markdown.Requested(r) {
+		ph.md.Posts(full.Post)
+		ph.md.Threads(full.Thread)
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(full)
+}
+
+func (ph *PostHandler) GetReplies(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+	u, _ := url.Parse(r.URL.RequestURI())
+	query := u.Query()
+
+	limit, _ := strconv.ParseInt(query.Get("limit"), 10, 64)
+	since, _ := strconv.ParseInt(query.Get("since"), 10, 64)
+	isDescOrder := query.Get("desc") == "true"
+
+	replies, selectErr := ph.pu.GetReplies(r.Context(), id, limit, since, isDescOrder)
+	if selectErr == myerror.NotExist {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(selectErr)
+		return
+	}
+	if selectErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(selectErr)
+		return
+	}
+
+	if markdown.Requested(r) {
+		ph.md.Posts(replies...)
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(replies)
+}
+
+func (ph *PostHandler) GetAncestors(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+	u, _ := url.Parse(r.URL.RequestURI())
+	limit, _ := strconv.ParseInt(u.Query().Get("limit"), 10, 64)
+
+	ancestors, selectErr := ph.pu.GetAncestors(r.Context(), id, limit)
+	if selectErr == myerror.NotExist {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(selectErr)
+		return
+	}
+	if selectErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(selectErr)
+		return
+	}
+
+	if markdown.Requested(r) {
+		ph.md.Posts(ancestors...)
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ancestors)
+}
+
+func (ph *PostHandler) GetContext(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
 
 	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
-	var user *models.User
-	user = nil
-	var thread *models.Thread
-	thread = nil
-	var forum *models.Forum
-	forum = nil
-
-	post, selectErr := ph.pu.Get(id)
+
+	u, _ := url.Parse(r.URL.RequestURI())
+	n, err := strconv.ParseInt(u.Query().Get("n"), 10, 64)
+	if err != nil || n <= 0 {
+		n = 5
+	}
+
+	postContext, selectErr := ph.pu.GetContext(r.Context(), id, n)
 	if selectErr == myerror.NotExist {
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(selectErr)
 		return
 	}
+	if selectErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(selectErr)
+		return
+	}
 
-	if related == "user" {
-		user, _ = ph.uu.GetByNickname(post.Author)
+	if markdown.Requested(r) {
+		ph.md.Posts(postContext.Post)
+		ph.md.Posts(postContext.Ancestors...)
+		ph.md.Posts(postContext.SiblingsBefore...)
+		ph.md.Posts(postContext.SiblingsAfter...)
 	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(postContext)
+}
 
-	if related == "thread" {
-		thread, _ = ph.tu.GetBySlugOrId(fmt.Sprintf("%d", post.Thread))
+func (ph *PostHandler) GetUserPosts(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	nickname := mux.Vars(r)["nickname"]
+
+	u, _ := url.Parse(r.URL.RequestURI())
+
+	filter, err := cursor.ParseAuthorFilter(u.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(err)
+		return
 	}
 
-	if related == "forum" {
-		forum, _ = ph.fu.GetBySlug(post.Forum)
+	author, err := ph.uu.GetByNickname(r.Context(), nickname)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(myerror.UNotFound)
+		return
+	}
+	if !strings.EqualFold(author.Nickname, nickname) {
+		u.Path = "/api/user/" + author.Nickname + "/posts"
+		w.Header().Set("Location", u.RequestURI())
+		w.WriteHeader(http.StatusMovedPermanently)
+		return
 	}
 
-	if related == "user,thread" {
-		user, _ = ph.uu.GetByNickname(post.Author)
-		thread, _ = ph.tu.GetBySlugOrId(fmt.Sprintf("%d", post.Thread))
+	if filter.Forum != "" {
+		if current, resolveErr := ph.fu.ResolveSlug(r.Context(), filter.Forum); resolveErr == nil {
+			filter.Forum = current
+		}
 	}
 
-	if related == "thread,forum" {
-		thread, _ = ph.tu.GetBySlugOrId(fmt.Sprintf("%d", post.Thread))
-		forum, _ = ph.fu.GetBySlug(post.Forum)
+	posts, next, selectErr := ph.pu.GetByAuthor(r.Context(), author.Nickname, filter)
+	if selectErr == myerror.InvalidCursor {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(selectErr)
+		return
+	}
+	if selectErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(selectErr)
+		return
 	}
 
-	if related == "user,forum" {
-		user, _ = ph.uu.GetByNickname(post.Author)
-		forum, _ = ph.fu.GetBySlug(post.Forum)
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+	if markdown.Requested(r) {
+		ph.md.Posts(posts...)
 	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(posts)
+}
 
-	if related == "user,thread,forum" {
-		user, _ = ph.uu.GetByNickname(post.Author)
-		thread, _ = ph.tu.GetBySlugOrId(fmt.Sprintf("%d", post.Thread))
-		forum, _ = ph.fu.GetBySlug(post.Forum)
+func (ph *PostHandler) GetUserMentions(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	user, err := ph.uu.GetByNickname(r.Context(), mux.Vars(r)["nickname"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(myerror.UNotFound)
+		return
 	}
 
+	u, _ := url.Parse(r.URL.RequestURI())
+	query := u.Query()
+
+	limit, _ := strconv.ParseInt(query.Get("limit"), 10, 64)
+	since, _ := strconv.ParseInt(query.Get("since"), 10, 64)
+
+	posts, selectErr := ph.pu.GetMentioning(r.Context(), user.Nickname, limit, since)
+	if selectErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(selectErr)
+		return
+	}
+
+	if markdown.Requested(r) {
+		ph.md.Posts(posts...)
+	}
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(models.PostFull{Post: post, Author: user, Thread: thread, Forum: forum})
+	json.NewEncoder(w).Encode(posts)
 }
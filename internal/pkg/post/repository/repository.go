@@ -3,11 +3,17 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"forum/internal/cursor"
+	"forum/internal/dbtx"
 	myerror "forum/internal/error"
 	"forum/internal/models"
+	"strings"
 )
 
+const postColumns = "id, parent, author, message, is_edited, forum, thread, created_at, score, reactions::TEXT"
+
 type PostRepository struct {
 	DB *sql.DB
 }
@@ -18,12 +24,7 @@ func NewPostRepository(DB *sql.DB) *PostRepository {
 	}
 }
 
-func (pr *PostRepository) InsertAll(posts []*models.Post) ([]*models.Post, error) {
-	tx, err := pr.DB.BeginTx(context.Background(), nil)
-	if err != nil {
-		return nil, myerror.InternalError
-	}
-
+func (pr *PostRepository) InsertAll(ctx context.Context, posts []*models.Post) ([]*models.Post, error) {
 	query := `INSERT INTO post (parent, author, message, is_edited, forum, thread, created_at)
 	VALUES`
 	arr := []interface{}{}
@@ -43,30 +44,28 @@ func (pr *PostRepository) InsertAll(posts []*models.Post) ([]*models.Post, error
 		arr = append(arr, post.Created)
 		first = false
 	}
-	query += " RETURNING id, parent, author, message, is_edited, forum, thread, created_at;"
-	rows, err := tx.Query(query, arr...)
-	defer rows.Close()
-
-	if err != nil {
-		tx.Rollback()
-		return nil, myerror.ConflictError
-	}
+	query += " RETURNING " + postColumns + ";"
 
-	i := 0
-	newPosts := []*models.Post{}
-	for rows.Next() {
-		newPost := models.Post{}
-		if err := rows.Scan(&newPost.Id, &newPost.Parent, &newPost.Author, &newPost.Message, &newPost.IsEdited, &newPost.Forum, &newPost.Thread, &newPost.Created); err != nil {
-			tx.Rollback()
-			return nil, myerror.InsertError
+	var newPosts []*models.Post
+	err := dbtx.Run(ctx, pr.DB, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, query, arr...)
+		if err != nil {
+			return err
 		}
-		i++
-		newPosts = append(newPosts, &newPost)
-	}
-
-	err = tx.Commit()
+		defer rows.Close()
+
+		newPosts = []*models.Post{}
+		for rows.Next() {
+			newPost, err := scanPost(rows)
+			if err != nil {
+				return dbtx.Fail(err, myerror.InsertError)
+			}
+			newPosts = append(newPosts, newPost)
+		}
+		return rows.Err()
+	})
 	if err != nil {
-		return nil, myerror.NotExist
+		return nil, dbtx.Classify(err, myerror.NotExist)
 	}
 
 	if len(newPosts) != len(posts) {
@@ -76,8 +75,10 @@ func (pr *PostRepository) InsertAll(posts []*models.Post) ([]*models.Post, error
 	return newPosts, nil
 }
 
-func (fr *PostRepository) SelectAllFlat(thread int32, limit int64, since int64, isDescOrder bool) ([]*models.Post, error) {
-	query := "SELECT id, parent, author, message, is_edited, forum, thread, created_at FROM post WHERE thread = $1"
+// flatQuery orders the posts of a thread by creation, since is the id of the
+// last post of the previous page.
+func flatQuery(thread int32, limit int64, since int64, isDescOrder bool) (string, []interface{}) {
+	query := "SELECT " + postColumns + " FROM post WHERE thread = $1"
 	arr := []interface{}{
 		thread,
 	}
@@ -108,24 +109,21 @@ func (fr *PostRepository) SelectAllFlat(thread int32, limit int64, since int64,
 		arr = append(arr, limit)
 	}
 
-	rows, _ := fr.DB.Query(query, arr...)
-	defer rows.Close()
+	return query, arr
+}
 
-	posts := []*models.Post{}
-	for rows.Next() {
+func (fr *PostRepository) SelectAllFlat(ctx context.Context, thread int32, limit int64, since int64, isDescOrder bool) ([]*models.Post, error) {
+	query, arr := flatQuery(thread, limit, since, isDescOrder)
 
-		post := models.Post{}
-		if err := rows.Scan(&post.Id, &post.Parent, &post.Author, &post.Message, &post.IsEdited, &post.Forum, &post.Thread, &post.Created); err != nil {
-			return nil, myerror.InternalError
-		}
-		posts = append(posts, &post)
-	}
+	rows, _ := fr.DB.QueryContext(ctx, query, arr...)
+	defer rows.Close()
 
-	return posts, nil
+	return scanPosts(rows)
 }
 
-func (fr *PostRepository) SelectAllTree(thread int32, limit int64, since int64, isDescOrder bool) ([]*models.Post, error) {
-	query := "SELECT id, parent, author, message, is_edited, forum, thread, created_at FROM post WHERE thread = $1"
+// treeQuery orders the posts of a thread depth first.
+func treeQuery(thread int32, limit int64, since int64, isDescOrder bool) (string, []interface{}) {
+	query := "SELECT " + postColumns + " FROM post WHERE thread = $1"
 	arr := []interface{}{
 		thread,
 	}
@@ -153,22 +151,22 @@ func (fr *PostRepository) SelectAllTree(thread int32, limit int64, since int64,
 		arr = append(arr, limit)
 	}
 
-	rows, _ := fr.DB.Query(query, arr...)
+	return query, arr
+}
+
+func (fr *PostRepository) SelectAllTree(ctx context.Context, thread int32, limit int64, since int64, isDescOrder bool) ([]*models.Post, error) {
+	query, arr := treeQuery(thread, limit, since, isDescOrder)
+
+	rows, _ := fr.DB.QueryContext(ctx, query, arr...)
 	defer rows.Close()
 
-	posts := []*models.Post{}
-	for rows.Next() {
-		post := models.Post{}
-		if err := rows.Scan(&post.Id, &post.Parent, &post.Author, &post.Message, &post.IsEdited, &post.Forum, &post.Thread, &post.Created); err != nil {
-			return nil, myerror.InternalError
-		}
-		posts = append(posts, &post)
-	}
-	return posts, nil
+	return scanPosts(rows)
 }
 
-func (fr *PostRepository) SelectAllParentTree(thread int32, limit int64, since int64, isDescOrder bool) ([]*models.Post, error) {
-	query := "SELECT id, parent, author, message, is_edited, forum, thread, created_at FROM post AS temp WHERE thread = $1"
+// parentTreeQuery orders the posts of a thread depth first, limit and since
+// apply to root posts.
+func parentTreeQuery(thread int32, limit int64, since int64, isDescOrder bool) (string, []interface{}) {
+	query := "SELECT " + postColumns + " FROM post AS temp WHERE thread = $1"
 	arr := []interface{}{
 		thread,
 	}
@@ -199,36 +197,94 @@ func (fr *PostRepository) SelectAllParentTree(thread int32, limit int64, since i
 
 	query += ", (array_append(path, id))[2:]"
 
-	rows, _ := fr.DB.Query(query, arr...)
+	return query, arr
+}
+
+func (fr *PostRepository) SelectAllParentTree(ctx context.Context, thread int32, limit int64, since int64, isDescOrder bool) ([]*models.Post, error) {
+	query, arr := parentTreeQuery(thread, limit, since, isDescOrder)
+
+	rows, _ := fr.DB.QueryContext(ctx, query, arr...)
 	defer rows.Close()
 
-	posts := []*models.Post{}
-	for rows.Next() {
+	return scanPosts(rows)
+}
 
-		post := models.Post{}
-		if err := rows.Scan(&post.Id, &post.Parent, &post.Author, &post.Message, &post.IsEdited, &post.Forum, &post.Thread, &post.Created); err != nil {
-			return nil, myerror.InternalError
-		}
-		posts = append(posts, &post)
+// topQuery orders root posts by score and keeps replies nested under them in
+// tree order. Like the other sorts desc=false is ascending and desc=true
+// descending, ties go by id in the same direction. Limit counts root posts
+// like in parent_tree, since is a post whose root the page starts after.
+// Scores change with votes, so a page starts after the current score of that
+// root rather than after the position it had on the previous page.
+func topQuery(thread int32, limit int64, since int64, isDescOrder bool) (string, []interface{}) {
+	var order string
+	var sign string
+	if isDescOrder {
+		order = "DESC"
+		sign = "<"
+	} else {
+		order = "ASC"
+		sign = ">"
 	}
-	return posts, nil
+
+	rootQuery := "SELECT id, score FROM post WHERE thread = $1 AND parent = 0"
+	arr := []interface{}{
+		thread,
+	}
+
+	if since > 0 {
+		rootQuery += fmt.Sprintf(` AND (score, id) %s (SELECT root.score, root.id FROM post AS since
+		JOIN post AS root ON root.id = COALESCE(since.path[1], since.id) WHERE since.id = $%d)`, sign, len(arr)+1)
+		arr = append(arr, since)
+	}
+
+	rootQuery += fmt.Sprintf(" ORDER BY score %s, id %s", order, order)
+
+	if limit > 0 {
+		rootQuery += fmt.Sprintf(" LIMIT $%d", len(arr)+1)
+		arr = append(arr, limit)
+	}
+
+	query := fmt.Sprintf(`SELECT %s FROM post AS p JOIN (%s) AS root ON root.id = COALESCE(p.path[1], p.id)
+	WHERE p.thread = $1
+	ORDER BY root.score %s, root.id %s, array_append(p.path, p.id)`, qualified("p", postColumns), rootQuery, order, order)
+
+	return query, arr
 }
 
-func (pr *PostRepository) Get(id int64) (*models.Post, error) {
-	row := pr.DB.QueryRow(`SELECT parent, author, message, is_edited, forum, thread, created_at FROM post WHERE id = $1`, id)
+// qualified prefixes every column of a column list with table, for lists
+// like postColumns used in joins.
+func qualified(table string, columns string) string {
+	parts := strings.Split(columns, ", ")
+	for i, part := range parts {
+		parts[i] = table + "." + part
+	}
+	return strings.Join(parts, ", ")
+}
 
-	post := models.Post{
-		Id: id,
+func (fr *PostRepository) SelectAllTop(ctx context.Context, thread int32, limit int64, since int64, isDescOrder bool) ([]*models.Post, error) {
+	query, arr := topQuery(thread, limit, since, isDescOrder)
+
+	rows, err := fr.DB.QueryContext(ctx, query, arr...)
+	if err != nil {
+		return nil, myerror.InternalError
 	}
-	err := row.Scan(&post.Parent, &post.Author, &post.Message, &post.IsEdited, &post.Forum, &post.Thread, &post.Created)
+	defer rows.Close()
+
+	return scanPosts(rows)
+}
+
+func (pr *PostRepository) Get(ctx context.Context, id int64) (*models.Post, error) {
+	row := pr.DB.QueryRowContext(ctx, `SELECT `+postColumns+` FROM post WHERE id = $1`, id)
+
+	post, err := scanPost(row)
 	if err != nil {
 		return nil, myerror.NotExist
 	}
 
-	return &post, nil
+	return post, nil
 }
 
-func (pr *PostRepository) Check(ids []int64, forum string) (bool, error) {
+func (pr *PostRepository) Check(ctx context.Context, ids []int64, forum string) (bool, error) {
 	query := fmt.Sprintf("select %d = (select count(*) from post where forum=$1 and id in (", len(ids))
 	isFirst := true
 	for _, id := range ids {
@@ -240,7 +296,7 @@ func (pr *PostRepository) Check(ids []int64, forum string) (bool, error) {
 		}
 	}
 	query += "))"
-	row := pr.DB.QueryRow(query, forum)
+	row := pr.DB.QueryRowContext(ctx, query, forum)
 
 	noConflict := false
 	err := row.Scan(&noConflict)
@@ -251,25 +307,407 @@ func (pr *PostRepository) Check(ids []int64, forum string) (bool, error) {
 	return noConflict, nil
 }
 
-func (pr *PostRepository) Update(id int64, postToUpdate *models.PostUpdate) (*models.Post, error) {
-	tx, err := pr.DB.BeginTx(context.Background(), nil)
+func (pr *PostRepository) Update(ctx context.Context, id int64, postToUpdate *models.PostUpdate) (*models.Post, error) {
+	var newPost *models.Post
+	err := dbtx.Run(ctx, pr.DB, func(tx *sql.Tx) error {
+		var err error
+		newPost, err = scanPost(tx.QueryRowContext(ctx, `UPDATE post SET message = COALESCE($2, message), is_edited=(CASE WHEN $2 IS NULL OR message=$2 THEN is_edited ELSE true END) WHERE id = $1
+		RETURNING `+postColumns, id, postToUpdate.Message))
+		return err
+	})
+	if err != nil {
+		return nil, dbtx.Classify(err, myerror.BadUpdate)
+	}
+
+	return newPost, nil
+}
+
+func (pr *PostRepository) CountReplies(ctx context.Context, ids []int64) (map[int64]int64, error) {
+	counts := map[int64]int64{}
+	if len(ids) == 0 {
+		return counts, nil
+	}
+
+	query := "SELECT parent, count(*) FROM post WHERE parent IN ("
+	isFirst := true
+	for _, id := range ids {
+		if isFirst {
+			query += fmt.Sprintf("'%d'", id)
+			isFirst = false
+		} else {
+			query += fmt.Sprintf(", '%d'", id)
+		}
+	}
+	query += ") GROUP BY parent"
+
+	rows, err := pr.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, myerror.InternalError
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var parent, count int64
+		if err := rows.Scan(&parent, &count); err != nil {
+			return nil, myerror.InternalError
+		}
+		counts[parent] = count
+	}
+
+	return counts, nil
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanPost(row scanner) (*models.Post, error) {
+	post := &models.Post{}
+	var reactions string
+	err := row.Scan(&post.Id, &post.Parent, &post.Author, &post.Message, &post.IsEdited, &post.Forum, &post.Thread, &post.Created, &post.Score, &reactions)
+	if err != nil {
+		return nil, err
+	}
+
+	if reactions != "{}" && reactions != "" {
+		if err := json.Unmarshal([]byte(reactions), &post.Reactions); err != nil {
+			return nil, err
+		}
+	}
+
+	return post, nil
+}
+
+func scanPosts(rows *sql.Rows) ([]*models.Post, error) {
+	posts := []*models.Post{}
+	for rows.Next() {
+		post, err := scanPost(rows)
+		if err != nil {
+			return nil, myerror.InternalError
+		}
+		posts = append(posts, post)
+	}
+	return posts, nil
+}
+
+func (pr *PostRepository) SelectReplies(ctx context.Context, id int64, limit int64, since int64, isDescOrder bool) ([]*models.Post, error) {
+	query := `SELECT ` + postColumns + ` FROM post
+	WHERE thread = (SELECT thread FROM post WHERE id = $1) AND path @> ARRAY[$1::BIGINT]`
+	arr := []interface{}{
+		id,
+	}
+
+	var order string
+	var sign string
+	if isDescOrder {
+		order = "DESC"
+		sign = "<"
+	} else {
+		order = "ASC"
+		sign = ">"
+	}
+
+	if since > 0 {
+		query += fmt.Sprintf(" AND array_append(path, id) %s (SELECT array_append(path, id) FROM post WHERE id = $%d)", sign, len(arr)+1)
+		arr = append(arr, since)
+	}
+
+	query += " ORDER BY array_append(path, id) " + order
+
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT $%d", len(arr)+1)
+		arr = append(arr, limit)
+	}
+
+	rows, err := pr.DB.QueryContext(ctx, query, arr...)
+	if err != nil {
+		return nil, myerror.InternalError
+	}
+	defer rows.Close()
+
+	return scanPosts(rows)
+}
+
+// SelectAncestors returns up to limit nearest ancestors of the post, ordered
+// from the thread root down to the direct parent.
+func (pr *PostRepository) SelectAncestors(ctx context.Context, id int64, limit int64) ([]*models.Post, error) {
+	query := `SELECT ` + postColumns + ` FROM post
+	WHERE id IN (SELECT unnest(path) FROM post WHERE id = $1) ORDER BY cardinality(path) DESC`
+	arr := []interface{}{
+		id,
+	}
+
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT $%d", len(arr)+1)
+		arr = append(arr, limit)
+	}
+
+	rows, err := pr.DB.QueryContext(ctx, query, arr...)
 	if err != nil {
 		return nil, myerror.InternalError
 	}
+	defer rows.Close()
 
-	newPost := &models.Post{}
-	err = tx.QueryRow(`UPDATE post SET message = COALESCE($2, message), is_edited=(CASE WHEN $2 IS NULL OR message=$2 THEN is_edited ELSE true END) WHERE id = $1
-	RETURNING id, parent, author, message, is_edited, forum, thread, created_at`, id, postToUpdate.Message).
-		Scan(&newPost.Id, &newPost.Parent, &newPost.Author, &newPost.Message, &newPost.IsEdited, &newPost.Forum, &newPost.Thread, &newPost.Created)
+	posts, err := scanPosts(rows)
 	if err != nil {
-		tx.Rollback()
-		return nil, myerror.BadUpdate
+		return nil, err
 	}
 
-	err = tx.Commit()
+	for i, j := 0, len(posts)-1; i < j; i, j = i+1, j-1 {
+		posts[i], posts[j] = posts[j], posts[i]
+	}
+	return posts, nil
+}
+
+// SelectSiblings returns up to limit posts sharing the parent of the given
+// one, created right before and right after it.
+func (pr *PostRepository) SelectSiblings(ctx context.Context, post *models.Post, limit int64) ([]*models.Post, []*models.Post, error) {
+	query := `SELECT ` + postColumns + ` FROM post
+	WHERE thread = $1 AND parent = $2 AND id %s $3 ORDER BY id %s LIMIT $4`
+
+	rows, err := pr.DB.QueryContext(ctx, fmt.Sprintf(query, "<", "DESC"), post.Thread, post.Parent, post.Id, limit)
 	if err != nil {
-		return nil, myerror.ConflictError
+		return nil, nil, myerror.InternalError
+	}
+	before, err := scanPosts(rows)
+	rows.Close()
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return newPost, nil
+	for i, j := 0, len(before)-1; i < j; i, j = i+1, j-1 {
+		before[i], before[j] = before[j], before[i]
+	}
+
+	rows, err = pr.DB.QueryContext(ctx, fmt.Sprintf(query, ">", "ASC"), post.Thread, post.Parent, post.Id, limit)
+	if err != nil {
+		return nil, nil, myerror.InternalError
+	}
+	defer rows.Close()
+
+	after, err := scanPosts(rows)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return before, after, nil
+}
+
+// SelectByAuthor pages through the posts of one author ordered by
+// (created_at, id). A cursor in the filter continues after the row it encodes.
+func (pr *PostRepository) SelectByAuthor(ctx context.Context, author string, filter *models.AuthorFilter) ([]*models.Post, error) {
+	query := "SELECT " + postColumns + " FROM post WHERE author = $1"
+	arr := []interface{}{
+		author,
+	}
+
+	if filter.Forum != "" {
+		query += fmt.Sprintf(" AND forum = $%d", len(arr)+1)
+		arr = append(arr, filter.Forum)
+	}
+	if !filter.From.IsZero() {
+		query += fmt.Sprintf(" AND created_at >= $%d", len(arr)+1)
+		arr = append(arr, filter.From)
+	}
+	if !filter.To.IsZero() {
+		query += fmt.Sprintf(" AND created_at < $%d", len(arr)+1)
+		arr = append(arr, filter.To)
+	}
+
+	order, sign := "ASC", ">"
+	if filter.Desc {
+		order, sign = "DESC", "<"
+	}
+
+	if filter.Cursor != "" {
+		created, id, err := cursor.Decode(filter.Cursor, filter.Scope)
+		if err != nil {
+			return nil, err
+		}
+		query += fmt.Sprintf(" AND (created_at, id) %s ($%d, $%d)", sign, len(arr)+1, len(arr)+2)
+		arr = append(arr, created, id)
+	}
+
+	query += fmt.Sprintf(" ORDER BY created_at %s, id %s LIMIT $%d", order, order, len(arr)+1)
+	arr = append(arr, filter.Limit)
+
+	rows, err := pr.DB.QueryContext(ctx, query, arr...)
+	if err != nil {
+		return nil, myerror.DBSelectError
+	}
+	defer rows.Close()
+
+	return scanPosts(rows)
+}
+
+// mentionedUsers resolves the names of m (post, name) to the current
+// nickname of the user they name, directly or through a nickname alias left
+// by a rename.
+const mentionedUsers = `SELECT m.post, m.name, COALESCE(u.nickname, a.target) AS nickname FROM m
+	LEFT JOIN users AS u ON u.nickname = m.name
+	LEFT JOIN user_nickname_alias AS a ON a.nickname = m.name
+	WHERE u.nickname IS NOT NULL OR a.target IS NOT NULL`
+
+// scanMentionNames reads rows of post, name and nickname into the names of
+// the mentioned users per post, see mention.Resolve.
+func scanMentionNames(rows *sql.Rows) (map[int64]map[string]string, error) {
+	names := map[int64]map[string]string{}
+	for rows.Next() {
+		var post int64
+		var name, nickname string
+		if err := rows.Scan(&post, &name, &nickname); err != nil {
+			return nil, err
+		}
+		if names[post] == nil {
+			names[post] = map[string]string{}
+		}
+		names[post][strings.ToLower(name)] = nickname
+	}
+
+	return names, rows.Err()
+}
+
+// InsertMentions stores the users named in new posts, names are the
+// nicknames as written in the messages. Names that are not users or aliases
+// of one are skipped; the result maps the names of every post to the
+// nicknames stored for them.
+func (pr *PostRepository) InsertMentions(ctx context.Context, mentions map[int64][]string) (map[int64]map[string]string, error) {
+	if len(mentions) == 0 {
+		return map[int64]map[string]string{}, nil
+	}
+
+	values := []string{}
+	arr := []interface{}{}
+	for post, names := range mentions {
+		for _, name := range names {
+			values = append(values, fmt.Sprintf("($%d::BIGINT, $%d::citext)", len(arr)+1, len(arr)+2))
+			arr = append(arr, post, name)
+		}
+	}
+
+	query := `WITH m (post, name) AS (VALUES ` + strings.Join(values, ", ") + `),
+	resolved AS (` + mentionedUsers + `),
+	stored AS (INSERT INTO post_mention (post, nickname) SELECT DISTINCT post, nickname FROM resolved ON CONFLICT DO NOTHING)
+	SELECT post, name, nickname FROM resolved`
+
+	rows, err := pr.DB.QueryContext(ctx, query, arr...)
+	if err != nil {
+		return nil, myerror.InsertError
+	}
+	defer rows.Close()
+
+	resolved, err := scanMentionNames(rows)
+	if err != nil {
+		return nil, myerror.DBScanError
+	}
+
+	return resolved, nil
+}
+
+// ReplaceMentions swaps the stored mentions of an edited post for the users
+// named in names, as InsertMentions.
+func (pr *PostRepository) ReplaceMentions(ctx context.Context, id int64, names []string) (map[string]string, error) {
+	values := make([]string, 0, len(names))
+	arr := []interface{}{id}
+	for _, name := range names {
+		arr = append(arr, name)
+		values = append(values, fmt.Sprintf("($1::BIGINT, $%d::citext)", len(arr)))
+	}
+
+	var resolved map[string]string
+	err := dbtx.Run(ctx, pr.DB, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM post_mention WHERE post = $1", id)
+		if err != nil {
+			return err
+		}
+
+		resolved = map[string]string{}
+		if len(names) == 0 {
+			return nil
+		}
+
+		rows, err := tx.QueryContext(ctx, `WITH m (post, name) AS (VALUES `+strings.Join(values, ", ")+`),
+		resolved AS (`+mentionedUsers+`),
+		stored AS (INSERT INTO post_mention (post, nickname) SELECT DISTINCT post, nickname FROM resolved ON CONFLICT DO NOTHING)
+		SELECT post, name, nickname FROM resolved`, arr...)
+		if err != nil {
+			return dbtx.Fail(err, myerror.InsertError)
+		}
+		defer rows.Close()
+
+		names, err := scanMentionNames(rows)
+		if err != nil {
+			return dbtx.Fail(err, myerror.DBScanError)
+		}
+		if names[id] != nil {
+			resolved = names[id]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, dbtx.Classify(err, myerror.InternalError)
+	}
+
+	return resolved, nil
+}
+
+// SelectMentions returns the names of the users mentioned in posts: their
+// nicknames and the aliases a rename left, which older messages still use.
+func (pr *PostRepository) SelectMentions(ctx context.Context, ids []int64) (map[int64]map[string]string, error) {
+	if len(ids) == 0 {
+		return map[int64]map[string]string{}, nil
+	}
+
+	in := make([]string, 0, len(ids))
+	for _, id := range ids {
+		in = append(in, fmt.Sprintf("'%d'", id))
+	}
+
+	rows, err := pr.DB.QueryContext(ctx, fmt.Sprintf(`SELECT post, nickname, nickname FROM post_mention WHERE post IN (%[1]s)
+	UNION ALL
+	SELECT m.post, a.nickname, m.nickname FROM post_mention AS m
+	JOIN user_nickname_alias AS a ON a.target = m.nickname
+	WHERE m.post IN (%[1]s)`, strings.Join(in, ", ")))
+	if err != nil {
+		return nil, myerror.InternalError
+	}
+	defer rows.Close()
+
+	mentions, err := scanMentionNames(rows)
+	if err != nil {
+		return nil, myerror.InternalError
+	}
+
+	return mentions, nil
+}
+
+// SelectMentioning returns the posts that mention a user, newest first.
+// Since is the id of the last post of the previous page.
+func (pr *PostRepository) SelectMentioning(ctx context.Context, nickname string, limit int64, since int64) ([]*models.Post, error) {
+	query := "SELECT " + postColumns + " FROM post WHERE id IN (SELECT post FROM post_mention WHERE nickname = $1"
+	arr := []interface{}{
+		nickname,
+	}
+
+	if since > 0 {
+		query += fmt.Sprintf(" AND post < $%d", len(arr)+1)
+		arr = append(arr, since)
+	}
+
+	query += " ORDER BY post DESC"
+
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT $%d", len(arr)+1)
+		arr = append(arr, limit)
+	}
+
+	query += ") ORDER BY id DESC"
+
+	rows, err := pr.DB.QueryContext(ctx, query, arr...)
+	if err != nil {
+		return nil, myerror.DBSelectError
+	}
+	defer rows.Close()
+
+	return scanPosts(rows)
 }
@@ -1,10 +1,16 @@
 package usecase
 
 import (
+	"context"
+	"forum/internal/cursor"
+	"forum/internal/mention"
 	"forum/internal/models"
+	notification "forum/internal/pkg/notification/usecase"
 	"forum/internal/pkg/post/repository"
 	threadRepository "forum/internal/pkg/thread/repository"
+	"log"
 	"strconv"
+	"strings"
 	"time"
 
 	myerror "forum/internal/error"
@@ -29,16 +35,18 @@ func Difference(a, b []int64) (diff []int64) {
 type PostUsecase struct {
 	pr *repository.PostRepository
 	tr *threadRepository.ThreadRepository
+	nu *notification.NotificationUsecase
 }
 
-func NewPostUsecase(pr *repository.PostRepository, tr *threadRepository.ThreadRepository) *PostUsecase {
+func NewPostUsecase(pr *repository.PostRepository, tr *threadRepository.ThreadRepository, nu *notification.NotificationUsecase) *PostUsecase {
 	return &PostUsecase{
 		pr: pr,
 		tr: tr,
+		nu: nu,
 	}
 }
 
-func (pu *PostUsecase) CreateAll(posts []*models.Post, slug_or_id string) ([]*models.Post, error) {
+func (pu *PostUsecase) CreateAll(ctx context.Context, posts []*models.Post, slug_or_id string) ([]*models.Post, error) {
 	insertTime := time.Now()
 	var slug string
 	var id int32
@@ -50,14 +58,14 @@ func (pu *PostUsecase) CreateAll(posts []*models.Post, slug_or_id string) ([]*mo
 	if err != nil {
 		slug = slug_or_id
 		passedSlug = len(slug_or_id) != 0
-		pId, pForum, err = pu.tr.SelectThreadIdForumBySlug(slug)
+		pId, pForum, err = pu.tr.SelectThreadIdForumBySlug(ctx, slug)
 		if err != nil {
 			return nil, myerror.NotExist
 		}
 	} else {
 		id = int32(aId)
 		passedId = true
-		pForum, err = pu.tr.SelectForumByThreadId(int64(id))
+		pForum, err = pu.tr.SelectForumByThreadId(ctx, int64(id))
 		if err != nil {
 			return nil, myerror.NotExist
 		}
@@ -91,7 +99,7 @@ func (pu *PostUsecase) CreateAll(posts []*models.Post, slug_or_id string) ([]*mo
 
 	parentsToCheck := Difference(parent_ids, ids)
 	if len(parentsToCheck) > 0 {
-		noConflict, err := pu.CheckAllParentsExist(parentsToCheck, *pForum)
+		noConflict, err := pu.CheckAllParentsExist(ctx, parentsToCheck, *pForum)
 		if err != nil {
 			return nil, myerror.InternalError
 		} else if !noConflict {
@@ -99,48 +107,279 @@ func (pu *PostUsecase) CreateAll(posts []*models.Post, slug_or_id string) ([]*mo
 		}
 	}
 
-	return pu.pr.InsertAll(posts)
+	createdPosts, err := pu.pr.InsertAll(ctx, posts)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed := map[int64][]string{}
+	for _, post := range createdPosts {
+		if names := mention.Parse(post.Message); len(names) > 0 {
+			parsed[post.Id] = names
+		}
+	}
+
+	// the posts are already stored, a failed mention index only costs links
+	resolved, err := pu.pr.InsertMentions(ctx, parsed)
+	if err != nil {
+		log.Printf("can not store mentions of %d posts: %v", len(parsed), err)
+	}
+	for _, post := range createdPosts {
+		post.Mentions = mention.Resolve(post.Message, resolved[post.Id])
+	}
+
+	pu.nu.Notify(createdPosts)
+
+	return createdPosts, nil
 }
 
-func (pu *PostUsecase) GetAll(slug_or_id string, limit int64, since int64, sort string, isDescOrder bool) ([]*models.Post, error) {
+func (pu *PostUsecase) GetAll(ctx context.Context, slug_or_id string, limit int64, since int64, sort string, isDescOrder bool) ([]*models.Post, error) {
 	var slug string
 	var id int32
 
 	aId, err := strconv.Atoi(slug_or_id)
 	if err != nil {
 		slug = slug_or_id
-		pId, _, err := pu.tr.SelectThreadIdForumBySlug(slug)
+		pId, _, err := pu.tr.SelectThreadIdForumBySlug(ctx, slug)
 		if err != nil {
 			return nil, myerror.NotExist
 		}
 		id = int32(*pId)
 	} else {
 		id = int32(aId)
-		_, err := pu.tr.SelectForumByThreadId(int64(id))
+		_, err := pu.tr.SelectForumByThreadId(ctx, int64(id))
 		if err != nil {
 			return nil, myerror.NotExist
 		}
 	}
 
+	var posts []*models.Post
 	if sort == "" || sort == "flat" {
-		return pu.pr.SelectAllFlat(id, limit, since, isDescOrder)
+		posts, err = pu.pr.SelectAllFlat(ctx, id, limit, since, isDescOrder)
 	} else if sort == "tree" {
-		return pu.pr.SelectAllTree(id, limit, since, isDescOrder)
+		posts, err = pu.pr.SelectAllTree(ctx, id, limit, since, isDescOrder)
 	} else if sort == "parent_tree" {
-		return pu.pr.SelectAllParentTree(id, limit, since, isDescOrder)
+		posts, err = pu.pr.SelectAllParentTree(ctx, id, limit, since, isDescOrder)
+	} else if sort == "top" {
+		posts, err = pu.pr.SelectAllTop(ctx, id, limit, since, isDescOrder)
+	} else {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return pu.withMentions(ctx, posts)
+}
+
+func (pu *PostUsecase) GetAllNested(ctx context.Context, slug_or_id string, limit int64, since int64, sort string, isDescOrder bool, maxDepth int, childLimit int) (models.PostTree, error) {
+	if sort != "parent_tree" && sort != "top" {
+		sort = "tree"
+	}
+
+	posts, err := pu.GetAll(ctx, slug_or_id, limit, since, sort, isDescOrder)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, 0, len(posts))
+	for _, post := range posts {
+		ids = append(ids, post.Id)
+	}
+
+	replies, err := pu.pr.CountReplies(ctx, ids)
+	if err != nil {
+		return nil, myerror.InternalError
 	}
 
-	return nil, nil
+	return BuildPostTree(posts, replies, maxDepth, childLimit), nil
 }
 
-func (pu *PostUsecase) Get(id int64) (*models.Post, error) {
-	return pu.pr.Get(id)
+// BuildPostTree nests posts ordered by path under their parents. Posts whose
+// parent is not in the slice (e.g. cut off by since) become roots.
+func BuildPostTree(posts []*models.Post, replies map[int64]int64, maxDepth int, childLimit int) models.PostTree {
+	nodes := make(map[int64]*models.PostNode, len(posts))
+	for _, post := range posts {
+		nodes[post.Id] = &models.PostNode{
+			Post:       post,
+			Children:   []*models.PostNode{},
+			ReplyCount: replies[post.Id],
+		}
+	}
+
+	roots := models.PostTree{}
+	for _, post := range posts {
+		node := nodes[post.Id]
+		if parent, ok := nodes[post.Parent]; ok && post.Parent != 0 {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+
+	trimPostTree(roots, 1, maxDepth, childLimit)
+	return roots
 }
 
-func (pu *PostUsecase) CheckAllParentsExist(ids []int64, forum string) (bool, error) {
-	return pu.pr.Check(ids, forum)
+func trimPostTree(nodes models.PostTree, depth int, maxDepth int, childLimit int) {
+	for _, node := range nodes {
+		if maxDepth > 0 && depth >= maxDepth {
+			node.Children = []*models.PostNode{}
+		} else if childLimit > 0 && len(node.Children) > childLimit {
+			node.Children = node.Children[:childLimit]
+		}
+		node.HasMore = int64(len(node.Children)) < node.ReplyCount
+
+		trimPostTree(node.Children, depth+1, maxDepth, childLimit)
+	}
+}
+
+func (pu *PostUsecase) Get(ctx context.Context, id int64) (*models.Post, error) {
+	post, err := pu.pr.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := pu.withMentions(ctx, []*models.Post{post}); err != nil {
+		return nil, err
+	}
+
+	return post, nil
 }
 
-func (pu *PostUsecase) Update(id int64, postToUpdate *models.PostUpdate) (*models.Post, error) {
-	return pu.pr.Update(int64(id), postToUpdate)
+// withMentions fills Mentions of the posts from the mention index. Only
+// posts with an @ in the message are looked up.
+func (pu *PostUsecase) withMentions(ctx context.Context, posts []*models.Post) ([]*models.Post, error) {
+	ids := []int64{}
+	for _, post := range posts {
+		if strings.Contains(post.Message, "@") {
+			ids = append(ids, post.Id)
+		}
+	}
+	if len(ids) == 0 {
+		return posts, nil
+	}
+
+	mentions, err := pu.pr.SelectMentions(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, post := range posts {
+		post.Mentions = mention.Resolve(post.Message, mentions[post.Id])
+	}
+
+	return posts, nil
+}
+
+func (pu *PostUsecase) GetMentioning(ctx context.Context, nickname string, limit int64, since int64) ([]*models.Post, error) {
+	posts, err := pu.pr.SelectMentioning(ctx, nickname, limit, since)
+	if err != nil {
+		return nil, err
+	}
+
+	return pu.withMentions(ctx, posts)
+}
+
+// GetByAuthor returns a page of posts and the cursor of the next page,
+// which is empty once the last page has been reached.
+func (pu *PostUsecase) GetByAuthor(ctx context.Context, author string, filter *models.AuthorFilter) ([]*models.Post, string, error) {
+	posts, err := pu.pr.SelectByAuthor(ctx, author, filter)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := pu.withMentions(ctx, posts); err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	if int64(len(posts)) == filter.Limit {
+		last := posts[len(posts)-1]
+		next = cursor.Encode(filter.Scope, last.Created, last.Id)
+	}
+
+	return posts, next, nil
+}
+
+func (pu *PostUsecase) GetReplies(ctx context.Context, id int64, limit int64, since int64, isDescOrder bool) ([]*models.Post, error) {
+	if _, err := pu.pr.Get(ctx, id); err != nil {
+		return nil, myerror.NotExist
+	}
+
+	replies, err := pu.pr.SelectReplies(ctx, id, limit, since, isDescOrder)
+	if err != nil {
+		return nil, err
+	}
+
+	return pu.withMentions(ctx, replies)
+}
+
+func (pu *PostUsecase) GetAncestors(ctx context.Context, id int64, limit int64) ([]*models.Post, error) {
+	if _, err := pu.pr.Get(ctx, id); err != nil {
+		return nil, myerror.NotExist
+	}
+
+	ancestors, err := pu.pr.SelectAncestors(ctx, id, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return pu.withMentions(ctx, ancestors)
+}
+
+func (pu *PostUsecase) GetContext(ctx context.Context, id int64, n int64) (*models.PostContext, error) {
+	post, err := pu.pr.Get(ctx, id)
+	if err != nil {
+		return nil, myerror.NotExist
+	}
+
+	ancestors, err := pu.pr.SelectAncestors(ctx, id, n)
+	if err != nil {
+		return nil, err
+	}
+
+	before, after, err := pu.pr.SelectSiblings(ctx, post, n)
+	if err != nil {
+		return nil, err
+	}
+
+	all := append(append([]*models.Post{post}, ancestors...), before...)
+	if _, err := pu.withMentions(ctx, append(all, after...)); err != nil {
+		return nil, err
+	}
+
+	return &models.PostContext{
+		Post:           post,
+		Ancestors:      ancestors,
+		SiblingsBefore: before,
+		SiblingsAfter:  after,
+	}, nil
+}
+
+func (pu *PostUsecase) CheckAllParentsExist(ctx context.Context, ids []int64, forum string) (bool, error) {
+	return pu.pr.Check(ctx, ids, forum)
+}
+
+func (pu *PostUsecase) Update(ctx context.Context, id int64, postToUpdate *models.PostUpdate) (*models.Post, error) {
+	post, err := pu.pr.Update(ctx, int64(id), postToUpdate)
+	if err != nil {
+		return nil, err
+	}
+
+	if postToUpdate.Message == nil {
+		if _, err := pu.withMentions(ctx, []*models.Post{post}); err != nil {
+			return nil, err
+		}
+		return post, nil
+	}
+
+	resolved, err := pu.pr.ReplaceMentions(ctx, post.Id, mention.Parse(post.Message))
+	if err != nil {
+		return nil, err
+	}
+	post.Mentions = mention.Resolve(post.Message, resolved)
+
+	pu.nu.NotifyMentions([]*models.Post{post})
+
+	return post, nil
 }
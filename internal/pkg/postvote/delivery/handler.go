@@ -0,0 +1,98 @@
+package delivery
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"forum/internal/models"
+	"forum/internal/pkg/postvote/usecase"
+
+	myerror "forum/internal/error"
+
+	"github.com/gorilla/mux"
+)
+
+type PostVoteHandler struct {
+	pvu *usecase.PostVoteUsecase
+}
+
+func NewPostVoteHandler(pvu *usecase.PostVoteUsecase) *PostVoteHandler {
+	return &PostVoteHandler{
+		pvu: pvu,
+	}
+}
+
+func (pvh *PostVoteHandler) Routing(r *mux.Router) {
+	r.HandleFunc("/post/{id}/vote", http.HandlerFunc(pvh.CreateVote)).Methods(http.MethodPost)
+	r.HandleFunc("/post/{id}/vote", http.HandlerFunc(pvh.DeleteVote)).Methods(http.MethodDelete)
+}
+
+func (pvh *PostVoteHandler) CreateVote(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+	vote := &models.PostVote{}
+
+	err := json.NewDecoder(r.Body).Decode(vote)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(err)
+		return
+	}
+
+	vote.Post, _ = strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+	post, createErr := pvh.pvu.Create(r.Context(), vote)
+	if createErr == myerror.InvalidVoice {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(createErr)
+		return
+	}
+	if createErr == myerror.NotExist {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(createErr)
+		return
+	}
+	if createErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(createErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(post)
+}
+
+func (pvh *PostVoteHandler) DeleteVote(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	vote := &models.PostVote{
+		Nickname: r.URL.Query().Get("nickname"),
+	}
+	if vote.Nickname == "" {
+		err := json.NewDecoder(r.Body).Decode(vote)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(err)
+			return
+		}
+	}
+
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+	post, deleteErr := pvh.pvu.Delete(r.Context(), vote.Nickname, id)
+	if deleteErr == myerror.NotExist {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(deleteErr)
+		return
+	}
+	if deleteErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(deleteErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(post)
+}
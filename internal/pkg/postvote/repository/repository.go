@@ -0,0 +1,53 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"forum/internal/dbtx"
+	myerror "forum/internal/error"
+	"forum/internal/models"
+)
+
+type PostVoteRepository struct {
+	DB *sql.DB
+}
+
+func NewPostVoteRepository(DB *sql.DB) *PostVoteRepository {
+	return &PostVoteRepository{
+		DB: DB,
+	}
+}
+
+func (pvr *PostVoteRepository) Insert(ctx context.Context, vote *models.PostVote) (*models.PostVote, error) {
+	newVote := &models.PostVote{}
+	err := dbtx.Run(ctx, pvr.DB, func(tx *sql.Tx) error {
+		return tx.QueryRowContext(ctx, `INSERT INTO post_vote (author, voice, post)
+		VALUES ($1, $2, $3) ON CONFLICT (author, post)
+		DO
+		UPDATE
+		SET voice=$2, updated_at=NOW() RETURNING author, voice, post, updated_at`, vote.Nickname, vote.Voice, vote.Post).
+			Scan(&newVote.Nickname, &newVote.Voice, &newVote.Post, &newVote.UpdatedAt)
+	})
+	if err != nil {
+		return nil, dbtx.Classify(err, myerror.NotExist)
+	}
+
+	return newVote, nil
+}
+
+func (pvr *PostVoteRepository) Delete(ctx context.Context, nickname string, post int64) error {
+	err := dbtx.Run(ctx, pvr.DB, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, "DELETE FROM post_vote WHERE author = $1 AND post = $2", nickname, post)
+		if err != nil {
+			return err
+		}
+
+		deleted, err := result.RowsAffected()
+		if err != nil || deleted == 0 {
+			return myerror.NotExist
+		}
+		return nil
+	})
+
+	return dbtx.Classify(err, myerror.InternalError)
+}
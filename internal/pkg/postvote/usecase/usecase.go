@@ -0,0 +1,47 @@
+package usecase
+
+import (
+	"context"
+	"forum/internal/models"
+	postRepository "forum/internal/pkg/post/repository"
+	"forum/internal/pkg/postvote/repository"
+
+	myerror "forum/internal/error"
+)
+
+type PostVoteUsecase struct {
+	pvr *repository.PostVoteRepository
+	pr  *postRepository.PostRepository
+}
+
+func NewPostVoteUsecase(pvr *repository.PostVoteRepository, pr *postRepository.PostRepository) *PostVoteUsecase {
+	return &PostVoteUsecase{
+		pvr: pvr,
+		pr:  pr,
+	}
+}
+
+// Create upserts a vote of +1 or -1 for the post. A voice of 0 retracts the
+// previous vote.
+func (pvu *PostVoteUsecase) Create(ctx context.Context, vote *models.PostVote) (*models.Post, error) {
+	if vote.Voice == 0 {
+		return pvu.Delete(ctx, vote.Nickname, vote.Post)
+	}
+	if vote.Voice != 1 && vote.Voice != -1 {
+		return nil, myerror.InvalidVoice
+	}
+
+	if _, err := pvu.pvr.Insert(ctx, vote); err != nil {
+		return nil, err
+	}
+
+	return pvu.pr.Get(ctx, vote.Post)
+}
+
+func (pvu *PostVoteUsecase) Delete(ctx context.Context, nickname string, post int64) (*models.Post, error) {
+	if err := pvu.pvr.Delete(ctx, nickname, post); err != nil {
+		return nil, err
+	}
+
+	return pvu.pr.Get(ctx, post)
+}
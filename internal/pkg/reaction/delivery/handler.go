@@ -0,0 +1,112 @@
+package delivery
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"forum/internal/models"
+	"forum/internal/pkg/reaction/usecase"
+
+	myerror "forum/internal/error"
+
+	"github.com/gorilla/mux"
+)
+
+type ReactionHandler struct {
+	ru *usecase.ReactionUsecase
+}
+
+func NewReactionHandler(ru *usecase.ReactionUsecase) *ReactionHandler {
+	return &ReactionHandler{
+		ru: ru,
+	}
+}
+
+func (rh *ReactionHandler) Routing(r *mux.Router) {
+	r.HandleFunc("/post/{id}/reactions", http.HandlerFunc(rh.GetReactions)).Methods(http.MethodGet)
+	r.HandleFunc("/post/{id}/reactions", http.HandlerFunc(rh.CreateReaction)).Methods(http.MethodPost)
+	r.HandleFunc("/post/{id}/reactions", http.HandlerFunc(rh.DeleteReaction)).Methods(http.MethodDelete)
+}
+
+func writeReactionError(w http.ResponseWriter, err error) {
+	switch err {
+	case myerror.InvalidReaction:
+		w.WriteHeader(http.StatusBadRequest)
+	case myerror.NotExist:
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(err)
+}
+
+func (rh *ReactionHandler) CreateReaction(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+	reaction := &models.Reaction{}
+
+	err := json.NewDecoder(r.Body).Decode(reaction)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(err)
+		return
+	}
+
+	reaction.Post, _ = strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+	post, createErr := rh.ru.Create(r.Context(), reaction)
+	if createErr != nil {
+		writeReactionError(w, createErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(post)
+}
+
+func (rh *ReactionHandler) DeleteReaction(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+	reaction := &models.Reaction{
+		Nickname: query.Get("nickname"),
+		Emoji:    query.Get("emoji"),
+	}
+	if reaction.Nickname == "" {
+		err := json.NewDecoder(r.Body).Decode(reaction)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(err)
+			return
+		}
+	}
+
+	reaction.Post, _ = strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+	post, deleteErr := rh.ru.Delete(r.Context(), reaction)
+	if deleteErr != nil {
+		writeReactionError(w, deleteErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(post)
+}
+
+func (rh *ReactionHandler) GetReactions(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+	reactions, selectErr := rh.ru.GetByPost(r.Context(), id)
+	if selectErr != nil {
+		writeReactionError(w, selectErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(reactions)
+}
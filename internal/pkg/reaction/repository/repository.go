@@ -0,0 +1,65 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"forum/internal/dbtx"
+	myerror "forum/internal/error"
+	"forum/internal/models"
+)
+
+type ReactionRepository struct {
+	DB *sql.DB
+}
+
+func NewReactionRepository(DB *sql.DB) *ReactionRepository {
+	return &ReactionRepository{
+		DB: DB,
+	}
+}
+
+func (rr *ReactionRepository) Insert(ctx context.Context, reaction *models.Reaction) error {
+	err := dbtx.Run(ctx, rr.DB, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `INSERT INTO post_reaction (author, post, emoji) VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`, reaction.Nickname, reaction.Post, reaction.Emoji)
+		return err
+	})
+
+	return dbtx.Classify(err, myerror.InternalError)
+}
+
+func (rr *ReactionRepository) Delete(ctx context.Context, reaction *models.Reaction) error {
+	err := dbtx.Run(ctx, rr.DB, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, "DELETE FROM post_reaction WHERE author = $1 AND post = $2 AND emoji = $3", reaction.Nickname, reaction.Post, reaction.Emoji)
+		if err != nil {
+			return err
+		}
+
+		deleted, err := result.RowsAffected()
+		if err != nil || deleted == 0 {
+			return myerror.NotExist
+		}
+		return nil
+	})
+
+	return dbtx.Classify(err, myerror.InternalError)
+}
+
+func (rr *ReactionRepository) SelectByPost(ctx context.Context, post int64) ([]*models.Reaction, error) {
+	rows, err := rr.DB.QueryContext(ctx, "SELECT author, emoji, post, created_at FROM post_reaction WHERE post = $1 ORDER BY created_at, author", post)
+	if err != nil {
+		return nil, myerror.InternalError
+	}
+	defer rows.Close()
+
+	reactions := []*models.Reaction{}
+	for rows.Next() {
+		reaction := models.Reaction{}
+		if err := rows.Scan(&reaction.Nickname, &reaction.Emoji, &reaction.Post, &reaction.Created); err != nil {
+			return nil, myerror.InternalError
+		}
+		reactions = append(reactions, &reaction)
+	}
+
+	return reactions, nil
+}
@@ -0,0 +1,63 @@
+package usecase
+
+import (
+	"context"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"forum/internal/models"
+	postRepository "forum/internal/pkg/post/repository"
+	"forum/internal/pkg/reaction/repository"
+
+	myerror "forum/internal/error"
+)
+
+const maxEmojiLength = 16
+
+type ReactionUsecase struct {
+	rr *repository.ReactionRepository
+	pr *postRepository.PostRepository
+}
+
+func NewReactionUsecase(rr *repository.ReactionRepository, pr *postRepository.PostRepository) *ReactionUsecase {
+	return &ReactionUsecase{
+		rr: rr,
+		pr: pr,
+	}
+}
+
+func validEmoji(emoji string) bool {
+	if emoji == "" || utf8.RuneCountInString(emoji) > maxEmojiLength {
+		return false
+	}
+	return strings.IndexFunc(emoji, unicode.IsSpace) < 0
+}
+
+func (ru *ReactionUsecase) Create(ctx context.Context, reaction *models.Reaction) (*models.Post, error) {
+	if !validEmoji(reaction.Emoji) {
+		return nil, myerror.InvalidReaction
+	}
+
+	if err := ru.rr.Insert(ctx, reaction); err != nil {
+		return nil, err
+	}
+
+	return ru.pr.Get(ctx, reaction.Post)
+}
+
+func (ru *ReactionUsecase) Delete(ctx context.Context, reaction *models.Reaction) (*models.Post, error) {
+	if err := ru.rr.Delete(ctx, reaction); err != nil {
+		return nil, err
+	}
+
+	return ru.pr.Get(ctx, reaction.Post)
+}
+
+func (ru *ReactionUsecase) GetByPost(ctx context.Context, post int64) ([]*models.Reaction, error) {
+	if _, err := ru.pr.Get(ctx, post); err != nil {
+		return nil, myerror.NotExist
+	}
+
+	return ru.rr.SelectByPost(ctx, post)
+}
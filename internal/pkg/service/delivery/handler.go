@@ -3,19 +3,38 @@ package delivery
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
 
+	"forum/internal/dbtx"
+	myerror "forum/internal/error"
+	"forum/internal/fault"
+	"forum/internal/models"
+	notificationUsecase "forum/internal/pkg/notification/usecase"
 	"forum/internal/pkg/service/usecase"
+	userUsecase "forum/internal/pkg/user/usecase"
+	"forum/internal/querylog"
 
 	"github.com/gorilla/mux"
 )
 
 type ServiceHandler struct {
-	su *usecase.ServiceUsecase
+	su  *usecase.ServiceUsecase
+	nu  *notificationUsecase.NotificationUsecase
+	uu  *userUsecase.UserUsecase
+	ql  *querylog.Log
+	inj *fault.Injector
 }
 
-func NewServiceHandler(su *usecase.ServiceUsecase) *ServiceHandler {
+// NewServiceHandler serves the slow query log of ql, which is nil when
+// statements are not timed, and the rules of inj, which is nil unless fault
+// injection is enabled.
+func NewServiceHandler(su *usecase.ServiceUsecase, nu *notificationUsecase.NotificationUsecase, uu *userUsecase.UserUsecase, ql *querylog.Log, inj *fault.Injector) *ServiceHandler {
 	return &ServiceHandler{
-		su: su,
+		su:  su,
+		nu:  nu,
+		uu:  uu,
+		ql:  ql,
+		inj: inj,
 	}
 }
 
@@ -23,6 +42,13 @@ func (sh *ServiceHandler) Routing(r *mux.Router) {
 	s := r.PathPrefix("/service").Subrouter()
 	s.HandleFunc("/status", http.HandlerFunc(sh.GetStatus)).Methods(http.MethodGet)
 	s.HandleFunc("/clear", http.HandlerFunc(sh.ClearAll)).Methods(http.MethodPost)
+	s.HandleFunc("/check", http.HandlerFunc(sh.Check)).Methods(http.MethodGet)
+	s.HandleFunc("/check", http.HandlerFunc(sh.Repair)).Methods(http.MethodPost)
+	s.HandleFunc("/slow-queries", http.HandlerFunc(sh.GetSlowQueries)).Methods(http.MethodGet)
+	s.HandleFunc("/transactions", http.HandlerFunc(sh.GetTransactions)).Methods(http.MethodGet)
+	s.HandleFunc("/notifications", http.HandlerFunc(sh.GetNotifications)).Methods(http.MethodGet)
+	s.HandleFunc("/faults", http.HandlerFunc(sh.Faults)).Methods(http.MethodGet, http.MethodPut, http.MethodDelete)
+	s.HandleFunc("/user/{nickname}/role", http.HandlerFunc(sh.SetRole)).Methods(http.MethodPost)
 	//s.HandleFunc("/{nickname}/profile", http.HandlerFunc(uh.Profile)).Methods(http.MethodGet)
 	//s.HandleFunc("/{nickname}/profile", http.HandlerFunc(uh.Update)).Methods(http.MethodPost)
 }
@@ -31,7 +57,7 @@ func (sh *ServiceHandler) GetStatus(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	w.Header().Set("Content-Type", "application/json")
 
-	status, err := sh.su.GetStatus()
+	status, err := sh.su.GetStatus(r.Context())
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(err)
@@ -46,7 +72,7 @@ func (sh *ServiceHandler) ClearAll(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	w.Header().Set("Content-Type", "application/json")
 
-	err := sh.su.Clear()
+	err := sh.su.Clear(r.Context())
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(err)
@@ -56,3 +82,136 @@ func (sh *ServiceHandler) ClearAll(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(nil)
 }
+
+func (sh *ServiceHandler) Check(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	report, err := sh.su.Check(r.Context(), false, 0)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
+
+func (sh *ServiceHandler) Repair(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	batch, _ := strconv.Atoi(r.URL.Query().Get("batch"))
+
+	report, err := sh.su.Check(r.Context(), true, batch)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
+
+func (sh *ServiceHandler) GetSlowQueries(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+
+	entries := []querylog.Entry{}
+	if sh.ql != nil {
+		entries = sh.ql.Recent(limit)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(entries)
+}
+
+// GetTransactions reports how many repository transactions ran and how often
+// they were retried after serialization failures and deadlocks.
+func (sh *ServiceHandler) GetTransactions(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(dbtx.GetStats())
+}
+
+// GetNotifications reports how many post batches the notification fan-out
+// handled, deferred to notification_pending or dropped.
+func (sh *ServiceHandler) GetNotifications(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(sh.nu.Stats())
+}
+
+// SetRole assigns the role of a JSON body like {"role": "moderator"} to a
+// user. Like the other routes under /service it is an operator route and
+// takes no credentials, keep /api/service out of public reach.
+func (sh *ServiceHandler) SetRole(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	role := &models.UserRole{}
+	if err := json.NewDecoder(r.Body).Decode(role); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(myerror.Message{Message: "can not parse role"})
+		return
+	}
+
+	userRole, err := sh.uu.SetRole(r.Context(), mux.Vars(r)["nickname"], role)
+	switch err {
+	case nil:
+	case myerror.BadUpdate:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(err)
+		return
+	case myerror.NotExist:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(myerror.UNotFound)
+		return
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(userRole)
+}
+
+// Faults shows the fault injection rules on GET, replaces them with the JSON
+// array of a PUT and removes them on DELETE.
+func (sh *ServiceHandler) Faults(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	if sh.inj == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(myerror.Message{Message: "fault injection is disabled"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		rules, err := fault.ReadRules(r.Body)
+		if err == nil {
+			err = sh.inj.SetRules(rules)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(myerror.Message{Message: err.Error()})
+			return
+		}
+	case http.MethodDelete:
+		sh.inj.SetRules([]*fault.Rule{})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(sh.inj.Rules())
+}
@@ -1,8 +1,12 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
+	"forum/internal/dbtx"
+	myerror "forum/internal/error"
 	"forum/internal/models"
+	"strings"
 )
 
 type ServiceRepository struct {
@@ -15,7 +19,7 @@ func NewServiceRepository(DB *sql.DB) *ServiceRepository {
 	}
 }
 
-func (sr *ServiceRepository) CountAll() (*models.Status, error) {
+func (sr *ServiceRepository) CountAll(ctx context.Context) (*models.Status, error) {
 	query := `
 	SELECT * FROM
 	(SELECT COUNT(*) FROM users) AS u,
@@ -24,14 +28,193 @@ func (sr *ServiceRepository) CountAll() (*models.Status, error) {
 	(SELECT COUNT(*) FROM post) AS p`
 
 	status := &models.Status{}
-	err := sr.DB.QueryRow(query).Scan(&status.User, &status.Forum, &status.Thread, &status.Post)
+	err := sr.DB.QueryRowContext(ctx, query).Scan(&status.User, &status.Forum, &status.Thread, &status.Post)
 
 	return status, err
 }
 
-func (sr *ServiceRepository) Clear() error {
-	query := `TRUNCATE users, forum, thread, post, vote, forum_users`
-	_, err := sr.DB.Exec(query)
+func (sr *ServiceRepository) Clear(ctx context.Context) error {
+	query := `TRUNCATE users, forum, thread, post, vote, forum_users, thread_slug_alias, forum_slug_alias, user_nickname_alias, post_vote, post_reaction, user_reputation, thread_subscription, notification, notification_pending, post_mention, idempotency_key`
+	_, err := sr.DB.ExecContext(ctx, query)
 
 	return err
 }
+
+// driftQueries recompute every trigger maintained aggregate from source rows
+// and return entity key, stored and actual value for mismatches only.
+var driftQueries = []struct {
+	entity string
+	field  string
+	query  string
+}{
+	{"forum", "posts", `SELECT f.slug, f.posts, COALESCE(p.count, 0) FROM forum AS f
+	LEFT JOIN (SELECT forum, count(*) AS count FROM post GROUP BY forum) AS p ON p.forum = f.slug
+	WHERE f.posts IS DISTINCT FROM COALESCE(p.count, 0)`},
+	{"forum", "threads", `SELECT f.slug, f.threads, COALESCE(t.count, 0) FROM forum AS f
+	LEFT JOIN (SELECT forum, count(*) AS count FROM thread GROUP BY forum) AS t ON t.forum = f.slug
+	WHERE f.threads IS DISTINCT FROM COALESCE(t.count, 0)`},
+	{"thread", "votes", `SELECT t.id::TEXT, t.votes, COALESCE(v.sum, 0) FROM thread AS t
+	LEFT JOIN (SELECT thread, sum(voice * weight) AS sum FROM vote GROUP BY thread) AS v ON v.thread = t.id
+	WHERE t.votes IS DISTINCT FROM COALESCE(v.sum, 0)`},
+	{"post", "score", `SELECT p.id::TEXT, p.score, COALESCE(v.sum, 0) FROM post AS p
+	JOIN (SELECT post, sum(voice) AS sum FROM post_vote GROUP BY post) AS v ON v.post = p.id
+	WHERE p.score != v.sum
+	UNION ALL
+	SELECT p.id::TEXT, p.score, 0 FROM post AS p
+	WHERE p.score != 0 AND NOT EXISTS (SELECT 1 FROM post_vote WHERE post = p.id)`},
+	{"user_reputation", "score", `SELECT COALESCE(r.forum, a.forum) || '/' || COALESCE(r.nickname, a.nickname),
+		COALESCE(r.thread_score + r.post_score, 0), COALESCE(a.thread_score + a.post_score, 0)
+	FROM user_reputation AS r FULL JOIN user_reputation_actual AS a ON a.nickname = r.nickname AND a.forum = r.forum
+	WHERE (COALESCE(r.thread_score, 0), COALESCE(r.post_score, 0)) IS DISTINCT FROM (COALESCE(a.thread_score, 0), COALESCE(a.post_score, 0))`},
+	{"forum_users", "missing", `SELECT a.forum || '/' || a.author, 0, 1 FROM
+	(SELECT forum, author FROM thread UNION SELECT forum, author FROM post) AS a
+	LEFT JOIN forum_users AS fu ON fu.forum = a.forum AND fu.nickname = a.author
+	WHERE fu.nickname IS NULL`},
+	{"forum_users", "extra", `SELECT fu.forum || '/' || fu.nickname, 1, 0 FROM forum_users AS fu
+	WHERE NOT EXISTS (SELECT 1 FROM thread WHERE forum = fu.forum AND author = fu.nickname)
+	AND NOT EXISTS (SELECT 1 FROM post WHERE forum = fu.forum AND author = fu.nickname)`},
+	{"forum_users", "stale", `SELECT fu.forum || '/' || fu.nickname, 1, 0 FROM forum_users AS fu
+	JOIN users AS u ON u.nickname = fu.nickname
+	WHERE (fu.fullname, fu.email, fu.about) IS DISTINCT FROM (u.fullname, u.email, u.about)`},
+}
+
+// repair fixes a batch of keys found by the matching drift query. The value
+// is recomputed inside the statement, so writes made after the check are
+// taken into account. Keys are passed as typed arrays, so that the batch is
+// looked up through the primary key of the table rather than by a scan.
+type repair struct {
+	query string
+	// pairs are forum/nickname keys, passed as an array of forums in $1 and
+	// one of nicknames in $2, the others are passed whole in $1
+	pairs bool
+}
+
+var repairQueries = map[string]repair{
+	"forum/posts": {query: `UPDATE forum SET posts = (SELECT count(*) FROM post WHERE post.forum = forum.slug)
+	WHERE slug = ANY($1::citext[])`},
+	"forum/threads": {query: `UPDATE forum SET threads = (SELECT count(*) FROM thread WHERE thread.forum = forum.slug)
+	WHERE slug = ANY($1::citext[])`},
+	"thread/votes": {query: `UPDATE thread SET votes = (SELECT COALESCE(sum(voice * weight), 0) FROM vote WHERE vote.thread = thread.id)
+	WHERE id = ANY($1::BIGINT[])`},
+	"post/score": {query: `UPDATE post SET score = (SELECT COALESCE(sum(voice), 0) FROM post_vote WHERE post_vote.post = post.id)
+	WHERE id = ANY($1::BIGINT[])`},
+	"user_reputation/score": {pairs: true, query: `INSERT INTO user_reputation (nickname, forum, thread_score, post_score)
+	SELECT k.nickname, k.forum, COALESCE(a.thread_score, 0), COALESCE(a.post_score, 0)
+	FROM unnest($1::citext[], $2::citext[]) AS k (forum, nickname)
+	LEFT JOIN user_reputation_actual AS a ON a.forum = k.forum AND a.nickname = k.nickname
+	ON CONFLICT (nickname, forum) DO UPDATE SET thread_score = EXCLUDED.thread_score, post_score = EXCLUDED.post_score`},
+	"forum_users/missing": {pairs: true, query: `INSERT INTO forum_users (nickname, fullname, email, about, forum)
+	SELECT u.nickname, u.fullname, u.email, u.about, k.forum
+	FROM unnest($1::citext[], $2::citext[]) AS k (forum, nickname)
+	JOIN users AS u ON u.nickname = k.nickname
+	ON CONFLICT DO NOTHING`},
+	"forum_users/extra": {pairs: true, query: `DELETE FROM forum_users AS fu
+	WHERE (fu.forum, fu.nickname) IN (SELECT * FROM unnest($1::citext[], $2::citext[]))
+	AND NOT EXISTS (SELECT 1 FROM thread WHERE forum = fu.forum AND author = fu.nickname)
+	AND NOT EXISTS (SELECT 1 FROM post WHERE forum = fu.forum AND author = fu.nickname)`},
+	"forum_users/stale": {pairs: true, query: `UPDATE forum_users AS fu SET fullname = u.fullname, email = u.email, about = u.about
+	FROM users AS u
+	WHERE u.nickname = fu.nickname AND (fu.forum, fu.nickname) IN (SELECT * FROM unnest($1::citext[], $2::citext[]))`},
+}
+
+func (sr *ServiceRepository) FindDrift(ctx context.Context) ([]*models.Drift, error) {
+	drifts := []*models.Drift{}
+
+	for _, check := range driftQueries {
+		rows, err := sr.DB.QueryContext(ctx, check.query)
+		if err != nil {
+			return nil, myerror.DBSelectError
+		}
+
+		for rows.Next() {
+			drift := &models.Drift{
+				Entity: check.entity,
+				Field:  check.field,
+			}
+			if err := rows.Scan(&drift.Key, &drift.Stored, &drift.Actual); err != nil {
+				rows.Close()
+				return nil, myerror.DBScanError
+			}
+			drifts = append(drifts, drift)
+		}
+		rows.Close()
+	}
+
+	return drifts, nil
+}
+
+// RepairDrift fixes drifts batch keys per transaction, so that no forum,
+// thread or forum_users row stays locked for long.
+func (sr *ServiceRepository) RepairDrift(ctx context.Context, drifts []*models.Drift, batch int) (int64, error) {
+	if batch <= 0 {
+		batch = 500
+	}
+
+	groups := map[string][]string{}
+	order := []string{}
+	for _, drift := range drifts {
+		name := drift.Entity + "/" + drift.Field
+		if _, ok := groups[name]; !ok {
+			order = append(order, name)
+		}
+		groups[name] = append(groups[name], drift.Key)
+	}
+
+	var repaired int64
+	for _, name := range order {
+		keys := groups[name]
+		for start := 0; start < len(keys); start += batch {
+			end := start + batch
+			if end > len(keys) {
+				end = len(keys)
+			}
+
+			affected, err := sr.repairBatch(ctx, repairQueries[name], keys[start:end])
+			if err != nil {
+				return repaired, err
+			}
+			repaired += affected
+		}
+	}
+
+	return repaired, nil
+}
+
+func (sr *ServiceRepository) repairBatch(ctx context.Context, r repair, keys []string) (int64, error) {
+	args := []interface{}{arrayLiteral(keys)}
+	if r.pairs {
+		forums := make([]string, 0, len(keys))
+		nicknames := make([]string, 0, len(keys))
+		for _, key := range keys {
+			// slugs have no slash, nicknames may
+			i := strings.IndexByte(key, '/')
+			forums = append(forums, key[:i])
+			nicknames = append(nicknames, key[i+1:])
+		}
+		args = []interface{}{arrayLiteral(forums), arrayLiteral(nicknames)}
+	}
+
+	var result sql.Result
+	err := dbtx.Run(ctx, sr.DB, func(tx *sql.Tx) error {
+		var err error
+		result, err = tx.ExecContext(ctx, r.query, args...)
+		return dbtx.Fail(err, myerror.DBUpdateError)
+	})
+	if err != nil {
+		return 0, dbtx.Classify(err, myerror.DBCommitError)
+	}
+
+	return result.RowsAffected()
+}
+
+// arrayLiteral writes values as a Postgres array literal, to be cast to the
+// array type in the statement.
+func arrayLiteral(values []string) string {
+	quoted := make([]string, 0, len(values))
+	for _, value := range values {
+		quoted = append(quoted, `"`+arrayEscaper.Replace(value)+`"`)
+	}
+	return "{" + strings.Join(quoted, ",") + "}"
+}
+
+var arrayEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
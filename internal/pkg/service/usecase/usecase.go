@@ -1,6 +1,7 @@
 package usecase
 
 import (
+	"context"
 	"forum/internal/models"
 	"forum/internal/pkg/service/repository"
 )
@@ -15,10 +16,32 @@ func NewServiceUsecase(sr *repository.ServiceRepository) *ServiceUsecase {
 	}
 }
 
-func (su *ServiceUsecase) GetStatus() (*models.Status, error) {
-	return su.sr.CountAll()
+func (su *ServiceUsecase) GetStatus(ctx context.Context) (*models.Status, error) {
+	return su.sr.CountAll(ctx)
 }
 
-func (su *ServiceUsecase) Clear() error {
-	return su.sr.Clear()
+func (su *ServiceUsecase) Clear(ctx context.Context) error {
+	return su.sr.Clear(ctx)
+}
+
+// Check recomputes counters and forum users from source rows. With repair
+// set, the found drifts are fixed in batches of batch keys.
+func (su *ServiceUsecase) Check(ctx context.Context, repair bool, batch int) (*models.CheckReport, error) {
+	drifts, err := su.sr.FindDrift(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &models.CheckReport{
+		Drifts: drifts,
+	}
+
+	if repair && len(drifts) > 0 {
+		report.Repaired, err = su.sr.RepairDrift(ctx, drifts, batch)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
 }
@@ -5,9 +5,16 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 
+	"forum/internal/cursor"
+	"forum/internal/include"
+	"forum/internal/markdown"
 	"forum/internal/models"
+	forum "forum/internal/pkg/forum/usecase"
 	"forum/internal/pkg/thread/usecase"
+	user "forum/internal/pkg/user/usecase"
 
 	"github.com/gorilla/mux"
 
@@ -16,11 +23,17 @@ import (
 
 type ThreadHandler struct {
 	tu *usecase.ThreadUsecase
+	uu *user.UserUsecase
+	fu *forum.ForumUsecase
+	md *markdown.Renderer
 }
 
-func NewThreadHandler(tu *usecase.ThreadUsecase) *ThreadHandler {
+func NewThreadHandler(tu *usecase.ThreadUsecase, uu *user.UserUsecase, fu *forum.ForumUsecase, md *markdown.Renderer) *ThreadHandler {
 	return &ThreadHandler{
 		tu: tu,
+		uu: uu,
+		fu: fu,
+		md: md,
 	}
 }
 
@@ -29,6 +42,10 @@ func (th *ThreadHandler) Routing(r *mux.Router) {
 	r.HandleFunc(`/forum/{slug}/threads`, http.HandlerFunc(th.GetAllThreadsInForum)).Methods(http.MethodGet)
 	r.HandleFunc(`/thread/{slug_or_id}/details`, http.HandlerFunc(th.GetThread)).Methods(http.MethodGet)
 	r.HandleFunc(`/thread/{slug_or_id}/details`, http.HandlerFunc(th.UpdateThread)).Methods(http.MethodPost)
+	r.HandleFunc(`/thread/{slug_or_id}/move`, http.HandlerFunc(th.MoveThread)).Methods(http.MethodPost)
+	r.HandleFunc(`/thread/{slug_or_id}/merge`, http.HandlerFunc(th.MergeThread)).Methods(http.MethodPost)
+	r.HandleFunc(`/post/{id}/split`, http.HandlerFunc(th.SplitThread)).Methods(http.MethodPost)
+	r.HandleFunc(`/user/{nickname}/threads`, http.HandlerFunc(th.GetUserThreads)).Methods(http.MethodGet)
 }
 
 func (th *ThreadHandler) CreateThread(w http.ResponseWriter, r *http.Request) {
@@ -45,9 +62,20 @@ func (th *ThreadHandler) CreateThread(w http.ResponseWriter, r *http.Request) {
 
 	thread.Forum = mux.Vars(r)["slug"]
 
-	createdThread, createErr := th.tu.Create(thread)
+	createdThread, createErr := th.tu.Create(r.Context(), thread)
+	if createErr == myerror.InvalidSlug {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(createErr)
+		return
+	}
+	if createErr == myerror.SlugUnavailable {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(createErr)
+		return
+	}
 	if createErr == myerror.ConflictError {
-		selectedThread, _ := th.tu.GetBySlug(thread.Slug)
+		selectedThread, _ := th.tu.GetBySlug(r.Context(), thread.Slug)
 		w.WriteHeader(http.StatusConflict)
 		json.NewEncoder(w).Encode(selectedThread)
 		return
@@ -58,6 +86,9 @@ func (th *ThreadHandler) CreateThread(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if markdown.Requested(r) {
+		th.md.Threads(createdThread)
+	}
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(createdThread)
 }
@@ -79,13 +110,23 @@ func (th *ThreadHandler) GetAllThreadsInForum(w http.ResponseWriter, r *http.Req
 		isDescOrder = true
 	}
 
-	selectedThreads, selectErr := th.tu.GetAll(slug, limit, since, isDescOrder)
+	selectedThreads, selectErr := th.tu.GetAll(r.Context(), slug, limit, since, isDescOrder)
 	if selectErr == myerror.NotExist {
+		if current, resolveErr := th.fu.ResolveSlug(r.Context(), slug); resolveErr == nil {
+			u.Path = "/api/forum/" + current + "/threads"
+			w.Header().Set("Location", u.RequestURI())
+			w.WriteHeader(http.StatusMovedPermanently)
+			return
+		}
+
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(selectErr)
 		return
 	}
 
+	if markdown.Requested(r) {
+		th.md.Threads(selectedThreads...)
+	}
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(selectedThreads)
 }
@@ -96,14 +137,61 @@ func (th *ThreadHandler) GetThread(w http.ResponseWriter, r *http.Request) {
 
 	slug_or_id := mux.Vars(r)["slug_or_id"]
 
-	selectedThread, selectErr := th.tu.GetBySlugOrId(slug_or_id)
+	u, _ := url.Parse(r.URL.RequestURI())
+	related, parseErr := include.Parse(u.Query().Get("include"), "forum", "author")
+	if parseErr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(parseErr)
+		return
+	}
+
+	selectedThread, selectErr := th.tu.GetBySlugOrId(r.Context(), slug_or_id)
 	if selectErr == myerror.NotExist {
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(selectErr)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(selectedThread)
+
+	status := http.StatusOK
+	if _, err := strconv.Atoi(slug_or_id); err != nil && !strings.EqualFold(slug_or_id, selectedThread.Slug) {
+		// requested by an old slug, point the client to the current one
+		w.Header().Set("Location", "/api/thread/"+selectedThread.Slug+"/details")
+		status = http.StatusMovedPermanently
+	}
+
+	if markdown.Requested(r) {
+		th.md.Threads(selectedThread)
+	}
+
+	if related.Empty() {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(selectedThread)
+		return
+	}
+
+	full := models.ThreadFull{Thread: selectedThread}
+	wg := sync.WaitGroup{}
+
+	if related.Has("author") {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			full.Author, _ = th.uu.GetByNickname(r.Context(), selectedThread.Author)
+		}()
+	}
+
+	if related.Has("forum") {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			full.Forum, _ = th.fu.GetBySlug(r.Context(), selectedThread.Forum)
+		}()
+	}
+
+	wg.Wait()
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(full)
 }
 
 func (th *ThreadHandler) UpdateThread(w http.ResponseWriter, r *http.Request) {
@@ -120,12 +208,180 @@ func (th *ThreadHandler) UpdateThread(w http.ResponseWriter, r *http.Request) {
 
 	slug_or_id := mux.Vars(r)["slug_or_id"]
 
-	updatedThread, updateErr := th.tu.UpdateBySlugOrId(slug_or_id, threadToUpdate)
+	updatedThread, updateErr := th.tu.UpdateBySlugOrId(r.Context(), slug_or_id, threadToUpdate)
+	if updateErr == myerror.BadUpdate {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(updateErr)
+		return
+	}
+	if updateErr == myerror.ConflictError && threadToUpdate.Slug != nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(updateErr)
+		return
+	}
 	if updateErr != nil {
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(updateErr)
 		return
 	}
+	if markdown.Requested(r) {
+		th.md.Threads(updatedThread)
+	}
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(updatedThread)
 }
+
+func writeModerationError(w http.ResponseWriter, err error) {
+	switch err {
+	case myerror.BadUpdate:
+		w.WriteHeader(http.StatusBadRequest)
+	case myerror.NotExist:
+		w.WriteHeader(http.StatusNotFound)
+	case myerror.ConflictError:
+		w.WriteHeader(http.StatusConflict)
+	case myerror.Forbidden:
+		w.WriteHeader(http.StatusForbidden)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(err)
+}
+
+func (th *ThreadHandler) MoveThread(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+	move := &models.ThreadMove{}
+
+	err := json.NewDecoder(r.Body).Decode(move)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(err)
+		return
+	}
+
+	if authErr := th.uu.Authorize(r.Context(), move.Moderator); authErr != nil {
+		writeModerationError(w, authErr)
+		return
+	}
+
+	movedThread, moveErr := th.tu.Move(r.Context(), mux.Vars(r)["slug_or_id"], move)
+	if moveErr != nil {
+		writeModerationError(w, moveErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(movedThread)
+}
+
+func (th *ThreadHandler) MergeThread(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+	merge := &models.ThreadMerge{}
+
+	err := json.NewDecoder(r.Body).Decode(merge)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(err)
+		return
+	}
+
+	if authErr := th.uu.Authorize(r.Context(), merge.Moderator); authErr != nil {
+		writeModerationError(w, authErr)
+		return
+	}
+
+	mergedThread, mergeErr := th.tu.Merge(r.Context(), mux.Vars(r)["slug_or_id"], merge)
+	if mergeErr != nil {
+		writeModerationError(w, mergeErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(mergedThread)
+}
+
+func (th *ThreadHandler) SplitThread(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+	split := &models.ThreadSplit{}
+
+	err := json.NewDecoder(r.Body).Decode(split)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(err)
+		return
+	}
+
+	if authErr := th.uu.Authorize(r.Context(), split.Moderator); authErr != nil {
+		writeModerationError(w, authErr)
+		return
+	}
+
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+	newThread, splitErr := th.tu.Split(r.Context(), id, split)
+	if splitErr != nil {
+		writeModerationError(w, splitErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newThread)
+}
+
+func (th *ThreadHandler) GetUserThreads(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	nickname := mux.Vars(r)["nickname"]
+
+	u, _ := url.Parse(r.URL.RequestURI())
+
+	filter, err := cursor.ParseAuthorFilter(u.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(err)
+		return
+	}
+
+	author, err := th.uu.GetByNickname(r.Context(), nickname)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(myerror.UNotFound)
+		return
+	}
+	if !strings.EqualFold(author.Nickname, nickname) {
+		u.Path = "/api/user/" + author.Nickname + "/threads"
+		w.Header().Set("Location", u.RequestURI())
+		w.WriteHeader(http.StatusMovedPermanently)
+		return
+	}
+
+	if filter.Forum != "" {
+		if current, resolveErr := th.fu.ResolveSlug(r.Context(), filter.Forum); resolveErr == nil {
+			filter.Forum = current
+		}
+	}
+
+	threads, next, selectErr := th.tu.GetByAuthor(r.Context(), author.Nickname, filter)
+	if selectErr == myerror.InvalidCursor {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(selectErr)
+		return
+	}
+	if selectErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(selectErr)
+		return
+	}
+
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+	if markdown.Requested(r) {
+		th.md.Threads(threads...)
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(threads)
+}
@@ -4,9 +4,11 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"forum/internal/cursor"
+	"forum/internal/dbtx"
 	myerror "forum/internal/error"
 	"forum/internal/models"
-	"regexp"
+	"strings"
 )
 
 type ThreadRepository struct {
@@ -19,39 +21,25 @@ func NewThreadRepository(DB *sql.DB) *ThreadRepository {
 	}
 }
 
-func (tr *ThreadRepository) Insert(thread *models.Thread) (*models.Thread, error) {
-	tx, err := tr.DB.BeginTx(context.Background(), nil)
-	if err != nil {
-		return nil, myerror.InternalError
-	}
-
+func (tr *ThreadRepository) Insert(ctx context.Context, thread *models.Thread) (*models.Thread, error) {
 	newThread := &models.Thread{}
-	err = tx.QueryRow(`INSERT INTO thread (title, author, forum, message, votes, slug, created_at)
-	VALUES ($1, $2, COALESCE((SELECT slug FROM forum WHERE slug = $3), $3), $4, $5, $6, $7) RETURNING id, title, author, forum, message, votes, slug, created_at;`,
-		thread.Title, thread.Author, thread.Forum, thread.Message, thread.Votes, thread.Slug, thread.Created).Scan(&newThread.Id, &newThread.Title, &newThread.Author, &newThread.Forum, &newThread.Message, &newThread.Votes, &newThread.Slug, &newThread.Created)
-
+	err := dbtx.Run(ctx, tr.DB, func(tx *sql.Tx) error {
+		return tx.QueryRowContext(ctx, `INSERT INTO thread (title, author, forum, message, votes, slug, created_at)
+		VALUES ($1, $2, COALESCE((SELECT slug FROM forum WHERE slug = $3), (SELECT forum FROM forum_slug_alias WHERE slug = $3), $3), $4, $5, $6, $7) RETURNING id, title, author, forum, message, votes, slug, created_at;`,
+			thread.Title, thread.Author, thread.Forum, thread.Message, thread.Votes, thread.Slug, thread.Created).Scan(&newThread.Id, &newThread.Title, &newThread.Author, &newThread.Forum, &newThread.Message, &newThread.Votes, &newThread.Slug, &newThread.Created)
+	})
 	if err != nil {
-		tx.Rollback()
-		if match, _ := regexp.MatchString(`.*violates foreign.*`, err.Error()); match {
-			return nil, myerror.NotExist
-		} else {
-			return nil, myerror.ConflictError
-		}
-	}
-
-	err = tx.Commit()
-	if err != nil {
-		return nil, myerror.InternalError
+		return nil, dbtx.Classify(err, myerror.ConflictError)
 	}
 
 	return newThread, nil
 }
 
-func (tr *ThreadRepository) Select(id int32) (*models.Thread, error) {
+func (tr *ThreadRepository) Select(ctx context.Context, id int32) (*models.Thread, error) {
 	thread := models.Thread{}
 	var buf sql.NullString
 
-	err := tr.DB.QueryRow(
+	err := tr.DB.QueryRowContext(ctx,
 		"SELECT id, title, author, forum, message, votes, slug, created_at FROM thread WHERE id = $1", id).
 		Scan(&thread.Id, &thread.Title, &thread.Author, &thread.Forum, &thread.Message, &thread.Votes, &buf, &thread.Created)
 
@@ -66,9 +54,13 @@ func (tr *ThreadRepository) Select(id int32) (*models.Thread, error) {
 	return &thread, nil
 }
 
-func (tr *ThreadRepository) SelectBySlug(slug string) (*models.Thread, error) {
-	row := tr.DB.QueryRow(
-		"SELECT id, title, author, forum, message, votes, slug, created_at FROM thread WHERE slug = $1",
+func (tr *ThreadRepository) SelectBySlug(ctx context.Context, slug string) (*models.Thread, error) {
+	row := tr.DB.QueryRowContext(ctx,
+		`SELECT id, title, author, forum, message, votes, slug, created_at FROM thread WHERE slug = $1
+		UNION ALL
+		SELECT t.id, t.title, t.author, t.forum, t.message, t.votes, t.slug, t.created_at FROM thread AS t
+		JOIN thread_slug_alias AS a ON a.thread = t.id WHERE a.slug = $1
+		LIMIT 1`,
 		slug)
 
 	thread := models.Thread{}
@@ -85,9 +77,9 @@ func (tr *ThreadRepository) SelectBySlug(slug string) (*models.Thread, error) {
 	return &thread, nil
 }
 
-func (tr *ThreadRepository) SelectAll(forum string, limit int64, since string, isDescOrder bool) ([]*models.Thread, error) {
+func (tr *ThreadRepository) SelectAll(ctx context.Context, forum string, limit int64, since string, isDescOrder bool) ([]*models.Thread, error) {
 	var exists bool
-	err := tr.DB.QueryRow("SELECT exists (SELECT id FROM thread WHERE forum=$1)", forum).Scan(&exists)
+	err := tr.DB.QueryRowContext(ctx, "SELECT exists (SELECT id FROM thread WHERE forum=$1)", forum).Scan(&exists)
 	if err != nil || !exists {
 		return nil, myerror.NotExist
 	}
@@ -121,7 +113,7 @@ func (tr *ThreadRepository) SelectAll(forum string, limit int64, since string, i
 		arr = append(arr, limit)
 	}
 
-	rows, err := tr.DB.Query(query, arr...)
+	rows, err := tr.DB.QueryContext(ctx, query, arr...)
 	if err != nil {
 		return nil, myerror.InternalError
 	}
@@ -145,8 +137,8 @@ func (tr *ThreadRepository) SelectAll(forum string, limit int64, since string, i
 	return threads, nil
 }
 
-func (tr *ThreadRepository) SelectForumByThreadId(id int64) (*string, error) {
-	row := tr.DB.QueryRow("SELECT forum FROM thread WHERE id = $1", id)
+func (tr *ThreadRepository) SelectForumByThreadId(ctx context.Context, id int64) (*string, error) {
+	row := tr.DB.QueryRowContext(ctx, "SELECT forum FROM thread WHERE id = $1", id)
 
 	var forum string
 	err := row.Scan(&forum)
@@ -157,8 +149,11 @@ func (tr *ThreadRepository) SelectForumByThreadId(id int64) (*string, error) {
 	return &forum, nil
 }
 
-func (tr *ThreadRepository) SelectThreadIdForumBySlug(slug string) (*int64, *string, error) {
-	row := tr.DB.QueryRow("SELECT id, forum FROM thread WHERE slug = $1", slug)
+func (tr *ThreadRepository) SelectThreadIdForumBySlug(ctx context.Context, slug string) (*int64, *string, error) {
+	row := tr.DB.QueryRowContext(ctx, `SELECT id, forum FROM thread WHERE slug = $1
+	UNION ALL
+	SELECT t.id, t.forum FROM thread AS t JOIN thread_slug_alias AS a ON a.thread = t.id WHERE a.slug = $1
+	LIMIT 1`, slug)
 
 	var id int64
 	var forum string
@@ -170,57 +165,507 @@ func (tr *ThreadRepository) SelectThreadIdForumBySlug(slug string) (*int64, *str
 	return &id, &forum, nil
 }
 
-func (tr *ThreadRepository) Update(id int64, threadToUpdate *models.ThreadUpdate) (*models.Thread, error) {
-	tx, err := tr.DB.BeginTx(context.Background(), nil)
+// UniqueSlug returns base or the first of base-2, base-3, ... that is used
+// neither by a thread nor by a thread slug alias.
+func (tr *ThreadRepository) UniqueSlug(ctx context.Context, base string) (string, error) {
+	var slug string
+	err := tr.DB.QueryRowContext(ctx, `SELECT candidate FROM (
+		SELECT n, CASE WHEN n = 1 THEN $1 ELSE $1 || '-' || n END AS candidate FROM generate_series(1, 1000) AS n
+	) AS c
+	WHERE NOT EXISTS (SELECT 1 FROM thread WHERE slug = c.candidate)
+	AND NOT EXISTS (SELECT 1 FROM thread_slug_alias WHERE slug = c.candidate)
+	ORDER BY n LIMIT 1`, base).Scan(&slug)
 	if err != nil {
-		return nil, myerror.InternalError
+		return "", myerror.InternalError
+	}
+
+	return slug, nil
+}
+
+func (tr *ThreadRepository) Update(ctx context.Context, id int64, threadToUpdate *models.ThreadUpdate) (*models.Thread, error) {
+	var thread *models.Thread
+	err := dbtx.Run(ctx, tr.DB, func(tx *sql.Tx) error {
+		var err error
+		thread, err = tr.update(ctx, tx, id, threadToUpdate)
+		return err
+	})
+	if err != nil {
+		return nil, dbtx.Classify(err, myerror.InternalError)
+	}
+
+	return thread, nil
+}
+
+func (tr *ThreadRepository) UpdateBySlug(ctx context.Context, slug string, threadToUpdate *models.ThreadUpdate) (*models.Thread, error) {
+	var thread *models.Thread
+	err := dbtx.Run(ctx, tr.DB, func(tx *sql.Tx) error {
+		var id int64
+		err := tx.QueryRowContext(ctx, `SELECT id FROM thread WHERE slug = $1
+		UNION ALL
+		SELECT thread FROM thread_slug_alias WHERE slug = $1
+		LIMIT 1`, slug).Scan(&id)
+		if err != nil {
+			return dbtx.Fail(err, myerror.NotExist)
+		}
+
+		thread, err = tr.update(ctx, tx, id, threadToUpdate)
+		return err
+	})
+	if err != nil {
+		return nil, dbtx.Classify(err, myerror.InternalError)
+	}
+
+	return thread, nil
+}
+
+func (tr *ThreadRepository) update(ctx context.Context, tx *sql.Tx, id int64, threadToUpdate *models.ThreadUpdate) (*models.Thread, error) {
+	if threadToUpdate.Slug != nil {
+		if err := tr.renameSlug(ctx, tx, id, *threadToUpdate.Slug); err != nil {
+			return nil, err
+		}
 	}
 
 	thread := &models.Thread{}
-	err = tx.QueryRow(`UPDATE thread SET message = COALESCE($2, message), title = COALESCE($3, title) WHERE id = $1
-	RETURNING id, author, title, forum, message, votes, slug, created_at`, id, threadToUpdate.Message, threadToUpdate.Title).
+	err := tx.QueryRowContext(ctx, `UPDATE thread SET message = COALESCE($2, message), title = COALESCE($3, title), slug = COALESCE($4, slug) WHERE id = $1
+	RETURNING id, author, title, forum, message, votes, slug, created_at`, id, threadToUpdate.Message, threadToUpdate.Title, threadToUpdate.Slug).
 		Scan(&thread.Id, &thread.Author, &thread.Title, &thread.Forum, &thread.Message, &thread.Votes, &thread.Slug, &thread.Created)
 
 	if err != nil {
-		tx.Rollback()
-		if match, _ := regexp.MatchString(`.*no rows.*`, err.Error()); match {
-			return nil, myerror.NotExist
-		} else {
-			return nil, myerror.ConflictError
+		return nil, dbtx.Fail(err, myerror.ConflictError)
+	}
+
+	return thread, nil
+}
+
+// renameSlug keeps the current slug of the thread as an alias, so that old
+// links keep resolving after the thread gets a new one.
+func (tr *ThreadRepository) renameSlug(ctx context.Context, tx *sql.Tx, id int64, newSlug string) error {
+	var oldSlug sql.NullString
+	err := tx.QueryRowContext(ctx, "SELECT slug FROM thread WHERE id = $1 FOR UPDATE", id).Scan(&oldSlug)
+	if err != nil {
+		return dbtx.Fail(err, myerror.NotExist)
+	}
+
+	if strings.EqualFold(oldSlug.String, newSlug) {
+		return nil
+	}
+
+	var taken bool
+	err = tx.QueryRowContext(ctx, "SELECT exists (SELECT 1 FROM thread_slug_alias WHERE slug = $1 AND thread != $2)", newSlug, id).Scan(&taken)
+	if err != nil {
+		return dbtx.Fail(err, myerror.InternalError)
+	}
+	if taken {
+		return myerror.ConflictError
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM thread_slug_alias WHERE slug = $1", newSlug)
+	if err != nil {
+		return dbtx.Fail(err, myerror.InternalError)
+	}
+
+	if oldSlug.String != "" {
+		_, err = tx.ExecContext(ctx, "INSERT INTO thread_slug_alias (slug, thread) VALUES ($1, $2) ON CONFLICT (slug) DO UPDATE SET thread = EXCLUDED.thread", oldSlug.String, id)
+		if err != nil {
+			return dbtx.Fail(err, myerror.InternalError)
 		}
 	}
 
-	err = tx.Commit()
+	return nil
+}
+
+// Move puts the thread with all of its posts into another forum and moves
+// forum counters and forum users along.
+func (tr *ThreadRepository) Move(ctx context.Context, id int64, forum string) (*models.Thread, error) {
+	var thread *models.Thread
+	err := dbtx.Run(ctx, tr.DB, func(tx *sql.Tx) error {
+		var oldForum string
+		err := tx.QueryRowContext(ctx, "SELECT forum FROM thread WHERE id = $1 FOR UPDATE", id).Scan(&oldForum)
+		if err != nil {
+			return dbtx.Fail(err, myerror.NotExist)
+		}
+
+		var newForum string
+		err = tx.QueryRowContext(ctx, `SELECT slug FROM forum WHERE slug = $1
+		UNION ALL
+		SELECT forum FROM forum_slug_alias WHERE slug = $1
+		LIMIT 1`, forum).Scan(&newForum)
+		if err != nil {
+			return dbtx.Fail(err, myerror.NotExist)
+		}
+
+		if !strings.EqualFold(oldForum, newForum) {
+			authors, err := threadAuthors(ctx, tx, id)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.ExecContext(ctx, "UPDATE thread SET forum = $2 WHERE id = $1", id, newForum)
+			if err != nil {
+				return err
+			}
+
+			moved, err := moveThreadPosts(ctx, tx, id, id, newForum)
+			if err != nil {
+				return err
+			}
+
+			if err = shiftForumCounters(ctx, tx, oldForum, newForum, 1, moved); err != nil {
+				return err
+			}
+
+			if err = moveForumUsers(ctx, tx, authors, oldForum, newForum); err != nil {
+				return err
+			}
+
+			if err = recomputeReputation(ctx, tx, oldForum, newForum); err != nil {
+				return err
+			}
+		}
+
+		thread, err = selectThreadTx(ctx, tx, id)
+		return err
+	})
 	if err != nil {
-		return nil, myerror.InternalError
+		return nil, dbtx.Classify(err, myerror.InternalError)
 	}
 
 	return thread, nil
 }
 
-func (tr *ThreadRepository) UpdateBySlug(slug string, threadToUpdate *models.ThreadUpdate) (*models.Thread, error) {
-	tx, err := tr.DB.BeginTx(context.Background(), nil)
+// Merge moves posts and votes of the source thread into the target one and
+// deletes the source. Slugs of the source become aliases of the target.
+func (tr *ThreadRepository) Merge(ctx context.Context, source int64, target int64) (*models.Thread, error) {
+	if source == target {
+		return nil, myerror.ConflictError
+	}
+
+	var thread *models.Thread
+	err := dbtx.Run(ctx, tr.DB, func(tx *sql.Tx) error {
+		forums := map[int64]string{}
+		slugs := map[int64]string{}
+		rows, err := tx.QueryContext(ctx, "SELECT id, forum, slug FROM thread WHERE id IN ($1, $2) ORDER BY id FOR UPDATE", source, target)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id int64
+			var forum string
+			var slug sql.NullString
+			if err := rows.Scan(&id, &forum, &slug); err != nil {
+				rows.Close()
+				return err
+			}
+			forums[id] = forum
+			slugs[id] = slug.String
+		}
+		rows.Close()
+
+		if len(forums) != 2 {
+			return myerror.NotExist
+		}
+
+		authors, err := threadAuthors(ctx, tx, source)
+		if err != nil {
+			return err
+		}
+
+		moved, err := moveThreadPosts(ctx, tx, source, target, forums[target])
+		if err != nil {
+			return err
+		}
+
+		// a voter who voted for both threads keeps the vote given to the target
+		_, err = tx.ExecContext(ctx, `INSERT INTO vote (author, voice, weight, thread, updated_at)
+		SELECT author, voice, weight, $2, updated_at FROM vote WHERE thread = $1
+		ON CONFLICT (author, thread) DO NOTHING`, source, target)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "DELETE FROM vote WHERE thread = $1", source)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE thread SET votes = (SELECT COALESCE(SUM(voice * weight), 0) FROM vote WHERE thread = $1) WHERE id = $1", target)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO thread_subscription (nickname, thread, created_at)
+		SELECT nickname, $2, created_at FROM thread_subscription WHERE thread = $1
+		ON CONFLICT (thread, nickname) DO NOTHING`, source, target)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "DELETE FROM thread_subscription WHERE thread = $1", source)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE thread_slug_alias SET thread = $2 WHERE thread = $1", source, target)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "DELETE FROM thread WHERE id = $1", source)
+		if err != nil {
+			return err
+		}
+
+		if slugs[source] != "" {
+			_, err = tx.ExecContext(ctx, "INSERT INTO thread_slug_alias (slug, thread) VALUES ($1, $2) ON CONFLICT (slug) DO UPDATE SET thread = EXCLUDED.thread", slugs[source], target)
+			if err != nil {
+				return err
+			}
+		}
+
+		if err = shiftForumCounters(ctx, tx, forums[source], forums[target], 1, moved); err != nil {
+			return err
+		}
+		// the source thread is gone rather than moved
+		_, err = tx.ExecContext(ctx, "UPDATE forum SET threads = threads - 1 WHERE slug = $1", forums[target])
+		if err != nil {
+			return err
+		}
+
+		if err = moveForumUsers(ctx, tx, authors, forums[source], forums[target]); err != nil {
+			return err
+		}
+
+		if err = recomputeReputation(ctx, tx, forums[source], forums[target]); err != nil {
+			return err
+		}
+
+		thread, err = selectThreadTx(ctx, tx, target)
+		return err
+	})
 	if err != nil {
-		return nil, myerror.InternalError
+		return nil, dbtx.Classify(err, myerror.InternalError)
 	}
 
+	return thread, nil
+}
+
+// Split turns the post into the first post of a new thread and moves all of
+// its replies along. Paths are cut so that the post becomes a root.
+func (tr *ThreadRepository) Split(ctx context.Context, postId int64, split *models.ThreadSplit) (*models.Thread, error) {
+	newThread := &models.Thread{}
+	err := dbtx.Run(ctx, tr.DB, func(tx *sql.Tx) error {
+		var oldThread int64
+		var depth int
+		post := models.Post{}
+		err := tx.QueryRowContext(ctx, `SELECT thread, forum, author, message, created_at, COALESCE(cardinality(path), 0) FROM post WHERE id = $1 FOR UPDATE`, postId).
+			Scan(&oldThread, &post.Forum, &post.Author, &post.Message, &post.Created, &depth)
+		if err != nil {
+			return dbtx.Fail(err, myerror.NotExist)
+		}
+
+		message := split.Message
+		if message == "" {
+			message = post.Message
+		}
+
+		err = tx.QueryRowContext(ctx, `INSERT INTO thread (title, author, forum, message, slug, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, title, author, forum, message, votes, slug, created_at`,
+			split.Title, post.Author, post.Forum, message, split.Slug, post.Created).
+			Scan(&newThread.Id, &newThread.Title, &newThread.Author, &newThread.Forum, &newThread.Message, &newThread.Votes, &newThread.Slug, &newThread.Created)
+		if err != nil {
+			return dbtx.Fail(err, myerror.ConflictError)
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE post SET thread = $3, path = path[$4:] WHERE thread = $1 AND path @> ARRAY[$2::BIGINT]`,
+			oldThread, postId, newThread.Id, depth+1)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE post SET thread = $2, parent = 0, path = ARRAY []::BIGINT[] WHERE id = $1`, postId, newThread.Id)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, dbtx.Classify(err, myerror.InternalError)
+	}
+
+	return newThread, nil
+}
+
+func selectThreadTx(ctx context.Context, tx *sql.Tx, id int64) (*models.Thread, error) {
 	thread := &models.Thread{}
-	err = tx.QueryRow(`UPDATE thread SET message = COALESCE($2, message), title = COALESCE($3, title) WHERE slug = $1
-	RETURNING id, author, title, forum, message, votes, slug, created_at`, slug, threadToUpdate.Message, threadToUpdate.Title).
-		Scan(&thread.Id, &thread.Author, &thread.Title, &thread.Forum, &thread.Message, &thread.Votes, &thread.Slug, &thread.Created)
+	var buf sql.NullString
+	err := tx.QueryRowContext(ctx, "SELECT id, title, author, forum, message, votes, slug, created_at FROM thread WHERE id = $1", id).
+		Scan(&thread.Id, &thread.Title, &thread.Author, &thread.Forum, &thread.Message, &thread.Votes, &buf, &thread.Created)
 	if err != nil {
-		tx.Rollback()
-		if match, _ := regexp.MatchString(`.*no rows.*`, err.Error()); match {
-			return nil, myerror.NotExist
-		} else {
-			return nil, myerror.ConflictError
+		return nil, dbtx.Fail(err, myerror.NotExist)
+	}
+	thread.Slug = buf.String
+
+	return thread, nil
+}
+
+func threadAuthors(ctx context.Context, tx *sql.Tx, id int64) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT author FROM thread WHERE id = $1 UNION SELECT author FROM post WHERE thread = $1", id)
+	if err != nil {
+		return nil, dbtx.Fail(err, myerror.InternalError)
+	}
+	defer rows.Close()
+
+	authors := []string{}
+	for rows.Next() {
+		var author string
+		if err := rows.Scan(&author); err != nil {
+			return nil, dbtx.Fail(err, myerror.InternalError)
 		}
+		authors = append(authors, author)
+	}
+
+	return authors, nil
+}
+
+func moveThreadPosts(ctx context.Context, tx *sql.Tx, from int64, to int64, forum string) (int64, error) {
+	result, err := tx.ExecContext(ctx, "UPDATE post SET thread = $2, forum = $3 WHERE thread = $1", from, to, forum)
+	if err != nil {
+		return 0, dbtx.Fail(err, myerror.InternalError)
+	}
+
+	moved, err := result.RowsAffected()
+	if err != nil {
+		return 0, dbtx.Fail(err, myerror.InternalError)
+	}
+
+	return moved, nil
+}
+
+func shiftForumCounters(ctx context.Context, tx *sql.Tx, from string, to string, threads int64, posts int64) error {
+	if strings.EqualFold(from, to) {
+		return nil
 	}
 
-	err = tx.Commit()
+	_, err := tx.ExecContext(ctx, `UPDATE forum SET
+		threads = threads + (CASE WHEN slug = $2 THEN $3 ELSE -$3 END),
+		posts = posts + (CASE WHEN slug = $2 THEN $4 ELSE -$4 END)
+	WHERE slug IN ($1, $2)`, from, to, threads, posts)
+	if err != nil {
+		return dbtx.Fail(err, myerror.InternalError)
+	}
+
+	return nil
+}
+
+// moveForumUsers adds authors to the forum users of to and drops them from
+// from unless they still have threads or posts there.
+func moveForumUsers(ctx context.Context, tx *sql.Tx, authors []string, from string, to string) error {
+	if strings.EqualFold(from, to) || len(authors) == 0 {
+		return nil
+	}
+
+	placeholders := ""
+	names := []interface{}{}
+	for i, author := range authors {
+		if i > 0 {
+			placeholders += ", "
+		}
+		placeholders += fmt.Sprintf("$%d", i+2)
+		names = append(names, author)
+	}
+
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`INSERT INTO forum_users (nickname, fullname, email, about, forum)
+	SELECT nickname, fullname, email, about, $1 FROM users WHERE nickname IN (%s)
+	ON CONFLICT DO NOTHING`, placeholders), append([]interface{}{to}, names...)...)
+	if err != nil {
+		return dbtx.Fail(err, myerror.InternalError)
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM forum_users AS fu WHERE fu.forum = $1 AND fu.nickname IN (%s)
+	AND NOT EXISTS (SELECT 1 FROM thread WHERE forum = $1 AND author = fu.nickname)
+	AND NOT EXISTS (SELECT 1 FROM post WHERE forum = $1 AND author = fu.nickname)`, placeholders), append([]interface{}{from}, names...)...)
+	if err != nil {
+		return dbtx.Fail(err, myerror.InternalError)
+	}
+
+	return nil
+}
+
+// recomputeReputation rebuilds reputation of both forums after votes were
+// moved between them.
+func recomputeReputation(ctx context.Context, tx *sql.Tx, from string, to string) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM user_reputation WHERE forum IN ($1, $2)", from, to)
+	if err != nil {
+		return dbtx.Fail(err, myerror.InternalError)
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO user_reputation (nickname, forum, thread_score, post_score)
+	SELECT nickname, forum, thread_score, post_score FROM user_reputation_actual WHERE forum IN ($1, $2)`, from, to)
+	if err != nil {
+		return dbtx.Fail(err, myerror.InternalError)
+	}
+
+	return nil
+}
+
+// SelectByAuthor pages through the threads of one author ordered by
+// (created_at, id), the same way PostRepository.SelectByAuthor does.
+func (tr *ThreadRepository) SelectByAuthor(ctx context.Context, author string, filter *models.AuthorFilter) ([]*models.Thread, error) {
+	query := "SELECT id, title, author, forum, message, votes, slug, created_at FROM thread WHERE author = $1"
+	arr := []interface{}{
+		author,
+	}
+
+	if filter.Forum != "" {
+		query += fmt.Sprintf(" AND forum = $%d", len(arr)+1)
+		arr = append(arr, filter.Forum)
+	}
+	if !filter.From.IsZero() {
+		query += fmt.Sprintf(" AND created_at >= $%d", len(arr)+1)
+		arr = append(arr, filter.From)
+	}
+	if !filter.To.IsZero() {
+		query += fmt.Sprintf(" AND created_at < $%d", len(arr)+1)
+		arr = append(arr, filter.To)
+	}
+
+	order, sign := "ASC", ">"
+	if filter.Desc {
+		order, sign = "DESC", "<"
+	}
+
+	if filter.Cursor != "" {
+		created, id, err := cursor.Decode(filter.Cursor, filter.Scope)
+		if err != nil {
+			return nil, err
+		}
+		query += fmt.Sprintf(" AND (created_at, id) %s ($%d, $%d)", sign, len(arr)+1, len(arr)+2)
+		arr = append(arr, created, id)
+	}
+
+	query += fmt.Sprintf(" ORDER BY created_at %s, id %s LIMIT $%d", order, order, len(arr)+1)
+	arr = append(arr, filter.Limit)
+
+	rows, err := tr.DB.QueryContext(ctx, query, arr...)
 	if err != nil {
 		return nil, myerror.InternalError
 	}
+	defer rows.Close()
 
-	return thread, nil
+	threads := []*models.Thread{}
+
+	for rows.Next() {
+		thread := models.Thread{}
+		var buf sql.NullString
+		if err := rows.Scan(&thread.Id, &thread.Title, &thread.Author, &thread.Forum, &thread.Message, &thread.Votes, &buf, &thread.Created); err != nil {
+			return nil, myerror.InternalError
+		}
+		if buf.Valid {
+			thread.Slug = buf.String
+		}
+
+		threads = append(threads, &thread)
+	}
+
+	return threads, nil
 }
@@ -1,8 +1,11 @@
 package usecase
 
 import (
+	"context"
+	"forum/internal/cursor"
 	"forum/internal/models"
 	"forum/internal/pkg/thread/repository"
+	"forum/internal/slug"
 	"strconv"
 	"time"
 
@@ -19,23 +22,50 @@ func NewThreadUsecase(tr *repository.ThreadRepository) *ThreadUsecase {
 	}
 }
 
-func (tu *ThreadUsecase) Create(thread *models.Thread) (*models.Thread, error) {
+const slugAttempts = 3
+
+func (tu *ThreadUsecase) Create(ctx context.Context, thread *models.Thread) (*models.Thread, error) {
 	if thread.Created.IsZero() {
 		thread.Created = time.Now()
 	}
 
-	return tu.tr.Insert(thread)
+	if thread.Slug != "" {
+		if !slug.Valid(thread.Slug) {
+			return nil, myerror.InvalidSlug
+		}
+		return tu.tr.Insert(ctx, thread)
+	}
+
+	// a concurrent insert may take the generated slug, so try a few times.
+	// The client did not ask for the slug, so losing every race is not a
+	// conflict with the thread that has it.
+	base := slug.FromTitle(thread.Title, "thread")
+	for attempt := 1; ; attempt++ {
+		unique, err := tu.tr.UniqueSlug(ctx, base)
+		if err != nil {
+			return nil, err
+		}
+		thread.Slug = unique
+
+		newThread, err := tu.tr.Insert(ctx, thread)
+		if err != myerror.ConflictError {
+			return newThread, err
+		}
+		if attempt == slugAttempts {
+			return nil, myerror.SlugUnavailable
+		}
+	}
 }
 
-func (tu *ThreadUsecase) Get(id int32) (*models.Thread, error) {
-	return tu.tr.Select(id)
+func (tu *ThreadUsecase) Get(ctx context.Context, id int32) (*models.Thread, error) {
+	return tu.tr.Select(ctx, id)
 }
 
-func (tu *ThreadUsecase) GetBySlug(slug string) (*models.Thread, error) {
-	return tu.tr.SelectBySlug(slug)
+func (tu *ThreadUsecase) GetBySlug(ctx context.Context, slug string) (*models.Thread, error) {
+	return tu.tr.SelectBySlug(ctx, slug)
 }
 
-func (tu *ThreadUsecase) GetBySlugOrId(slug_or_id string) (*models.Thread, error) {
+func (tu *ThreadUsecase) GetBySlugOrId(ctx context.Context, slug_or_id string) (*models.Thread, error) {
 	var slug string
 	var id int32
 	passedId, passedSlug := false, false
@@ -53,12 +83,12 @@ func (tu *ThreadUsecase) GetBySlugOrId(slug_or_id string) (*models.Thread, error
 	thread = nil
 
 	if passedId {
-		thread, err = tu.tr.Select(id)
+		thread, err = tu.tr.Select(ctx, id)
 		if err != nil {
 			return nil, myerror.NotExist
 		}
 	} else if passedSlug {
-		thread, err = tu.tr.SelectBySlug(slug)
+		thread, err = tu.tr.SelectBySlug(ctx, slug)
 		if err != nil {
 			return nil, myerror.NotExist
 		}
@@ -71,7 +101,11 @@ func (tu *ThreadUsecase) GetBySlugOrId(slug_or_id string) (*models.Thread, error
 	return thread, nil
 }
 
-func (tu *ThreadUsecase) UpdateBySlugOrId(slug_or_id string, threadToUpdate *models.ThreadUpdate) (*models.Thread, error) {
+func (tu *ThreadUsecase) UpdateBySlugOrId(ctx context.Context, slug_or_id string, threadToUpdate *models.ThreadUpdate) (*models.Thread, error) {
+	if threadToUpdate.Slug != nil && !slug.Valid(*threadToUpdate.Slug) {
+		return nil, myerror.BadUpdate
+	}
+
 	var slug string
 	var id int32
 	passedId, passedSlug := false, false
@@ -89,12 +123,12 @@ func (tu *ThreadUsecase) UpdateBySlugOrId(slug_or_id string, threadToUpdate *mod
 	updatedThread = nil
 
 	if passedId {
-		updatedThread, err = tu.tr.Update(int64(id), threadToUpdate)
+		updatedThread, err = tu.tr.Update(ctx, int64(id), threadToUpdate)
 		if err != nil {
 			return nil, err
 		}
 	} else if passedSlug {
-		updatedThread, err = tu.tr.UpdateBySlug(slug, threadToUpdate)
+		updatedThread, err = tu.tr.UpdateBySlug(ctx, slug, threadToUpdate)
 		if err != nil {
 			return nil, err
 		}
@@ -107,6 +141,85 @@ func (tu *ThreadUsecase) UpdateBySlugOrId(slug_or_id string, threadToUpdate *mod
 	return updatedThread, nil
 }
 
-func (tu *ThreadUsecase) GetAll(forum string, limit int64, since string, isDescOrder bool) ([]*models.Thread, error) {
-	return tu.tr.SelectAll(forum, limit, since, isDescOrder)
+func (tu *ThreadUsecase) GetAll(ctx context.Context, forum string, limit int64, since string, isDescOrder bool) ([]*models.Thread, error) {
+	return tu.tr.SelectAll(ctx, forum, limit, since, isDescOrder)
+}
+
+// GetByAuthor returns a page of threads and the cursor of the next page,
+// which is empty once the last page has been reached.
+func (tu *ThreadUsecase) GetByAuthor(ctx context.Context, author string, filter *models.AuthorFilter) ([]*models.Thread, string, error) {
+	threads, err := tu.tr.SelectByAuthor(ctx, author, filter)
+	if err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	if int64(len(threads)) == filter.Limit {
+		last := threads[len(threads)-1]
+		next = cursor.Encode(filter.Scope, last.Created, int64(last.Id))
+	}
+
+	return threads, next, nil
+}
+
+func (tu *ThreadUsecase) resolveId(ctx context.Context, slug_or_id string) (int64, error) {
+	if id, err := strconv.Atoi(slug_or_id); err == nil {
+		return int64(id), nil
+	}
+
+	pId, _, err := tu.tr.SelectThreadIdForumBySlug(ctx, slug_or_id)
+	if err != nil {
+		return 0, myerror.NotExist
+	}
+
+	return *pId, nil
+}
+
+func (tu *ThreadUsecase) Move(ctx context.Context, slug_or_id string, move *models.ThreadMove) (*models.Thread, error) {
+	if move.Forum == "" {
+		return nil, myerror.BadUpdate
+	}
+
+	id, err := tu.resolveId(ctx, slug_or_id)
+	if err != nil {
+		return nil, err
+	}
+
+	return tu.tr.Move(ctx, id, move.Forum)
+}
+
+func (tu *ThreadUsecase) Merge(ctx context.Context, slug_or_id string, merge *models.ThreadMerge) (*models.Thread, error) {
+	if merge.Into == "" {
+		return nil, myerror.BadUpdate
+	}
+
+	source, err := tu.resolveId(ctx, slug_or_id)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := tu.resolveId(ctx, merge.Into)
+	if err != nil {
+		return nil, err
+	}
+
+	return tu.tr.Merge(ctx, source, target)
+}
+
+func (tu *ThreadUsecase) Split(ctx context.Context, postId int64, split *models.ThreadSplit) (*models.Thread, error) {
+	if split.Title == "" {
+		return nil, myerror.BadUpdate
+	}
+
+	if split.Slug == "" {
+		unique, err := tu.tr.UniqueSlug(ctx, slug.FromTitle(split.Title, "thread"))
+		if err != nil {
+			return nil, err
+		}
+		split.Slug = unique
+	} else if !slug.Valid(split.Slug) {
+		return nil, myerror.BadUpdate
+	}
+
+	return tu.tr.Split(ctx, postId, split)
 }
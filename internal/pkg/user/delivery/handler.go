@@ -3,6 +3,7 @@ package delivery
 import (
 	"encoding/json"
 	"net/http"
+	"strings"
 
 	"forum/internal/models"
 	"forum/internal/pkg/user/usecase"
@@ -27,6 +28,8 @@ func (uh *UserHandler) Routing(r *mux.Router) {
 	s.HandleFunc("/{nickname}/create", http.HandlerFunc(uh.Create)).Methods(http.MethodPost)
 	s.HandleFunc("/{nickname}/profile", http.HandlerFunc(uh.Profile)).Methods(http.MethodGet)
 	s.HandleFunc("/{nickname}/profile", http.HandlerFunc(uh.Update)).Methods(http.MethodPost)
+	s.HandleFunc("/{nickname}/rename", http.HandlerFunc(uh.Rename)).Methods(http.MethodPost)
+	s.HandleFunc("/{nickname}/summary", http.HandlerFunc(uh.Summary)).Methods(http.MethodGet)
 }
 
 func (uh *UserHandler) Create(w http.ResponseWriter, r *http.Request) {
@@ -46,9 +49,9 @@ func (uh *UserHandler) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	createdUser, createErr := uh.uu.Create(user)
+	createdUser, createErr := uh.uu.Create(r.Context(), user)
 	if createErr == myerror.ConflictError {
-		conflictUsers, _ := uh.uu.GetConflict(user.Nickname, user.Email)
+		conflictUsers, _ := uh.uu.GetConflict(r.Context(), user.Nickname, user.Email)
 		w.WriteHeader(http.StatusConflict)
 		json.NewEncoder(w).Encode(conflictUsers)
 		return
@@ -65,13 +68,21 @@ func (uh *UserHandler) Profile(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	nickname := vars["nickname"]
 
-	user, err := uh.uu.GetByNickname(nickname)
+	user, err := uh.uu.GetProfile(r.Context(), nickname)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(myerror.UNotFound)
 		return
 	}
 
+	if !strings.EqualFold(nickname, user.Nickname) {
+		// requested by an old nickname, point the client to the current one
+		w.Header().Set("Location", "/api/user/"+user.Nickname+"/profile")
+		w.WriteHeader(http.StatusMovedPermanently)
+		json.NewEncoder(w).Encode(user)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(user)
 }
@@ -91,7 +102,7 @@ func (uh *UserHandler) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	updatedUser, updateErr := uh.uu.Update(nickname, toUpdate)
+	updatedUser, updateErr := uh.uu.Update(r.Context(), nickname, toUpdate)
 	if updateErr == myerror.NotExist {
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(updateErr)
@@ -106,3 +117,65 @@ func (uh *UserHandler) Update(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(updatedUser)
 }
+
+func (uh *UserHandler) Rename(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+	nickname := mux.Vars(r)["nickname"]
+
+	rename := &models.UserRename{}
+
+	err := json.NewDecoder(r.Body).Decode(rename)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(err)
+		return
+	}
+
+	renamedUser, renameErr := uh.uu.Rename(r.Context(), nickname, rename)
+	if renameErr == myerror.BadUpdate {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(renameErr)
+		return
+	}
+	if renameErr == myerror.NotExist {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(renameErr)
+		return
+	}
+	if renameErr == myerror.ConflictError {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(renameErr)
+		return
+	}
+	if renameErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(renameErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(renamedUser)
+}
+
+func (uh *UserHandler) Summary(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	nickname := mux.Vars(r)["nickname"]
+
+	summary, err := uh.uu.GetSummary(r.Context(), nickname)
+	if err == myerror.UNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(err)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(summary)
+}
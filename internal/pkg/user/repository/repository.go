@@ -3,9 +3,10 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"forum/internal/dbtx"
 	myerror "forum/internal/error"
 	"forum/internal/models"
-	"regexp"
+	"strings"
 )
 
 type UserRepository struct {
@@ -18,54 +19,40 @@ func NewUserRepository(DB *sql.DB) *UserRepository {
 	}
 }
 
-func (ur *UserRepository) Insert(user *models.User) (*models.User, error) {
-	tx, err := ur.DB.BeginTx(context.Background(), nil)
-	if err != nil {
-		return nil, myerror.InternalError
-	}
-
+func (ur *UserRepository) Insert(ctx context.Context, user *models.User) (*models.User, error) {
 	newUser := &models.User{}
-	err = tx.QueryRow(`INSERT INTO users (nickname, fullname, about, email)
-						VALUES ($1, $2, $3, $4) RETURNING nickname, fullname, about, email;`,
-		user.Nickname, user.Fullname, user.About, user.Email).Scan(&newUser.Nickname, &newUser.Fullname, &newUser.About, &newUser.Email)
-
-	if err != nil {
-		tx.Rollback()
-		if match, _ := regexp.MatchString(`.*no rows.*`, err.Error()); match {
-			return nil, myerror.NotExist
-		} else {
-			return nil, myerror.ConflictError
-		}
-	}
-
-	err = tx.Commit()
+	err := dbtx.Run(ctx, ur.DB, func(tx *sql.Tx) error {
+		return tx.QueryRowContext(ctx, `INSERT INTO users (nickname, fullname, about, email)
+							VALUES ($1, $2, $3, $4) RETURNING nickname, fullname, about, email;`,
+			user.Nickname, user.Fullname, user.About, user.Email).Scan(&newUser.Nickname, &newUser.Fullname, &newUser.About, &newUser.Email)
+	})
 	if err != nil {
-		return nil, myerror.InternalError
+		return nil, dbtx.Classify(err, myerror.ConflictError)
 	}
 
 	return newUser, nil
 }
 
-func (ur *UserRepository) SelectByNickname(nickname string) (*models.User, error) {
+func (ur *UserRepository) SelectByNickname(ctx context.Context, nickname string) (*models.User, error) {
 	user := &models.User{}
 
-	err := ur.DB.QueryRow(
-		"SELECT nickname, fullname, about, email FROM users WHERE nickname = $1",
+	err := ur.DB.QueryRowContext(ctx,
+		`SELECT nickname, fullname, about, email FROM users WHERE nickname = $1
+		UNION ALL
+		SELECT u.nickname, u.fullname, u.about, u.email FROM users AS u
+		JOIN user_nickname_alias AS a ON a.target = u.nickname WHERE a.nickname = $1
+		LIMIT 1`,
 		nickname).Scan(&user.Nickname, &user.Fullname, &user.About, &user.Email)
 
 	if err != nil {
-		if match, _ := regexp.MatchString(`.*no rows.*`, err.Error()); match {
-			return nil, myerror.NotExist
-		} else {
-			return nil, myerror.ConflictError
-		}
+		return nil, dbtx.Classify(err, myerror.ConflictError)
 	}
 
 	return user, nil
 }
 
-func (ur *UserRepository) SelectByEmail(email string) (*models.User, error) {
-	row := ur.DB.QueryRowContext(context.Background(),
+func (ur *UserRepository) SelectByEmail(ctx context.Context, email string) (*models.User, error) {
+	row := ur.DB.QueryRowContext(ctx,
 		"SELECT nickname, fullname, about, email FROM users WHERE email = $1",
 		email)
 
@@ -78,8 +65,8 @@ func (ur *UserRepository) SelectByEmail(email string) (*models.User, error) {
 	return &user, nil
 }
 
-func (ur *UserRepository) SelectConflict(nickname string, email string) ([]*models.User, error) {
-	rows, err := ur.DB.Query(
+func (ur *UserRepository) SelectConflict(ctx context.Context, nickname string, email string) ([]*models.User, error) {
+	rows, err := ur.DB.QueryContext(ctx,
 		"SELECT nickname, fullname, about, email FROM users WHERE nickname = $1 OR email = $2", nickname, email)
 	if err != nil {
 		return nil, myerror.DBSelectError
@@ -100,28 +87,145 @@ func (ur *UserRepository) SelectConflict(nickname string, email string) ([]*mode
 	return users, nil
 }
 
-func (ur *UserRepository) Update(nickname string, toUpdate *models.UserUpdate) (*models.User, error) {
-	tx, err := ur.DB.BeginTx(context.Background(), nil)
+func (ur *UserRepository) Update(ctx context.Context, nickname string, toUpdate *models.UserUpdate) (*models.User, error) {
+	user := &models.User{}
+	err := dbtx.Run(ctx, ur.DB, func(tx *sql.Tx) error {
+		return tx.QueryRowContext(ctx, `UPDATE users set fullname = COALESCE($2, fullname), about = COALESCE($3, about), email = COALESCE($4, email)
+		WHERE nickname = (SELECT nickname FROM users WHERE nickname = $1 UNION ALL SELECT target FROM user_nickname_alias WHERE nickname = $1 LIMIT 1)
+		RETURNING nickname, fullname, about, email`, nickname, toUpdate.Fullname, toUpdate.About, toUpdate.Email).
+			Scan(&user.Nickname, &user.Fullname, &user.About, &user.Email)
+	})
+	if err != nil {
+		return nil, dbtx.Classify(err, myerror.ConflictError)
+	}
+
+	return user, nil
+}
+
+func (ur *UserRepository) UpdateRole(ctx context.Context, nickname string, role string) (*models.UserRole, error) {
+	userRole := &models.UserRole{}
+	err := dbtx.Run(ctx, ur.DB, func(tx *sql.Tx) error {
+		return tx.QueryRowContext(ctx, `UPDATE users SET role = $2
+		WHERE nickname = (SELECT nickname FROM users WHERE nickname = $1 UNION ALL SELECT target FROM user_nickname_alias WHERE nickname = $1 LIMIT 1)
+		RETURNING nickname, role`, nickname, role).Scan(&userRole.Nickname, &userRole.Role)
+	})
 	if err != nil {
-		return nil, myerror.InternalError
+		return nil, dbtx.Classify(err, myerror.InternalError)
 	}
 
+	return userRole, nil
+}
+
+func (ur *UserRepository) SelectRole(ctx context.Context, nickname string) (string, error) {
+	var role string
+	err := ur.DB.QueryRowContext(ctx, `SELECT role FROM users WHERE nickname = $1
+	UNION ALL
+	SELECT u.role FROM users AS u JOIN user_nickname_alias AS a ON a.target = u.nickname WHERE a.nickname = $1
+	LIMIT 1`, nickname).Scan(&role)
+	if err != nil {
+		return "", dbtx.Classify(err, myerror.InternalError)
+	}
+
+	return role, nil
+}
+
+// Rename changes the nickname everywhere it is referenced through ON UPDATE
+// CASCADE and keeps the old one as an alias for lookups.
+func (ur *UserRepository) Rename(ctx context.Context, nickname string, newNickname string) (*models.User, error) {
 	user := &models.User{}
-	err = tx.QueryRow(`UPDATE users set fullname = COALESCE($2, fullname), about = COALESCE($3, about), email = COALESCE($4, email) WHERE nickname = $1 RETURNING nickname, fullname, about, email`, nickname, toUpdate.Fullname, toUpdate.About, toUpdate.Email).
-		Scan(&user.Nickname, &user.Fullname, &user.About, &user.Email)
+	err := dbtx.Run(ctx, ur.DB, func(tx *sql.Tx) error {
+		var oldNickname string
+		err := tx.QueryRowContext(ctx, `SELECT nickname FROM users WHERE nickname = $1
+		UNION ALL
+		SELECT target FROM user_nickname_alias WHERE nickname = $1
+		LIMIT 1`, nickname).Scan(&oldNickname)
+		if err != nil {
+			return dbtx.Fail(err, myerror.NotExist)
+		}
+
+		var taken bool
+		err = tx.QueryRowContext(ctx, "SELECT exists (SELECT 1 FROM user_nickname_alias WHERE nickname = $1 AND target != $2)", newNickname, oldNickname).Scan(&taken)
+		if err != nil {
+			return dbtx.Fail(err, myerror.ConflictError)
+		}
+		if taken {
+			return myerror.ConflictError
+		}
+
+		_, err = tx.ExecContext(ctx, "DELETE FROM user_nickname_alias WHERE nickname = $1", newNickname)
+		if err != nil {
+			return err
+		}
+
+		err = tx.QueryRowContext(ctx, `UPDATE users SET nickname = $2 WHERE nickname = $1 RETURNING nickname, fullname, about, email`, oldNickname, newNickname).
+			Scan(&user.Nickname, &user.Fullname, &user.About, &user.Email)
+		if err != nil {
+			return dbtx.Fail(err, myerror.ConflictError)
+		}
+
+		if !strings.EqualFold(oldNickname, newNickname) {
+			_, err = tx.ExecContext(ctx, "INSERT INTO user_nickname_alias (nickname, target) VALUES ($1, $2)", oldNickname, user.Nickname)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, dbtx.Classify(err, myerror.InternalError)
+	}
+
+	return user, nil
+}
+
+func (ur *UserRepository) SelectReputation(ctx context.Context, nickname string) ([]*models.Reputation, error) {
+	rows, err := ur.DB.QueryContext(ctx, `SELECT forum, thread_score, post_score, thread_score + post_score FROM user_reputation
+	WHERE nickname = $1 ORDER BY thread_score + post_score DESC, forum`, nickname)
 	if err != nil {
-		tx.Rollback()
-		if match, _ := regexp.MatchString(`.*no rows.*`, err.Error()); match {
-			return nil, myerror.NotExist
-		} else {
-			return nil, myerror.ConflictError
+		return nil, myerror.DBSelectError
+	}
+	defer rows.Close()
+
+	reputation := []*models.Reputation{}
+	for rows.Next() {
+		forum := models.Reputation{}
+		if err := rows.Scan(&forum.Forum, &forum.ThreadScore, &forum.PostScore, &forum.Total); err != nil {
+			return nil, myerror.DBScanError
 		}
+		reputation = append(reputation, &forum)
+	}
+
+	return reputation, nil
+}
+
+// SelectSummary counts what the user has written. The forums come from
+// forum_users, which lists every forum the user has a thread or a post in.
+func (ur *UserRepository) SelectSummary(ctx context.Context, nickname string) (*models.UserSummary, error) {
+	summary := &models.UserSummary{
+		Nickname: nickname,
+		Forums:   []string{},
 	}
 
-	err = tx.Commit()
+	err := ur.DB.QueryRowContext(ctx, `SELECT
+	(SELECT COUNT(*) FROM post WHERE author = $1),
+	(SELECT COUNT(*) FROM thread WHERE author = $1)`, nickname).Scan(&summary.Posts, &summary.Threads)
 	if err != nil {
-		return nil, myerror.ConflictError
+		return nil, myerror.DBSelectError
 	}
 
-	return user, nil
+	rows, err := ur.DB.QueryContext(ctx, "SELECT forum FROM forum_users WHERE nickname = $1 ORDER BY forum", nickname)
+	if err != nil {
+		return nil, myerror.DBSelectError
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var forum string
+		if err := rows.Scan(&forum); err != nil {
+			return nil, myerror.DBScanError
+		}
+		summary.Forums = append(summary.Forums, forum)
+	}
+
+	return summary, nil
 }
@@ -1,6 +1,7 @@
 package usecase
 
 import (
+	"context"
 	"forum/internal/models"
 	"forum/internal/pkg/user/repository"
 
@@ -17,16 +18,16 @@ func NewUserUsecase(ur *repository.UserRepository) *UserUsecase {
 	}
 }
 
-func (uu *UserUsecase) Create(user *models.User) (*models.User, error) {
-	return uu.ur.Insert(user)
+func (uu *UserUsecase) Create(ctx context.Context, user *models.User) (*models.User, error) {
+	return uu.ur.Insert(ctx, user)
 }
 
-func (uu *UserUsecase) GetByNickname(nickname string) (*models.User, error) {
-	return uu.ur.SelectByNickname(nickname)
+func (uu *UserUsecase) GetByNickname(ctx context.Context, nickname string) (*models.User, error) {
+	return uu.ur.SelectByNickname(ctx, nickname)
 }
 
-func (uu *UserUsecase) GetByEmail(email string) (*models.User, error) {
-	user, dbErr := uu.ur.SelectByEmail(email)
+func (uu *UserUsecase) GetByEmail(ctx context.Context, email string) (*models.User, error) {
+	user, dbErr := uu.ur.SelectByEmail(ctx, email)
 
 	switch dbErr {
 	case myerror.DBScanError:
@@ -38,10 +39,91 @@ func (uu *UserUsecase) GetByEmail(email string) (*models.User, error) {
 	return nil, myerror.UnexpectedError
 }
 
-func (uu *UserUsecase) GetConflict(nickname string, email string) ([]*models.User, error) {
-	return uu.ur.SelectConflict(nickname, email)
+func (uu *UserUsecase) GetConflict(ctx context.Context, nickname string, email string) ([]*models.User, error) {
+	return uu.ur.SelectConflict(ctx, nickname, email)
 }
 
-func (uu *UserUsecase) Update(nickname string, toUpdate *models.UserUpdate) (*models.User, error) {
-	return uu.ur.Update(nickname, toUpdate)
+func (uu *UserUsecase) Update(ctx context.Context, nickname string, toUpdate *models.UserUpdate) (*models.User, error) {
+	return uu.ur.Update(ctx, nickname, toUpdate)
+}
+
+func (uu *UserUsecase) Rename(ctx context.Context, nickname string, rename *models.UserRename) (*models.User, error) {
+	if rename.Nickname == "" {
+		return nil, myerror.BadUpdate
+	}
+
+	return uu.ur.Rename(ctx, nickname, rename.Nickname)
+}
+
+// SetRole assigns a role to a user. Roles are the names used in the vote
+// weights, lowercase letters, digits and underscores.
+func (uu *UserUsecase) SetRole(ctx context.Context, nickname string, role *models.UserRole) (*models.UserRole, error) {
+	if !validRole(role.Role) {
+		return nil, myerror.BadUpdate
+	}
+
+	return uu.ur.UpdateRole(ctx, nickname, role.Role)
+}
+
+// Authorize checks that nickname names a user with one of the
+// ModeratorRoles. The API has no authentication, the nickname is trusted
+// like the one of a vote.
+func (uu *UserUsecase) Authorize(ctx context.Context, nickname string) error {
+	if nickname == "" {
+		return myerror.Forbidden
+	}
+
+	role, err := uu.ur.SelectRole(ctx, nickname)
+	if err == myerror.NotExist {
+		return myerror.Forbidden
+	}
+	if err != nil {
+		return err
+	}
+
+	if !models.ModeratorRoles[role] {
+		return myerror.Forbidden
+	}
+	return nil
+}
+
+func validRole(role string) bool {
+	if role == "" || len(role) > 32 {
+		return false
+	}
+	for _, c := range role {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// GetProfile is GetByNickname with the reputation of the user summed up over
+// all forums and broken down per forum.
+func (uu *UserUsecase) GetProfile(ctx context.Context, nickname string) (*models.User, error) {
+	user, err := uu.ur.SelectByNickname(ctx, nickname)
+	if err != nil {
+		return nil, err
+	}
+
+	user.ReputationByForum, err = uu.ur.SelectReputation(ctx, user.Nickname)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, forum := range user.ReputationByForum {
+		user.Reputation += forum.Total
+	}
+
+	return user, nil
+}
+
+func (uu *UserUsecase) GetSummary(ctx context.Context, nickname string) (*models.UserSummary, error) {
+	user, err := uu.ur.SelectByNickname(ctx, nickname)
+	if err != nil {
+		return nil, myerror.UNotFound
+	}
+
+	return uu.ur.SelectSummary(ctx, user.Nickname)
 }
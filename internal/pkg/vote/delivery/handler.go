@@ -3,6 +3,7 @@ package delivery
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
 
 	"forum/internal/models"
 	thread "forum/internal/pkg/thread/usecase"
@@ -27,7 +28,9 @@ func NewVoteHandler(vu *usecase.VoteUsecase, tu *thread.ThreadUsecase) *VoteHand
 
 func (vh *VoteHandler) Routing(r *mux.Router) {
 	r.HandleFunc("/thread/{slug_or_id}/vote", http.HandlerFunc(vh.CreateVote)).Methods(http.MethodPost)
-	//r.HandleFunc(`/forum/{slug}/threads`, http.HandlerFunc(th.GetAllThreadsInForum)).Methods(http.MethodGet)
+	r.HandleFunc("/thread/{slug_or_id}/vote", http.HandlerFunc(vh.DeleteVote)).Methods(http.MethodDelete)
+	r.HandleFunc("/thread/{slug_or_id}/votes", http.HandlerFunc(vh.GetThreadVotes)).Methods(http.MethodGet)
+	r.HandleFunc("/user/{nickname}/votes", http.HandlerFunc(vh.GetUserVotes)).Methods(http.MethodGet)
 }
 
 func (vh *VoteHandler) CreateVote(w http.ResponseWriter, r *http.Request) {
@@ -44,7 +47,12 @@ func (vh *VoteHandler) CreateVote(w http.ResponseWriter, r *http.Request) {
 
 	slug_or_id := mux.Vars(r)["slug_or_id"]
 
-	thread, createErr := vh.vu.CreateBySlugOrId(vote, slug_or_id)
+	thread, createErr := vh.vu.CreateBySlugOrId(r.Context(), vote, slug_or_id)
+	if createErr == myerror.InvalidVoice {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(createErr)
+		return
+	}
 	if createErr == myerror.NotExist {
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(createErr)
@@ -59,3 +67,91 @@ func (vh *VoteHandler) CreateVote(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(thread)
 }
+
+func (vh *VoteHandler) DeleteVote(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	vote := &models.Vote{
+		Nickname: r.URL.Query().Get("nickname"),
+	}
+	if vote.Nickname == "" {
+		err := json.NewDecoder(r.Body).Decode(vote)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(err)
+			return
+		}
+	}
+
+	slug_or_id := mux.Vars(r)["slug_or_id"]
+
+	thread, deleteErr := vh.vu.DeleteBySlugOrId(r.Context(), vote.Nickname, slug_or_id)
+	if deleteErr == myerror.NotExist {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(deleteErr)
+		return
+	}
+	if deleteErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(deleteErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(thread)
+}
+
+func (vh *VoteHandler) GetThreadVotes(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	slug_or_id := mux.Vars(r)["slug_or_id"]
+
+	query := r.URL.Query()
+	limit, _ := strconv.ParseInt(query.Get("limit"), 10, 64)
+	since := query.Get("since")
+	isDescOrder := query.Get("desc") == "true"
+
+	votes, selectErr := vh.vu.GetByThread(r.Context(), slug_or_id, limit, since, isDescOrder)
+	if selectErr == myerror.NotExist {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(selectErr)
+		return
+	}
+	if selectErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(selectErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(votes)
+}
+
+func (vh *VoteHandler) GetUserVotes(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	nickname := mux.Vars(r)["nickname"]
+
+	query := r.URL.Query()
+	limit, _ := strconv.ParseInt(query.Get("limit"), 10, 64)
+	since, _ := strconv.ParseInt(query.Get("since"), 10, 64)
+	isDescOrder := query.Get("desc") == "true"
+
+	votes, selectErr := vh.vu.GetByAuthor(r.Context(), nickname, limit, since, isDescOrder)
+	if selectErr == myerror.NotExist {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(selectErr)
+		return
+	}
+	if selectErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(selectErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(votes)
+}
@@ -3,6 +3,8 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"forum/internal/dbtx"
 	myerror "forum/internal/error"
 	"forum/internal/models"
 )
@@ -17,28 +19,127 @@ func NewVoteRepository(DB *sql.DB) *VoteRepository {
 	}
 }
 
-func (pr *VoteRepository) Insert(vote *models.Vote) (*models.Vote, error) {
-	tx, err := pr.DB.BeginTx(context.Background(), nil)
+func (pr *VoteRepository) Insert(ctx context.Context, vote *models.Vote) (*models.Vote, error) {
+	newVote := &models.Vote{}
+	err := dbtx.Run(ctx, pr.DB, func(tx *sql.Tx) error {
+		return tx.QueryRowContext(ctx, `INSERT INTO vote (author, voice, weight, thread)
+		VALUES ($1, $2, $3, $4) ON CONFLICT (author, thread)
+		DO
+		UPDATE
+		SET voice=$2, weight=$3, updated_at=NOW() RETURNING author, voice, weight, thread, updated_at`, vote.Nickname, vote.Voice, vote.Weight, vote.Thread).
+			Scan(&newVote.Nickname, &newVote.Voice, &newVote.Weight, &newVote.Thread, &newVote.UpdatedAt)
+	})
 	if err != nil {
-		return nil, myerror.InternalError
+		return nil, dbtx.Classify(err, myerror.NotExist)
 	}
 
-	newVote := &models.Vote{}
-	err = tx.QueryRow(`INSERT INTO vote (author, voice, thread)
-	VALUES ($1, $2, $3) ON CONFLICT (author, thread)
-	DO
-	UPDATE
-	SET voice=$2 RETURNING author, voice, thread`, vote.Nickname, vote.Voice, vote.Thread).Scan(&newVote.Nickname, &newVote.Voice, &newVote.Thread)
+	return newVote, nil
+}
 
+func (pr *VoteRepository) Delete(ctx context.Context, nickname string, thread int32) error {
+	err := dbtx.Run(ctx, pr.DB, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, "DELETE FROM vote WHERE author = $1 AND thread = $2", nickname, thread)
+		if err != nil {
+			return err
+		}
+
+		deleted, err := result.RowsAffected()
+		if err != nil || deleted == 0 {
+			return myerror.NotExist
+		}
+		return nil
+	})
+
+	return dbtx.Classify(err, myerror.InternalError)
+}
+
+func (pr *VoteRepository) SelectRole(ctx context.Context, nickname string) (string, error) {
+	var role string
+	err := pr.DB.QueryRowContext(ctx, "SELECT role FROM users WHERE nickname = $1", nickname).Scan(&role)
 	if err != nil {
-		tx.Rollback()
-		return nil, myerror.NotExist
+		return "", myerror.NotExist
 	}
 
-	err = tx.Commit()
+	return role, nil
+}
+
+func (pr *VoteRepository) SelectByThread(ctx context.Context, thread int32, limit int64, since string, isDescOrder bool) ([]*models.Vote, error) {
+	query := "SELECT author, voice, weight, thread, updated_at FROM vote WHERE thread = $1"
+	arr := []interface{}{
+		thread,
+	}
+
+	var order string
+	var sign string
+	if isDescOrder {
+		order = "DESC"
+		sign = "<"
+	} else {
+		order = "ASC"
+		sign = ">"
+	}
+
+	if len(since) > 0 {
+		query += fmt.Sprintf(" AND author %s $%d", sign, len(arr)+1)
+		arr = append(arr, since)
+	}
+
+	query += " ORDER BY author " + order
+
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT $%d", len(arr)+1)
+		arr = append(arr, limit)
+	}
+
+	return pr.selectVotes(ctx, query, arr)
+}
+
+func (pr *VoteRepository) SelectByAuthor(ctx context.Context, nickname string, limit int64, since int64, isDescOrder bool) ([]*models.Vote, error) {
+	query := "SELECT author, voice, weight, thread, updated_at FROM vote WHERE author = $1"
+	arr := []interface{}{
+		nickname,
+	}
+
+	var order string
+	var sign string
+	if isDescOrder {
+		order = "DESC"
+		sign = "<"
+	} else {
+		order = "ASC"
+		sign = ">"
+	}
+
+	if since > 0 {
+		query += fmt.Sprintf(" AND thread %s $%d", sign, len(arr)+1)
+		arr = append(arr, since)
+	}
+
+	query += " ORDER BY thread " + order
+
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT $%d", len(arr)+1)
+		arr = append(arr, limit)
+	}
+
+	return pr.selectVotes(ctx, query, arr)
+}
+
+func (pr *VoteRepository) selectVotes(ctx context.Context, query string, arr []interface{}) ([]*models.Vote, error) {
+	rows, err := pr.DB.QueryContext(ctx, query, arr...)
 	if err != nil {
-		return nil, myerror.NotExist
+		return nil, myerror.InternalError
 	}
+	defer rows.Close()
 
-	return newVote, nil
+	votes := []*models.Vote{}
+	for rows.Next() {
+		vote := models.Vote{}
+		if err := rows.Scan(&vote.Nickname, &vote.Voice, &vote.Weight, &vote.Thread, &vote.UpdatedAt); err != nil {
+			return nil, myerror.InternalError
+		}
+		votes = append(votes, &vote)
+	}
+
+	return votes, nil
 }
@@ -1,6 +1,7 @@
 package usecase
 
 import (
+	"context"
 	"forum/internal/models"
 	threadRepository "forum/internal/pkg/thread/repository"
 	"forum/internal/pkg/vote/repository"
@@ -10,8 +11,9 @@ import (
 )
 
 type VoteUsecase struct {
-	vr *repository.VoteRepository
-	tr *threadRepository.ThreadRepository
+	vr      *repository.VoteRepository
+	tr      *threadRepository.ThreadRepository
+	weights map[string]int32
 }
 
 func NewVoteUsecase(vr *repository.VoteRepository, tr *threadRepository.ThreadRepository) *VoteUsecase {
@@ -21,43 +23,116 @@ func NewVoteUsecase(vr *repository.VoteRepository, tr *threadRepository.ThreadRe
 	}
 }
 
-func (vu *VoteUsecase) Create(vote *models.Vote) (*models.Vote, error) {
-	return vu.vr.Insert(vote)
+// SetRoleWeights makes votes of users with the given roles count more than
+// once. Roles missing from weights keep the weight of 1.
+func (vu *VoteUsecase) SetRoleWeights(weights map[string]int32) {
+	vu.weights = weights
 }
 
-func (vu *VoteUsecase) CreateBySlugOrId(vote *models.Vote, slug_or_id string) (*models.Thread, error) {
-	var slug string
-	var id int32
-	passedId, passedSlug := false, false
+func (vu *VoteUsecase) weight(ctx context.Context, nickname string) (int32, error) {
+	if len(vu.weights) == 0 {
+		return 1, nil
+	}
+
+	role, err := vu.vr.SelectRole(ctx, nickname)
+	if err != nil {
+		return 0, err
+	}
 
+	if weight, ok := vu.weights[role]; ok && weight > 0 {
+		return weight, nil
+	}
+	return 1, nil
+}
+
+func (vu *VoteUsecase) Create(ctx context.Context, vote *models.Vote) (*models.Vote, error) {
+	weight, err := vu.weight(ctx, vote.Nickname)
+	if err != nil {
+		return nil, err
+	}
+	vote.Weight = weight
+
+	return vu.vr.Insert(ctx, vote)
+}
+
+func (vu *VoteUsecase) threadId(ctx context.Context, slug_or_id string) (int32, error) {
 	aId, err := strconv.Atoi(slug_or_id)
+	if err == nil {
+		return int32(aId), nil
+	}
+
+	pId, _, err := vu.tr.SelectThreadIdForumBySlug(ctx, slug_or_id)
 	if err != nil {
-		slug = slug_or_id
-		passedSlug = len(slug_or_id) != 0
-	} else {
-		id = int32(aId)
-		passedId = true
+		return 0, myerror.NotExist
+	}
+
+	return int32(*pId), nil
+}
+
+// CreateBySlugOrId upserts a vote of +1 or -1. A voice of 0 retracts the
+// previous vote.
+func (vu *VoteUsecase) CreateBySlugOrId(ctx context.Context, vote *models.Vote, slug_or_id string) (*models.Thread, error) {
+	if vote.Voice == 0 {
+		return vu.DeleteBySlugOrId(ctx, vote.Nickname, slug_or_id)
+	}
+	if vote.Voice != 1 && vote.Voice != -1 {
+		return nil, myerror.InvalidVoice
 	}
 
-	if passedId {
-		vote.Thread = id
-	} else if passedSlug {
-		pId, _, err := vu.tr.SelectThreadIdForumBySlug(slug)
-		if err != nil {
-			return nil, myerror.NotExist
-		}
-		vote.Thread = int32(*pId)
+	id, err := vu.threadId(ctx, slug_or_id)
+	if err != nil {
+		return nil, err
 	}
+	vote.Thread = id
 
-	newVote, createErr := vu.Create(vote)
+	newVote, createErr := vu.Create(ctx, vote)
 	if createErr != nil {
 		return nil, createErr
 	}
 
-	thread, updateErr := vu.tr.Select(newVote.Thread)
+	thread, updateErr := vu.tr.Select(ctx, newVote.Thread)
 	if updateErr != nil {
 		return nil, updateErr
 	}
 
 	return thread, nil
 }
+
+func (vu *VoteUsecase) DeleteBySlugOrId(ctx context.Context, nickname string, slug_or_id string) (*models.Thread, error) {
+	id, err := vu.threadId(ctx, slug_or_id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := vu.vr.Delete(ctx, nickname, id); err != nil {
+		return nil, err
+	}
+
+	thread, err := vu.tr.Select(ctx, id)
+	if err != nil {
+		return nil, myerror.NotExist
+	}
+
+	return thread, nil
+}
+
+func (vu *VoteUsecase) GetByThread(ctx context.Context, slug_or_id string, limit int64, since string, isDescOrder bool) ([]*models.Vote, error) {
+	id, err := vu.threadId(ctx, slug_or_id)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := vu.tr.Select(ctx, id); err != nil {
+		return nil, myerror.NotExist
+	}
+
+	return vu.vr.SelectByThread(ctx, id, limit, since, isDescOrder)
+}
+
+func (vu *VoteUsecase) GetByAuthor(ctx context.Context, nickname string, limit int64, since int64, isDescOrder bool) ([]*models.Vote, error) {
+	if _, err := vu.vr.SelectRole(ctx, nickname); err != nil {
+		return nil, myerror.NotExist
+	}
+
+	return vu.vr.SelectByAuthor(ctx, nickname, limit, since, isDescOrder)
+}
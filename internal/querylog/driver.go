@@ -0,0 +1,103 @@
+package querylog
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"time"
+)
+
+type connector struct {
+	driver.Connector
+	l *Log
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	inner, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: inner, l: c.l}, nil
+}
+
+// conn times Query and Exec of the driver connection. Prepared statements
+// are passed through, the repositories do not use them.
+type conn struct {
+	driver.Conn
+	l *Log
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	start := time.Now()
+	inner, err := queryer.QueryContext(ctx, query, args)
+	if err != nil {
+		c.l.observe(ctx, query, args, start, err)
+		return nil, err
+	}
+
+	return &rows{Rows: inner, ctx: ctx, l: c.l, query: query, args: args, start: start}, nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	start := time.Now()
+	result, err := execer.ExecContext(ctx, query, args)
+	c.l.observe(ctx, query, args, start, err)
+	return result, err
+}
+
+// rows counts the time spent reading results into the statement, a query
+// is done when its rows are closed.
+type rows struct {
+	driver.Rows
+	ctx   context.Context
+	l     *Log
+	query string
+	args  []driver.NamedValue
+	start time.Time
+	err   error
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return err
+}
+
+func (r *rows) Close() error {
+	err := r.Rows.Close()
+	r.l.observe(r.ctx, r.query, r.args, r.start, r.err)
+	return err
+}
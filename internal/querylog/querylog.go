@@ -0,0 +1,279 @@
+package querylog
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"forum/internal/record"
+)
+
+// Entry is one statement that ran longer than the threshold.
+type Entry struct {
+	Time      time.Time     `json:"time"`
+	Duration  int64         `json:"duration_us"`
+	Query     string        `json:"query"`
+	Args      []interface{} `json:"args,omitempty"`
+	RequestID string        `json:"request_id,omitempty"`
+	Error     string        `json:"error,omitempty"`
+	// Plan is the output of EXPLAIN (ANALYZE, BUFFERS), it is filled in the
+	// background for a sample of slow statements that only read, see
+	// explainable
+	Plan string `json:"plan,omitempty"`
+}
+
+type Config struct {
+	// Threshold is the duration from which a statement is logged
+	Threshold time.Duration
+	// ExplainSample is the share of slow read-only statements that are run
+	// again under EXPLAIN (ANALYZE, BUFFERS)
+	ExplainSample float64
+	// Keep is the number of recent slow statements served by Recent
+	Keep int
+}
+
+// DefaultKeep is the number of recent slow statements kept when Config.Keep
+// is not set.
+const DefaultKeep = 200
+
+// explainQueueSize is the number of plans waiting to be captured. EXPLAIN
+// ANALYZE runs the statement once more, so plans are dropped rather than
+// piling load on a database that is already slow.
+const explainQueueSize = 16
+
+type explainJob struct {
+	entry *Entry
+	query string
+	args  []interface{}
+}
+
+// Log times the statements of the connections it opens and keeps the slow
+// ones.
+type Log struct {
+	threshold     time.Duration
+	explainSample float64
+
+	mu     sync.Mutex
+	recent []*Entry
+	next   int
+
+	explainDB *sql.DB
+	explains  chan explainJob
+}
+
+func New(c *Config) *Log {
+	keep := c.Keep
+	if keep <= 0 {
+		keep = DefaultKeep
+	}
+
+	return &Log{
+		threshold:     c.Threshold,
+		explainSample: c.ExplainSample,
+		recent:        make([]*Entry, 0, keep),
+	}
+}
+
+// Wrap returns a connector whose statements are timed by the log. Plans are
+// captured on a separate pool opened with c, which is not instrumented.
+func (l *Log) Wrap(c driver.Connector) driver.Connector {
+	if l.explainSample > 0 && l.explainDB == nil {
+		l.explainDB = sql.OpenDB(c)
+		l.explainDB.SetMaxOpenConns(1)
+		l.explains = make(chan explainJob, explainQueueSize)
+		go l.explain()
+	}
+
+	return &connector{Connector: c, l: l}
+}
+
+// Recent returns up to limit slow statements, newest first.
+func (l *Log) Recent(limit int) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if limit <= 0 || limit > len(l.recent) {
+		limit = len(l.recent)
+	}
+
+	entries := make([]Entry, 0, limit)
+	for i := 1; i <= limit; i++ {
+		entries = append(entries, *l.recent[(l.next-i+len(l.recent))%len(l.recent)])
+	}
+	return entries
+}
+
+type requestIDKey struct{}
+
+// RequestID returns the ID Middleware gave to the request of ctx.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Middleware gives every request an ID, taken from X-Request-Id when the
+// client sent a sane one, and echoes it in the response. Repositories run
+// their statements in the request context, which carries the ID to the
+// driver. Statements run outside a request, like the notification fan-out,
+// are logged without an ID.
+func (l *Log) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if len(id) == 0 || len(id) > 64 || strings.ContainsAny(id, " \t\r\n") {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-Id", id)
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func newRequestID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// observe is called once a statement is done, for queries that is when the
+// rows are closed.
+func (l *Log) observe(ctx context.Context, query string, args []driver.NamedValue, start time.Time, err error) {
+	duration := time.Since(start)
+	if duration < l.threshold {
+		return
+	}
+
+	entry := &Entry{
+		Time:      start,
+		Duration:  duration.Microseconds(),
+		Query:     Normalize(query),
+		Args:      redactArgs(args),
+		RequestID: RequestID(ctx),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	log.Printf("slow query %s [%s]: %s %v", duration, entry.RequestID, entry.Query, entry.Args)
+
+	l.mu.Lock()
+	if len(l.recent) < cap(l.recent) {
+		l.recent = append(l.recent, entry)
+	} else {
+		l.recent[l.next] = entry
+	}
+	l.next = (l.next + 1) % cap(l.recent)
+	l.mu.Unlock()
+
+	if err == nil && l.explains != nil && explainable(query) && mathrand.Float64() < l.explainSample {
+		values := make([]interface{}, len(args))
+		for i, arg := range args {
+			values[i] = arg.Value
+		}
+
+		select {
+		case l.explains <- explainJob{entry: entry, query: query, args: values}:
+		default:
+		}
+	}
+}
+
+var (
+	selectStatement = regexp.MustCompile(`(?i)^\s*SELECT\b`)
+	// writes and locks anywhere in the statement, also in subqueries and in
+	// string literals, which only makes the check stricter
+	sideEffect = regexp.MustCompile(`(?i)\b(?:FOR\s+(?:NO\s+KEY\s+)?UPDATE|FOR\s+(?:KEY\s+)?SHARE|INSERT|UPDATE|DELETE|MERGE|INTO|LOCK|NEXTVAL|SETVAL|PG_ADVISORY_\w+|PG_TRY_ADVISORY_\w+)\b`)
+)
+
+// explainable reports whether query only reads. EXPLAIN ANALYZE runs the
+// statement, so a SELECT ... FOR UPDATE would take its row locks again and
+// anything writing would write twice.
+func explainable(query string) bool {
+	return selectStatement.MatchString(query) && !sideEffect.MatchString(query)
+}
+
+func (l *Log) explain() {
+	for job := range l.explains {
+		plan, err := l.plan(job.query, job.args)
+		if err != nil {
+			log.Printf("can not explain slow query: %v", err)
+			continue
+		}
+
+		l.mu.Lock()
+		job.entry.Plan = plan
+		l.mu.Unlock()
+	}
+}
+
+// plan runs EXPLAIN in a read-only transaction that is rolled back, in case
+// a function called by the statement writes after all.
+func (l *Log) plan(query string, args []interface{}) (string, error) {
+	tx, err := l.explainDB.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("EXPLAIN (ANALYZE, BUFFERS) "+query, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	lines := []string{}
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return "", err
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), rows.Err()
+}
+
+var (
+	literal = regexp.MustCompile(`\$\d+|'(?:[^']|'')*'|\b\d+(?:\.\d+)?\b`)
+	list    = regexp.MustCompile(`\?(?:\s*,\s*\?)+`)
+	space   = regexp.MustCompile(`\s+`)
+)
+
+// Normalize replaces literals with ? and collapses lists of them, so that
+// statements built with inlined ids, like IN ('1', '2'), read the same
+// whatever the ids. Placeholders are kept.
+func Normalize(query string) string {
+	query = literal.ReplaceAllStringFunc(query, func(match string) string {
+		if strings.HasPrefix(match, "$") {
+			return match
+		}
+		return "?"
+	})
+	query = list.ReplaceAllString(query, "?, ...")
+	return strings.TrimSpace(space.ReplaceAllString(query, " "))
+}
+
+// redactArgs keeps numbers, booleans and times and hashes strings, which
+// hold messages, emails and nicknames.
+func redactArgs(args []driver.NamedValue) []interface{} {
+	redacted := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch value := arg.Value.(type) {
+		case string:
+			redacted[i] = record.Redact(value)
+		case []byte:
+			redacted[i] = fmt.Sprintf("<%d bytes>", len(value))
+		default:
+			redacted[i] = value
+		}
+	}
+	return redacted
+}
@@ -0,0 +1,36 @@
+package querylog
+
+import "testing"
+
+func TestExplainable(t *testing.T) {
+	cases := []struct {
+		query string
+		want  bool
+	}{
+		{"SELECT id, slug FROM thread WHERE forum = $1 ORDER BY created_at LIMIT $2", true},
+		{"  select nickname from users where nickname = $1", true},
+		{"SELECT p.id FROM post AS p WHERE p.updated_at > $1", true},
+		{"SELECT key FROM idempotency_key WHERE locked_until < NOW()", true},
+
+		{"SELECT slug FROM thread WHERE id = $1 FOR UPDATE", false},
+		{"SELECT id FROM notification_pending ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED", false},
+		{"SELECT id FROM thread WHERE id = $1 FOR NO KEY UPDATE", false},
+		{"SELECT id FROM thread WHERE id = $1 for share", false},
+		{"SELECT id FROM thread WHERE id = $1 FOR KEY SHARE", false},
+		{"SELECT * INTO thread_copy FROM thread", false},
+		{"SELECT nextval('post_id_seq')", false},
+		{"SELECT setval(pg_get_serial_sequence('post', 'id'), 1)", false},
+		{"SELECT pg_advisory_xact_lock($1)", false},
+		{"SELECT pg_try_advisory_lock($1)", false},
+		{"INSERT INTO users (nickname) VALUES ($1) RETURNING id", false},
+		{"UPDATE thread SET votes = votes + $1 WHERE id = $2", false},
+		{"WITH moved AS (DELETE FROM notification_pending RETURNING *) SELECT count(*) FROM moved", false},
+		{"WITH t AS (SELECT id FROM thread) SELECT id FROM t", false},
+	}
+
+	for _, c := range cases {
+		if got := explainable(c.query); got != c.want {
+			t.Errorf("explainable(%q) = %v, want %v", c.query, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Entry is one recorded request, written as a line of NDJSON.
+type Entry struct {
+	Start    time.Time         `json:"start"`
+	Duration int64             `json:"duration_us"`
+	Method   string            `json:"method"`
+	Route    string            `json:"route"`
+	Path     string            `json:"path"`
+	Vars     map[string]string `json:"vars,omitempty"`
+	Query    string            `json:"query,omitempty"`
+	Body     json.RawMessage   `json:"body,omitempty"`
+	Status   int               `json:"status"`
+	Response json.RawMessage   `json:"response,omitempty"`
+	// Truncated is set when the response was longer than MaxResponse and
+	// is not recorded
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// MaxResponse is the longest response body kept in a recording. Responses
+// are needed to remap ids and to compare runs, big list reads are skipped.
+const MaxResponse = 256 << 10
+
+// queueSize is the number of entries waiting to be written. When the file can
+// not keep up entries are dropped instead of slowing requests down.
+const queueSize = 4096
+
+// redactor hashes the values of some JSON fields.
+type redactor map[string]bool
+
+func newRedactor(fields []string) redactor {
+	rd := redactor{}
+	for _, field := range fields {
+		if field = strings.ToLower(strings.TrimSpace(field)); field != "" {
+			rd[field] = true
+		}
+	}
+	return rd
+}
+
+type Recorder struct {
+	sample  float64
+	redact  redactor
+	queue   chan *Entry
+	dropped int64
+	done    chan struct{}
+}
+
+// NewRecorder writes a sample of requests to w. Values of JSON fields named
+// in redact are replaced by a hash, so equal values stay equal and unique
+// ones stay unique when the recording is replayed.
+func NewRecorder(w io.Writer, sample float64, redact []string) *Recorder {
+	rec := &Recorder{
+		sample: sample,
+		redact: newRedactor(redact),
+		queue:  make(chan *Entry, queueSize),
+		done:   make(chan struct{}),
+	}
+
+	go rec.write(w)
+	return rec
+}
+
+func (rec *Recorder) write(w io.Writer) {
+	defer close(rec.done)
+
+	buf := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buf)
+	for entry := range rec.queue {
+		encoder.Encode(entry)
+		// flush once the queue is drained, so a crash loses little
+		if len(rec.queue) == 0 {
+			if err := buf.Flush(); err != nil {
+				log.Printf("can not write recording: %v", err)
+			}
+		}
+	}
+	buf.Flush()
+}
+
+// Close writes the queued entries and stops the recorder.
+func (rec *Recorder) Close() {
+	close(rec.queue)
+	<-rec.done
+	if dropped := atomic.LoadInt64(&rec.dropped); dropped > 0 {
+		log.Printf("recording dropped %d requests", dropped)
+	}
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	if !rr.truncated {
+		if rr.body.Len()+len(b) > MaxResponse {
+			rr.truncated = true
+			rr.body.Reset()
+		} else {
+			rr.body.Write(b)
+		}
+	}
+	return rr.ResponseWriter.Write(b)
+}
+
+// Middleware records requests routed by mux. It has to be added with Use on
+// the router, so that the matched route is known.
+func (rec *Recorder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rec.sample < 1 && rand.Float64() >= rec.sample {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var body []byte
+		if r.Body != nil {
+			body, _ = ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		entry := &Entry{
+			Start:  time.Now(),
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Vars:   mux.Vars(r),
+			Query:  r.URL.RawQuery,
+			Body:   rec.redact.json(body),
+		}
+		if route := mux.CurrentRoute(r); route != nil {
+			entry.Route, _ = route.GetPathTemplate()
+		}
+
+		rr := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rr, r)
+
+		entry.Duration = time.Since(entry.Start).Microseconds()
+		entry.Status = rr.status
+		entry.Truncated = rr.truncated
+		if !rr.truncated {
+			entry.Response = rec.redact.json(rr.body.Bytes())
+		}
+
+		select {
+		case rec.queue <- entry:
+		default:
+			atomic.AddInt64(&rec.dropped, 1)
+		}
+	})
+}
+
+// json returns body with redacted fields. Bodies that are not JSON are
+// dropped, the API only speaks JSON.
+func (rd redactor) json(body []byte) json.RawMessage {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return nil
+	}
+	if len(rd) == 0 {
+		return json.RawMessage(body)
+	}
+
+	redacted, err := json.Marshal(rd.value(value))
+	if err != nil {
+		return nil
+	}
+	return redacted
+}
+
+func (rd redactor) value(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if s, ok := field.(string); ok && rd[strings.ToLower(key)] {
+				v[key] = Redact(s)
+				continue
+			}
+			v[key] = rd.value(field)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = rd.value(v[i])
+		}
+	}
+	return value
+}
+
+// Redact hashes a value. The result keeps the shape of an email address,
+// which the API validates by uniqueness only.
+func Redact(value string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(value)))
+	redacted := "redacted-" + hex.EncodeToString(sum[:8])
+	if strings.Contains(value, "@") {
+		redacted += "@redacted.invalid"
+	}
+	return redacted
+}
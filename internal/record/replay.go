@@ -0,0 +1,505 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Read loads a recording and orders it by start time, concurrent requests
+// are written in the order they finished.
+func Read(r io.Reader) ([]*Entry, error) {
+	entries := []*Entry{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 2*MaxResponse+(1<<20))
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		entry := &Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Start.Before(entries[j].Start)
+	})
+	return entries, nil
+}
+
+// Ids created by the server differ between runs. They are learned from the
+// responses of the requests that create them and substituted in later ones.
+const (
+	kindThread = iota
+	kindPost
+)
+
+type idKey struct {
+	kind int
+	id   int64
+}
+
+// Diff is a replayed request whose response does not match the recording.
+type Diff struct {
+	Index    int      `json:"index"`
+	Method   string   `json:"method"`
+	Route    string   `json:"route"`
+	Path     string   `json:"path"`
+	Recorded int      `json:"recorded_status"`
+	Status   int      `json:"status"`
+	Error    string   `json:"error,omitempty"`
+	Fields   []string `json:"fields,omitempty"`
+}
+
+// Report sums up a replay.
+type Report struct {
+	Requests     int
+	StatusDiffs  int
+	BodyDiffs    int
+	Failed       int
+	Elapsed      time.Duration
+	Diffs        []*Diff
+	RouteDiffs   map[string]int
+	RouteTotals  map[string]int
+	UnmappedIds  int
+	RecordedTime time.Duration
+}
+
+// maxFields is the number of differing fields listed per response.
+const maxFields = 10
+
+type Replayer struct {
+	base   string
+	http   *http.Client
+	speed  float64
+	ignore map[string]bool
+	redact redactor
+
+	entries   []*Entry
+	done      []chan struct{}
+	producers map[idKey]int
+
+	mu       sync.Mutex
+	ids      map[idKey]int64
+	recorded map[idKey]int64
+	unmapped int
+}
+
+// NewReplayer sends entries to the server at base. With speed 1 requests
+// keep their recorded spacing, 2 plays twice as fast, 0 sends them one after
+// another. Fields named in ignore are not compared, e.g. server timestamps,
+// fields named in redact are hashed like they were when recording.
+func NewReplayer(base string, entries []*Entry, speed float64, timeout time.Duration, ignore []string, redact []string) *Replayer {
+	rp := &Replayer{
+		base:      strings.TrimRight(base, "/"),
+		http:      &http.Client{Timeout: timeout},
+		speed:     speed,
+		ignore:    map[string]bool{},
+		redact:    newRedactor(redact),
+		entries:   entries,
+		done:      make([]chan struct{}, len(entries)),
+		producers: map[idKey]int{},
+		ids:       map[idKey]int64{},
+		recorded:  map[idKey]int64{},
+	}
+	for _, field := range ignore {
+		if field = strings.TrimSpace(field); field != "" {
+			rp.ignore[field] = true
+		}
+	}
+
+	for i, entry := range entries {
+		rp.done[i] = make(chan struct{})
+		for _, key := range created(entry, entry.Response) {
+			if _, ok := rp.producers[key]; !ok {
+				rp.producers[key] = i
+			}
+		}
+	}
+	return rp
+}
+
+// created returns the ids made by a request, read from its response.
+func created(entry *Entry, response []byte) []idKey {
+	if entry.Method != http.MethodPost || len(response) == 0 {
+		return nil
+	}
+
+	var objects []map[string]interface{}
+	var kind int
+	switch {
+	case strings.HasSuffix(entry.Route, "/forum/{slug}/create"), strings.HasSuffix(entry.Route, "/post/{id}/split"):
+		object := map[string]interface{}{}
+		if decode(response, &object) != nil {
+			return nil
+		}
+		objects, kind = []map[string]interface{}{object}, kindThread
+	case strings.HasSuffix(entry.Route, "/thread/{slug_or_id}/create"):
+		if decode(response, &objects) != nil {
+			return nil
+		}
+		kind = kindPost
+	default:
+		return nil
+	}
+
+	keys := make([]idKey, 0, len(objects))
+	for _, object := range objects {
+		if id, ok := number(object["id"]); ok {
+			keys = append(keys, idKey{kind, id})
+		}
+	}
+	return keys
+}
+
+func decode(data []byte, out interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(out)
+}
+
+func number(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		id, err := v.Int64()
+		return id, err == nil
+	case string:
+		id, err := strconv.ParseInt(v, 10, 64)
+		return id, err == nil
+	}
+	return 0, false
+}
+
+// Run replays all entries and compares the responses.
+func (rp *Replayer) Run() *Report {
+	report := &Report{
+		Requests:    len(rp.entries),
+		RouteDiffs:  map[string]int{},
+		RouteTotals: map[string]int{},
+	}
+	if len(rp.entries) > 0 {
+		first, last := rp.entries[0], rp.entries[len(rp.entries)-1]
+		report.RecordedTime = last.Start.Sub(first.Start)
+	}
+
+	diffs := make([]*Diff, len(rp.entries))
+	start := time.Now()
+
+	wg := sync.WaitGroup{}
+	for i, entry := range rp.entries {
+		if rp.speed <= 0 {
+			diffs[i] = rp.replay(i)
+			continue
+		}
+
+		offset := time.Duration(float64(entry.Start.Sub(rp.entries[0].Start)) / rp.speed)
+		if wait := time.Until(start.Add(offset)); wait > 0 {
+			time.Sleep(wait)
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			diffs[i] = rp.replay(i)
+		}(i)
+	}
+	wg.Wait()
+	report.Elapsed = time.Since(start)
+
+	for i, entry := range rp.entries {
+		route := entry.Method + " " + entry.Route
+		report.RouteTotals[route]++
+
+		diff := diffs[i]
+		if diff == nil {
+			continue
+		}
+		report.Diffs = append(report.Diffs, diff)
+		report.RouteDiffs[route]++
+		switch {
+		case diff.Error != "":
+			report.Failed++
+		case diff.Status != diff.Recorded:
+			report.StatusDiffs++
+		default:
+			report.BodyDiffs++
+		}
+	}
+	report.UnmappedIds = rp.unmapped
+
+	return report
+}
+
+// replay sends one entry and returns how its response differs, or nil.
+func (rp *Replayer) replay(i int) *Diff {
+	entry := rp.entries[i]
+	defer close(rp.done[i])
+
+	path, query, body := rp.remapRequest(i, entry)
+	diff := &Diff{Index: i, Method: entry.Method, Route: entry.Route, Path: path, Recorded: entry.Status}
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	target := rp.base + path
+	if query != "" {
+		target += "?" + query
+	}
+	req, err := http.NewRequest(entry.Method, target, reader)
+	if err != nil {
+		diff.Error = err.Error()
+		return diff
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := rp.http.Do(req)
+	if err != nil {
+		diff.Error = err.Error()
+		return diff
+	}
+	response, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		diff.Error = err.Error()
+		return diff
+	}
+	diff.Status = resp.StatusCode
+
+	if resp.StatusCode < 300 {
+		rp.learn(entry, response)
+	}
+
+	if diff.Status != diff.Recorded {
+		return diff
+	}
+	if entry.Truncated || len(bytes.TrimSpace(response)) == 0 && len(entry.Response) == 0 {
+		return nil
+	}
+	if diff.Fields = rp.compare(entry.Response, rp.redact.json(response)); len(diff.Fields) > 0 {
+		return diff
+	}
+	return nil
+}
+
+// learn pairs the ids created by the replayed request with the recorded ones.
+func (rp *Replayer) learn(entry *Entry, response []byte) {
+	recorded, replayed := created(entry, entry.Response), created(entry, response)
+	if len(recorded) != len(replayed) {
+		return
+	}
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	for i, key := range recorded {
+		rp.ids[key] = replayed[i].id
+		rp.recorded[replayed[i]] = key.id
+	}
+}
+
+// mapId returns the id of this run for a recorded one. It waits for the
+// request that creates the id, when that one is still running.
+func (rp *Replayer) mapId(i int, kind int, id int64) int64 {
+	key := idKey{kind, id}
+	producer, ok := rp.producers[key]
+	if !ok || producer >= i {
+		return id
+	}
+	<-rp.done[producer]
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if mapped, ok := rp.ids[key]; ok {
+		return mapped
+	}
+	rp.unmapped++
+	return id
+}
+
+func (rp *Replayer) remapRequest(i int, entry *Entry) (string, string, []byte) {
+	vars := map[string]string{}
+	for name, value := range entry.Vars {
+		vars[name] = value
+	}
+	if id, err := strconv.ParseInt(vars["slug_or_id"], 10, 64); err == nil {
+		vars["slug_or_id"] = strconv.FormatInt(rp.mapId(i, kindThread, id), 10)
+	}
+	if id, err := strconv.ParseInt(vars["id"], 10, 64); err == nil {
+		vars["id"] = strconv.FormatInt(rp.mapId(i, kindPost, id), 10)
+	}
+
+	path := entry.Path
+	if entry.Route != "" {
+		path = entry.Route
+		for name, value := range vars {
+			path = strings.Replace(path, "{"+name+"}", url.PathEscape(value), 1)
+		}
+	}
+
+	query := entry.Query
+	if values, err := url.ParseQuery(query); err == nil && values.Get("since") != "" &&
+		(strings.Contains(entry.Route, "/thread/") || strings.Contains(entry.Route, "/post/")) {
+		if id, err := strconv.ParseInt(values.Get("since"), 10, 64); err == nil {
+			values.Set("since", strconv.FormatInt(rp.mapId(i, kindPost, id), 10))
+			query = values.Encode()
+		}
+	}
+
+	body := []byte(entry.Body)
+	switch {
+	case strings.HasSuffix(entry.Route, "/thread/{slug_or_id}/create"):
+		posts := []map[string]interface{}{}
+		if decode(body, &posts) == nil {
+			for _, post := range posts {
+				if parent, ok := number(post["parent"]); ok && parent != 0 {
+					post["parent"] = rp.mapId(i, kindPost, parent)
+				}
+			}
+			body, _ = json.Marshal(posts)
+		}
+	case strings.HasSuffix(entry.Route, "/thread/{slug_or_id}/merge"):
+		merge := map[string]interface{}{}
+		if decode(body, &merge) == nil {
+			if into, ok := merge["into"].(string); ok {
+				if id, err := strconv.ParseInt(into, 10, 64); err == nil {
+					merge["into"] = strconv.FormatInt(rp.mapId(i, kindThread, id), 10)
+				}
+			}
+			body, _ = json.Marshal(merge)
+		}
+	}
+
+	return path, query, body
+}
+
+// compare lists the fields that differ between the recorded and the
+// replayed response, after mapping replayed ids back to recorded ones.
+func (rp *Replayer) compare(recorded []byte, replayed []byte) []string {
+	var want, got interface{}
+	if decode(recorded, &want) != nil {
+		want = string(recorded)
+	}
+	if decode(replayed, &got) != nil {
+		got = string(replayed)
+	}
+
+	rp.mu.Lock()
+	got = rp.restoreIds(got)
+	rp.mu.Unlock()
+
+	fields := []string{}
+	rp.diff("$", want, got, &fields)
+	return fields
+}
+
+// restoreIds rewrites ids in a response to their recorded values. An object
+// with a title is a thread, one with a thread field is a post.
+func (rp *Replayer) restoreIds(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		idKind := -1
+		if _, ok := v["title"]; ok {
+			idKind = kindThread
+		} else if _, ok := v["thread"]; ok {
+			idKind = kindPost
+		}
+
+		for key, field := range v {
+			kind := -1
+			switch key {
+			case "id":
+				kind = idKind
+			case "thread":
+				kind = kindThread
+			case "parent":
+				kind = kindPost
+			}
+			if id, ok := number(field); ok && kind >= 0 {
+				if original, ok := rp.recorded[idKey{kind, id}]; ok {
+					v[key] = json.Number(strconv.FormatInt(original, 10))
+				}
+				continue
+			}
+			v[key] = rp.restoreIds(field)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = rp.restoreIds(v[i])
+		}
+	}
+	return value
+}
+
+func (rp *Replayer) diff(path string, want interface{}, got interface{}, fields *[]string) {
+	if len(*fields) >= maxFields {
+		return
+	}
+
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(w)+len(g))
+		for key := range w {
+			keys = append(keys, key)
+		}
+		for key := range g {
+			if _, ok := w[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if !rp.ignore[key] {
+				rp.diff(path+"."+key, w[key], g[key], fields)
+			}
+		}
+		return
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok {
+			break
+		}
+		if len(w) != len(g) {
+			*fields = append(*fields, fmt.Sprintf("%s: %d items recorded, %d replayed", path, len(w), len(g)))
+			return
+		}
+		for i := range w {
+			rp.diff(fmt.Sprintf("%s[%d]", path, i), w[i], g[i], fields)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(want, got) {
+		*fields = append(*fields, fmt.Sprintf("%s: recorded %s, replayed %s", path, brief(want), brief(got)))
+	}
+}
+
+func brief(value interface{}) string {
+	if value == nil {
+		return "nothing"
+	}
+	data, _ := json.Marshal(value)
+	if len(data) > 80 {
+		return string(data[:77]) + "..."
+	}
+	return string(data)
+}
@@ -0,0 +1,363 @@
+package seed
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Config sizes a generated dataset. The same Config always produces the
+// same rows, ids included.
+type Config struct {
+	Seed      int64
+	Users     int
+	Forums    int
+	Threads   int
+	Posts     int
+	Votes     int
+	PostVotes int
+	// MaxDepth bounds reply chains, a reply to a post at MaxDepth goes to
+	// its parent instead
+	MaxDepth int
+	// Skew is the Zipf exponent for how activity spreads over users, forums
+	// and threads, it has to be greater than 1
+	Skew float64
+}
+
+// Base is the creation time of the first thread. Threads are a minute apart,
+// posts follow the last thread a second apart.
+var Base = time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Share of new posts that start a branch, answer one of the latest posts of
+// the thread, or answer any earlier post. Answers to the latest posts build
+// long chains, answers to any post spread the tree wide.
+const (
+	rootShare   = 0.15
+	recentShare = 0.45
+)
+
+// Independent streams, so that e.g. more votes do not change the posts.
+const (
+	streamUsers = iota + 1
+	streamForums
+	streamThreads
+	streamPosts
+	streamVotes
+	streamPostVotes
+)
+
+func (c *Config) Validate() error {
+	if c.Users < 1 || c.Forums < 1 || c.Threads < 1 {
+		return fmt.Errorf("need at least one user, forum and thread")
+	}
+	if c.Posts < 0 || c.Votes < 0 || c.PostVotes < 0 {
+		return fmt.Errorf("counts can not be negative")
+	}
+	if c.MaxDepth < 1 {
+		return fmt.Errorf("max depth has to be positive")
+	}
+	if c.Skew <= 1 {
+		return fmt.Errorf("skew has to be greater than 1")
+	}
+	return nil
+}
+
+func (c *Config) rand(stream int64) *rand.Rand {
+	return rand.New(rand.NewSource(c.Seed*1000 + stream))
+}
+
+func (c *Config) zipf(r *rand.Rand, n int) func() int {
+	z := rand.NewZipf(r, c.Skew, 1, uint64(n-1))
+	// the most active entity is not always the first one
+	perm := r.Perm(n)
+	return func() int {
+		return perm[z.Uint64()]
+	}
+}
+
+var (
+	firstNames = []string{"Anna", "Boris", "Clara", "Dmitry", "Elena", "Fedor", "Galina", "Igor", "Julia", "Kirill", "Lena", "Maxim", "Nina", "Oleg", "Pavel", "Rita", "Sergey", "Tanya", "Vera", "Yuri"}
+	lastNames  = []string{"Ivanov", "Smirnova", "Kuznetsov", "Popova", "Vasiliev", "Petrova", "Sokolov", "Mikhailova", "Novikov", "Fedorova", "Morozov", "Volkova", "Alekseev", "Lebedeva", "Semenov"}
+	words      = strings.Fields(`the a query index tree post thread forum vote reply latency
+	database server cache load test plan slow fast table row column sort order parent
+	child branch root depth path array trigger counter user nickname slug message
+	benchmark throughput request response pool connection lock update insert select`)
+)
+
+func sentence(r *rand.Rand, min int, max int) string {
+	n := min + r.Intn(max-min+1)
+	parts := make([]string, n)
+	for i := range parts {
+		parts[i] = words[r.Intn(len(words))]
+	}
+	parts[0] = strings.ToUpper(parts[0][:1]) + parts[0][1:]
+	return strings.Join(parts, " ") + "."
+}
+
+type User struct {
+	Nickname string
+	Fullname string
+	About    string
+	Email    string
+}
+
+func (c *Config) nickname(i int) string {
+	return fmt.Sprintf("user%06d", i)
+}
+
+func (c *Config) GenerateUsers() []*User {
+	r := c.rand(streamUsers)
+	users := make([]*User, c.Users)
+	for i := range users {
+		nickname := c.nickname(i)
+		users[i] = &User{
+			Nickname: nickname,
+			Fullname: firstNames[r.Intn(len(firstNames))] + " " + lastNames[r.Intn(len(lastNames))],
+			About:    sentence(r, 3, 12),
+			Email:    nickname + "@seed.local",
+		}
+	}
+	return users
+}
+
+type Forum struct {
+	Slug   string
+	Title  string
+	Author string
+}
+
+func (c *Config) GenerateForums() []*Forum {
+	r := c.rand(streamForums)
+	forums := make([]*Forum, c.Forums)
+	for i := range forums {
+		forums[i] = &Forum{
+			Slug:   fmt.Sprintf("forum-%03d", i),
+			Title:  sentence(r, 1, 4),
+			Author: c.nickname(r.Intn(c.Users)),
+		}
+	}
+	return forums
+}
+
+type Thread struct {
+	Id      int32
+	Title   string
+	Author  string
+	Forum   string
+	Message string
+	Slug    string
+	Created time.Time
+}
+
+func (c *Config) GenerateThreads() []*Thread {
+	r := c.rand(streamThreads)
+	forum := c.zipf(r, c.Forums)
+	author := c.zipf(r, c.Users)
+
+	threads := make([]*Thread, c.Threads)
+	for i := range threads {
+		threads[i] = &Thread{
+			Id:      int32(i + 1),
+			Title:   sentence(r, 2, 8),
+			Author:  c.nickname(author()),
+			Forum:   fmt.Sprintf("forum-%03d", forum()),
+			Message: sentence(r, 5, 40),
+			Slug:    fmt.Sprintf("thread-%06d", i+1),
+			Created: Base.Add(time.Duration(i) * time.Minute),
+		}
+	}
+	return threads
+}
+
+type Post struct {
+	Id      int64
+	Parent  int64
+	Author  string
+	Message string
+	Forum   string
+	Thread  int32
+	Created time.Time
+	Path    []int64
+}
+
+// PostGenerator yields posts in id order, parents always come before their
+// replies. Memory is a few words per post for parents and depths.
+type PostGenerator struct {
+	c       *Config
+	r       *rand.Rand
+	thread  func() int
+	author  func() int
+	threads []*Thread
+
+	parents []int64
+	depths  []uint16
+	// ids of the posts of every thread in creation order
+	byThread [][]int64
+
+	next int64
+}
+
+func (c *Config) NewPostGenerator(threads []*Thread) *PostGenerator {
+	r := c.rand(streamPosts)
+	return &PostGenerator{
+		c:        c,
+		r:        r,
+		thread:   c.zipf(r, len(threads)),
+		author:   c.zipf(r, c.Users),
+		threads:  threads,
+		parents:  make([]int64, c.Posts+1),
+		depths:   make([]uint16, c.Posts+1),
+		byThread: make([][]int64, len(threads)),
+	}
+}
+
+func (g *PostGenerator) Next() *Post {
+	if g.next >= int64(g.c.Posts) {
+		return nil
+	}
+	g.next++
+	id := g.next
+
+	t := g.thread()
+	thread := g.threads[t]
+	siblings := g.byThread[t]
+
+	var parent int64
+	if n := len(siblings); n > 0 {
+		switch p := g.r.Float64(); {
+		case p < rootShare:
+		case p < rootShare+recentShare:
+			back := int(g.r.ExpFloat64() * 3)
+			if back >= n {
+				back = n - 1
+			}
+			parent = siblings[n-1-back]
+		default:
+			parent = siblings[g.r.Intn(n)]
+		}
+	}
+	for parent != 0 && int(g.depths[parent]) >= g.c.MaxDepth {
+		parent = g.parents[parent]
+	}
+
+	g.parents[id] = parent
+	if parent != 0 {
+		g.depths[id] = g.depths[parent] + 1
+	}
+	g.byThread[t] = append(siblings, id)
+
+	message := sentence(g.r, 3, 60)
+	if parent != 0 && g.r.Intn(20) == 0 {
+		message = fmt.Sprintf(">>%d %s", parent, message)
+	}
+
+	return &Post{
+		Id:      id,
+		Parent:  parent,
+		Author:  g.c.nickname(g.author()),
+		Message: message,
+		Forum:   thread.Forum,
+		Thread:  thread.Id,
+		Created: Base.Add(time.Duration(g.c.Threads)*time.Minute + time.Duration(id)*time.Second),
+		Path:    g.path(parent),
+	}
+}
+
+// path matches what the post_insert trigger stores: the ids of all
+// ancestors, root first.
+func (g *PostGenerator) path(parent int64) []int64 {
+	path := []int64{}
+	for id := parent; id != 0; id = g.parents[id] {
+		path = append(path, id)
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+// Generated returns the number of posts produced so far.
+func (g *PostGenerator) Generated() int64 {
+	return g.next
+}
+
+type Vote struct {
+	Author string
+	Voice  int32
+	Target int64
+}
+
+// generateVotes makes n votes, at most one per user and target. Targets are
+// picked with the same skew as activity, most votes go to few threads.
+func (c *Config) generateVotes(stream int64, n int, targets int, offset int64) []*Vote {
+	if targets == 0 || c.Users == 0 {
+		return nil
+	}
+	if max := targets * c.Users; n > max {
+		n = max
+	}
+
+	r := c.rand(stream)
+	target := c.zipf(r, targets)
+	seen := make(map[[2]int64]bool, n)
+
+	votes := make([]*Vote, 0, n)
+	for attempts := 0; len(votes) < n && attempts < n*20; attempts++ {
+		user, t := r.Intn(c.Users), target()
+		key := [2]int64{int64(user), int64(t)}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		voice := int32(1)
+		if r.Intn(10) < 3 {
+			voice = -1
+		}
+		votes = append(votes, &Vote{Author: c.nickname(user), Voice: voice, Target: int64(t) + offset})
+	}
+	return votes
+}
+
+func (c *Config) GenerateVotes() []*Vote {
+	return c.generateVotes(streamVotes, c.Votes, c.Threads, 1)
+}
+
+func (c *Config) GeneratePostVotes() []*Vote {
+	return c.generateVotes(streamPostVotes, c.PostVotes, c.Posts, 1)
+}
+
+// Digest hashes every generated row. Two machines that print the same digest
+// for a Config load identical data.
+func (c *Config) Digest() (string, error) {
+	if err := c.Validate(); err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	for _, u := range c.GenerateUsers() {
+		fmt.Fprintln(h, u.Nickname, u.Fullname, u.About, u.Email)
+	}
+	for _, f := range c.GenerateForums() {
+		fmt.Fprintln(h, f.Slug, f.Title, f.Author)
+	}
+	threads := c.GenerateThreads()
+	for _, t := range threads {
+		fmt.Fprintln(h, t.Id, t.Title, t.Author, t.Forum, t.Message, t.Slug, t.Created.Unix())
+	}
+	g := c.NewPostGenerator(threads)
+	for p := g.Next(); p != nil; p = g.Next() {
+		fmt.Fprintln(h, p.Id, p.Parent, p.Author, p.Message, p.Forum, p.Thread, p.Created.Unix(), p.Path)
+	}
+	for _, v := range c.GenerateVotes() {
+		fmt.Fprintln(h, v.Author, v.Voice, v.Target)
+	}
+	for _, v := range c.GeneratePostVotes() {
+		fmt.Fprintln(h, v.Author, v.Voice, v.Target)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
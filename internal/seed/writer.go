@@ -0,0 +1,153 @@
+package seed
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/stdlib"
+)
+
+type Report struct {
+	Users     int           `json:"users"`
+	Forums    int           `json:"forums"`
+	Threads   int           `json:"threads"`
+	Posts     int64         `json:"posts"`
+	Votes     int           `json:"votes"`
+	PostVotes int           `json:"post_votes"`
+	Elapsed   time.Duration `json:"elapsed"`
+}
+
+// Write generates the dataset described by c and loads it with COPY in one
+// transaction. The database has to be empty, ids are fixed by the generator.
+// Counters, forum_users and reputation are filled by the usual triggers; only
+// post_insert is disabled, the generator computes post paths itself.
+func Write(db *sql.DB, c *Config) (*Report, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	var used bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM users) OR EXISTS (SELECT 1 FROM thread) OR EXISTS (SELECT 1 FROM post)").Scan(&used)
+	if err != nil {
+		return nil, err
+	}
+	if used {
+		return nil, fmt.Errorf("database is not empty, clear it first")
+	}
+
+	conn, err := stdlib.AcquireConn(db)
+	if err != nil {
+		return nil, err
+	}
+	defer stdlib.ReleaseConn(db, conn)
+
+	start := time.Now()
+	report := &Report{}
+
+	tx, err := conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("ALTER TABLE post DISABLE TRIGGER post_insert"); err != nil {
+		return nil, err
+	}
+
+	users := c.GenerateUsers()
+	rows := make([][]interface{}, 0, len(users))
+	for _, u := range users {
+		rows = append(rows, []interface{}{u.Nickname, u.Fullname, u.About, u.Email})
+	}
+	if report.Users, err = tx.CopyFrom(pgx.Identifier{"users"}, []string{"nickname", "fullname", "about", "email"}, pgx.CopyFromRows(rows)); err != nil {
+		return nil, fmt.Errorf("copy users: %v", err)
+	}
+
+	forums := c.GenerateForums()
+	rows = make([][]interface{}, 0, len(forums))
+	for _, f := range forums {
+		rows = append(rows, []interface{}{f.Title, f.Author, f.Slug})
+	}
+	if report.Forums, err = tx.CopyFrom(pgx.Identifier{"forum"}, []string{"title", "author", "slug"}, pgx.CopyFromRows(rows)); err != nil {
+		return nil, fmt.Errorf("copy forums: %v", err)
+	}
+
+	threads := c.GenerateThreads()
+	rows = make([][]interface{}, 0, len(threads))
+	for _, t := range threads {
+		rows = append(rows, []interface{}{t.Id, t.Title, t.Author, t.Forum, t.Message, t.Slug, t.Created})
+	}
+	if report.Threads, err = tx.CopyFrom(pgx.Identifier{"thread"}, []string{"id", "title", "author", "forum", "message", "slug", "created_at"}, pgx.CopyFromRows(rows)); err != nil {
+		return nil, fmt.Errorf("copy threads: %v", err)
+	}
+
+	posts := &postSource{g: c.NewPostGenerator(threads)}
+	if _, err = tx.CopyFrom(pgx.Identifier{"post"}, []string{"id", "parent", "author", "message", "forum", "thread", "created_at", "path"}, posts); err != nil {
+		return nil, fmt.Errorf("copy posts: %v", err)
+	}
+	report.Posts = posts.g.Generated()
+
+	votes := c.GenerateVotes()
+	rows = make([][]interface{}, 0, len(votes))
+	for _, v := range votes {
+		rows = append(rows, []interface{}{v.Author, v.Voice, int32(v.Target)})
+	}
+	if report.Votes, err = tx.CopyFrom(pgx.Identifier{"vote"}, []string{"author", "voice", "thread"}, pgx.CopyFromRows(rows)); err != nil {
+		return nil, fmt.Errorf("copy votes: %v", err)
+	}
+
+	postVotes := c.GeneratePostVotes()
+	rows = make([][]interface{}, 0, len(postVotes))
+	for _, v := range postVotes {
+		rows = append(rows, []interface{}{v.Author, v.Voice, v.Target})
+	}
+	if report.PostVotes, err = tx.CopyFrom(pgx.Identifier{"post_vote"}, []string{"author", "voice", "post"}, pgx.CopyFromRows(rows)); err != nil {
+		return nil, fmt.Errorf("copy post votes: %v", err)
+	}
+
+	if _, err := tx.Exec("ALTER TABLE post ENABLE TRIGGER post_insert"); err != nil {
+		return nil, err
+	}
+
+	// ids were given explicitly, move the sequences past them
+	for _, table := range []string{"thread", "post"} {
+		_, err := tx.Exec(fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%s', 'id'), GREATEST((SELECT MAX(id) FROM %s), 1))", table, table))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	// fresh statistics, so that plans match the loaded data
+	if _, err := conn.Exec("ANALYZE"); err != nil {
+		return nil, err
+	}
+
+	report.Elapsed = time.Since(start)
+	return report, nil
+}
+
+// postSource streams generated posts into COPY without holding them all.
+type postSource struct {
+	g    *PostGenerator
+	post *Post
+}
+
+func (s *postSource) Next() bool {
+	s.post = s.g.Next()
+	return s.post != nil
+}
+
+func (s *postSource) Values() ([]interface{}, error) {
+	p := s.post
+	return []interface{}{p.Id, p.Parent, p.Author, p.Message, p.Forum, p.Thread, p.Created, p.Path}, nil
+}
+
+func (s *postSource) Err() error {
+	return nil
+}
@@ -0,0 +1,90 @@
+package slug
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const maxLength = 64
+
+var cyrillic = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e",
+	'ж': "zh", 'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m",
+	'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u",
+	'ф': "f", 'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "shch",
+	'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu", 'я': "ya",
+	'і': "i", 'ї': "yi", 'є': "ye", 'ґ': "g",
+}
+
+// Make builds a lowercase latin slug from title: Cyrillic letters are
+// transliterated, everything else that is not a letter or digit becomes a
+// single dash. "Привет, мир!" turns into "privet-mir".
+func Make(title string) string {
+	var b strings.Builder
+	dash := false
+
+	for _, r := range strings.ToLower(title) {
+		var part string
+		if latin, ok := cyrillic[r]; ok {
+			part = latin
+		} else if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			part = string(r)
+		} else if r == '_' {
+			part = "_"
+		}
+
+		if part == "" {
+			if _, ok := cyrillic[r]; !ok {
+				dash = b.Len() > 0
+			}
+			continue
+		}
+
+		if dash {
+			b.WriteByte('-')
+			dash = false
+		}
+		b.WriteString(part)
+
+		if b.Len() >= maxLength {
+			break
+		}
+	}
+
+	result := b.String()
+	if len(result) > maxLength {
+		result = result[:maxLength]
+	}
+	return strings.Trim(result, "-")
+}
+
+// FromTitle is Make with a fallback for titles without usable characters.
+// Purely numeric slugs would be taken for ids in slug_or_id routes, so they
+// get the fallback as a prefix.
+func FromTitle(title string, fallback string) string {
+	result := Make(title)
+	if result == "" {
+		return fallback
+	}
+	if _, err := strconv.Atoi(result); err == nil {
+		return fallback + "-" + result
+	}
+	return result
+}
+
+// Valid reports whether value can be used as a slug set by a client. Slugs
+// are path segments of slug_or_id routes, so they can not hold slashes,
+// whitespace or the characters that end a path, and can not be numbers.
+func Valid(value string) bool {
+	if strings.TrimSpace(value) == "" {
+		return false
+	}
+	if strings.IndexFunc(value, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '/' || r == '?' || r == '#'
+	}) >= 0 {
+		return false
+	}
+	_, err := strconv.Atoi(value)
+	return err != nil
+}
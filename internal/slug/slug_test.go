@@ -0,0 +1,44 @@
+package slug
+
+import "testing"
+
+func TestValid(t *testing.T) {
+	cases := map[string]bool{
+		"party":       true,
+		"tea-party_2": true,
+		"вечеринка":   true,
+		"":            false,
+		"   ":         false,
+		"42":          false,
+		"a/b":         false,
+		"with space":  false,
+		"tab\there":   false,
+		" party":      false,
+		"what?":       false,
+		"a#b":         false,
+	}
+
+	for value, want := range cases {
+		if got := Valid(value); got != want {
+			t.Errorf("Valid(%q) = %v, want %v", value, got, want)
+		}
+	}
+}
+
+func TestFromTitle(t *testing.T) {
+	cases := map[string]string{
+		"Привет, мир!":  "privet-mir",
+		"  Tea  party ": "tea-party",
+		"2021":          "thread-2021",
+		"!!!":           "thread",
+	}
+
+	for title, want := range cases {
+		if got := FromTitle(title, "thread"); got != want {
+			t.Errorf("FromTitle(%q) = %q, want %q", title, got, want)
+		}
+		if got := FromTitle(title, "thread"); !Valid(got) {
+			t.Errorf("FromTitle(%q) = %q is not a valid slug", title, got)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+-- Slug aliases for threads and forums.
+--
+-- Renamed threads and forums keep answering under their old slugs through the
+-- alias tables. Forum renames update the slug in place, so the references to
+-- forum.slug cascade. The foreign keys are added NOT VALID and validated after
+-- the commit, which does not block writes while the tables are scanned.
+--   psql -d forum -f migrations/001_slug_aliases.sql
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS thread_slug_alias (
+    slug citext PRIMARY KEY,
+    thread INT NOT NULL,
+
+    FOREIGN KEY (thread) REFERENCES thread (id)
+);
+
+CREATE TABLE IF NOT EXISTS forum_slug_alias (
+    slug citext PRIMARY KEY,
+    forum citext NOT NULL,
+
+    FOREIGN KEY (forum) REFERENCES forum (slug) ON UPDATE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS thread_slug_alias_thread ON thread_slug_alias (thread);
+
+ALTER TABLE thread DROP CONSTRAINT thread_forum_fkey,
+    ADD CONSTRAINT thread_forum_fkey FOREIGN KEY (forum) REFERENCES forum (slug) ON UPDATE CASCADE NOT VALID;
+ALTER TABLE post DROP CONSTRAINT post_forum_fkey,
+    ADD CONSTRAINT post_forum_fkey FOREIGN KEY (forum) REFERENCES forum (slug) ON UPDATE CASCADE NOT VALID;
+ALTER TABLE forum_users DROP CONSTRAINT forum_users_forum_fkey,
+    ADD CONSTRAINT forum_users_forum_fkey FOREIGN KEY (forum) REFERENCES forum (slug) ON UPDATE CASCADE NOT VALID;
+
+COMMIT;
+
+ALTER TABLE thread VALIDATE CONSTRAINT thread_forum_fkey;
+ALTER TABLE post VALIDATE CONSTRAINT post_forum_fkey;
+ALTER TABLE forum_users VALIDATE CONSTRAINT forum_users_forum_fkey;
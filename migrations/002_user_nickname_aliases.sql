@@ -0,0 +1,41 @@
+-- User renames.
+--
+-- A rename updates users.nickname in place and every reference cascades. The
+-- old nickname stays reachable through user_nickname_alias. The foreign keys
+-- are added NOT VALID and validated after the commit, as in 001.
+--
+-- The author indexes serve the rewrite of post and thread rows on a rename.
+-- They are built concurrently, which can not run inside a transaction, apply
+-- without wrapping the file in one:
+--   psql -d forum -f migrations/002_user_nickname_aliases.sql
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS user_nickname_alias (
+    nickname citext PRIMARY KEY,
+    target citext NOT NULL,
+
+    FOREIGN KEY (target) REFERENCES users (nickname) ON UPDATE CASCADE
+);
+
+ALTER TABLE forum DROP CONSTRAINT forum_author_fkey,
+    ADD CONSTRAINT forum_author_fkey FOREIGN KEY (author) REFERENCES users (nickname) ON UPDATE CASCADE NOT VALID;
+ALTER TABLE thread DROP CONSTRAINT thread_author_fkey,
+    ADD CONSTRAINT thread_author_fkey FOREIGN KEY (author) REFERENCES users (nickname) ON UPDATE CASCADE NOT VALID;
+ALTER TABLE post DROP CONSTRAINT post_author_fkey,
+    ADD CONSTRAINT post_author_fkey FOREIGN KEY (author) REFERENCES users (nickname) ON UPDATE CASCADE NOT VALID;
+ALTER TABLE vote DROP CONSTRAINT vote_author_fkey,
+    ADD CONSTRAINT vote_author_fkey FOREIGN KEY (author) REFERENCES users (nickname) ON UPDATE CASCADE NOT VALID;
+ALTER TABLE forum_users DROP CONSTRAINT forum_users_nickname_fkey,
+    ADD CONSTRAINT forum_users_nickname_fkey FOREIGN KEY (nickname) REFERENCES users (nickname) ON UPDATE CASCADE NOT VALID;
+
+COMMIT;
+
+ALTER TABLE forum VALIDATE CONSTRAINT forum_author_fkey;
+ALTER TABLE thread VALIDATE CONSTRAINT thread_author_fkey;
+ALTER TABLE post VALIDATE CONSTRAINT post_author_fkey;
+ALTER TABLE vote VALIDATE CONSTRAINT vote_author_fkey;
+ALTER TABLE forum_users VALIDATE CONSTRAINT forum_users_nickname_fkey;
+
+CREATE INDEX CONCURRENTLY IF NOT EXISTS thread_author ON thread (author);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS post_author ON post (author);
@@ -0,0 +1,66 @@
+-- Surrogate keys for users, step one.
+--
+-- Renames currently rewrite every row that references users.nickname through
+-- ON UPDATE CASCADE, which touches the whole post table for active users.
+-- This migration makes users.id a real key and adds author_id columns next to
+-- the nickname ones. The columns are backfilled here and kept in sync by
+-- triggers, so queries can move to joins on author_id one by one. Once nothing
+-- reads the nickname columns any more they can be dropped and a rename becomes
+-- a single row update of users.
+--
+-- Apply after 002:
+--   psql -d forum -f migrations/003_users_surrogate_key.sql
+
+BEGIN;
+
+ALTER TABLE users ALTER COLUMN id SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS users_id ON users (id);
+
+ALTER TABLE forum ADD COLUMN IF NOT EXISTS author_id INT;
+ALTER TABLE thread ADD COLUMN IF NOT EXISTS author_id INT;
+ALTER TABLE post ADD COLUMN IF NOT EXISTS author_id INT;
+ALTER TABLE vote ADD COLUMN IF NOT EXISTS author_id INT;
+ALTER TABLE forum_users ADD COLUMN IF NOT EXISTS user_id INT;
+
+UPDATE forum SET author_id = u.id FROM users AS u WHERE u.nickname = forum.author;
+UPDATE thread SET author_id = u.id FROM users AS u WHERE u.nickname = thread.author;
+UPDATE post SET author_id = u.id FROM users AS u WHERE u.nickname = post.author;
+UPDATE vote SET author_id = u.id FROM users AS u WHERE u.nickname = vote.author;
+UPDATE forum_users SET user_id = u.id FROM users AS u WHERE u.nickname = forum_users.nickname;
+
+ALTER TABLE forum ADD CONSTRAINT forum_author_id_fk FOREIGN KEY (author_id) REFERENCES users (id);
+ALTER TABLE thread ADD CONSTRAINT thread_author_id_fk FOREIGN KEY (author_id) REFERENCES users (id);
+ALTER TABLE post ADD CONSTRAINT post_author_id_fk FOREIGN KEY (author_id) REFERENCES users (id);
+ALTER TABLE vote ADD CONSTRAINT vote_author_id_fk FOREIGN KEY (author_id) REFERENCES users (id);
+ALTER TABLE forum_users ADD CONSTRAINT forum_users_user_id_fk FOREIGN KEY (user_id) REFERENCES users (id);
+
+CREATE INDEX IF NOT EXISTS thread_author_id ON thread (author_id);
+CREATE INDEX IF NOT EXISTS post_author_id ON post (author_id);
+CREATE INDEX IF NOT EXISTS vote_author_id ON vote (author_id);
+
+CREATE OR REPLACE FUNCTION fill_author_id() RETURNS TRIGGER AS $fill_author_id$
+BEGIN
+    NEW.author_id = (SELECT id FROM users WHERE nickname = NEW.author);
+    RETURN NEW;
+END;
+$fill_author_id$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION fill_user_id() RETURNS TRIGGER AS $fill_user_id$
+BEGIN
+    NEW.user_id = (SELECT id FROM users WHERE nickname = NEW.nickname);
+    RETURN NEW;
+END;
+$fill_user_id$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS forum_fill_author_id ON forum;
+CREATE TRIGGER forum_fill_author_id BEFORE INSERT ON forum FOR EACH ROW EXECUTE PROCEDURE fill_author_id();
+DROP TRIGGER IF EXISTS thread_fill_author_id ON thread;
+CREATE TRIGGER thread_fill_author_id BEFORE INSERT ON thread FOR EACH ROW EXECUTE PROCEDURE fill_author_id();
+DROP TRIGGER IF EXISTS post_fill_author_id ON post;
+CREATE TRIGGER post_fill_author_id BEFORE INSERT ON post FOR EACH ROW EXECUTE PROCEDURE fill_author_id();
+DROP TRIGGER IF EXISTS vote_fill_author_id ON vote;
+CREATE TRIGGER vote_fill_author_id BEFORE INSERT ON vote FOR EACH ROW EXECUTE PROCEDURE fill_author_id();
+DROP TRIGGER IF EXISTS forum_users_fill_user_id ON forum_users;
+CREATE TRIGGER forum_users_fill_user_id BEFORE INSERT ON forum_users FOR EACH ROW EXECUTE PROCEDURE fill_user_id();
+
+COMMIT;
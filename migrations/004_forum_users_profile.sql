@@ -0,0 +1,24 @@
+-- Profile updates reach forum_users.
+--
+-- forum_users keeps a copy of fullname, email and about of every user who
+-- posted in a forum. The trigger updates the copies when a profile changes.
+-- Copies that went stale before it existed are reported and repaired by
+-- POST /api/service/check.
+--   psql -d forum -f migrations/004_forum_users_profile.sql
+
+CREATE OR REPLACE FUNCTION user_update_forum_users() RETURNS TRIGGER AS $user_update_forum_users$
+BEGIN
+    UPDATE forum_users SET
+        fullname = NEW.fullname,
+        email = NEW.email,
+        about = NEW.about
+    WHERE nickname = NEW.nickname;
+
+    RETURN NULL;
+END;
+$user_update_forum_users$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS user_update_forum_users ON users;
+CREATE TRIGGER user_update_forum_users AFTER UPDATE OF fullname, email, about ON users
+FOR EACH ROW WHEN (OLD.fullname IS DISTINCT FROM NEW.fullname OR OLD.email IS DISTINCT FROM NEW.email OR OLD.about IS DISTINCT FROM NEW.about)
+EXECUTE PROCEDURE user_update_forum_users();
@@ -0,0 +1,61 @@
+-- Vote validation, retraction and role weights.
+--
+-- Users get a role, a vote counts with the weight of the role its author had
+-- when voting. Votes cast before count with weight 1, so thread.votes stays
+-- the sum of voice * weight. The voice CHECK is validated after the commit;
+-- it fails if an old vote has a voice other than -1 and 1, fix those first:
+--   SELECT id, voice FROM vote WHERE voice NOT IN (-1, 1) OR voice IS NULL;
+--
+-- Retracting deletes the vote row, vote_delete takes it off the thread.
+--
+-- The index for vote listings is built concurrently, which can not run inside
+-- a transaction, apply without wrapping the file in one:
+--   psql -d forum -f migrations/005_vote_weights.sql
+
+BEGIN;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user';
+
+ALTER TABLE vote ADD COLUMN IF NOT EXISTS weight INT NOT NULL DEFAULT 1 CHECK (weight > 0);
+ALTER TABLE vote DROP CONSTRAINT IF EXISTS vote_voice_check,
+    ADD CONSTRAINT vote_voice_check CHECK (voice IN (-1, 1)) NOT VALID;
+
+CREATE OR REPLACE FUNCTION vote_insert() RETURNS TRIGGER AS $vote_insert$
+BEGIN
+    UPDATE thread
+    SET votes = votes + NEW.voice * NEW.weight
+    WHERE id = NEW.thread;
+    RETURN NULL;
+END;
+$vote_insert$  LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION vote_update() RETURNS TRIGGER AS $vote_update$
+BEGIN
+	IF OLD.voice = NEW.voice AND OLD.weight = NEW.weight
+		THEN RETURN NULL;
+	END IF;
+  	UPDATE thread
+	SET
+		votes = votes - OLD.voice * OLD.weight + NEW.voice * NEW.weight
+  	WHERE id = NEW.thread;
+  	RETURN NULL;
+END;
+$vote_update$ LANGUAGE  plpgsql;
+
+CREATE OR REPLACE FUNCTION vote_delete() RETURNS TRIGGER AS $vote_delete$
+BEGIN
+    UPDATE thread
+    SET votes = votes - OLD.voice * OLD.weight
+    WHERE id = OLD.thread;
+    RETURN NULL;
+END;
+$vote_delete$  LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS vote_delete ON vote;
+CREATE TRIGGER vote_delete AFTER DELETE ON vote FOR EACH ROW EXECUTE PROCEDURE vote_delete();
+
+COMMIT;
+
+ALTER TABLE vote VALIDATE CONSTRAINT vote_voice_check;
+
+CREATE INDEX CONCURRENTLY IF NOT EXISTS vote_thread ON vote (thread, author);
@@ -0,0 +1,81 @@
+-- Post votes and emoji reactions.
+--
+-- post.score and post.reactions are kept by triggers on post_vote and
+-- post_reaction. Both columns have a constant default, adding them does not
+-- rewrite the post table.
+--
+-- The index for sort=top is built concurrently, which can not run inside a
+-- transaction, apply without wrapping the file in one:
+--   psql -d forum -f migrations/006_post_votes_reactions.sql
+
+BEGIN;
+
+ALTER TABLE post ADD COLUMN IF NOT EXISTS score BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE post ADD COLUMN IF NOT EXISTS reactions JSONB NOT NULL DEFAULT '{}';
+
+CREATE TABLE IF NOT EXISTS post_vote (
+    id BIGSERIAL PRIMARY KEY,
+    author citext NOT NULL,
+    post BIGINT NOT NULL,
+    voice INT NOT NULL CHECK (voice IN (-1, 1)),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    UNIQUE (author, post),
+
+    FOREIGN KEY (author) REFERENCES users (nickname) ON UPDATE CASCADE,
+    FOREIGN KEY (post) REFERENCES post (id)
+);
+
+CREATE TABLE IF NOT EXISTS post_reaction (
+    author citext NOT NULL,
+    post BIGINT NOT NULL,
+    emoji TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    PRIMARY KEY (post, emoji, author),
+
+    FOREIGN KEY (author) REFERENCES users (nickname) ON UPDATE CASCADE,
+    FOREIGN KEY (post) REFERENCES post (id)
+);
+
+CREATE INDEX IF NOT EXISTS post_vote_post ON post_vote (post);
+
+CREATE OR REPLACE FUNCTION post_vote_change() RETURNS TRIGGER AS $post_vote_change$
+BEGIN
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        UPDATE post SET score = score - OLD.voice WHERE id = OLD.post;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        UPDATE post SET score = score + NEW.voice WHERE id = NEW.post;
+    END IF;
+    RETURN NULL;
+END;
+$post_vote_change$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS post_vote_change ON post_vote;
+CREATE TRIGGER post_vote_change AFTER INSERT OR UPDATE OF voice OR DELETE ON post_vote FOR EACH ROW EXECUTE PROCEDURE post_vote_change();
+
+CREATE OR REPLACE FUNCTION post_reaction_change() RETURNS TRIGGER AS $post_reaction_change$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        UPDATE post
+        SET reactions = jsonb_set(reactions, ARRAY[NEW.emoji], to_jsonb(COALESCE((reactions->>NEW.emoji)::BIGINT, 0) + 1))
+        WHERE id = NEW.post;
+    ELSE
+        UPDATE post
+        SET reactions = (CASE WHEN COALESCE((reactions->>OLD.emoji)::BIGINT, 0) <= 1
+            THEN reactions - OLD.emoji
+            ELSE jsonb_set(reactions, ARRAY[OLD.emoji], to_jsonb((reactions->>OLD.emoji)::BIGINT - 1)) END)
+        WHERE id = OLD.post;
+    END IF;
+    RETURN NULL;
+END;
+$post_reaction_change$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS post_reaction_change ON post_reaction;
+CREATE TRIGGER post_reaction_change AFTER INSERT OR DELETE ON post_reaction FOR EACH ROW EXECUTE PROCEDURE post_reaction_change();
+
+COMMIT;
+
+-- replaced by the (thread, score, id) index of 012
+CREATE INDEX CONCURRENTLY IF NOT EXISTS post_top_roots ON post (thread, score DESC, id) WHERE parent = 0;
@@ -0,0 +1,81 @@
+-- Per forum user reputation.
+--
+-- user_reputation sums the votes on the threads and posts of a user in a
+-- forum and is kept by triggers on vote and post_vote. It is filled from the
+-- votes cast so far in the same transaction the triggers are created in, so
+-- no vote is counted twice or missed.
+--   psql -d forum -f migrations/007_user_reputation.sql
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS user_reputation (
+    nickname citext NOT NULL,
+    forum citext NOT NULL,
+    thread_score BIGINT NOT NULL DEFAULT 0,
+    post_score BIGINT NOT NULL DEFAULT 0,
+
+    PRIMARY KEY (nickname, forum),
+
+    FOREIGN KEY (nickname) REFERENCES users (nickname) ON UPDATE CASCADE,
+    FOREIGN KEY (forum) REFERENCES forum (slug) ON UPDATE CASCADE
+);
+
+-- reputation recomputed from source rows, used to verify and rebuild user_reputation
+CREATE OR REPLACE VIEW user_reputation_actual AS
+SELECT nickname, forum, sum(thread_score)::BIGINT AS thread_score, sum(post_score)::BIGINT AS post_score FROM (
+    SELECT t.author AS nickname, t.forum AS forum, v.voice * v.weight AS thread_score, 0 AS post_score
+    FROM vote AS v JOIN thread AS t ON t.id = v.thread
+    UNION ALL
+    SELECT p.author, p.forum, 0, pv.voice
+    FROM post_vote AS pv JOIN post AS p ON p.id = pv.post
+) AS scores
+GROUP BY nickname, forum;
+
+-- votes must not change between the backfill and the triggers
+LOCK TABLE vote, post_vote IN SHARE MODE;
+
+INSERT INTO user_reputation (nickname, forum, thread_score, post_score)
+SELECT nickname, forum, thread_score, post_score FROM user_reputation_actual
+ON CONFLICT (nickname, forum) DO UPDATE SET thread_score = EXCLUDED.thread_score, post_score = EXCLUDED.post_score;
+
+CREATE OR REPLACE FUNCTION vote_reputation() RETURNS TRIGGER AS $vote_reputation$
+BEGIN
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        INSERT INTO user_reputation (nickname, forum, thread_score)
+        SELECT author, forum, -OLD.voice * OLD.weight FROM thread WHERE id = OLD.thread
+        ON CONFLICT (nickname, forum) DO UPDATE SET thread_score = user_reputation.thread_score + EXCLUDED.thread_score;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        INSERT INTO user_reputation (nickname, forum, thread_score)
+        SELECT author, forum, NEW.voice * NEW.weight FROM thread WHERE id = NEW.thread
+        ON CONFLICT (nickname, forum) DO UPDATE SET thread_score = user_reputation.thread_score + EXCLUDED.thread_score;
+    END IF;
+    RETURN NULL;
+END;
+$vote_reputation$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS vote_reputation ON vote;
+CREATE TRIGGER vote_reputation AFTER INSERT OR UPDATE OF voice, weight OR DELETE ON vote FOR EACH ROW EXECUTE PROCEDURE vote_reputation();
+
+CREATE OR REPLACE FUNCTION post_vote_reputation() RETURNS TRIGGER AS $post_vote_reputation$
+BEGIN
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        INSERT INTO user_reputation (nickname, forum, post_score)
+        SELECT author, forum, -OLD.voice FROM post WHERE id = OLD.post
+        ON CONFLICT (nickname, forum) DO UPDATE SET post_score = user_reputation.post_score + EXCLUDED.post_score;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        INSERT INTO user_reputation (nickname, forum, post_score)
+        SELECT author, forum, NEW.voice FROM post WHERE id = NEW.post
+        ON CONFLICT (nickname, forum) DO UPDATE SET post_score = user_reputation.post_score + EXCLUDED.post_score;
+    END IF;
+    RETURN NULL;
+END;
+$post_vote_reputation$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS post_vote_reputation ON post_vote;
+CREATE TRIGGER post_vote_reputation AFTER INSERT OR UPDATE OF voice OR DELETE ON post_vote FOR EACH ROW EXECUTE PROCEDURE post_vote_reputation();
+
+CREATE INDEX IF NOT EXISTS user_reputation_leaderboard ON user_reputation (forum, (thread_score + post_score) DESC, nickname);
+
+COMMIT;
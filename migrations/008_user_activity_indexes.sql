@@ -0,0 +1,15 @@
+-- Indexes for the user activity endpoints.
+--
+-- GET /api/user/{nickname}/posts and /threads page through one author's rows
+-- ordered by (created_at, id). The new indexes serve both that order and plain
+-- lookups by author, so the single column ones are dropped.
+--
+-- CREATE INDEX CONCURRENTLY can not run inside a transaction, apply without
+-- wrapping it in one:
+--   psql -d forum -f migrations/008_user_activity_indexes.sql
+
+CREATE INDEX CONCURRENTLY IF NOT EXISTS post_author_created ON post (author, created_at, id);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS thread_author_created ON thread (author, created_at, id);
+
+DROP INDEX CONCURRENTLY IF EXISTS post_author;
+DROP INDEX CONCURRENTLY IF EXISTS thread_author;
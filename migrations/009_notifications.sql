@@ -0,0 +1,39 @@
+-- Thread subscriptions and the notification inbox.
+--
+-- Notifications are written by the server after posts are created, there is
+-- nothing to fill for posts created before.
+--   psql -d forum -f migrations/009_notifications.sql
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS thread_subscription (
+    nickname citext NOT NULL,
+    thread INT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    PRIMARY KEY (thread, nickname),
+
+    FOREIGN KEY (nickname) REFERENCES users (nickname) ON UPDATE CASCADE,
+    FOREIGN KEY (thread) REFERENCES thread (id)
+);
+
+-- the thread and forum of a notification are read from the post, so merged
+-- and moved threads need no update here
+CREATE TABLE IF NOT EXISTS notification (
+    id BIGSERIAL PRIMARY KEY,
+    nickname citext NOT NULL,
+    kind TEXT NOT NULL CHECK (kind IN ('mention', 'reply', 'post')),
+    post BIGINT NOT NULL,
+    is_read BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    UNIQUE (nickname, post),
+
+    FOREIGN KEY (nickname) REFERENCES users (nickname) ON UPDATE CASCADE,
+    FOREIGN KEY (post) REFERENCES post (id)
+);
+
+CREATE INDEX IF NOT EXISTS notification_inbox ON notification (nickname, id DESC);
+CREATE INDEX IF NOT EXISTS notification_unread ON notification (nickname) WHERE NOT is_read;
+
+COMMIT;
@@ -0,0 +1,32 @@
+-- Index of @mentions in posts.
+--
+-- The server indexes the mentions of posts it creates or edits. Posts written
+-- before are indexed here with a pattern that follows mention.Find: an @ not
+-- preceded by a nickname character, followed by a nickname that does not end
+-- with a dot. Names that are neither a user nor an alias of one are skipped.
+--   psql -d forum -f migrations/010_post_mentions.sql
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS post_mention (
+    post BIGINT NOT NULL,
+    nickname citext NOT NULL,
+
+    PRIMARY KEY (post, nickname),
+
+    FOREIGN KEY (post) REFERENCES post (id),
+    FOREIGN KEY (nickname) REFERENCES users (nickname) ON UPDATE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS post_mention_nickname ON post_mention (nickname, post DESC);
+
+INSERT INTO post_mention (post, nickname)
+SELECT DISTINCT p.id, COALESCE(u.nickname, a.target)
+FROM post AS p
+CROSS JOIN LATERAL regexp_matches(p.message, '(?:^|[^[:alnum:]_.])@([[:alnum:]_.]*[[:alnum:]_])', 'g') AS m (name)
+LEFT JOIN users AS u ON u.nickname = m.name[1]::citext
+LEFT JOIN user_nickname_alias AS a ON a.nickname = m.name[1]::citext
+WHERE p.message LIKE '%@%' AND (u.nickname IS NOT NULL OR a.target IS NOT NULL)
+ON CONFLICT DO NOTHING;
+
+COMMIT;
@@ -0,0 +1,18 @@
+-- Idempotency keys for the create endpoints.
+--
+-- POST requests sent with an Idempotency-Key header store the response here,
+-- a retry with the same key gets it back instead of creating again. Rows
+-- older than the TTL are deleted by the server.
+--   psql -d forum -f migrations/011_idempotency_keys.sql
+
+-- responses to create requests sent with an Idempotency-Key, replayed when
+-- the client retries. status is NULL while the first request is served.
+CREATE TABLE IF NOT EXISTS idempotency_key (
+    key TEXT PRIMARY KEY,
+    request_hash TEXT NOT NULL,
+    status INT,
+    body BYTEA,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_key_created ON idempotency_key (created_at);
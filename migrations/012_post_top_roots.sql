@@ -0,0 +1,15 @@
+-- sort=top pages through root posts by (score, id) in both directions.
+--
+-- The first version of post_top_roots ordered score descending and id
+-- ascending, which serves neither keyset paging on (score, id) nor a scan
+-- with both columns in the same direction. The new index is built under a
+-- temporary name, so that sort=top keeps an index while it is built.
+--
+-- CREATE INDEX CONCURRENTLY can not run inside a transaction, apply without
+-- wrapping it in one:
+--   psql -d forum -f migrations/012_post_top_roots.sql
+
+CREATE INDEX CONCURRENTLY IF NOT EXISTS post_top_roots_new ON post (thread, score, id) WHERE parent = 0;
+
+DROP INDEX CONCURRENTLY IF EXISTS post_top_roots;
+ALTER INDEX post_top_roots_new RENAME TO post_top_roots;
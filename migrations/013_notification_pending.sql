@@ -0,0 +1,12 @@
+-- Overflow of the notification fan-out queue.
+--
+-- Post batches that do not fit into the in-memory queue are kept here instead
+-- of being dropped, the server drains the table in the background.
+--   psql -d forum -f migrations/013_notification_pending.sql
+
+CREATE TABLE IF NOT EXISTS notification_pending (
+    id BIGSERIAL PRIMARY KEY,
+    posts BIGINT[] NOT NULL,
+    mentions_only BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
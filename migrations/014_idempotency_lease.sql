@@ -0,0 +1,10 @@
+-- Leases for idempotency keys.
+--
+-- A key stays claimed with a NULL status while its request is served. When
+-- the server dies in between, or the response can not be stored, a retry may
+-- take the key over once locked_until has passed instead of getting a 409
+-- until the key expires. Keys claimed before the column existed count as
+-- expired leases.
+--   psql -d forum -f migrations/014_idempotency_lease.sql
+
+ALTER TABLE idempotency_key ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();